@@ -0,0 +1,90 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package firehose
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/elastic/apm-server/model"
+)
+
+const (
+	cloudwatchDataMessage    = "DATA_MESSAGE"
+	cloudwatchControlMessage = "CONTROL_MESSAGE"
+)
+
+// cloudwatchLogs holds the CloudWatch Logs subscription filter payload,
+// which Firehose delivers as gzip-compressed JSON. Records are decompressed
+// before being decoded.
+//
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/logs/SubscriptionFilters.html
+type cloudwatchLogs struct {
+	MessageType         string               `json:"messageType"`
+	Owner               string               `json:"owner"`
+	LogGroup            string               `json:"logGroup"`
+	LogStream           string               `json:"logStream"`
+	SubscriptionFilters []string             `json:"subscriptionFilters"`
+	LogEvents           []cloudwatchLogEvent `json:"logEvents"`
+}
+
+type cloudwatchLogEvent struct {
+	ID        string `json:"id"`
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+// decodeCloudWatchLogs decodes a CloudWatch Logs subscription filter
+// payload from data, reporting whether data holds such a payload.
+func decodeCloudWatchLogs(data []byte) (cloudwatchLogs, bool) {
+	var logs cloudwatchLogs
+	if len(data) == 0 || data[0] != '{' {
+		return logs, false
+	}
+	if err := json.Unmarshal(data, &logs); err != nil {
+		return logs, false
+	}
+	switch logs.MessageType {
+	case cloudwatchDataMessage, cloudwatchControlMessage:
+		return logs, true
+	}
+	return logs, false
+}
+
+// processCloudWatchLogs appends a log event to batch for each of the
+// CloudWatch log events in logs. Control messages, which Amazon sends
+// to check that the destination is reachable, are ignored.
+func processCloudWatchLogs(logs cloudwatchLogs, baseEvent model.APMEvent, batch model.Batch) model.Batch {
+	if logs.MessageType != cloudwatchDataMessage {
+		return batch
+	}
+	for _, logEvent := range logs.LogEvents {
+		event := baseEvent
+		if logEvent.Timestamp != 0 {
+			event.Timestamp = time.UnixMilli(logEvent.Timestamp)
+		}
+		event.Processor = model.LogProcessor
+		event.Message = strings.TrimSuffix(logEvent.Message, "\n")
+		event.Service.Name = logs.LogGroup
+		event.Labels = copyLabels(baseEvent.Labels, 1)
+		event.Labels["log_stream"] = logs.LogStream
+		batch = append(batch, event)
+	}
+	return batch
+}
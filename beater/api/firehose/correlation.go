@@ -0,0 +1,63 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package firehose
+
+import (
+	"regexp"
+
+	"github.com/elastic/apm-server/model"
+)
+
+// defaultTraceIDKey holds the key of the trace ID in JSON log lines,
+// when none is configured.
+const defaultTraceIDKey = "trace.id"
+
+// traceIDKey returns cfg.TraceIDKey, or the default if it is empty.
+func (cfg HandlerConfig) traceIDKey() string {
+	if cfg.TraceIDKey == "" {
+		return defaultTraceIDKey
+	}
+	return cfg.TraceIDKey
+}
+
+// correlate sets the trace and transaction IDs of event from line, using
+// the first capture group of cfg.TraceIDPattern and cfg.TransactionIDPattern
+// respectively. IDs which are already set, e.g. from a JSON log line, are
+// left unmodified.
+func (cfg HandlerConfig) correlate(line string, event *model.APMEvent) {
+	if event.Trace.ID == "" {
+		event.Trace.ID = extractSubmatch(line, cfg.TraceIDPattern)
+	}
+	if event.Transaction == nil {
+		if id := extractSubmatch(line, cfg.TransactionIDPattern); id != "" {
+			event.Transaction = &model.Transaction{ID: id}
+		}
+	}
+}
+
+// extractSubmatch returns the first capture group of pattern in line,
+// or an empty string if pattern is nil or does not match line.
+func extractSubmatch(line string, pattern *regexp.Regexp) string {
+	if pattern == nil {
+		return ""
+	}
+	if match := pattern.FindStringSubmatch(line); len(match) > 1 {
+		return match[1]
+	}
+	return ""
+}
@@ -0,0 +1,77 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package firehose
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+var gzipReaderPool sync.Pool
+
+// isGzip reports whether data begins with the gzip magic number.
+func isGzip(data []byte) bool {
+	return len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b
+}
+
+// gunzip returns the decompressed contents of the gzip-compressed data.
+//
+// If limit is positive, gunzip returns an error if the decompressed
+// contents exceed limit bytes, guarding against small records which
+// decompress to very large ones.
+func gunzip(data []byte, limit int64) ([]byte, error) {
+	r, err := getGzipReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReaderPool.Put(r)
+	var src io.Reader = r
+	if limit > 0 {
+		// Read one byte beyond the limit to detect exceeding it.
+		src = io.LimitReader(r, limit+1)
+	}
+	decompressed, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(len(decompressed)) > limit {
+		return nil, fmt.Errorf("decompressed record exceeds %d bytes", limit)
+	}
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+	return decompressed, nil
+}
+
+// getGzipReader returns a gzip.Reader reading from r, reusing a pooled
+// reader if available. The reader should be returned to gzipReaderPool
+// once it is no longer used.
+func getGzipReader(r io.Reader) (*gzip.Reader, error) {
+	if pooled, ok := gzipReaderPool.Get().(*gzip.Reader); ok {
+		if err := pooled.Reset(r); err != nil {
+			gzipReaderPool.Put(pooled)
+			return nil, err
+		}
+		return pooled, nil
+	}
+	return gzip.NewReader(r)
+}
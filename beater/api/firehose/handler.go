@@ -21,21 +21,84 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+
 	"github.com/elastic/apm-server/beater/auth"
 	"github.com/elastic/apm-server/beater/headers"
+	"github.com/elastic/apm-server/beater/ratelimit"
 	"github.com/elastic/apm-server/beater/request"
 	"github.com/elastic/apm-server/datastreams"
+	logs "github.com/elastic/apm-server/log"
 	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modelindexer"
+	"github.com/elastic/apm-server/model/modelprocessor"
 	"github.com/elastic/apm-server/publish"
 )
 
-const dataset = "firehose"
+const (
+	dataset = "firehose"
+
+	// accessKeyIDLabel holds the label used for recording the
+	// ID of the API Key used as the Firehose access key.
+	accessKeyIDLabel = "firehose_access_key_id"
+
+	// RecordFormatText identifies records holding newline-delimited
+	// text, producing an event per line.
+	RecordFormatText = "text"
+
+	// RecordFormatJSON identifies records holding a single JSON
+	// document, producing a structured event per record.
+	RecordFormatJSON = "json"
+
+	// RecordFormatNDJSON identifies records holding a JSON document
+	// on each line, producing a structured event per line.
+	RecordFormatNDJSON = "ndjson"
+
+	// RecordFormatOTLPTraces identifies records each holding a
+	// protobuf-encoded OTLP ExportTraceServiceRequest, producing
+	// transaction, span, and error events.
+	RecordFormatOTLPTraces = "otlp_traces"
+
+	// RecordFormatOTLPMetrics identifies records each holding a
+	// protobuf-encoded OTLP ExportMetricsServiceRequest, producing
+	// metricset events.
+	RecordFormatOTLPMetrics = "otlp_metrics"
+
+	// maxTimestampSeconds holds the largest Firehose request timestamp
+	// interpreted as seconds since the Unix epoch; larger values are
+	// interpreted as milliseconds. As seconds it falls in the year 5138,
+	// and as milliseconds in 1973, so the ranges do not overlap for any
+	// plausible timestamp.
+	maxTimestampSeconds = 1e11
+
+	// maxTimestampSkew holds how far in the future of the time a request
+	// is received its timestamp may be before it is considered implausible.
+	maxTimestampSkew = 24 * time.Hour
+)
+
+// minTimestamp holds the earliest plausible Firehose request timestamp.
+var minTimestamp = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	// MonitoringMap holds a mapping for request.IDs to monitoring counters
+	MonitoringMap = request.DefaultMonitoringMapForRegistry(registry)
+	registry      = monitoring.Default.NewRegistry("apm-server.firehose")
+
+	recordsCount = monitoring.NewInt(registry, "records.count")
+	recordsError = monitoring.NewInt(registry, "records.errors")
+	eventsCount  = monitoring.NewInt(registry, "events.count")
+)
 
 type record struct {
 	Data string `json:"data"`
@@ -58,6 +121,38 @@ type requestError struct {
 	err error
 }
 
+// authorizeDataStreams checks that the client is authorized to ingest
+// events into each of the data streams of the events in batch. Events
+// without a namespace will be written to the given namespace.
+func authorizeDataStreams(ctx context.Context, batch model.Batch, namespace string) error {
+	authorized := make(map[string]bool)
+	for _, event := range batch {
+		eventNamespace := event.DataStream.Namespace
+		if eventNamespace == "" {
+			eventNamespace = namespace
+		}
+		dataStream := fmt.Sprintf(
+			"%s-%s-%s", event.DataStream.Type, event.DataStream.Dataset, eventNamespace,
+		)
+		if authorized[dataStream] {
+			continue
+		}
+		if err := auth.Authorize(ctx, auth.ActionEventIngest, auth.Resource{
+			DataStream: dataStream,
+		}); err != nil {
+			return err
+		}
+		authorized[dataStream] = true
+	}
+	return nil
+}
+
+// recordError holds an error relating to an individual firehose record.
+type recordError struct {
+	index int
+	err   error
+}
+
 // arn struct separate the Amazon Resource Name into individual fields.
 type arn struct {
 	Partition string
@@ -65,77 +160,369 @@ type arn struct {
 	Region    string
 	AccountID string
 	Resource  string
+
+	// ResourceType and ResourceID hold the components of Resource,
+	// for resources of the form "type/id" or "type:id". For resources
+	// without a type, ResourceType is empty and ResourceID is Resource.
+	ResourceType string
+	ResourceID   string
 }
 
+// Classifier classifies the events of firehose records by content, given
+// a log line, or a record in the JSON record format. Classifier returns
+// the dataset and namespace of the data stream for the line's event; if
+// either is empty, the default is used.
+type Classifier func(line string) (dataset, namespace string)
+
+// RecordDecoder decodes the data of a firehose record in a custom format,
+// after any base64 and gzip encoding has been removed, appending events to
+// batch. baseEvent holds metadata common to all events of the request. If
+// the record cannot be decoded, RecordDecoder returns batch unmodified and
+// an error, and the record is skipped.
+type RecordDecoder func(data []byte, baseEvent model.APMEvent, batch model.Batch) (model.Batch, error)
+
 // Authenticator provides provides authentication and authorization support.
 type Authenticator interface {
 	Authenticate(ctx context.Context, kind, token string) (auth.AuthenticationDetails, auth.Authorizer, error)
 }
 
+// HandlerConfig holds configuration for Handler.
+type HandlerConfig struct {
+	// RecordFormat holds the format of records which are not CloudWatch
+	// Logs or Metric Stream payloads: one of RecordFormatText,
+	// RecordFormatJSON, or RecordFormatNDJSON. Records which do not match
+	// the JSON or NDJSON formats are skipped. If RecordFormat is empty,
+	// RecordFormatText is used.
+	//
+	// RecordFormat may also be RecordFormatOTLPTraces or
+	// RecordFormatOTLPMetrics, or a key of RecordDecoders, in which
+	// case all records are decoded in that format.
+	//
+	// ParseJSONLines, ParseVPCFlowLogs, and ExtractLogLevel apply only
+	// to RecordFormatText.
+	RecordFormat string
+
+	// RecordDecoders holds record decoders for custom record formats,
+	// keyed by format. Records are decoded with the decoder registered
+	// for RecordFormat, if any, which takes precedence over the built-in
+	// formats.
+	RecordDecoders map[string]RecordDecoder
+
+	// LineDelimiter holds the delimiter separating the lines of
+	// RecordFormatText records. Empty lines are skipped. If
+	// LineDelimiter is empty, "\n" is used.
+	LineDelimiter string
+
+	// ParseJSONLines controls whether newline-delimited records are
+	// parsed as structured JSON logs. Lines which are not valid JSON
+	// objects are recorded as plain messages.
+	ParseJSONLines bool
+
+	// ParseVPCFlowLogs controls whether newline-delimited records are
+	// parsed as VPC Flow Logs. Lines which do not match the flow log
+	// format are recorded as plain messages.
+	ParseVPCFlowLogs bool
+
+	// VPCFlowLogFields holds the fields of the VPC Flow Logs format,
+	// in order, for custom flow log formats. If VPCFlowLogFields is
+	// empty, the default version 2 format is assumed.
+	VPCFlowLogFields []string
+
+	// ExtractLogLevel controls whether the log level is extracted
+	// from plain-text log lines, using LogLevelPatterns.
+	ExtractLogLevel bool
+
+	// LogLevelPatterns holds regular expressions for extracting the
+	// log level from plain-text log lines. The first capture group of
+	// the first matching pattern is recorded as the log level. If
+	// LogLevelPatterns is empty, patterns matching common level tokens
+	// such as "ERROR" and "level=warn" are used.
+	LogLevelPatterns []*regexp.Regexp
+
+	// TraceIDKey holds the key of the trace ID in JSON log lines and
+	// records, which may be dotted to address nested objects. If
+	// TraceIDKey is empty, "trace.id" is used.
+	TraceIDKey string
+
+	// TransactionIDKey holds the key of the transaction ID in JSON log
+	// lines and records. If TransactionIDKey is empty, transaction IDs
+	// are not extracted from JSON logs.
+	TransactionIDKey string
+
+	// TraceIDPattern, if non-nil, holds a regular expression for
+	// extracting the trace ID from log lines without one, such as
+	// plain-text lines. The first capture group is recorded as the
+	// trace ID, for correlating logs with traces.
+	TraceIDPattern *regexp.Regexp
+
+	// TransactionIDPattern, if non-nil, holds a regular expression for
+	// extracting the transaction ID from log lines without one. The first
+	// capture group is recorded as the transaction ID.
+	TransactionIDPattern *regexp.Regexp
+
+	// Classifier, if non-nil, classifies log events by content, routing
+	// them to different data streams. Events of CloudWatch Logs and
+	// Metric Stream records are not classified. Classified namespaces
+	// are kept by modelprocessor.SetDataStream, through the context
+	// passed to the processor.
+	Classifier Classifier
+
+	// Namespace holds the data stream namespace to which events
+	// will be written, used for authorizing event ingestion.
+	Namespace string
+
+	// MaxBodyBytes holds the maximum request body size, in bytes,
+	// after any Content-Encoding has been decoded. Requests with larger
+	// bodies are rejected. MaxBodyBytes also limits the decompressed
+	// size of each gzip-compressed record; records exceeding it are
+	// skipped. If MaxBodyBytes is zero, sizes are not limited.
+	MaxBodyBytes int64
+
+	// ProcessTimeout holds the maximum duration to wait for the events of
+	// a request to be processed. If processing does not complete in time,
+	// the request is rejected with a 503, so that Firehose retries it. If
+	// ProcessTimeout is zero, processing is bounded only by the request
+	// context.
+	ProcessTimeout time.Duration
+
+	// MaxBatchSize holds the maximum number of events passed to the
+	// processor in a single batch. The events of requests producing more
+	// events are split into batches of at most MaxBatchSize events, which
+	// are processed in turn. If processing a batch fails, the remaining
+	// batches are not processed, and the error reports how many events
+	// were processed; as Firehose retries the whole request, those events
+	// may be duplicated. If MaxBatchSize is zero, the events of each
+	// request are processed as a single batch.
+	MaxBatchSize int
+
+	// RateLimitStore, if non-nil, holds token bucket rate limiters for
+	// limiting the request rate of each delivery stream. Requests are
+	// keyed by the ID of the API Key used as the access key, or else by
+	// the source ARN, and are rejected with a 429 when the rate limit is
+	// exceeded, so that Firehose retries them.
+	RateLimitStore *ratelimit.Store
+
+	// SigV4Verifier, if non-nil, authenticates requests by their AWS
+	// Signature Version 4 signature, for deployments which front the
+	// endpoint with IAM, instead of by the X-Amz-Firehose-Access-Key
+	// header. The AWS access key ID of each request is recorded as
+	// a label, and used for rate limiting. As the signature covers
+	// the request body, the body is buffered in full for verification.
+	SigV4Verifier *SigV4Verifier
+}
+
 // Handler returns a request.Handler for managing firehose requests.
-func Handler(processor model.BatchProcessor, authenticator Authenticator) request.Handler {
-	handle := func(c *request.Context) (*result, error) {
-		accessKey := c.Request.Header.Get("X-Amz-Firehose-Access-Key")
-		if accessKey == "" {
-			return nil, requestError{
-				id:  request.IDResponseErrorsUnauthorized,
-				err: errors.New("Access key is required for using /firehose endpoint"),
+//
+// The events of each request are passed to processor as a single batch,
+// or split into batches of at most cfg.MaxBatchSize events.
+// processor may be a publisher, or a *modelindexer.Indexer for indexing
+// events directly into Elasticsearch; in either case, requests received
+// after the processor has been closed are rejected with a 503, so that
+// Firehose retries them.
+//
+// Firehose retries requests which fail with a 5xx or 429 status code until
+// its retry duration elapses, while other 4xx status codes are treated as
+// permanent failures, and the records are delivered to the backup bucket
+// if configured. Transient conditions, such as a full queue or the server
+// shutting down, are therefore reported with a 5xx status code, and only
+// requests which would fail again if retried unchanged, such as malformed
+// or unauthorized requests, are reported with a 4xx status code.
+func Handler(processor model.BatchProcessor, authenticator Authenticator, cfg HandlerConfig) request.Handler {
+	handle := func(c *request.Context, firehose *firehoseLog) error {
+		// Record the time the request was received, for timestamping
+		// events when the request timestamp is missing or implausible.
+		received := time.Now()
+		var sigV4AccessKeyID string
+		if cfg.SigV4Verifier != nil {
+			accessKeyID, err := authenticateSigV4(c, cfg.SigV4Verifier, cfg.MaxBodyBytes, received)
+			if err != nil {
+				return err
+			}
+			sigV4AccessKeyID = accessKeyID
+			c.Request = c.Request.WithContext(auth.ContextWithAuthorizer(c.Request.Context(), sigV4Authorizer{}))
+		} else {
+			accessKey := c.Request.Header.Get("X-Amz-Firehose-Access-Key")
+			kind := headers.APIKey
+			if accessKey == "" {
+				// Requests without an access key are authenticated as if
+				// no credentials were supplied, which succeeds only if the
+				// authenticator does not require authentication.
+				kind = ""
 			}
+			details, authorizer, err := authenticator.Authenticate(c.Request.Context(), kind, accessKey)
+			if err != nil {
+				if accessKey == "" {
+					return requestError{
+						id:  request.IDResponseErrorsUnauthorized,
+						err: errors.New("Access key is required for using /firehose endpoint"),
+					}
+				}
+				return requestError{
+					id:  request.IDResponseErrorsUnauthorized,
+					err: errors.New("authentication failed"),
+				}
+			}
+			c.Authentication = details
+			c.Request = c.Request.WithContext(auth.ContextWithAuthorizer(c.Request.Context(), authorizer))
 		}
 
-		details, authorizer, err := authenticator.Authenticate(c.Request.Context(), headers.APIKey, accessKey)
-		if err != nil {
-			return nil, requestError{
-				id:  request.IDResponseErrorsUnauthorized,
-				err: errors.New("authentication failed"),
+		if cfg.RateLimitStore != nil {
+			if !cfg.RateLimitStore.ForKey(rateLimitKey(c, sigV4AccessKeyID)).Allow() {
+				return requestError{
+					id:  request.IDResponseErrorsRateLimit,
+					err: ratelimit.ErrRateLimitExceeded,
+				}
 			}
 		}
-
-		c.Authentication = details
-		c.Request = c.Request.WithContext(auth.ContextWithAuthorizer(c.Request.Context(), authorizer))
 		if c.Request.Method != http.MethodPost {
-			return nil, requestError{
+			return requestError{
 				id:  request.IDResponseErrorsMethodNotAllowed,
 				err: errors.New("only POST requests are supported"),
 			}
 		}
 
-		var firehose firehoseLog
-		err = json.NewDecoder(c.Request.Body).Decode(&firehose)
+		var body io.ReadCloser = c.Request.Body
+		switch encoding := c.Request.Header.Get(headers.ContentEncoding); encoding {
+		case "", "identity":
+		case "gzip":
+			gzipReader, err := getGzipReader(body)
+			if err != nil {
+				return requestError{
+					id:  request.IDResponseErrorsDecode,
+					err: errors.Wrap(err, "failed to decompress request body"),
+				}
+			}
+			defer gzipReaderPool.Put(gzipReader)
+			body = gzipReader
+		default:
+			return requestError{
+				id:  request.IDResponseErrorsUnsupportedMediaType,
+				err: fmt.Errorf("unsupported Content-Encoding %q", encoding),
+			}
+		}
+		if cfg.MaxBodyBytes > 0 {
+			body = http.MaxBytesReader(nil, body, cfg.MaxBodyBytes)
+		}
+		baseEvent, err := requestMetadata(c)
 		if err != nil {
-			return nil, err
+			return requestError{id: request.IDResponseErrorsValidate, err: err}
+		}
+		if sigV4AccessKeyID != "" {
+			// Record the access key ID with which the request was
+			// signed, so events may be attributed to the IAM caller.
+			if baseEvent.Labels == nil {
+				baseEvent.Labels = make(common.MapStr)
+			}
+			baseEvent.Labels[sigV4AccessKeyIDLabel] = sigV4AccessKeyID
 		}
 
-		// convert firehose log to events
-		baseEvent := requestMetadata(c)
-		batch, err := processFirehoseLog(firehose, baseEvent)
+		records, err := decodeFirehoseRequest(body, firehose, baseEvent, received, cfg)
 		if err != nil {
-			return nil, err
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				return requestError{
+					id:  request.IDResponseErrorsRequestTooLarge,
+					err: fmt.Errorf("request body exceeds %d bytes", cfg.MaxBodyBytes),
+				}
+			}
+			return requestError{
+				id:  request.IDResponseErrorsDecode,
+				err: errors.Wrap(err, "failed to decode request body"),
+			}
+		}
+		if id := c.Request.Header.Get("X-Amz-Firehose-Request-Id"); id != "" && id != firehose.RequestID {
+			// A mismatch indicates the request was replayed or
+			// modified, e.g. by a misbehaving proxy.
+			return requestError{
+				id: request.IDResponseErrorsValidate,
+				err: fmt.Errorf(
+					"X-Amz-Firehose-Request-Id header %q does not match body requestId %q",
+					id, firehose.RequestID,
+				),
+			}
+		}
+		if err := records.check(); err != nil {
+			// An empty request most likely indicates a
+			// misconfigured producer, so reject it.
+			return requestError{id: request.IDResponseErrorsValidate, err: err}
 		}
 
-		if err := processor.ProcessBatch(c.Request.Context(), &batch); err != nil {
-			switch err {
-			case publish.ErrChannelClosed:
-				return nil, requestError{
-					id:  request.IDResponseErrorsShuttingDown,
-					err: errors.New("server is shutting down"),
-				}
-			case publish.ErrFull:
-				return nil, requestError{
-					id:  request.IDResponseErrorsFullQueue,
-					err: err,
-				}
+		batch, recordErrors := records.batch, records.recordErrors
+		requestBytes.record(records.decodedBytes)
+		requestDecodeDuration.recordDuration(records.decodeDuration)
+		recordsCount.Add(int64(records.records))
+		recordsError.Add(int64(len(recordErrors)))
+		eventsCount.Add(int64(len(batch)))
+		if len(recordErrors) > 0 && len(recordErrors) == records.records {
+			// Nothing could be processed, and retrying would not change
+			// that, so report a permanent failure to Firehose.
+			err := fmt.Errorf(
+				"failed to process all %d records, first error: %w",
+				len(recordErrors), recordErrors[0],
+			)
+			return requestError{id: request.IDResponseErrorsDecode, err: err}
+		}
+		if len(recordErrors) > 0 {
+			logger := c.Logger
+			if logger == nil {
+				logger = logp.NewLogger(logs.Handler)
+			}
+			for _, err := range recordErrors {
+				logger.With(logp.Error(err)).Warn("skipped invalid firehose record")
 			}
-			return nil, err
 		}
-		// Set required requestId and timestamp to match Firehose HTTP delivery
-		// request response format.
-		// https://docs.aws.amazon.com/firehose/latest/dev/httpdeliveryrequestresponse.html#responseformat
-		return &result{RequestID: firehose.RequestID, Timestamp: firehose.Timestamp}, nil
+
+		for i := range batch {
+			setEventDataset(&batch[i])
+		}
+		if err := authorizeDataStreams(c.Request.Context(), batch, cfg.Namespace); err != nil {
+			if errors.Is(err, auth.ErrUnauthorized) {
+				return requestError{id: request.IDResponseErrorsForbidden, err: err}
+			}
+			return err
+		}
+		ctx := c.Request.Context()
+		if cfg.Classifier != nil {
+			// Keep classified namespaces, rather than having
+			// them replaced with the server's namespace.
+			ctx = modelprocessor.ContextWithEventNamespaces(ctx)
+		}
+		if cfg.ProcessTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, cfg.ProcessTimeout)
+			defer cancel()
+		}
+		start := time.Now()
+		processed, err := processBatches(ctx, processor, batch, cfg.MaxBatchSize)
+		requestProcessDuration.recordDuration(time.Since(start))
+		if err != nil {
+			err = processError(err, cfg)
+			if processed > 0 {
+				// Report the events processed before the failure,
+				// which will be duplicated when Firehose retries.
+				err = partialError(err, processed, len(batch))
+			}
+			return err
+		}
+		return nil
 	}
 
 	return func(c *request.Context) {
-		result, err := handle(c)
+		var firehose firehoseLog
+		err := handle(c, &firehose)
+
+		// Set required requestId and timestamp to match Firehose HTTP delivery
+		// request response format, for both successful and failed requests.
+		// If the request body could not be decoded, fall back to the request
+		// ID header and the current time.
+		// https://docs.aws.amazon.com/firehose/latest/dev/httpdeliveryrequestresponse.html#responseformat
+		result := result{RequestID: firehose.RequestID, Timestamp: firehose.Timestamp}
+		if result.RequestID == "" {
+			result.RequestID = c.Request.Header.Get("X-Amz-Firehose-Request-Id")
+		}
+		if result.Timestamp == 0 {
+			result.Timestamp = time.Now().UnixMilli()
+		}
 		if err != nil {
 			switch err := err.(type) {
 			case requestError:
@@ -143,6 +530,8 @@ func Handler(processor model.BatchProcessor, authenticator Authenticator) reques
 			default:
 				c.Result.SetWithError(request.IDResponseErrorsInternal, err)
 			}
+			result.ErrorMessage = err.Error()
+			c.Result.Body = result
 		} else {
 			c.Result.SetWithBody(request.IDResponseValidAccepted, result)
 			c.Result.StatusCode = 200
@@ -154,44 +543,469 @@ func Handler(processor model.BatchProcessor, authenticator Authenticator) reques
 	}
 }
 
+// processBatches passes the events of batch to processor in batches of
+// at most size events, or in a single batch if size is zero, returning
+// the number of events in the batches processed successfully.
+func processBatches(ctx context.Context, processor model.BatchProcessor, batch model.Batch, size int) (int, error) {
+	if size <= 0 || len(batch) <= size {
+		if err := processor.ProcessBatch(ctx, &batch); err != nil {
+			return 0, err
+		}
+		return len(batch), nil
+	}
+	var processed int
+	for len(batch) > 0 {
+		n := size
+		if n > len(batch) {
+			n = len(batch)
+		}
+		// Limit the capacity of each sub-batch, so processors
+		// appending to it cannot overwrite the following events.
+		chunk := batch[:n:n]
+		if err := processor.ProcessBatch(ctx, &chunk); err != nil {
+			return processed, err
+		}
+		processed += n
+		batch = batch[n:]
+	}
+	return processed, nil
+}
+
+// processError returns a requestError for err, returned by the
+// processor, identifying the response for the request.
+func processError(err error, cfg HandlerConfig) error {
+	if errors.Is(err, auth.ErrUnauthorized) {
+		return requestError{id: request.IDResponseErrorsForbidden, err: err}
+	}
+	switch err {
+	case publish.ErrChannelClosed, modelindexer.ErrClosed:
+		return requestError{
+			id:  request.IDResponseErrorsShuttingDown,
+			err: errors.New("server is shutting down"),
+		}
+	case publish.ErrFull, modelindexer.ErrFull:
+		return requestError{
+			id:  request.IDResponseErrorsFullQueue,
+			err: err,
+		}
+	case modelindexer.ErrCircuitOpen:
+		return requestError{
+			id:  request.IDResponseErrorsServiceUnavailable,
+			err: err,
+		}
+	case context.DeadlineExceeded:
+		return requestError{
+			id:  request.IDResponseErrorsTimeout,
+			err: fmt.Errorf("timed out processing events after %s", cfg.ProcessTimeout),
+		}
+	}
+	return err
+}
+
+// partialError returns err annotated with the number of events
+// processed before it occurred, preserving the response identified
+// by a requestError.
+func partialError(err error, processed, total int) error {
+	if rerr, ok := err.(requestError); ok {
+		rerr.err = partialError(rerr.err, processed, total)
+		return rerr
+	}
+	return fmt.Errorf("%w (processed %d of %d events)", err, processed, total)
+}
+
+// rateLimitKey returns the key identifying the delivery stream of the
+// request for rate limiting: the AWS access key ID with which the request
+// was signed, or the ID of the API Key used as the access key, or else the
+// source ARN, or else the client IP.
+func rateLimitKey(c *request.Context, sigV4AccessKeyID string) string {
+	if sigV4AccessKeyID != "" {
+		return "sigv4:" + sigV4AccessKeyID
+	}
+	if c.Authentication.APIKey != nil {
+		return "apikey:" + c.Authentication.APIKey.ID
+	}
+	if arn := c.Request.Header.Get("X-Amz-Firehose-Source-Arn"); arn != "" {
+		return "source_arn:" + arn
+	}
+	return "ip:" + c.ClientIP.String()
+}
+
+// firehoseTimestamp returns the time for the Firehose request timestamp ts,
+// which is interpreted as seconds or milliseconds since the Unix epoch
+// according to its magnitude, as producers have been seen to send either.
+// If ts is zero, or falls before 2000 or more than maxTimestampSkew after
+// received, received is returned instead.
+func firehoseTimestamp(ts int64, received time.Time) time.Time {
+	if ts <= 0 {
+		return received
+	}
+	var t time.Time
+	if ts < maxTimestampSeconds {
+		t = time.Unix(ts, 0)
+	} else {
+		t = time.UnixMilli(ts)
+	}
+	if t.Before(minTimestamp) || t.After(received.Add(maxTimestampSkew)) {
+		return received
+	}
+	return t
+}
+
+// setEventDataset sets the ECS event.dataset field of event to its resolved
+// data stream dataset, and event.module to the dataset up to the first dot,
+// following the ECS convention of "<module>.<dataset>" dataset names, so
+// events are grouped correctly in the Logs UI.
+func setEventDataset(event *model.APMEvent) {
+	event.Event.Dataset = event.DataStream.Dataset
+	event.Event.Module = event.DataStream.Dataset
+	if i := strings.IndexRune(event.Event.Module, '.'); i >= 0 {
+		event.Event.Module = event.Event.Module[:i]
+	}
+}
+
+// lineDelimiter returns cfg.LineDelimiter, or "\n" if it is empty.
+func (cfg HandlerConfig) lineDelimiter() string {
+	if cfg.LineDelimiter == "" {
+		return "\n"
+	}
+	return cfg.LineDelimiter
+}
+
+// recordDecoder returns the RecordDecoder for cfg.RecordFormat, or nil
+// if the format is not decoded by a RecordDecoder.
+func (cfg HandlerConfig) recordDecoder() RecordDecoder {
+	if decode, ok := cfg.RecordDecoders[cfg.RecordFormat]; ok {
+		return decode
+	}
+	return defaultRecordDecoders[cfg.RecordFormat]
+}
+
+// classify sets the data stream of event, from line, using cfg.Classifier.
+func (cfg HandlerConfig) classify(line string, event *model.APMEvent) {
+	if cfg.Classifier == nil {
+		return
+	}
+	dataset, namespace := cfg.Classifier(line)
+	if dataset != "" {
+		event.DataStream.Dataset = dataset
+	}
+	if namespace != "" {
+		event.DataStream.Namespace = namespace
+	}
+}
+
 func (e requestError) Error() string {
 	return e.err.Error()
 }
 
-func processFirehoseLog(firehose firehoseLog, baseEvent model.APMEvent) (model.Batch, error) {
-	var batch model.Batch
+func (e recordError) Error() string {
+	return fmt.Sprintf("record %d: %s", e.index, e.err)
+}
+
+// decodeFirehoseLog decodes a Firehose request body from r into firehose,
+// calling process for each record in order rather than recording them in
+// firehose.Records, so that the records need not all be held in memory.
+//
+// Records are passed to process as they are decoded if the request
+// timestamp precedes them in the body, as it does in requests sent by
+// Firehose. Otherwise they are held until the body has been decoded,
+// so that firehose.Timestamp is set whenever process is called.
+func decodeFirehoseLog(r io.Reader, firehose *firehoseLog, process func(record)) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	var haveTimestamp bool
+	for dec.More() {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		// Match keys case-insensitively, as encoding/json does.
+		switch key, _ := token.(string); {
+		case strings.EqualFold(key, "requestId"):
+			err = dec.Decode(&firehose.RequestID)
+		case strings.EqualFold(key, "timestamp"):
+			err = dec.Decode(&firehose.Timestamp)
+			haveTimestamp = true
+		case strings.EqualFold(key, "records"):
+			err = decodeRecords(dec, func(record record) {
+				if haveTimestamp {
+					process(record)
+				} else {
+					firehose.Records = append(firehose.Records, record)
+				}
+			})
+		default:
+			var value json.RawMessage
+			err = dec.Decode(&value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after top-level value")
+		}
+		return err
+	}
 	for _, record := range firehose.Records {
-		event := baseEvent
-		recordDec, err := base64.StdEncoding.DecodeString(record.Data)
+		process(record)
+	}
+	firehose.Records = nil
+	return nil
+}
+
+// decodeRecords decodes the Firehose records array from dec, calling
+// process for each record as it is decoded.
+func decodeRecords(dec *json.Decoder, process func(record)) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token == nil {
+		return nil
+	}
+	if token != json.Delim('[') {
+		return fmt.Errorf("expected records array, got %v", token)
+	}
+	for dec.More() {
+		var record record
+		if err := dec.Decode(&record); err != nil {
+			return err
+		}
+		process(record)
+	}
+	return expectDelim(dec, ']')
+}
+
+// expectDelim reads the next token from dec, returning an error
+// if it is not the delimiter delim.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected '%s', got %v", delim, token)
+	}
+	return nil
+}
+
+// decodeFirehoseRequest decodes the Firehose request body r into firehose,
+// converting records to events as they are read, so the records need not
+// all be held in memory. The returned recordProcessor holds the events,
+// based on baseEvent, and any errors for records which were skipped.
+//
+// Events are timestamped with the Firehose request timestamp, as
+// interpreted by firehoseTimestamp, unless the record format provides a
+// more precise timestamp.
+func decodeFirehoseRequest(r io.Reader, firehose *firehoseLog, baseEvent model.APMEvent, received time.Time, cfg HandlerConfig) (*recordProcessor, error) {
+	var p *recordProcessor
+	err := decodeFirehoseLog(r, firehose, func(record record) {
+		if p == nil {
+			// The request timestamp precedes the records.
+			p = newRecordProcessor(baseEvent, firehoseTimestamp(firehose.Timestamp, received), cfg)
+		}
+		start := time.Now()
+		p.process(record)
+		p.decodeDuration += time.Since(start)
+	})
+	if p == nil {
+		p = newRecordProcessor(baseEvent, time.Time{}, cfg)
+	}
+	return p, err
+}
+
+// recordProcessor converts Firehose records to events one at a time,
+// so that records may be processed as they are decoded.
+type recordProcessor struct {
+	cfg              HandlerConfig
+	baseEvent        model.APMEvent
+	flowLogFields    []string
+	logLevelPatterns []*regexp.Regexp
+
+	batch        model.Batch
+	recordErrors []recordError
+
+	// records and emptyRecords hold the number of records processed,
+	// and how many of those held empty data.
+	records      int
+	emptyRecords int
+
+	// decodedBytes holds the total size of the records processed,
+	// after base64 decoding and gzip decompression, and decodeDuration
+	// the time spent processing them, as measured by the caller.
+	decodedBytes   int64
+	decodeDuration time.Duration
+}
+
+// newRecordProcessor returns a recordProcessor for converting records
+// to events based on baseEvent, timestamped with timestamp.
+func newRecordProcessor(baseEvent model.APMEvent, timestamp time.Time, cfg HandlerConfig) *recordProcessor {
+	baseEvent.Timestamp = timestamp
+	p := &recordProcessor{cfg: cfg, baseEvent: baseEvent}
+	p.flowLogFields = cfg.VPCFlowLogFields
+	if len(p.flowLogFields) == 0 {
+		p.flowLogFields = defaultVPCFlowLogFields
+	}
+	if cfg.ExtractLogLevel {
+		p.logLevelPatterns = cfg.LogLevelPatterns
+		if len(p.logLevelPatterns) == 0 {
+			p.logLevelPatterns = defaultLogLevelPatterns
+		}
+	}
+	return p
+}
+
+// check returns an error if no records were processed, or if every
+// record held empty data.
+func (p *recordProcessor) check() error {
+	if p.records == 0 {
+		return errors.New("request contains no records")
+	}
+	if p.emptyRecords == p.records {
+		return fmt.Errorf("all %d records are empty", p.records)
+	}
+	return nil
+}
+
+// process converts record to events, appending them to p.batch, or
+// appending to p.recordErrors if the record cannot be processed.
+//
+// Gzip-compressed records are decompressed first. If cfg.RecordFormat
+// has a RecordDecoder, the record is decoded with it. Otherwise,
+// CloudWatch Logs and Metric Stream records produce an event per log
+// event or metric, and other records are parsed per cfg.RecordFormat:
+// an event per JSON record, or per non-empty NDJSON or text line.
+func (p *recordProcessor) process(record record) {
+	i := p.records
+	p.records++
+	if record.Data == "" {
+		p.emptyRecords++
+	}
+	recordDec, err := base64.StdEncoding.DecodeString(record.Data)
+	if err != nil {
+		p.recordErrors = append(p.recordErrors, recordError{
+			index: i,
+			err:   errors.Wrap(err, "failed to decode record"),
+		})
+		return
+	}
+	if isGzip(recordDec) {
+		if recordDec, err = gunzip(recordDec, p.cfg.MaxBodyBytes); err != nil {
+			p.recordErrors = append(p.recordErrors, recordError{
+				index: i,
+				err:   errors.Wrap(err, "failed to decompress record"),
+			})
+			return
+		}
+	}
+	p.decodedBytes += int64(len(recordDec))
+	if decode := p.cfg.recordDecoder(); decode != nil {
+		if p.batch, err = decode(recordDec, p.baseEvent, p.batch); err != nil {
+			p.recordErrors = append(p.recordErrors, recordError{index: i, err: err})
+		}
+		return
+	}
+	if cloudwatch, ok := decodeCloudWatchLogs(recordDec); ok {
+		p.batch = processCloudWatchLogs(cloudwatch, p.baseEvent, p.batch)
+		return
+	}
+	if metrics, ok, err := decodeMetricStream(recordDec); ok {
 		if err != nil {
-			return nil, err
+			p.recordErrors = append(p.recordErrors, recordError{index: i, err: err})
+			return
 		}
+		p.batch = processMetricStream(metrics, p.baseEvent, p.batch)
+		return
+	}
 
-		splitLines := strings.Split(string(recordDec), "\n")
-		for _, line := range splitLines {
-			if line == "" {
-				break
-			}
-			event.Timestamp = time.Unix(firehose.Timestamp/1000, 0)
-			event.Processor = model.LogProcessor
+	switch p.cfg.RecordFormat {
+	case RecordFormatJSON:
+		event := p.baseEvent
+		event.Processor = model.LogProcessor
+		data := strings.TrimSpace(string(recordDec))
+		if !parseJSONLine(data, p.cfg.traceIDKey(), p.cfg.TransactionIDKey, &event) {
+			p.recordErrors = append(p.recordErrors, recordError{
+				index: i,
+				err:   errors.New("record is not a JSON object"),
+			})
+			return
+		}
+		p.cfg.correlate(data, &event)
+		p.cfg.classify(data, &event)
+		p.batch = append(p.batch, event)
+		return
+	case RecordFormatNDJSON:
+		if p.batch, err = parseNDJSON(string(recordDec), p.baseEvent, p.batch, p.cfg); err != nil {
+			p.recordErrors = append(p.recordErrors, recordError{index: i, err: err})
+		}
+		return
+	}
+
+	splitLines := strings.Split(string(recordDec), p.cfg.lineDelimiter())
+	for _, line := range splitLines {
+		if line == "" {
+			// Skip blank lines, rather than stopping at the first,
+			// so lines following a blank line are not dropped.
+			continue
+		}
+		event := p.baseEvent
+		event.Processor = model.LogProcessor
+		switch {
+		case p.cfg.ParseJSONLines && parseJSONLine(line, p.cfg.traceIDKey(), p.cfg.TransactionIDKey, &event):
+		case p.cfg.ParseVPCFlowLogs && parseVPCFlowLog(line, p.flowLogFields, &event):
+		default:
 			event.Message = line
-			batch = append(batch, event)
+			event.Log.Level = extractLogLevel(line, p.logLevelPatterns)
+			event.Labels = copyLabels(p.baseEvent.Labels, 0)
 		}
+		p.cfg.correlate(line, &event)
+		p.cfg.classify(line, &event)
+		p.batch = append(p.batch, event)
 	}
-	return batch, nil
 }
 
-func requestMetadata(c *request.Context) model.APMEvent {
+// requestMetadata returns an event holding metadata common to all events
+// in the request, derived from the Firehose request headers.
+func requestMetadata(c *request.Context) (model.APMEvent, error) {
 	arnString := c.Request.Header.Get("X-Amz-Firehose-Source-Arn")
 	arnParsed := parseARN(arnString)
 
 	var event model.APMEvent
+	if header := c.Request.Header.Get("X-Amz-Firehose-Common-Attributes"); header != "" {
+		labels, err := parseCommonAttributes(header)
+		if err != nil {
+			return model.APMEvent{}, err
+		}
+		event.Labels = labels
+	}
+	if c.Authentication.APIKey != nil {
+		// Record the non-secret ID of the API Key used, so events may be
+		// attributed to delivery streams configured with different keys.
+		if event.Labels == nil {
+			event.Labels = make(common.MapStr)
+		}
+		event.Labels[accessKeyIDLabel] = c.Authentication.APIKey.ID
+	}
 
 	cloudOrigin := &model.CloudOrigin{}
 	cloudOrigin.AccountID = arnParsed.AccountID
 	cloudOrigin.Region = arnParsed.Region
 	event.Cloud.Origin = cloudOrigin
 
+	// Firehose is an AWS service, so default the cloud fields to those
+	// of the delivery stream. These may be overridden by fields in the
+	// records, such as the account of a VPC Flow Log.
+	event.Cloud.Provider = "aws"
+	event.Cloud.AccountID = arnParsed.AccountID
+	event.Cloud.Region = arnParsed.Region
+
 	serviceOrigin := &model.ServiceOrigin{}
 	serviceOrigin.ID = arnString
 	serviceOrigin.Name = arnParsed.Resource
@@ -200,22 +1014,92 @@ func requestMetadata(c *request.Context) model.APMEvent {
 	// Set data stream type and dataset fields for Firehose
 	event.DataStream.Type = datastreams.LogsType
 	event.DataStream.Dataset = dataset
-	return event
+	return event, nil
+}
+
+// commonAttributes holds the value of the X-Amz-Firehose-Common-Attributes
+// header, which holds attributes configured for the delivery stream.
+//
+// https://docs.aws.amazon.com/firehose/latest/dev/httpdeliveryrequestresponse.html#requestformat
+type commonAttributes struct {
+	CommonAttributes map[string]interface{} `json:"commonAttributes"`
+}
+
+// parseCommonAttributes parses the X-Amz-Firehose-Common-Attributes header
+// value, returning its attributes as labels.
+//
+// Nested objects are flattened, joining the keys with underscores: the
+// attributes {"deployment": {"region": "us-east-1"}} produce the label
+// "deployment_region". Arrays are recorded as their JSON encoding.
+func parseCommonAttributes(header string) (common.MapStr, error) {
+	var attrs commonAttributes
+	if err := json.Unmarshal([]byte(header), &attrs); err != nil {
+		return nil, errors.Wrap(err, "invalid X-Amz-Firehose-Common-Attributes header")
+	}
+	if len(attrs.CommonAttributes) == 0 {
+		return nil, nil
+	}
+	labels := make(common.MapStr)
+	flattenAttributes("", attrs.CommonAttributes, labels)
+	return labels, nil
+}
+
+func flattenAttributes(prefix string, attrs map[string]interface{}, labels common.MapStr) {
+	for k, v := range attrs {
+		k = prefix + k
+		switch v := v.(type) {
+		case nil:
+		case map[string]interface{}:
+			flattenAttributes(k+"_", v, labels)
+		case []interface{}:
+			encoded, _ := json.Marshal(v)
+			labels[k] = string(encoded)
+		default:
+			labels[k] = v
+		}
+	}
+}
+
+// copyLabels returns a copy of labels, with capacity for n additional
+// labels. Each event must have its own labels, as they may be modified
+// when the event is encoded.
+func copyLabels(labels common.MapStr, n int) common.MapStr {
+	if len(labels)+n == 0 {
+		return nil
+	}
+	out := make(common.MapStr, len(labels)+n)
+	for k, v := range labels {
+		out[k] = v
+	}
+	return out
 }
 
 func parseARN(arnString string) arn {
-	// arn example for firehose:
+	// arn examples for firehose delivery streams and kinesis streams:
 	// arn:aws:firehose:us-east-1:123456789:deliverystream/vpc-flow-log-stream-http-endpoint
-	arnSections := 6
+	// arn:aws:kinesis:us-east-1:123456789:stream/vpc-flow-log-stream
+	//
+	// The resource may itself contain colons, so it is everything
+	// following the account ID. ARNs with fewer sections are parsed
+	// as far as possible, leaving the missing fields empty.
+	const arnSections = 6
 	sections := strings.SplitN(arnString, ":", arnSections)
-	if len(sections) != arnSections {
+	if len(sections) < 2 || sections[0] != "arn" {
 		return arn{}
 	}
-	return arn{
+	sections = append(sections, make([]string, arnSections-len(sections))...)
+	parsed := arn{
 		Partition: sections[1],
 		Service:   sections[2],
 		Region:    sections[3],
 		AccountID: sections[4],
 		Resource:  sections[5],
 	}
+	if i := strings.IndexAny(parsed.Resource, "/:"); i >= 0 {
+		parsed.ResourceType = parsed.Resource[:i]
+		parsed.ResourceID = parsed.Resource[i+1:]
+	} else {
+		parsed.ResourceID = parsed.Resource
+	}
+	return parsed
 }
@@ -19,24 +19,39 @@ package firehose
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+
 	"github.com/elastic/apm-server/beater/auth"
 	"github.com/elastic/apm-server/beater/config"
 	"github.com/elastic/apm-server/beater/headers"
+	"github.com/elastic/apm-server/beater/ratelimit"
 	"github.com/elastic/apm-server/beater/request"
+	"github.com/elastic/apm-server/elasticsearch"
 	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modelindexer"
 	"github.com/elastic/apm-server/model/modelprocessor"
+	"github.com/elastic/apm-server/publish"
 )
 
 const (
@@ -62,6 +77,13 @@ func TestFirehoseHandler(t *testing.T) {
 			code:              http.StatusUnauthorized,
 			id:                request.IDResponseErrorsUnauthorized,
 			firehoseAccessKey: "",
+			authenticator:     newRequiredAuthenticator(t),
+		},
+		"no_access_key_auth_disabled": {
+			path:              "vpc_log.json",
+			code:              http.StatusOK,
+			id:                request.IDResponseValidAccepted,
+			firehoseAccessKey: "",
 		},
 	} {
 		t.Run(name, func(t *testing.T) {
@@ -69,7 +91,7 @@ func TestFirehoseHandler(t *testing.T) {
 			tc.setup(t)
 
 			// call handler
-			h := Handler(tc.batchProcessor, tc.authenticator)
+			h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
 			h(tc.c)
 
 			require.Equal(t, string(tc.id), string(tc.c.Result.ID))
@@ -108,7 +130,7 @@ func TestProcessFirehoseLog(t *testing.T) {
 	}
 
 	tc.setup(t)
-	h := Handler(tc.batchProcessor, tc.authenticator)
+	h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
 	h(tc.c)
 
 	require.Len(t, batches, 1)
@@ -116,12 +138,1325 @@ func TestProcessFirehoseLog(t *testing.T) {
 	event := batches[0][0]
 
 	assert.Equal(t, expectedMessage, event.Message)
+	assert.True(t, time.Unix(1632865411, 915000000).Equal(event.Timestamp), event.Timestamp)
 	assert.Equal(t, expectedRegion, event.Cloud.Origin.Region)
 	assert.Equal(t, expectedAccountID, event.Cloud.Origin.AccountID)
 	assert.Equal(t, testARN, event.Service.Origin.ID)
 	assert.Equal(t, expectedResource, event.Service.Origin.Name)
 }
 
+func TestProcessFirehoseLogTimestampZero(t *testing.T) {
+	var batches []model.Batch
+	body := `{"requestId":"abc","timestamp":0,"records":[{"data":"` +
+		base64.StdEncoding.EncodeToString([]byte("line\n")) + `"}]}`
+	tc := testcaseFirehoseHandler{
+		r: httptest.NewRequest("POST", "/", strings.NewReader(body)),
+		batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			batches = append(batches, *batch)
+			return nil
+		}),
+	}
+	tc.setup(t)
+	before := time.Now()
+	Handler(tc.batchProcessor, tc.authenticator, tc.cfg)(tc.c)
+	after := time.Now()
+
+	assert.Equal(t, http.StatusOK, tc.w.Code, tc.w.Body.String())
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0], 1)
+	ts := batches[0][0].Timestamp
+	assert.False(t, ts.Before(before), ts)
+	assert.False(t, ts.After(after), ts)
+}
+
+func TestRequestMetadataCloud(t *testing.T) {
+	tc := testcaseFirehoseHandler{path: "vpc_log.json"}
+	tc.setup(t)
+	event, err := requestMetadata(tc.c)
+	require.NoError(t, err)
+	assert.Equal(t, model.Cloud{
+		Provider:  "aws",
+		AccountID: expectedAccountID,
+		Region:    expectedRegion,
+		Origin: &model.CloudOrigin{
+			AccountID: expectedAccountID,
+			Region:    expectedRegion,
+		},
+	}, event.Cloud)
+}
+
+func TestProcessFirehoseCloudWatchLogs(t *testing.T) {
+	var batches []model.Batch
+	tc := testcaseFirehoseHandler{
+		path:              "cloudwatch_log.json",
+		code:              http.StatusOK,
+		id:                request.IDResponseValidAccepted,
+		firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+		batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			batches = append(batches, *batch)
+			return nil
+		}),
+	}
+
+	tc.setup(t)
+	h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+	h(tc.c)
+	require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+
+	// The control message record is ignored.
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0], 2)
+	for i, expected := range []struct {
+		message   string
+		timestamp time.Time
+	}{{
+		message:   "START RequestId: 6d4a3d3e-5f0a-4c8b-9d2a-1f2e3d4c5b6a Version: $LATEST",
+		timestamp: time.Unix(1632865405, 123000000),
+	}, {
+		message:   "END RequestId: 6d4a3d3e-5f0a-4c8b-9d2a-1f2e3d4c5b6a",
+		timestamp: time.Unix(1632865405, 456000000),
+	}} {
+		event := batches[0][i]
+		assert.Equal(t, model.LogProcessor, event.Processor)
+		assert.Equal(t, expected.message, event.Message)
+		assert.True(t, expected.timestamp.Equal(event.Timestamp), event.Timestamp)
+		assert.Equal(t, "/aws/lambda/my-function", event.Service.Name)
+		assert.Equal(t, common.MapStr{
+			"log_stream": "2021/09/28/[$LATEST]e5b2d8d1b4a64a65b8d2b48a5c0f1c3e",
+		}, event.Labels)
+		assert.Equal(t, expectedRegion, event.Cloud.Origin.Region)
+		assert.Equal(t, testARN, event.Service.Origin.ID)
+	}
+}
+
+func TestProcessFirehoseLogTimestampMillis(t *testing.T) {
+	batch, recordErrors := processFirehoseRecords(t, firehoseLog{
+		Timestamp: 1700000000123,
+		Records:   []record{{Data: base64.StdEncoding.EncodeToString([]byte("line\n"))}},
+	}, model.APMEvent{}, time.Now(), HandlerConfig{})
+	require.Empty(t, recordErrors)
+	require.Len(t, batch, 1)
+	assert.Equal(t, int64(1700000000), batch[0].Timestamp.Unix())
+	assert.Equal(t, 123*time.Millisecond, time.Duration(batch[0].Timestamp.Nanosecond()))
+}
+
+func TestFirehoseTimestamp(t *testing.T) {
+	received := time.Date(2023, 11, 14, 22, 15, 0, 0, time.UTC)
+	for name, test := range map[string]struct {
+		ts     int64
+		expect time.Time
+	}{
+		"seconds":      {ts: 1700000000, expect: time.Unix(1700000000, 0)},
+		"milliseconds": {ts: 1700000000123, expect: time.UnixMilli(1700000000123)},
+		"zero":         {ts: 0, expect: received},
+		"negative":     {ts: -1, expect: received},
+		"too_old":      {ts: 1000, expect: received},
+		"future":       {ts: received.Add(48 * time.Hour).UnixMilli(), expect: received},
+		"microseconds": {ts: 1700000000123456, expect: received},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ts := firehoseTimestamp(test.ts, received)
+			assert.True(t, test.expect.Equal(ts), ts)
+		})
+	}
+}
+
+func TestProcessFirehoseLogTimestampSeconds(t *testing.T) {
+	batch, recordErrors := processFirehoseRecords(t, firehoseLog{
+		Timestamp: 1700000000,
+		Records:   []record{{Data: base64.StdEncoding.EncodeToString([]byte("line\n"))}},
+	}, model.APMEvent{}, time.Now(), HandlerConfig{})
+	require.Empty(t, recordErrors)
+	require.Len(t, batch, 1)
+	assert.True(t, time.Unix(1700000000, 0).Equal(batch[0].Timestamp), batch[0].Timestamp)
+}
+
+func TestProcessCloudWatchLogsTimestampFallback(t *testing.T) {
+	baseEvent := model.APMEvent{Timestamp: time.UnixMilli(1632865411915)}
+	batch := processCloudWatchLogs(cloudwatchLogs{
+		MessageType: cloudwatchDataMessage,
+		LogEvents: []cloudwatchLogEvent{
+			{Timestamp: 1632865405123, Message: "with timestamp"},
+			{Message: "without timestamp"},
+		},
+	}, baseEvent, nil)
+	require.Len(t, batch, 2)
+	assert.True(t, time.UnixMilli(1632865405123).Equal(batch[0].Timestamp), batch[0].Timestamp)
+	assert.True(t, time.UnixMilli(1632865411915).Equal(batch[1].Timestamp), batch[1].Timestamp)
+}
+
+func TestProcessFirehoseMetricStream(t *testing.T) {
+	var batches []model.Batch
+	tc := testcaseFirehoseHandler{
+		path:              "metric_stream.json",
+		code:              http.StatusOK,
+		id:                request.IDResponseValidAccepted,
+		firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+		batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			batches = append(batches, *batch)
+			return nil
+		}),
+	}
+
+	tc.setup(t)
+	h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+	h(tc.c)
+	require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0], 2)
+	event := batches[0][0]
+	assert.Equal(t, model.MetricsetProcessor, event.Processor)
+	assert.Equal(t, "metrics", event.DataStream.Type)
+	assert.Equal(t, "firehose", event.DataStream.Dataset)
+	assert.True(t, time.Unix(1632865405, 123000000).Equal(event.Timestamp), event.Timestamp)
+	assert.Empty(t, event.Message)
+	assert.Equal(t, "aws", event.Cloud.Provider)
+	assert.Equal(t, expectedAccountID, event.Cloud.AccountID)
+	assert.Equal(t, expectedRegion, event.Cloud.Region)
+	assert.Equal(t, common.MapStr{"InstanceId": "i-123456789012"}, event.Labels)
+	assert.Equal(t, &model.Metricset{
+		Name: "AWS/EC2",
+		Samples: map[string]model.MetricsetSample{
+			"DiskWriteOps.max":   {Type: model.MetricTypeGauge, Unit: "s", Value: 3},
+			"DiskWriteOps.min":   {Type: model.MetricTypeGauge, Unit: "s", Value: 0},
+			"DiskWriteOps.sum":   {Type: model.MetricTypeGauge, Unit: "s", Value: 9},
+			"DiskWriteOps.count": {Type: model.MetricTypeGauge, Value: 3},
+		},
+	}, event.Metricset)
+	assert.Equal(t, "byte", batches[0][1].Metricset.Samples["NetworkIn.sum"].Unit)
+	assert.Equal(t, float64(4096), batches[0][1].Metricset.Samples["NetworkIn.sum"].Value)
+}
+
+func TestProcessFirehoseJSONLines(t *testing.T) {
+	for name, parseJSONLines := range map[string]bool{"enabled": true, "disabled": false} {
+		t.Run(name, func(t *testing.T) {
+			var batches []model.Batch
+			tc := testcaseFirehoseHandler{
+				path:              "json_log.json",
+				code:              http.StatusOK,
+				id:                request.IDResponseValidAccepted,
+				firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+				cfg:               HandlerConfig{ParseJSONLines: parseJSONLines},
+				batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+					batches = append(batches, *batch)
+					return nil
+				}),
+			}
+
+			tc.setup(t)
+			h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+			h(tc.c)
+			require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+			require.Len(t, batches, 1)
+			require.Len(t, batches[0], 3)
+
+			if !parseJSONLines {
+				assert.Equal(t, "{", batches[0][0].Message[:1])
+				assert.Empty(t, batches[0][0].Log.Level)
+				return
+			}
+
+			structured := batches[0][0]
+			assert.Equal(t, "failed to connect to database", structured.Message)
+			assert.Equal(t, "error", structured.Log.Level)
+			assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", structured.Trace.ID)
+			assert.Equal(t, "checkout", structured.Service.Name)
+			assert.Equal(t, testARN, structured.Service.Origin.ID)
+			assert.True(t, time.Date(2021, 9, 28, 21, 43, 25, 123000000, time.UTC).Equal(structured.Timestamp))
+			assert.Equal(t, common.MapStr{"http_status_code": float64(503), "retry": true}, structured.Labels)
+
+			assert.Equal(t, "request completed", batches[0][1].Message)
+			assert.Equal(t, "INFO", batches[0][1].Log.Level)
+			assert.Empty(t, batches[0][1].Trace.ID)
+			assert.Nil(t, batches[0][1].Labels)
+
+			assert.Equal(t, "plain text log line", batches[0][2].Message)
+			assert.Empty(t, batches[0][2].Log.Level)
+		})
+	}
+}
+
+func TestProcessFirehoseRecordFormat(t *testing.T) {
+	records := []string{
+		"{\n  \"message\": \"pretty printed\",\n  \"level\": \"info\"\n}\n",
+		"{\"message\": \"first\"}\n\n{\"message\": \"second\", \"level\": \"warn\"}\n",
+		"{\"message\": \"valid\"}\nnot json\n",
+	}
+	firehose := firehoseLog{Timestamp: 1632865411915}
+	for _, data := range records {
+		firehose.Records = append(firehose.Records, record{
+			Data: base64.StdEncoding.EncodeToString([]byte(data)),
+		})
+	}
+
+	for name, test := range map[string]struct {
+		format   string
+		messages []string
+		levels   []string
+		errors   []string
+	}{
+		"json": {
+			format:   RecordFormatJSON,
+			messages: []string{"pretty printed"},
+			levels:   []string{"info"},
+			errors: []string{
+				"record 1: record is not a JSON object",
+				"record 2: record is not a JSON object",
+			},
+		},
+		"ndjson": {
+			format:   RecordFormatNDJSON,
+			messages: []string{"first", "second"},
+			levels:   []string{"", "warn"},
+			errors: []string{
+				"record 0: line 1 is not a JSON object",
+				"record 2: line 2 is not a JSON object",
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			batch, recordErrors := processFirehoseRecords(t, firehose, model.APMEvent{}, time.Now(), HandlerConfig{
+				RecordFormat: test.format,
+			})
+			var errors []string
+			for _, err := range recordErrors {
+				errors = append(errors, err.Error())
+			}
+			assert.Equal(t, test.errors, errors)
+
+			var messages, levels []string
+			for _, event := range batch {
+				assert.Equal(t, model.LogProcessor, event.Processor)
+				messages = append(messages, event.Message)
+				levels = append(levels, event.Log.Level)
+			}
+			assert.Equal(t, test.messages, messages)
+			assert.Equal(t, test.levels, levels)
+		})
+	}
+}
+
+func TestProcessFirehoseLineDelimiter(t *testing.T) {
+	for name, test := range map[string]struct {
+		delimiter string
+		data      string
+	}{
+		"default": {
+			data: "first\nsecond\nthird\n",
+		},
+		"crlf": {
+			delimiter: "\r\n",
+			data:      "first\r\nsecond\r\nthird\r\n",
+		},
+		"custom": {
+			delimiter: "|",
+			data:      "first|second|third",
+		},
+		"interior_blank_line": {
+			delimiter: "\r\n",
+			data:      "first\r\n\r\nsecond\r\nthird",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			firehose := firehoseLog{
+				Timestamp: 1632865411915,
+				Records:   []record{{Data: base64.StdEncoding.EncodeToString([]byte(test.data))}},
+			}
+			batch, recordErrors := processFirehoseRecords(t, firehose, model.APMEvent{}, time.Now(), HandlerConfig{
+				LineDelimiter: test.delimiter,
+			})
+			require.Empty(t, recordErrors)
+
+			var messages []string
+			for _, event := range batch {
+				messages = append(messages, event.Message)
+			}
+			assert.Equal(t, []string{"first", "second", "third"}, messages)
+		})
+	}
+}
+
+func TestProcessFirehoseBlankLines(t *testing.T) {
+	firehose := firehoseLog{
+		Timestamp: 1632865411915,
+		Records:   []record{{Data: base64.StdEncoding.EncodeToString([]byte("a\n\nb"))}},
+	}
+	batch, recordErrors := processFirehoseRecords(t, firehose, model.APMEvent{}, time.Now(), HandlerConfig{})
+	require.Empty(t, recordErrors)
+	require.Len(t, batch, 2)
+	assert.Equal(t, "a", batch[0].Message)
+	assert.Equal(t, "b", batch[1].Message)
+}
+
+func TestProcessFirehoseClassifier(t *testing.T) {
+	wafPattern := regexp.MustCompile(`^WAF\b`)
+	classifier := func(line string) (dataset, namespace string) {
+		switch {
+		case wafPattern.MatchString(line):
+			return "aws.waf", "security"
+		case strings.HasPrefix(line, "2 "):
+			return "aws.vpcflow", ""
+		case strings.Contains(line, `"level"`):
+			return "app", ""
+		}
+		return "", ""
+	}
+	baseEvent := model.APMEvent{DataStream: model.DataStream{Type: "logs", Dataset: "firehose"}}
+
+	lines := []string{
+		"WAF request blocked",
+		expectedMessage,
+		"unmatched line",
+	}
+	batch, recordErrors := processFirehoseRecords(t, firehoseLog{
+		Timestamp: 1632865411915,
+		Records: []record{
+			{Data: base64.StdEncoding.EncodeToString([]byte(strings.Join(lines, "\n") + "\n"))},
+		},
+	}, baseEvent, time.Now(), HandlerConfig{ParseVPCFlowLogs: true, Classifier: classifier})
+	require.Empty(t, recordErrors)
+	require.Len(t, batch, 3)
+	assert.Equal(t, model.DataStream{Type: "logs", Dataset: "aws.waf", Namespace: "security"}, batch[0].DataStream)
+	assert.Equal(t, model.DataStream{Type: "logs", Dataset: "aws.vpcflow"}, batch[1].DataStream)
+	assert.Equal(t, "reject", batch[1].Event.Action)
+	assert.Equal(t, model.DataStream{Type: "logs", Dataset: "firehose"}, batch[2].DataStream)
+
+	// Records in the JSON and NDJSON formats are classified
+	// by their record and line content respectively.
+	for _, format := range []string{RecordFormatJSON, RecordFormatNDJSON} {
+		batch, recordErrors := processFirehoseRecords(t, firehoseLog{
+			Timestamp: 1632865411915,
+			Records: []record{
+				{Data: base64.StdEncoding.EncodeToString([]byte(`{"message": "a", "level": "info"}`))},
+				{Data: base64.StdEncoding.EncodeToString([]byte(`{"message": "b"}`))},
+			},
+		}, baseEvent, time.Now(), HandlerConfig{RecordFormat: format, Classifier: classifier})
+		require.Empty(t, recordErrors)
+		require.Len(t, batch, 2)
+		assert.Equal(t, "app", batch[0].DataStream.Dataset, format)
+		assert.Equal(t, "firehose", batch[1].DataStream.Dataset, format)
+	}
+}
+
+func TestFirehoseClassifierNamespace(t *testing.T) {
+	var events []model.APMEvent
+	body := `{"requestId":"abc","timestamp":1632865411915,"records":[{"data":"` +
+		base64.StdEncoding.EncodeToString([]byte("WAF request blocked\nunmatched line\n")) + `"}]}`
+	tc := testcaseFirehoseHandler{
+		r: httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)),
+		cfg: HandlerConfig{Classifier: func(line string) (dataset, namespace string) {
+			if strings.HasPrefix(line, "WAF") {
+				return "aws.waf", "security"
+			}
+			return "", ""
+		}},
+		// The server's SetDataStream processor follows the handler,
+		// and must not replace the classified namespace.
+		batchProcessor: modelprocessor.Chained{
+			&modelprocessor.SetDataStream{Namespace: "default"},
+			model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+				events = append(events, (*batch)...)
+				return nil
+			}),
+		},
+	}
+	tc.setup(t)
+	Handler(tc.batchProcessor, tc.authenticator, tc.cfg)(tc.c)
+	require.Equal(t, http.StatusOK, tc.w.Code, tc.w.Body.String())
+	require.Len(t, events, 2)
+	assert.Equal(t, model.DataStream{Type: "logs", Dataset: "aws.waf", Namespace: "security"}, events[0].DataStream)
+	assert.Equal(t, model.DataStream{Type: "logs", Dataset: "firehose", Namespace: "default"}, events[1].DataStream)
+}
+
+func TestEventDataset(t *testing.T) {
+	for name, test := range map[string]struct {
+		path       string
+		classifier Classifier
+		dataset    string
+		module     string
+	}{
+		"logs":          {path: "vpc_log.json", dataset: "firehose", module: "firehose"},
+		"metric_stream": {path: "metric_stream.json", dataset: "firehose", module: "firehose"},
+		"classified": {
+			path: "vpc_log.json",
+			classifier: func(string) (string, string) {
+				return "aws.vpcflow", ""
+			},
+			dataset: "aws.vpcflow",
+			module:  "aws",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var events []model.APMEvent
+			tc := testcaseFirehoseHandler{
+				path: test.path,
+				cfg:  HandlerConfig{Classifier: test.classifier},
+				batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+					events = append(events, (*batch)...)
+					return nil
+				}),
+			}
+			tc.setup(t)
+			h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+			h(tc.c)
+			require.Equal(t, http.StatusOK, tc.w.Code, tc.w.Body.String())
+
+			require.NotEmpty(t, events)
+			for _, event := range events {
+				assert.Equal(t, test.dataset, event.DataStream.Dataset)
+				assert.Equal(t, test.dataset, event.Event.Dataset)
+				assert.Equal(t, test.module, event.Event.Module)
+
+				fields := event.BeatEvent(context.Background()).Fields
+				assert.Equal(t, test.dataset, fields["data_stream.dataset"])
+				eventFields, _ := fields["event"].(common.MapStr)
+				assert.Equal(t, test.dataset, eventFields["dataset"])
+				assert.Equal(t, test.module, eventFields["module"])
+			}
+		})
+	}
+}
+
+func TestProcessFirehoseTraceCorrelation(t *testing.T) {
+	process := func(cfg HandlerConfig, data ...string) model.Batch {
+		var records []record
+		for _, data := range data {
+			records = append(records, record{Data: base64.StdEncoding.EncodeToString([]byte(data))})
+		}
+		batch, recordErrors := processFirehoseRecords(t, firehoseLog{Timestamp: 1632865411915, Records: records}, model.APMEvent{}, time.Now(), cfg)
+		require.Empty(t, recordErrors)
+		return batch
+	}
+
+	t.Run("json_key", func(t *testing.T) {
+		cfg := HandlerConfig{
+			RecordFormat:     RecordFormatJSON,
+			TraceIDKey:       "traceId",
+			TransactionIDKey: "span.transaction",
+		}
+		batch := process(cfg,
+			`{"message": "a", "traceId": "abc123", "span": {"transaction": "def456"}}`,
+			`{"message": "b", "trace.id": "xyz"}`,
+		)
+		require.Len(t, batch, 2)
+		assert.Equal(t, "abc123", batch[0].Trace.ID)
+		assert.Equal(t, &model.Transaction{ID: "def456"}, batch[0].Transaction)
+		assert.Empty(t, batch[0].Labels)
+
+		// With a configured trace ID key, "trace.id" is recorded as a
+		// label; otherwise it is used for the trace ID.
+		assert.Empty(t, batch[1].Trace.ID)
+		assert.Nil(t, batch[1].Transaction)
+		assert.Equal(t, common.MapStr{"trace.id": "xyz"}, batch[1].Labels)
+		batch = process(HandlerConfig{RecordFormat: RecordFormatJSON}, `{"message": "b", "trace.id": "xyz"}`)
+		assert.Equal(t, "xyz", batch[0].Trace.ID)
+	})
+
+	t.Run("regex", func(t *testing.T) {
+		cfg := HandlerConfig{
+			TraceIDPattern:       regexp.MustCompile(`trace_id=([0-9a-f]+)`),
+			TransactionIDPattern: regexp.MustCompile(`transaction_id=([0-9a-f]+)`),
+		}
+		batch := process(cfg, strings.Join([]string{
+			"GET /api trace_id=0af7651916cd43dd transaction_id=b7ad6b71",
+			"GET /api trace_id=0af7651916cd43dd",
+			"GET /healthz",
+		}, "\n"))
+		require.Len(t, batch, 3)
+		assert.Equal(t, "0af7651916cd43dd", batch[0].Trace.ID)
+		assert.Equal(t, &model.Transaction{ID: "b7ad6b71"}, batch[0].Transaction)
+		assert.Equal(t, "0af7651916cd43dd", batch[1].Trace.ID)
+		assert.Nil(t, batch[1].Transaction)
+		assert.Empty(t, batch[2].Trace.ID)
+		assert.Nil(t, batch[2].Transaction)
+	})
+}
+
+func TestProcessFirehoseVPCFlowLogs(t *testing.T) {
+	customFields := []string{
+		"version", "vpc-id", "instance-id", "srcaddr", "dstaddr",
+		"srcport", "dstport", "protocol", "packets", "bytes", "start", "action",
+	}
+	for name, test := range map[string]struct {
+		line   string
+		fields []string
+		event  func(event *model.APMEvent)
+	}{
+		"default": {
+			line: "2 123456789 eni-0b27ae2b72f7bec4c 45.146.165.96 172.31.0.75 50716 8983 6 1 40 1631651611 1631651654 REJECT OK",
+			event: func(event *model.APMEvent) {
+				event.Cloud.Provider = "aws"
+				event.Cloud.AccountID = "123456789"
+				event.Source = model.Source{IP: net.ParseIP("45.146.165.96"), Port: 50716}
+				event.Destination = model.Destination{Address: "172.31.0.75", Port: 8983}
+				event.Network.Transport = "tcp"
+				event.Network.IANANumber = "6"
+				event.Network.Packets = 1
+				event.Network.Bytes = 40
+				event.Event.Action = "reject"
+				event.Timestamp = time.Unix(1631651611, 0)
+				event.Labels = common.MapStr{
+					"version":      "2",
+					"interface_id": "eni-0b27ae2b72f7bec4c",
+					"end":          "1631651654",
+					"log_status":   "OK",
+				}
+			},
+		},
+		"custom": {
+			line:   "5 vpc-0a1b2c3d i-0123456789abcdef0 10.0.0.1 10.0.0.2 443 49152 17 10 1500 1631651611 ACCEPT",
+			fields: customFields,
+			event: func(event *model.APMEvent) {
+				event.Cloud.InstanceID = "i-0123456789abcdef0"
+				event.Source = model.Source{IP: net.ParseIP("10.0.0.1"), Port: 443}
+				event.Destination = model.Destination{Address: "10.0.0.2", Port: 49152}
+				event.Network.Transport = "udp"
+				event.Network.IANANumber = "17"
+				event.Network.Packets = 10
+				event.Network.Bytes = 1500
+				event.Event.Action = "accept"
+				event.Timestamp = time.Unix(1631651611, 0)
+				event.Labels = common.MapStr{"version": "5", "vpc_id": "vpc-0a1b2c3d"}
+			},
+		},
+		"nodata": {
+			line: "2 123456789 eni-0b27ae2b72f7bec4c - - - - - - - 1631651611 1631651654 - NODATA",
+			event: func(event *model.APMEvent) {
+				event.Cloud.Provider = "aws"
+				event.Cloud.AccountID = "123456789"
+				event.Timestamp = time.Unix(1631651611, 0)
+				event.Labels = common.MapStr{
+					"version":      "2",
+					"interface_id": "eni-0b27ae2b72f7bec4c",
+					"end":          "1631651654",
+					"log_status":   "NODATA",
+				}
+			},
+		},
+		"mismatched_field_count": {
+			line: "2 123456789 eni-0b27ae2b72f7bec4c 45.146.165.96 172.31.0.75",
+		},
+		"invalid_address": {
+			line: "2 123456789 eni-0b27ae2b72f7bec4c not-an-ip 172.31.0.75 50716 8983 6 1 40 1631651611 1631651654 REJECT OK",
+		},
+		"custom_format_mismatch": {
+			line:   "2 123456789 eni-0b27ae2b72f7bec4c 45.146.165.96 172.31.0.75 50716 8983 6 1 40 1631651611 1631651654 REJECT OK",
+			fields: customFields,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			firehose := firehoseLog{
+				Timestamp: 1632865411915,
+				Records:   []record{{Data: base64.StdEncoding.EncodeToString([]byte(test.line + "\n"))}},
+			}
+			baseEvent := model.APMEvent{Service: model.Service{Origin: &model.ServiceOrigin{ID: testARN}}}
+			batch, recordErrors := processFirehoseRecords(t, firehose, baseEvent, time.Now(), HandlerConfig{
+				ParseVPCFlowLogs: true,
+				VPCFlowLogFields: test.fields,
+			})
+			require.Empty(t, recordErrors)
+			require.Len(t, batch, 1)
+
+			expected := baseEvent
+			expected.Processor = model.LogProcessor
+			expected.Message = test.line
+			expected.Timestamp = time.UnixMilli(firehose.Timestamp)
+			if test.event != nil {
+				test.event(&expected)
+			}
+			assert.Equal(t, expected, batch[0])
+		})
+	}
+}
+
+func TestProcessFirehoseLogLevel(t *testing.T) {
+	lines := []string{
+		"2021-09-28T21:43:25Z ERROR failed to connect to database",
+		"ts=2021-09-28T21:43:25Z level=warn msg=\"slow request\"",
+		"[debug] cache miss",
+		"no level here",
+	}
+	firehose := firehoseLog{
+		Timestamp: 1632865411915,
+		Records:   []record{{Data: base64.StdEncoding.EncodeToString([]byte(strings.Join(lines, "\n") + "\n"))}},
+	}
+	for name, test := range map[string]struct {
+		cfg    HandlerConfig
+		levels []string
+	}{
+		"disabled": {
+			cfg:    HandlerConfig{},
+			levels: []string{"", "", "", ""},
+		},
+		"default_patterns": {
+			cfg:    HandlerConfig{ExtractLogLevel: true},
+			levels: []string{"ERROR", "warn", "", ""},
+		},
+		"custom_patterns": {
+			cfg: HandlerConfig{
+				ExtractLogLevel:  true,
+				LogLevelPatterns: []*regexp.Regexp{regexp.MustCompile(`^\[(\w+)\]`)},
+			},
+			levels: []string{"", "", "debug", ""},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			batch, recordErrors := processFirehoseRecords(t, firehose, model.APMEvent{}, time.Now(), test.cfg)
+			require.Empty(t, recordErrors)
+			require.Len(t, batch, len(lines))
+			for i, event := range batch {
+				assert.Equal(t, lines[i], event.Message)
+				assert.Equal(t, test.levels[i], event.Log.Level, lines[i])
+			}
+		})
+	}
+}
+
+func TestProcessFirehoseGzipLog(t *testing.T) {
+	var batches []model.Batch
+	tc := testcaseFirehoseHandler{
+		path:              "gzip_log.json",
+		code:              http.StatusOK,
+		id:                request.IDResponseValidAccepted,
+		firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+		batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			batches = append(batches, *batch)
+			return nil
+		}),
+	}
+
+	tc.setup(t)
+	h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+	h(tc.c)
+	require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+
+	// The corrupt record is skipped, and the valid one decompressed.
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0], 1)
+	assert.Equal(t, expectedMessage, batches[0][0].Message)
+}
+
+func TestProcessFirehoseInvalidRecords(t *testing.T) {
+	var batches []model.Batch
+	tc := testcaseFirehoseHandler{
+		path:              "mixed_log.json",
+		code:              http.StatusOK,
+		id:                request.IDResponseValidAccepted,
+		firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+		batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			batches = append(batches, *batch)
+			return nil
+		}),
+	}
+
+	tc.setup(t)
+	h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+	h(tc.c)
+	require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+	assert.Equal(t, tc.code, tc.w.Code)
+
+	// The invalid record is skipped, and the valid one ingested.
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0], 1)
+	assert.Equal(t, expectedMessage, batches[0][0].Message)
+}
+
+func TestProcessFirehoseMonitoring(t *testing.T) {
+	for _, counter := range []*monitoring.Int{recordsCount, recordsError, eventsCount} {
+		counter.Set(0)
+	}
+	for _, path := range []string{"mixed_log.json", "invalid_log.json"} {
+		tc := testcaseFirehoseHandler{
+			path:              path,
+			firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+		}
+		tc.setup(t)
+		Handler(tc.batchProcessor, tc.authenticator, tc.cfg)(tc.c)
+	}
+	assert.Equal(t, int64(4), recordsCount.Get())
+	assert.Equal(t, int64(3), recordsError.Get())
+	assert.Equal(t, int64(1), eventsCount.Get())
+}
+
+func TestProcessFirehoseRequestMetrics(t *testing.T) {
+	for _, h := range []*histogram{requestBytes, requestDecodeDuration, requestProcessDuration} {
+		h.reset()
+	}
+	// The second record is gzip-compressed; its decompressed size is recorded.
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write([]byte("def\n"))
+	require.NoError(t, zw.Close())
+	body := `{"requestId":"abc","timestamp":1632865411915,"records":[` +
+		`{"data":"` + base64.StdEncoding.EncodeToString([]byte("abc\n")) + `"},` +
+		`{"data":"` + base64.StdEncoding.EncodeToString(compressed.Bytes()) + `"}]}`
+
+	for i := 0; i < 2; i++ {
+		tc := testcaseFirehoseHandler{
+			r: httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)),
+			batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+				time.Sleep(time.Millisecond)
+				return nil
+			}),
+		}
+		tc.setup(t)
+		Handler(tc.batchProcessor, tc.authenticator, tc.cfg)(tc.c)
+		require.Equal(t, http.StatusOK, tc.w.Code, tc.w.Body.String())
+	}
+
+	snapshot := monitoring.CollectFlatSnapshot(registry, monitoring.Full, false)
+	assert.Equal(t, int64(2), snapshot.Ints["request.bytes.count"])
+	assert.Equal(t, int64(16), snapshot.Ints["request.bytes.sum"])
+	assert.Equal(t, int64(8), snapshot.Ints["request.bytes.p50"])
+	assert.Equal(t, int64(8), snapshot.Ints["request.bytes.max"])
+	assert.Equal(t, int64(2), snapshot.Ints["request.decode.us.count"])
+	assert.Equal(t, int64(2), snapshot.Ints["request.process.us.count"])
+	assert.GreaterOrEqual(t, snapshot.Ints["request.process.us.p50"], int64(time.Millisecond/time.Microsecond))
+	assert.GreaterOrEqual(t, snapshot.Ints["request.process.us.sum"], int64(2*time.Millisecond/time.Microsecond))
+}
+
+func TestProcessFirehoseAllRecordsInvalid(t *testing.T) {
+	tc := testcaseFirehoseHandler{
+		path:              "invalid_log.json",
+		code:              http.StatusBadRequest,
+		id:                request.IDResponseErrorsDecode,
+		firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+		batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			t.Fatal("unexpected call to ProcessBatch")
+			return nil
+		}),
+	}
+
+	tc.setup(t)
+	h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+	h(tc.c)
+	require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+	assert.Equal(t, tc.code, tc.w.Code)
+	assert.Equal(t, "application/json", tc.w.Header().Get(headers.ContentType))
+
+	var decoded map[string]interface{}
+	err := json.Unmarshal(tc.w.Body.Bytes(), &decoded)
+	require.NoError(t, err)
+	assert.Equal(t, "request-id-abcd", decoded["requestId"])
+	assert.Equal(t, float64(1632865411915), decoded["timestamp"])
+	assert.Contains(t, decoded["errorMessage"], "failed to process all 2 records, first error: record 0: failed to decode record")
+}
+
+func TestProcessFirehoseEmptyRecords(t *testing.T) {
+	for name, test := range map[string]struct {
+		body     string
+		expected string
+	}{
+		"no_records": {
+			body:     `{"requestId":"request-id-abcd","timestamp":1632865411915,"records":[]}`,
+			expected: "request contains no records",
+		},
+		"missing_records": {
+			body:     `{"requestId":"request-id-abcd","timestamp":1632865411915}`,
+			expected: "request contains no records",
+		},
+		"empty_records": {
+			body:     `{"requestId":"request-id-abcd","timestamp":1632865411915,"records":[{"data":""},{"data":""}]}`,
+			expected: "all 2 records are empty",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(test.body))
+			r.Header.Add("Content-Type", "application/json")
+			r.Header.Add("X-Amz-Firehose-Source-Arn", testARN)
+			r.Header.Add("X-Amz-Firehose-Access-Key", "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==")
+			tc := testcaseFirehoseHandler{
+				r: r,
+				batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+					t.Fatal("unexpected call to ProcessBatch")
+					return nil
+				}),
+			}
+			tc.setup(t)
+			h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+			h(tc.c)
+			require.Equal(t, string(request.IDResponseErrorsValidate), string(tc.c.Result.ID))
+			assert.Equal(t, http.StatusBadRequest, tc.w.Code)
+
+			var decoded result
+			err := json.Unmarshal(tc.w.Body.Bytes(), &decoded)
+			require.NoError(t, err)
+			assert.Equal(t, result{
+				ErrorMessage: test.expected,
+				RequestID:    "request-id-abcd",
+				Timestamp:    1632865411915,
+			}, decoded)
+		})
+	}
+}
+
+func TestDecodeFirehoseLog(t *testing.T) {
+	for name, test := range map[string]struct {
+		body      string
+		expected  firehoseLog
+		records   []string
+		streamed  int
+		expectErr string
+	}{
+		"streamed": {
+			body:     `{"requestId":"abc","timestamp":123,"records":[{"data":"a"},{"data":"b"}]}`,
+			expected: firehoseLog{RequestID: "abc", Timestamp: 123},
+			records:  []string{"a", "b"},
+			streamed: 2,
+		},
+		"records_before_timestamp": {
+			body:     `{"records":[{"data":"a"},{"data":"b"}],"timestamp":123,"requestId":"abc"}`,
+			expected: firehoseLog{RequestID: "abc", Timestamp: 123},
+			records:  []string{"a", "b"},
+		},
+		"unknown_keys": {
+			body:     `{"RequestID":"abc","other":{"x":[1,2]},"timestamp":123,"records":null}`,
+			expected: firehoseLog{RequestID: "abc", Timestamp: 123},
+		},
+		"records_not_array": {
+			body:      `{"timestamp":123,"records":{}}`,
+			expectErr: "expected records array, got {",
+		},
+		"not_object": {
+			body:      `[]`,
+			expectErr: `expected '{', got [`,
+		},
+		"trailing_data": {
+			body:      `{"timestamp":123} {}`,
+			expectErr: "unexpected data after top-level value",
+		},
+		"truncated": {
+			body:      `{"timestamp":123,"records":[{"data":"a"}`,
+			expectErr: "unexpected end of JSON input",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var firehose firehoseLog
+			var records []string
+			var streamed int
+			err := decodeFirehoseLog(strings.NewReader(test.body), &firehose, func(record record) {
+				// Records held until decoding completes are
+				// processed while firehose.Records is still set.
+				records = append(records, record.Data)
+				if firehose.Records == nil {
+					streamed++
+				}
+			})
+			if test.expectErr != "" {
+				assert.EqualError(t, err, test.expectErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, firehose)
+			assert.Equal(t, test.records, records)
+			assert.Equal(t, test.streamed, streamed)
+		})
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	newRequest := func(method string, accessKey string) *http.Request {
+		data, err := ioutil.ReadFile(filepath.Join("../../../testdata/firehose", "vpc_log.json"))
+		require.NoError(t, err)
+		r := httptest.NewRequest(method, "/", bytes.NewBuffer(data))
+		r.Header.Add("Content-Type", "application/json")
+		r.Header.Add("X-Amz-Firehose-Source-Arn", testARN)
+		r.Header.Add("X-Amz-Firehose-Request-Id", "request-id-abcd")
+		if accessKey != "" {
+			r.Header.Add("X-Amz-Firehose-Access-Key", accessKey)
+		}
+		return r
+	}
+	accessKey := "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw=="
+
+	for name, test := range map[string]struct {
+		r              *http.Request
+		authenticator  Authenticator
+		batchProcessor model.BatchProcessor
+		code           int
+		id             request.ResultID
+
+		// expected holds the expected response body. If the
+		// timestamp is zero, it is expected to be set to the
+		// current time.
+		expected result
+	}{
+		"auth_failure": {
+			r:             newRequest(http.MethodPost, ""),
+			authenticator: newRequiredAuthenticator(t),
+			code:          http.StatusUnauthorized,
+			id:            request.IDResponseErrorsUnauthorized,
+			expected: result{
+				ErrorMessage: "Access key is required for using /firehose endpoint",
+				RequestID:    "request-id-abcd",
+			},
+		},
+		"method_not_allowed": {
+			r:    newRequest(http.MethodGet, accessKey),
+			code: http.StatusMethodNotAllowed,
+			id:   request.IDResponseErrorsMethodNotAllowed,
+			expected: result{
+				ErrorMessage: "only POST requests are supported",
+				RequestID:    "request-id-abcd",
+			},
+		},
+		"shutting_down": {
+			r: newRequest(http.MethodPost, accessKey),
+			batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+				return publish.ErrChannelClosed
+			}),
+			code: http.StatusServiceUnavailable,
+			id:   request.IDResponseErrorsShuttingDown,
+			expected: result{
+				ErrorMessage: "server is shutting down",
+				RequestID:    "request-id-abcd",
+				Timestamp:    1632865411915,
+			},
+		},
+		"indexer_closed": {
+			r:              newRequest(http.MethodPost, accessKey),
+			batchProcessor: newClosedIndexer(t),
+			code:           http.StatusServiceUnavailable,
+			id:             request.IDResponseErrorsShuttingDown,
+			expected: result{
+				ErrorMessage: "server is shutting down",
+				RequestID:    "request-id-abcd",
+				Timestamp:    1632865411915,
+			},
+		},
+		"indexer_full": {
+			r: newRequest(http.MethodPost, accessKey),
+			batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+				return modelindexer.ErrFull
+			}),
+			code: http.StatusServiceUnavailable,
+			id:   request.IDResponseErrorsFullQueue,
+			expected: result{
+				ErrorMessage: "model indexer full",
+				RequestID:    "request-id-abcd",
+				Timestamp:    1632865411915,
+			},
+		},
+		"invalid_json": {
+			r: func() *http.Request {
+				r := newRequest(http.MethodPost, accessKey)
+				r.Body = ioutil.NopCloser(strings.NewReader(`{"requestId":`))
+				return r
+			}(),
+			code: http.StatusBadRequest,
+			id:   request.IDResponseErrorsDecode,
+			expected: result{
+				ErrorMessage: "failed to decode request body: unexpected EOF",
+				RequestID:    "request-id-abcd",
+			},
+		},
+		"circuit_open": {
+			r: newRequest(http.MethodPost, accessKey),
+			batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+				return modelindexer.ErrCircuitOpen
+			}),
+			code: http.StatusServiceUnavailable,
+			id:   request.IDResponseErrorsServiceUnavailable,
+			expected: result{
+				ErrorMessage: "model indexer circuit breaker open",
+				RequestID:    "request-id-abcd",
+				Timestamp:    1632865411915,
+			},
+		},
+		"processing_failure": {
+			r: newRequest(http.MethodPost, accessKey),
+			batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+				return publish.ErrFull
+			}),
+			code: http.StatusServiceUnavailable,
+			id:   request.IDResponseErrorsFullQueue,
+			expected: result{
+				ErrorMessage: "queue is full",
+				RequestID:    "request-id-abcd",
+				Timestamp:    1632865411915,
+			},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tc := testcaseFirehoseHandler{
+				r:              test.r,
+				authenticator:  test.authenticator,
+				batchProcessor: test.batchProcessor,
+				code:           test.code,
+				id:             test.id,
+			}
+			tc.setup(t)
+			before := time.Now().UnixMilli()
+			h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+			h(tc.c)
+			require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+			assert.Equal(t, tc.code, tc.w.Code)
+			assert.Equal(t, "application/json", tc.w.Header().Get(headers.ContentType))
+
+			var decoded result
+			require.NoError(t, json.Unmarshal(tc.w.Body.Bytes(), &decoded))
+			if test.expected.Timestamp == 0 {
+				assert.GreaterOrEqual(t, decoded.Timestamp, before)
+				assert.LessOrEqual(t, decoded.Timestamp, time.Now().UnixMilli())
+				decoded.Timestamp = 0
+			}
+			assert.Equal(t, test.expected, decoded)
+		})
+	}
+}
+
+func TestResultIDStatusCodes(t *testing.T) {
+	// Firehose retries requests failing with a 5xx or 429 status code,
+	// and treats other 4xx status codes as permanent failures.
+	for id, code := range map[request.ResultID]int{
+		request.IDResponseValidAccepted:              http.StatusAccepted,
+		request.IDResponseErrorsUnauthorized:         http.StatusUnauthorized,
+		request.IDResponseErrorsForbidden:            http.StatusForbidden,
+		request.IDResponseErrorsMethodNotAllowed:     http.StatusMethodNotAllowed,
+		request.IDResponseErrorsUnsupportedMediaType: http.StatusUnsupportedMediaType,
+		request.IDResponseErrorsRequestTooLarge:      http.StatusRequestEntityTooLarge,
+		request.IDResponseErrorsDecode:               http.StatusBadRequest,
+		request.IDResponseErrorsValidate:             http.StatusBadRequest,
+		request.IDResponseErrorsRateLimit:            http.StatusTooManyRequests,
+		request.IDResponseErrorsShuttingDown:         http.StatusServiceUnavailable,
+		request.IDResponseErrorsFullQueue:            http.StatusServiceUnavailable,
+		request.IDResponseErrorsServiceUnavailable:   http.StatusServiceUnavailable,
+		request.IDResponseErrorsTimeout:              http.StatusServiceUnavailable,
+		request.IDResponseErrorsInternal:             http.StatusInternalServerError,
+	} {
+		assert.Equal(t, code, request.MapResultIDToStatus[id].Code, id)
+	}
+}
+
+func TestProcessTimeout(t *testing.T) {
+	var deadline time.Time
+	tc := testcaseFirehoseHandler{
+		path:              "vpc_log.json",
+		firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+		cfg:               HandlerConfig{ProcessTimeout: 10 * time.Millisecond},
+		batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			// Block as if waiting to enqueue events, until the deadline.
+			deadline, _ = ctx.Deadline()
+			<-ctx.Done()
+			return ctx.Err()
+		}),
+	}
+	tc.setup(t)
+	before := time.Now()
+	h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+	h(tc.c)
+	require.Equal(t, string(request.IDResponseErrorsTimeout), string(tc.c.Result.ID))
+	assert.Equal(t, http.StatusServiceUnavailable, tc.w.Code)
+	assert.False(t, deadline.Before(before.Add(tc.cfg.ProcessTimeout)))
+	assert.NoError(t, tc.r.Context().Err())
+
+	var decoded result
+	require.NoError(t, json.Unmarshal(tc.w.Body.Bytes(), &decoded))
+	assert.Equal(t, "timed out processing events after 10ms", decoded.ErrorMessage)
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	lines := []string{"a", "b", "c", "d", "e"}
+	body := `{"requestId":"abc","timestamp":1632865411915,"records":[{"data":"` +
+		base64.StdEncoding.EncodeToString([]byte(strings.Join(lines, "\n")+"\n")) + `"}]}`
+
+	test := func(t *testing.T, processor model.BatchProcessor) *testcaseFirehoseHandler {
+		tc := testcaseFirehoseHandler{
+			r:              httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)),
+			cfg:            HandlerConfig{MaxBatchSize: 2},
+			batchProcessor: processor,
+		}
+		tc.setup(t)
+		Handler(tc.batchProcessor, tc.authenticator, tc.cfg)(tc.c)
+		return &tc
+	}
+
+	t.Run("success", func(t *testing.T) {
+		var messages [][]string
+		tc := test(t, model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			var batchMessages []string
+			for _, event := range *batch {
+				batchMessages = append(batchMessages, event.Message)
+			}
+			messages = append(messages, batchMessages)
+			// Appending to a batch must not affect the following batches.
+			*batch = append(*batch, model.APMEvent{Message: "appended"})
+			return nil
+		}))
+		assert.Equal(t, http.StatusOK, tc.w.Code, tc.w.Body.String())
+		assert.Equal(t, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}, messages)
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		var batches int
+		tc := test(t, model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			if batches++; batches == 2 {
+				return modelindexer.ErrFull
+			}
+			return nil
+		}))
+		assert.Equal(t, 2, batches)
+		require.Equal(t, string(request.IDResponseErrorsFullQueue), string(tc.c.Result.ID))
+		assert.Equal(t, http.StatusServiceUnavailable, tc.w.Code)
+
+		var decoded result
+		require.NoError(t, json.Unmarshal(tc.w.Body.Bytes(), &decoded))
+		assert.Equal(t, "model indexer full (processed 2 of 5 events)", decoded.ErrorMessage)
+	})
+}
+
+func TestContentEncoding(t *testing.T) {
+	data, err := ioutil.ReadFile(filepath.Join("../../../testdata/firehose", "vpc_log.json"))
+	require.NoError(t, err)
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	_, err = zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	for name, test := range map[string]struct {
+		body     []byte
+		encoding string
+		code     int
+		id       request.ResultID
+		events   int
+	}{
+		"identity":     {body: data, encoding: "identity", code: http.StatusOK, id: request.IDResponseValidAccepted, events: 1},
+		"gzip":         {body: gzipped.Bytes(), encoding: "gzip", code: http.StatusOK, id: request.IDResponseValidAccepted, events: 1},
+		"invalid_gzip": {body: data, encoding: "gzip", code: http.StatusBadRequest, id: request.IDResponseErrorsDecode},
+		"unsupported":  {body: data, encoding: "br", code: http.StatusUnsupportedMediaType, id: request.IDResponseErrorsUnsupportedMediaType},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var batches []model.Batch
+			tc := testcaseFirehoseHandler{
+				code: test.code,
+				id:   test.id,
+				batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+					batches = append(batches, *batch)
+					return nil
+				}),
+			}
+			tc.r = httptest.NewRequest("POST", "/", bytes.NewReader(test.body))
+			tc.r.Header.Add("Content-Type", "application/json")
+			tc.r.Header.Add("Content-Encoding", test.encoding)
+			tc.r.Header.Add("X-Amz-Firehose-Source-Arn", testARN)
+			tc.r.Header.Add("X-Amz-Firehose-Access-Key", "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==")
+			tc.setup(t)
+			h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+			h(tc.c)
+			require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+			assert.Equal(t, tc.code, tc.w.Code)
+			if test.events > 0 {
+				require.Len(t, batches, 1)
+				assert.Len(t, batches[0], test.events)
+			} else {
+				assert.Empty(t, batches)
+			}
+		})
+	}
+}
+
+func TestGunzipPooled(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("hello"))
+	zw.Close()
+	for i := 0; i < 3; i++ {
+		out, err := gunzip(buf.Bytes(), 0)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(out))
+	}
+	_, err := gunzip([]byte("\x1f\x8bcorrupt"), 0)
+	assert.Error(t, err)
+}
+
+func TestGunzipLimit(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(bytes.Repeat([]byte("a"), 1024*1024))
+	zw.Close()
+
+	out, err := gunzip(buf.Bytes(), 1024*1024)
+	require.NoError(t, err)
+	assert.Len(t, out, 1024*1024)
+	_, err = gunzip(buf.Bytes(), 1024)
+	assert.EqualError(t, err, "decompressed record exceeds 1024 bytes")
+
+	// A record decompressing beyond MaxBodyBytes is skipped,
+	// while the request's other records are processed.
+	firehose := firehoseLog{
+		Timestamp: 1632865411915,
+		Records: []record{
+			{Data: base64.StdEncoding.EncodeToString(buf.Bytes())},
+			{Data: base64.StdEncoding.EncodeToString([]byte("line\n"))},
+		},
+	}
+	batch, recordErrors := processFirehoseRecords(t, firehose, model.APMEvent{}, time.Now(), HandlerConfig{
+		MaxBodyBytes: 64 * 1024,
+	})
+	require.Len(t, recordErrors, 1)
+	assert.EqualError(t, recordErrors[0], "record 0: failed to decompress record: decompressed record exceeds 65536 bytes")
+	require.Len(t, batch, 1)
+	assert.Equal(t, "line", batch[0].Message)
+}
+
+func TestFirehoseCommonAttributes(t *testing.T) {
+	var batches []model.Batch
+	tc := testcaseFirehoseHandler{
+		path:              "vpc_log.json",
+		code:              http.StatusOK,
+		id:                request.IDResponseValidAccepted,
+		firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+		batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			batches = append(batches, *batch)
+			return nil
+		}),
+	}
+	tc.setup(t)
+	tc.r.Header.Set("X-Amz-Firehose-Common-Attributes", `{
+		"commonAttributes": {
+			"environment": "production",
+			"team": "platform",
+			"deployment": {"region": "us-east-1", "version": 2, "canary": false},
+			"owners": ["alice", "bob"]
+		}
+	}`)
+
+	h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+	h(tc.c)
+	require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+
+	// Nested objects are flattened, joining keys with underscores.
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0], 1)
+	assert.Equal(t, common.MapStr{
+		"environment":        "production",
+		"team":               "platform",
+		"deployment_region":  "us-east-1",
+		"deployment_version": float64(2),
+		"deployment_canary":  false,
+		"owners":             `["alice","bob"]`,
+	}, batches[0][0].Labels)
+}
+
+func TestFirehoseCommonAttributesInvalid(t *testing.T) {
+	tc := testcaseFirehoseHandler{
+		path:              "vpc_log.json",
+		code:              http.StatusBadRequest,
+		id:                request.IDResponseErrorsValidate,
+		firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+	}
+	tc.setup(t)
+	tc.r.Header.Set("X-Amz-Firehose-Common-Attributes", `{"commonAttributes":`)
+
+	h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+	h(tc.c)
+	require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+	assert.Equal(t, tc.code, tc.w.Code)
+	assert.Contains(t, tc.c.Result.Err.Error(), "invalid X-Amz-Firehose-Common-Attributes header")
+}
+
 func TestAuth(t *testing.T) {
 	tc := testcaseFirehoseHandler{
 		path:              "vpc_log.json",
@@ -143,7 +1478,7 @@ func TestAuth(t *testing.T) {
 		return auth.Authorize(ctx, auth.ActionEventIngest, auth.Resource{})
 	})
 	tc.setup(t)
-	h := Handler(tc.batchProcessor, tc.authenticator)
+	h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
 	h(tc.c)
 
 	require.Equal(t, string(tc.id), string(tc.c.Result.ID))
@@ -151,6 +1486,239 @@ func TestAuth(t *testing.T) {
 	assert.True(t, authzCalled)
 }
 
+func TestAuthAccessKeys(t *testing.T) {
+	// Each delivery stream is configured with a different API Key,
+	// only one of which is permitted to ingest events.
+	authenticator := authenticatorFunc(func(ctx context.Context, kind, token string) (auth.AuthenticationDetails, auth.Authorizer, error) {
+		id := "id-" + token
+		var authz authorizerFunc = func(ctx context.Context, action auth.Action, resource auth.Resource) error {
+			if token != "allowed" {
+				return fmt.Errorf("%w: API Key %s not permitted", auth.ErrUnauthorized, id)
+			}
+			return nil
+		}
+		return auth.AuthenticationDetails{
+			Method: auth.MethodAPIKey,
+			APIKey: &auth.APIKeyAuthenticationDetails{ID: id},
+		}, authz, nil
+	})
+
+	for _, test := range []struct {
+		accessKey string
+		code      int
+		id        request.ResultID
+	}{
+		{accessKey: "allowed", code: http.StatusOK, id: request.IDResponseValidAccepted},
+		{accessKey: "denied", code: http.StatusForbidden, id: request.IDResponseErrorsForbidden},
+	} {
+		t.Run(test.accessKey, func(t *testing.T) {
+			var batches []model.Batch
+			tc := testcaseFirehoseHandler{
+				path:              "vpc_log.json",
+				code:              test.code,
+				id:                test.id,
+				firehoseAccessKey: test.accessKey,
+				authenticator:     authenticator,
+				batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+					if err := auth.Authorize(ctx, auth.ActionEventIngest, auth.Resource{}); err != nil {
+						return err
+					}
+					batches = append(batches, *batch)
+					return nil
+				}),
+			}
+			tc.setup(t)
+			h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+			h(tc.c)
+
+			require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+			assert.Equal(t, tc.code, tc.w.Code)
+			if tc.code != http.StatusOK {
+				assert.Empty(t, batches)
+				assert.Contains(t, tc.c.Result.Err.Error(), "API Key id-denied not permitted")
+				return
+			}
+			require.Len(t, batches, 1)
+			require.Len(t, batches[0], 1)
+			assert.Equal(t, common.MapStr{"firehose_access_key_id": "id-allowed"}, batches[0][0].Labels)
+		})
+	}
+}
+
+func TestAuthDataStream(t *testing.T) {
+	for _, test := range []struct {
+		path       string
+		classifier Classifier
+		dataStream string
+		code       int
+		id         request.ResultID
+	}{
+		{path: "vpc_log.json", dataStream: "logs-firehose-testing", code: http.StatusOK, id: request.IDResponseValidAccepted},
+		{path: "metric_stream.json", dataStream: "metrics-firehose-testing", code: http.StatusForbidden, id: request.IDResponseErrorsForbidden},
+		{
+			path: "vpc_log.json",
+			classifier: func(string) (string, string) {
+				return "aws.vpcflow", "network"
+			},
+			dataStream: "logs-aws.vpcflow-network",
+			code:       http.StatusForbidden,
+			id:         request.IDResponseErrorsForbidden,
+		},
+	} {
+		t.Run(test.dataStream, func(t *testing.T) {
+			var resources []auth.Resource
+			var processed bool
+			tc := testcaseFirehoseHandler{
+				path:              test.path,
+				code:              test.code,
+				id:                test.id,
+				firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+				cfg:               HandlerConfig{Namespace: "testing", Classifier: test.classifier},
+				batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+					processed = true
+					return nil
+				}),
+				authenticator: authenticatorFunc(func(ctx context.Context, kind, token string) (auth.AuthenticationDetails, auth.Authorizer, error) {
+					var authz authorizerFunc = func(ctx context.Context, action auth.Action, resource auth.Resource) error {
+						assert.Equal(t, auth.ActionEventIngest, action)
+						resources = append(resources, resource)
+						if resource.DataStream != "logs-firehose-testing" {
+							return fmt.Errorf("%w: data stream %q not permitted", auth.ErrUnauthorized, resource.DataStream)
+						}
+						return nil
+					}
+					return auth.AuthenticationDetails{Method: auth.MethodAPIKey}, authz, nil
+				}),
+			}
+			tc.setup(t)
+			h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+			h(tc.c)
+
+			require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+			assert.Equal(t, tc.code, tc.w.Code)
+			assert.Equal(t, tc.code == http.StatusOK, processed)
+			// Each data stream is authorized once per request.
+			assert.Equal(t, []auth.Resource{{DataStream: test.dataStream}}, resources)
+		})
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	for name, test := range map[string]struct {
+		maxBodyBytes int64
+		code         int
+		id           request.ResultID
+	}{
+		"unlimited": {maxBodyBytes: 0, code: http.StatusOK, id: request.IDResponseValidAccepted},
+		"within":    {maxBodyBytes: 1024 * 1024, code: http.StatusOK, id: request.IDResponseValidAccepted},
+		"exceeding": {maxBodyBytes: 10, code: http.StatusRequestEntityTooLarge, id: request.IDResponseErrorsRequestTooLarge},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tc := testcaseFirehoseHandler{
+				path:              "vpc_log.json",
+				code:              test.code,
+				id:                test.id,
+				firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+				cfg:               HandlerConfig{MaxBodyBytes: test.maxBodyBytes},
+			}
+			tc.setup(t)
+			h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+			h(tc.c)
+			require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+			assert.Equal(t, tc.code, tc.w.Code)
+		})
+	}
+}
+
+func TestRequestIDMismatch(t *testing.T) {
+	for name, test := range map[string]struct {
+		header string
+		code   int
+		id     request.ResultID
+	}{
+		"matching": {header: "request-id-abcd", code: http.StatusOK, id: request.IDResponseValidAccepted},
+		"mismatch": {header: "request-id-efgh", code: http.StatusBadRequest, id: request.IDResponseErrorsValidate},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tc := testcaseFirehoseHandler{
+				path:              "vpc_log.json",
+				code:              test.code,
+				id:                test.id,
+				firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+			}
+			tc.setup(t)
+			tc.r.Header.Set("X-Amz-Firehose-Request-Id", test.header)
+			h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+			h(tc.c)
+			require.Equal(t, string(tc.id), string(tc.c.Result.ID))
+			assert.Equal(t, tc.code, tc.w.Code)
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	authenticator := authenticatorFunc(func(ctx context.Context, kind, token string) (auth.AuthenticationDetails, auth.Authorizer, error) {
+		return auth.AuthenticationDetails{
+			Method: auth.MethodAPIKey,
+			APIKey: &auth.APIKeyAuthenticationDetails{ID: "id-" + token},
+		}, authorizerFunc(func(context.Context, auth.Action, auth.Resource) error { return nil }), nil
+	})
+	// Allow bursts of 10 requests, refilling a token every 100ms.
+	store, err := ratelimit.NewStore(10, 10, 1)
+	require.NoError(t, err)
+	h := Handler(modelprocessor.Nop{}, authenticator, HandlerConfig{RateLimitStore: store})
+
+	handle := func(accessKey string) testcaseFirehoseHandler {
+		tc := testcaseFirehoseHandler{path: "vpc_log.json", firehoseAccessKey: accessKey, authenticator: authenticator}
+		tc.setup(t)
+		h(tc.c)
+		return tc
+	}
+	for i := 0; i < 10; i++ {
+		tc := handle("a")
+		require.Equal(t, http.StatusOK, tc.w.Code)
+	}
+
+	// The bucket for access key "a" is empty.
+	before := time.Now().UnixMilli()
+	tc := handle("a")
+	require.Equal(t, string(request.IDResponseErrorsRateLimit), string(tc.c.Result.ID))
+	assert.Equal(t, http.StatusTooManyRequests, tc.w.Code)
+	assert.Equal(t, "application/json", tc.w.Header().Get(headers.ContentType))
+	var decoded result
+	require.NoError(t, json.Unmarshal(tc.w.Body.Bytes(), &decoded))
+	assert.GreaterOrEqual(t, decoded.Timestamp, before)
+	assert.LessOrEqual(t, decoded.Timestamp, time.Now().UnixMilli())
+	decoded.Timestamp = 0
+	assert.Equal(t, result{ErrorMessage: "rate limit exceeded"}, decoded)
+
+	// Other access keys have their own buckets.
+	tc = handle("b")
+	assert.Equal(t, http.StatusOK, tc.w.Code)
+
+	// The bucket is refilled over time.
+	time.Sleep(150 * time.Millisecond)
+	tc = handle("a")
+	assert.Equal(t, http.StatusOK, tc.w.Code)
+	tc = handle("a")
+	assert.Equal(t, http.StatusTooManyRequests, tc.w.Code)
+}
+
+func TestRateLimitKey(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	c := request.NewContext()
+	c.Reset(httptest.NewRecorder(), r)
+	c.ClientIP = net.ParseIP("192.0.2.1")
+	assert.Equal(t, "ip:192.0.2.1", rateLimitKey(c, ""))
+
+	r.Header.Set("X-Amz-Firehose-Source-Arn", testARN)
+	assert.Equal(t, "source_arn:"+testARN, rateLimitKey(c, ""))
+
+	c.Authentication.APIKey = &auth.APIKeyAuthenticationDetails{ID: "abc123"}
+	assert.Equal(t, "apikey:abc123", rateLimitKey(c, ""))
+	assert.Equal(t, "sigv4:AKIDEXAMPLE", rateLimitKey(c, "AKIDEXAMPLE"))
+}
+
 func TestAuthError(t *testing.T) {
 	tc := testcaseFirehoseHandler{
 		path:              "vpc_log.json",
@@ -162,7 +1730,7 @@ func TestAuthError(t *testing.T) {
 		return auth.AuthenticationDetails{}, nil, errors.New("authentication failed")
 	})
 	tc.setup(t)
-	h := Handler(tc.batchProcessor, tc.authenticator)
+	h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
 	h(tc.c)
 	require.Equal(t, string(tc.id), string(tc.c.Result.ID))
 	assert.Equal(t, tc.code, tc.w.Code)
@@ -174,6 +1742,7 @@ type testcaseFirehoseHandler struct {
 	r                 *http.Request
 	batchProcessor    model.BatchProcessor
 	authenticator     Authenticator
+	cfg               HandlerConfig
 	path              string
 	firehoseAccessKey string
 
@@ -181,6 +1750,17 @@ type testcaseFirehoseHandler struct {
 	id   request.ResultID
 }
 
+// processFirehoseRecords converts the records of firehose to events as
+// Handler does, by encoding firehose as a request body and decoding it.
+func processFirehoseRecords(t testing.TB, firehose firehoseLog, baseEvent model.APMEvent, received time.Time, cfg HandlerConfig) (model.Batch, []recordError) {
+	body, err := json.Marshal(firehose)
+	require.NoError(t, err)
+	var decoded firehoseLog
+	records, err := decodeFirehoseRequest(bytes.NewReader(body), &decoded, baseEvent, received, cfg)
+	require.NoError(t, err)
+	return records.batch, records.recordErrors
+}
+
 func (tc *testcaseFirehoseHandler) setup(t *testing.T) {
 	if tc.batchProcessor == nil {
 		tc.batchProcessor = modelprocessor.Nop{}
@@ -221,6 +1801,118 @@ func TestParseARN(t *testing.T) {
 	assert.Equal(t, expectedAccountID, arnParsed.AccountID)
 	assert.Equal(t, expectedRegion, arnParsed.Region)
 	assert.Equal(t, expectedResource, arnParsed.Resource)
+
+	for name, test := range map[string]struct {
+		arn      string
+		expected arn
+	}{
+		"delivery_stream": {
+			arn: testARN,
+			expected: arn{
+				Partition:    "aws",
+				Service:      "firehose",
+				Region:       "us-east-1",
+				AccountID:    "123456789",
+				Resource:     "deliverystream/vpc-flow-log-stream-http-endpoint",
+				ResourceType: "deliverystream",
+				ResourceID:   "vpc-flow-log-stream-http-endpoint",
+			},
+		},
+		"delivery_stream_colons": {
+			arn: "arn:aws-cn:firehose:cn-north-1:123456789:deliverystream/name:extra",
+			expected: arn{
+				Partition:    "aws-cn",
+				Service:      "firehose",
+				Region:       "cn-north-1",
+				AccountID:    "123456789",
+				Resource:     "deliverystream/name:extra",
+				ResourceType: "deliverystream",
+				ResourceID:   "name:extra",
+			},
+		},
+		"kinesis_stream": {
+			arn: "arn:aws:kinesis:us-east-1:123456789:stream/my-stream",
+			expected: arn{
+				Partition:    "aws",
+				Service:      "kinesis",
+				Region:       "us-east-1",
+				AccountID:    "123456789",
+				Resource:     "stream/my-stream",
+				ResourceType: "stream",
+				ResourceID:   "my-stream",
+			},
+		},
+		"resource_type_colon": {
+			arn: "arn:aws:logs:us-east-1:123456789:log-group:my-group",
+			expected: arn{
+				Partition:    "aws",
+				Service:      "logs",
+				Region:       "us-east-1",
+				AccountID:    "123456789",
+				Resource:     "log-group:my-group",
+				ResourceType: "log-group",
+				ResourceID:   "my-group",
+			},
+		},
+		"resource_without_type": {
+			arn: "arn:aws:sns:us-east-1:123456789:my-topic",
+			expected: arn{
+				Partition:  "aws",
+				Service:    "sns",
+				Region:     "us-east-1",
+				AccountID:  "123456789",
+				Resource:   "my-topic",
+				ResourceID: "my-topic",
+			},
+		},
+		"truncated": {
+			arn: "arn:aws:firehose:us-east-1",
+			expected: arn{
+				Partition: "aws",
+				Service:   "firehose",
+				Region:    "us-east-1",
+			},
+		},
+		"empty": {
+			arn:      "",
+			expected: arn{},
+		},
+		"not_arn": {
+			arn:      "deliverystream/vpc-flow-log-stream-http-endpoint",
+			expected: arn{},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expected, parseARN(test.arn))
+		})
+	}
+}
+
+// newClosedIndexer returns a closed modelindexer.Indexer, which rejects
+// all batches with modelindexer.ErrClosed.
+func newClosedIndexer(t testing.TB) *modelindexer.Indexer {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		fmt.Fprintln(w, `{"version":{"number":"1.2.3"}}`)
+	}))
+	t.Cleanup(srv.Close)
+
+	esConfig := elasticsearch.DefaultConfig()
+	esConfig.Hosts = elasticsearch.Hosts{srv.URL}
+	client, err := elasticsearch.NewClient(esConfig)
+	require.NoError(t, err)
+	indexer, err := modelindexer.New(client, modelindexer.Config{})
+	require.NoError(t, err)
+	require.NoError(t, indexer.Close(context.Background()))
+	return indexer
+}
+
+// newRequiredAuthenticator returns an Authenticator requiring
+// a secret token, and rejecting anonymous requests.
+func newRequiredAuthenticator(t testing.TB) Authenticator {
+	authenticator, err := auth.NewAuthenticator(config.AgentAuth{SecretToken: "abc123"})
+	require.NoError(t, err)
+	return authenticator
 }
 
 type authenticatorFunc func(ctx context.Context, kind, token string) (auth.AuthenticationDetails, auth.Authorizer, error)
@@ -234,3 +1926,71 @@ type authorizerFunc func(ctx context.Context, action auth.Action, resource auth.
 func (f authorizerFunc) Authorize(ctx context.Context, action auth.Action, resource auth.Resource) error {
 	return f(ctx, action, resource)
 }
+
+func BenchmarkHandler(b *testing.B) {
+	firehose := firehoseLog{RequestID: "request-id-abcd", Timestamp: 1632865411915}
+	for i := 0; i < 500; i++ {
+		firehose.Records = append(firehose.Records, record{
+			Data: base64.StdEncoding.EncodeToString([]byte(expectedMessage + "\n")),
+		})
+	}
+	body, err := json.Marshal(firehose)
+	require.NoError(b, err)
+
+	authenticator, err := auth.NewAuthenticator(config.AgentAuth{})
+	require.NoError(b, err)
+	h := Handler(modelprocessor.Nop{}, authenticator, HandlerConfig{})
+	c := request.NewContext()
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		r.Header.Add("Content-Type", "application/json")
+		r.Header.Add("X-Amz-Firehose-Source-Arn", testARN)
+		c.Reset(httptest.NewRecorder(), r)
+		h(c)
+	}
+}
+
+func BenchmarkHandlerLargeBody(b *testing.B) {
+	// Each record holds a single 64KiB line, for a body of ~22MB,
+	// so that memory use is dominated by the records rather than
+	// the events produced from them.
+	line := strings.Repeat("x", 64*1024) + "\n"
+	firehose := firehoseLog{RequestID: "request-id-abcd", Timestamp: 1632865411915}
+	for i := 0; i < 256; i++ {
+		firehose.Records = append(firehose.Records, record{
+			Data: base64.StdEncoding.EncodeToString([]byte(line)),
+		})
+	}
+	body, err := json.Marshal(firehose)
+	require.NoError(b, err)
+
+	// Measure the heap in use when the batch is processed, by which
+	// point all records have been read, excluding garbage.
+	var liveBytes uint64
+	processor := model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		liveBytes += stats.HeapAlloc
+		return nil
+	})
+
+	authenticator, err := auth.NewAuthenticator(config.AgentAuth{})
+	require.NoError(b, err)
+	h := Handler(processor, authenticator, HandlerConfig{})
+	c := request.NewContext()
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		r.Header.Add("Content-Type", "application/json")
+		r.Header.Add("X-Amz-Firehose-Source-Arn", testARN)
+		c.Reset(httptest.NewRecorder(), r)
+		h(c)
+	}
+	b.ReportMetric(float64(liveBytes)/float64(b.N), "live-B/op")
+}
@@ -0,0 +1,128 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package firehose
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/elastic/apm-server/model"
+)
+
+// parseJSONLine attempts to parse line as a structured JSON log, setting
+// well-known fields in event and recording the remaining fields as labels.
+// parseJSONLine reports whether line was parsed; if it returns false,
+// event is left unmodified.
+//
+// The well-known fields may be specified either with dotted keys (e.g.
+// "trace.id") or as nested objects (e.g. {"trace": {"id": ...}}):
+//
+//   - "@timestamp", an RFC 3339 timestamp, sets the event timestamp
+//   - "level" or "severity" sets the log level
+//   - "message" sets the log message
+//   - traceIDKey sets the trace ID
+//   - transactionIDKey, if non-empty, sets the transaction ID
+//   - "service.name" sets the service name
+func parseJSONLine(line, traceIDKey, transactionIDKey string, event *model.APMEvent) bool {
+	if !strings.HasPrefix(line, "{") {
+		return false
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return false
+	}
+	if v, ok := popJSONString(fields, "@timestamp"); ok {
+		if timestamp, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			event.Timestamp = timestamp
+		} else {
+			fields["@timestamp"] = v
+		}
+	}
+	if v, ok := popJSONString(fields, "level"); ok {
+		event.Log.Level = v
+	} else if v, ok := popJSONString(fields, "severity"); ok {
+		event.Log.Level = v
+	}
+	if v, ok := popJSONString(fields, "message"); ok {
+		event.Message = v
+	}
+	if v, ok := popJSONString(fields, traceIDKey); ok {
+		event.Trace.ID = v
+	}
+	if transactionIDKey != "" {
+		if v, ok := popJSONString(fields, transactionIDKey); ok {
+			event.Transaction = &model.Transaction{ID: v}
+		}
+	}
+	if v, ok := popJSONString(fields, "service.name"); ok {
+		event.Service.Name = v
+	}
+	event.Labels = copyLabels(event.Labels, len(fields))
+	flattenAttributes("", fields, event.Labels)
+	return true
+}
+
+// parseNDJSON parses each non-empty line of data as a structured JSON log,
+// appending an event for each line to batch, correlated and classified
+// according to cfg. If any line is not a JSON object, parseNDJSON returns
+// batch unmodified, and an error identifying the line.
+func parseNDJSON(data string, baseEvent model.APMEvent, batch model.Batch, cfg HandlerConfig) (model.Batch, error) {
+	n := len(batch)
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		event := baseEvent
+		event.Processor = model.LogProcessor
+		if !parseJSONLine(line, cfg.traceIDKey(), cfg.TransactionIDKey, &event) {
+			return batch[:n], fmt.Errorf("line %d is not a JSON object", i+1)
+		}
+		cfg.correlate(line, &event)
+		cfg.classify(line, &event)
+		batch = append(batch, event)
+	}
+	return batch, nil
+}
+
+// popJSONString removes and returns the string value at the given dotted
+// key path in fields, reporting whether it was found. The key is looked up
+// as-is, and then by descending into nested objects. Nested objects which
+// become empty are removed.
+func popJSONString(fields map[string]interface{}, key string) (string, bool) {
+	if v, ok := fields[key].(string); ok {
+		delete(fields, key)
+		return v, true
+	}
+	dot := strings.IndexRune(key, '.')
+	if dot < 0 {
+		return "", false
+	}
+	parent, child := key[:dot], key[dot+1:]
+	nested, ok := fields[parent].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	v, ok := popJSONString(nested, child)
+	if ok && len(nested) == 0 {
+		delete(fields, parent)
+	}
+	return v, ok
+}
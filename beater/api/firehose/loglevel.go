@@ -0,0 +1,40 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package firehose
+
+import "regexp"
+
+// defaultLogLevelPatterns holds the patterns used for extracting log levels
+// when none are configured: logfmt-style "level=" fields, and common upper
+// case level tokens.
+var defaultLogLevelPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`\blevel=(\w+)`),
+	regexp.MustCompile(`\b(FATAL|ERROR|WARN(?:ING)?|INFO|DEBUG|TRACE)\b`),
+}
+
+// extractLogLevel returns the log level in the plain-text log line,
+// using the first capture group of the first pattern matching line.
+// If no pattern matches, extractLogLevel returns an empty string.
+func extractLogLevel(line string, patterns []*regexp.Regexp) string {
+	for _, pattern := range patterns {
+		if match := pattern.FindStringSubmatch(line); len(match) > 1 && match[1] != "" {
+			return match[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,114 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package firehose
+
+import (
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/v7/libbeat/monitoring"
+	"github.com/elastic/go-hdrhistogram"
+)
+
+const (
+	// Bounds and precision of the request histograms. Values outside
+	// the bounds are clamped, so the maximum is only approximate for
+	// requests exceeding them.
+	minHistogramValue    = 1
+	maxHistogramBytes    = 1 << 30
+	maxHistogramDuration = time.Hour
+	histogramSigFigures  = 2
+)
+
+var (
+	// requestBytes records the total size of the records in each
+	// request, after base64 decoding and gzip decompression.
+	requestBytes = newHistogram(maxHistogramBytes)
+
+	// requestDecodeDuration records the time spent converting the
+	// records in each request to events, in microseconds, including
+	// base64 decoding, decompression, and line splitting, but
+	// excluding reading the request body.
+	requestDecodeDuration = newHistogram(maxHistogramDuration.Microseconds())
+
+	// requestProcessDuration records the time spent passing the events
+	// of each request to the batch processor, in microseconds.
+	requestProcessDuration = newHistogram(maxHistogramDuration.Microseconds())
+)
+
+func init() {
+	monitoring.NewFunc(registry, "request.bytes", requestBytes.collect, monitoring.Report)
+	monitoring.NewFunc(registry, "request.decode.us", requestDecodeDuration.collect, monitoring.Report)
+	monitoring.NewFunc(registry, "request.process.us", requestProcessDuration.collect, monitoring.Report)
+}
+
+// histogram records the distribution of a per-request measurement for
+// reporting as monitoring metrics. Values are recorded once per request,
+// so the lock is not contended on the per-record path.
+type histogram struct {
+	mu  sync.Mutex
+	h   *hdrhistogram.Histogram
+	sum int64
+}
+
+func newHistogram(max int64) *histogram {
+	return &histogram{h: hdrhistogram.New(minHistogramValue, max, histogramSigFigures)}
+}
+
+// record records v, clamped to the histogram's bounds.
+func (h *histogram) record(v int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sum += v
+	if min := h.h.LowestTrackableValue(); v < min {
+		v = min
+	} else if max := h.h.HighestTrackableValue(); v > max {
+		v = max
+	}
+	h.h.RecordValue(v)
+}
+
+// recordDuration records d in microseconds.
+func (h *histogram) recordDuration(d time.Duration) {
+	h.record(d.Microseconds())
+}
+
+// reset discards all recorded values.
+func (h *histogram) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sum = 0
+	h.h.Reset()
+}
+
+// collect reports the count and sum of recorded values, along with
+// percentiles and the maximum, since the server started. It is intended
+// to be used with libbeat/monitoring.NewFunc.
+func (h *histogram) collect(mode monitoring.Mode, V monitoring.Visitor) {
+	V.OnRegistryStart()
+	defer V.OnRegistryFinished()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	monitoring.ReportInt(V, "count", h.h.TotalCount())
+	monitoring.ReportInt(V, "sum", h.sum)
+	monitoring.ReportInt(V, "p50", h.h.ValueAtQuantile(50))
+	monitoring.ReportInt(V, "p95", h.h.ValueAtQuantile(95))
+	monitoring.ReportInt(V, "p99", h.h.ValueAtQuantile(99))
+	monitoring.ReportInt(V, "max", h.h.Max())
+}
@@ -0,0 +1,139 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package firehose
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/apm-server/datastreams"
+	"github.com/elastic/apm-server/model"
+)
+
+// metricStreamRecord holds a single metric from a CloudWatch Metric
+// Stream, in the JSON output format. Each firehose record holds one
+// or more newline-delimited metric stream records.
+//
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/CloudWatch-metric-streams-formats-json.html
+type metricStreamRecord struct {
+	MetricStreamName string            `json:"metric_stream_name"`
+	AccountID        string            `json:"account_id"`
+	Region           string            `json:"region"`
+	Namespace        string            `json:"namespace"`
+	MetricName       string            `json:"metric_name"`
+	Dimensions       map[string]string `json:"dimensions"`
+	Timestamp        int64             `json:"timestamp"`
+	Value            metricStreamValue `json:"value"`
+	Unit             string            `json:"unit"`
+}
+
+type metricStreamValue struct {
+	Max   float64 `json:"max"`
+	Min   float64 `json:"min"`
+	Sum   float64 `json:"sum"`
+	Count float64 `json:"count"`
+}
+
+// decodeMetricStream decodes the newline-delimited CloudWatch Metric Stream
+// records in data, reporting whether data holds metric stream records.
+//
+// Data is identified as holding metric stream records by the presence of
+// "metric_stream_name" in the first line. An error is returned if any
+// subsequent line is not a valid metric stream record.
+func decodeMetricStream(data []byte) ([]metricStreamRecord, bool, error) {
+	if trimmed := bytes.TrimLeft(data, " \t\r\n"); len(trimmed) == 0 || trimmed[0] != '{' {
+		// Avoid attempting to decode records which cannot be JSON.
+		return nil, false, nil
+	}
+	var records []metricStreamRecord
+	for len(data) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line, data = data[:i], data[i+1:]
+		} else {
+			line, data = data, nil
+		}
+		if len(line) == 0 {
+			continue
+		}
+		var record metricStreamRecord
+		err := json.Unmarshal(line, &record)
+		if records == nil && (err != nil || record.MetricStreamName == "") {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, true, errors.Wrap(err, "failed to decode metric stream record")
+		}
+		records = append(records, record)
+	}
+	return records, records != nil, nil
+}
+
+// processMetricStream appends a metricset event to batch for each of
+// the CloudWatch Metric Stream records. Each metricset holds the min,
+// max, sum, and count statistics for the metric, with the metric's
+// dimensions recorded as labels.
+func processMetricStream(records []metricStreamRecord, baseEvent model.APMEvent, batch model.Batch) model.Batch {
+	for _, record := range records {
+		event := baseEvent
+		if record.Timestamp != 0 {
+			event.Timestamp = time.UnixMilli(record.Timestamp)
+		}
+		event.Processor = model.MetricsetProcessor
+		event.DataStream.Type = datastreams.MetricsType
+		event.Cloud.Provider = "aws"
+		event.Cloud.AccountID = record.AccountID
+		event.Cloud.Region = record.Region
+		event.Labels = copyLabels(baseEvent.Labels, len(record.Dimensions))
+		for k, v := range record.Dimensions {
+			event.Labels[k] = v
+		}
+
+		unit := metricStreamUnit(record.Unit)
+		event.Metricset = &model.Metricset{
+			Name: record.Namespace,
+			Samples: map[string]model.MetricsetSample{
+				record.MetricName + ".max":   {Type: model.MetricTypeGauge, Unit: unit, Value: record.Value.Max},
+				record.MetricName + ".min":   {Type: model.MetricTypeGauge, Unit: unit, Value: record.Value.Min},
+				record.MetricName + ".sum":   {Type: model.MetricTypeGauge, Unit: unit, Value: record.Value.Sum},
+				record.MetricName + ".count": {Type: model.MetricTypeGauge, Value: record.Value.Count},
+			},
+		}
+		batch = append(batch, event)
+	}
+	return batch
+}
+
+// metricStreamUnit returns the metricset sample unit corresponding to
+// the CloudWatch unit, or an empty string if there is no equivalent.
+func metricStreamUnit(unit string) string {
+	switch unit {
+	case "Bytes":
+		return "byte"
+	case "Seconds":
+		return "s"
+	case "Milliseconds":
+		return "ms"
+	case "Microseconds":
+		return "micros"
+	}
+	return ""
+}
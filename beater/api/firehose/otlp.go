@@ -0,0 +1,104 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package firehose
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/collector/model/otlp"
+
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modelprocessor"
+	"github.com/elastic/apm-server/processor/otel"
+)
+
+var (
+	otlpTracesUnmarshaler  = otlp.NewProtobufTracesUnmarshaler()
+	otlpMetricsUnmarshaler = otlp.NewProtobufMetricsUnmarshaler()
+)
+
+// defaultRecordDecoders holds the built-in record decoders, keyed by
+// record format.
+var defaultRecordDecoders = map[string]RecordDecoder{
+	RecordFormatOTLPTraces:  decodeOTLPTraces,
+	RecordFormatOTLPMetrics: decodeOTLPMetrics,
+}
+
+// decodeOTLPTraces decodes data as a protobuf-encoded OTLP
+// ExportTraceServiceRequest, converting the spans to events
+// as they would be if received by the OTLP/gRPC endpoint.
+func decodeOTLPTraces(data []byte, baseEvent model.APMEvent, batch model.Batch) (model.Batch, error) {
+	traces, err := otlpTracesUnmarshaler.UnmarshalTraces(data)
+	if err != nil {
+		return batch, errors.Wrap(err, "failed to decode OTLP traces")
+	}
+	consumer := otel.Consumer{Processor: appendOTLPEvents(baseEvent, &batch)}
+	if err := consumer.ConsumeTraces(context.Background(), traces); err != nil {
+		return batch, err
+	}
+	return batch, nil
+}
+
+// decodeOTLPMetrics decodes data as a protobuf-encoded OTLP
+// ExportMetricsServiceRequest, converting the metrics to events
+// as they would be if received by the OTLP/gRPC endpoint.
+func decodeOTLPMetrics(data []byte, baseEvent model.APMEvent, batch model.Batch) (model.Batch, error) {
+	metrics, err := otlpMetricsUnmarshaler.UnmarshalMetrics(data)
+	if err != nil {
+		return batch, errors.Wrap(err, "failed to decode OTLP metrics")
+	}
+	consumer := otel.Consumer{Processor: appendOTLPEvents(baseEvent, &batch)}
+	if err := consumer.ConsumeMetrics(context.Background(), metrics); err != nil {
+		return batch, err
+	}
+	return batch, nil
+}
+
+// appendOTLPEvents returns a model.BatchProcessor which appends the events
+// converted from OTLP data to out.
+//
+// The events are written to the data streams they would be written to if
+// received by the OTLP/gRPC endpoint, rather than to the firehose data
+// stream, and describe the instrumented services, so only the delivery
+// stream origin and labels of baseEvent are recorded in them.
+func appendOTLPEvents(baseEvent model.APMEvent, out *model.Batch) model.BatchProcessor {
+	return model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		var setDataStream modelprocessor.SetDataStream
+		if err := setDataStream.ProcessBatch(ctx, batch); err != nil {
+			return err
+		}
+		for _, event := range *batch {
+			if event.Cloud.Origin == nil {
+				event.Cloud.Origin = baseEvent.Cloud.Origin
+			}
+			if event.Service.Origin == nil {
+				event.Service.Origin = baseEvent.Service.Origin
+			}
+			if len(baseEvent.Labels) > 0 {
+				labels := copyLabels(baseEvent.Labels, len(event.Labels))
+				for k, v := range event.Labels {
+					labels[k] = v
+				}
+				event.Labels = labels
+			}
+			*out = append(*out, event)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,170 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package firehose
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/model/otlp"
+	"go.opentelemetry.io/collector/model/pdata"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+
+	"github.com/elastic/apm-server/beater/auth"
+	"github.com/elastic/apm-server/model"
+)
+
+func TestProcessFirehoseOTLPTraces(t *testing.T) {
+	baseEvent := model.APMEvent{
+		Cloud:      model.Cloud{Origin: &model.CloudOrigin{AccountID: "123456789"}},
+		Service:    model.Service{Origin: &model.ServiceOrigin{ID: testARN}},
+		Labels:     common.MapStr{"deployment": "prod"},
+		DataStream: model.DataStream{Type: "logs", Dataset: "firehose"},
+	}
+	batch, recordErrors := processFirehoseRecords(t, firehoseLog{
+		Records: []record{
+			{Data: base64.StdEncoding.EncodeToString(newOTLPTraces(t))},
+			{Data: base64.StdEncoding.EncodeToString([]byte("not protobuf"))},
+		},
+	}, baseEvent, time.Now(), HandlerConfig{RecordFormat: RecordFormatOTLPTraces})
+	require.Len(t, recordErrors, 1)
+	assert.Contains(t, recordErrors[0].Error(), "record 1: failed to decode OTLP traces")
+
+	require.Len(t, batch, 1)
+	event := batch[0]
+	assert.Equal(t, model.TransactionProcessor, event.Processor)
+	require.NotNil(t, event.Transaction)
+	assert.Equal(t, "GET /", event.Transaction.Name)
+	assert.Equal(t, "0102030405060708090a0b0c0d0e0f10", event.Trace.ID)
+	assert.Equal(t, "otlp-service", event.Service.Name)
+	assert.Equal(t, model.DataStream{Type: "traces", Dataset: "apm"}, event.DataStream)
+	assert.Equal(t, baseEvent.Cloud.Origin, event.Cloud.Origin)
+	assert.Equal(t, baseEvent.Service.Origin, event.Service.Origin)
+	assert.Equal(t, "prod", event.Labels["deployment"])
+}
+
+func TestProcessFirehoseOTLPMetrics(t *testing.T) {
+	metrics := pdata.NewMetrics()
+	resourceMetrics := metrics.ResourceMetrics().AppendEmpty()
+	resourceMetrics.Resource().Attributes().InsertString("service.name", "otlp-service")
+	metric := resourceMetrics.InstrumentationLibraryMetrics().AppendEmpty().Metrics().AppendEmpty()
+	metric.SetName("queue_depth")
+	metric.SetDataType(pdata.MetricDataTypeGauge)
+	dp := metric.Gauge().DataPoints().AppendEmpty()
+	dp.SetTimestamp(pdata.NewTimestampFromTime(time.Unix(1632865411, 0)))
+	dp.SetDoubleVal(42)
+	data, err := otlp.NewProtobufMetricsMarshaler().MarshalMetrics(metrics)
+	require.NoError(t, err)
+
+	batch, recordErrors := processFirehoseRecords(t, firehoseLog{
+		Records: []record{{Data: base64.StdEncoding.EncodeToString(data)}},
+	}, model.APMEvent{}, time.Now(), HandlerConfig{RecordFormat: RecordFormatOTLPMetrics})
+	require.Empty(t, recordErrors)
+	require.Len(t, batch, 1)
+	event := batch[0]
+	assert.Equal(t, model.MetricsetProcessor, event.Processor)
+	require.NotNil(t, event.Metricset)
+	assert.Equal(t, 42.0, event.Metricset.Samples["queue_depth"].Value)
+	assert.Equal(t, model.DataStream{Type: "metrics", Dataset: "apm.app.otlp_service"}, event.DataStream)
+}
+
+func TestProcessFirehoseRecordDecoders(t *testing.T) {
+	decode := func(data []byte, baseEvent model.APMEvent, batch model.Batch) (model.Batch, error) {
+		event := baseEvent
+		event.Processor = model.LogProcessor
+		event.Message = "custom: " + string(data)
+		return append(batch, event), nil
+	}
+	for _, format := range []string{"custom", RecordFormatText, RecordFormatOTLPTraces} {
+		// Registered decoders take precedence over the built-in formats.
+		batch, recordErrors := processFirehoseRecords(t, firehoseLog{
+			Records: []record{{Data: base64.StdEncoding.EncodeToString([]byte("abc"))}},
+		}, model.APMEvent{}, time.Now(), HandlerConfig{
+			RecordFormat:   format,
+			RecordDecoders: map[string]RecordDecoder{format: decode},
+		})
+		require.Empty(t, recordErrors, format)
+		require.Len(t, batch, 1, format)
+		assert.Equal(t, "custom: abc", batch[0].Message, format)
+	}
+}
+
+func TestOTLPAuthDataStream(t *testing.T) {
+	body, err := json.Marshal(firehoseLog{
+		RequestID: "request-id",
+		Timestamp: time.Now().UnixMilli(),
+		Records:   []record{{Data: base64.StdEncoding.EncodeToString(newOTLPTraces(t))}},
+	})
+	require.NoError(t, err)
+
+	var resources []auth.Resource
+	var processed int
+	tc := testcaseFirehoseHandler{
+		r:                 httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)),
+		firehoseAccessKey: "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==",
+		cfg:               HandlerConfig{RecordFormat: RecordFormatOTLPTraces, Namespace: "testing"},
+		batchProcessor: model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+			processed += len(*batch)
+			return nil
+		}),
+		authenticator: authenticatorFunc(func(ctx context.Context, kind, token string) (auth.AuthenticationDetails, auth.Authorizer, error) {
+			var authz authorizerFunc = func(ctx context.Context, action auth.Action, resource auth.Resource) error {
+				resources = append(resources, resource)
+				return nil
+			}
+			return auth.AuthenticationDetails{Method: auth.MethodAPIKey}, authz, nil
+		}),
+	}
+	tc.setup(t)
+	tc.r.Header.Set("X-Amz-Firehose-Access-Key", tc.firehoseAccessKey)
+	h := Handler(tc.batchProcessor, tc.authenticator, tc.cfg)
+	h(tc.c)
+
+	assert.Equal(t, http.StatusOK, tc.w.Code, tc.w.Body.String())
+	assert.Equal(t, 1, processed)
+	// OTLP events are written to the APM data streams, not the firehose one.
+	assert.Equal(t, []auth.Resource{{DataStream: "traces-apm-testing"}}, resources)
+}
+
+// newOTLPTraces returns a protobuf-encoded OTLP ExportTraceServiceRequest
+// holding a single server span.
+func newOTLPTraces(t testing.TB) []byte {
+	traces := pdata.NewTraces()
+	resourceSpans := traces.ResourceSpans().AppendEmpty()
+	resourceSpans.Resource().Attributes().InsertString("service.name", "otlp-service")
+	span := resourceSpans.InstrumentationLibrarySpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetTraceID(pdata.NewTraceID([16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}))
+	span.SetSpanID(pdata.NewSpanID([8]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+	span.SetName("GET /")
+	span.SetKind(pdata.SpanKindServer)
+	start := time.Unix(1632865411, 0)
+	span.SetStartTimestamp(pdata.NewTimestampFromTime(start))
+	span.SetEndTimestamp(pdata.NewTimestampFromTime(start.Add(time.Second)))
+	data, err := otlp.NewProtobufTracesMarshaler().MarshalTraces(traces)
+	require.NoError(t, err)
+	return data
+}
@@ -0,0 +1,322 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package firehose
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/elastic/apm-server/beater/auth"
+	"github.com/elastic/apm-server/beater/request"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4DateFormat = "20060102T150405Z"
+
+	// sigV4AccessKeyIDLabel holds the label used for recording the
+	// AWS access key ID of SigV4 signed requests.
+	sigV4AccessKeyIDLabel = "firehose_aws_access_key_id"
+
+	// defaultSigV4MaxSkew holds the default maximum difference between
+	// the signing time of a request and the time it is received, matching
+	// the window allowed by AWS services.
+	defaultSigV4MaxSkew = 15 * time.Minute
+)
+
+// SigV4Verifier verifies requests signed with AWS Signature Version 4,
+// for deployments which front the firehose endpoint with IAM rather than
+// configuring an access key for the delivery stream.
+//
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+type SigV4Verifier struct {
+	// Credentials maps AWS access key IDs to their secret access keys.
+	// Requests signed with other access keys are rejected.
+	Credentials map[string]string
+
+	// Region and Service hold the region and service name for which
+	// requests must be signed. If either is empty, requests signed for
+	// any region or service, respectively, are accepted.
+	Region  string
+	Service string
+
+	// MaxSkew holds the maximum difference between the time a request
+	// was signed and the time it is received. If MaxSkew is zero, 15
+	// minutes is used.
+	MaxSkew time.Duration
+}
+
+// sigV4Authorization holds the parsed Authorization header of a SigV4
+// signed request.
+type sigV4Authorization struct {
+	accessKeyID   string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+}
+
+// authenticateSigV4 verifies the SigV4 signature of the request, returning
+// the access key ID with which it was signed. The payload hash is covered
+// by the signature, so the request body is read in full, and replaced with
+// a buffered copy for decoding.
+func authenticateSigV4(c *request.Context, verifier *SigV4Verifier, maxBodyBytes int64, received time.Time) (string, error) {
+	if c.Request.Header.Get("Authorization") == "" {
+		return "", requestError{
+			id:  request.IDResponseErrorsUnauthorized,
+			err: errors.New("SigV4 signature is required for using /firehose endpoint"),
+		}
+	}
+	body := c.Request.Body
+	if maxBodyBytes > 0 {
+		body = http.MaxBytesReader(nil, body, maxBodyBytes)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return "", requestError{
+				id:  request.IDResponseErrorsRequestTooLarge,
+				err: fmt.Errorf("request body exceeds %d bytes", maxBodyBytes),
+			}
+		}
+		return "", requestError{
+			id:  request.IDResponseErrorsDecode,
+			err: errors.Wrap(err, "failed to read request body"),
+		}
+	}
+	c.Request.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	payloadHash := sha256.Sum256(data)
+	accessKeyID, err := verifier.verify(c.Request, hex.EncodeToString(payloadHash[:]), received)
+	if err != nil {
+		return "", requestError{
+			id:  request.IDResponseErrorsUnauthorized,
+			err: errors.Wrap(err, "SigV4 authentication failed"),
+		}
+	}
+	return accessKeyID, nil
+}
+
+// verify verifies the SigV4 signature of r, whose body has the given
+// hex-encoded SHA-256 hash, returning the access key ID with which it
+// was signed.
+func (v *SigV4Verifier) verify(r *http.Request, payloadHash string, now time.Time) (string, error) {
+	authz, err := parseSigV4Authorization(r.Header.Get("Authorization"))
+	if err != nil {
+		return "", err
+	}
+	secretAccessKey, ok := v.Credentials[authz.accessKeyID]
+	if !ok {
+		return "", fmt.Errorf("unknown access key ID %q", authz.accessKeyID)
+	}
+	if v.Region != "" && authz.region != v.Region {
+		return "", fmt.Errorf("request signed for region %q, expected %q", authz.region, v.Region)
+	}
+	if v.Service != "" && authz.service != v.Service {
+		return "", fmt.Errorf("request signed for service %q, expected %q", authz.service, v.Service)
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	signed, err := time.Parse(sigV4DateFormat, amzDate)
+	if err != nil {
+		return "", fmt.Errorf("invalid X-Amz-Date header %q", amzDate)
+	}
+	if !strings.HasPrefix(amzDate, authz.date) {
+		return "", fmt.Errorf("X-Amz-Date header %q does not match credential scope date %q", amzDate, authz.date)
+	}
+	maxSkew := v.MaxSkew
+	if maxSkew == 0 {
+		maxSkew = defaultSigV4MaxSkew
+	}
+	if skew := now.Sub(signed); skew > maxSkew || skew < -maxSkew {
+		return "", fmt.Errorf("request signed at %s, outside the allowed skew of %s", signed.Format(time.RFC3339), maxSkew)
+	}
+	if hash := r.Header.Get("X-Amz-Content-Sha256"); hash != "" && hash != payloadHash {
+		return "", errors.New("X-Amz-Content-Sha256 header does not match request body")
+	}
+	var signedHost, signedDate bool
+	for _, name := range authz.signedHeaders {
+		switch name {
+		case "host":
+			signedHost = true
+		case "x-amz-date":
+			signedDate = true
+		}
+	}
+	if !signedHost || !signedDate {
+		return "", errors.New("SignedHeaders must include host and x-amz-date")
+	}
+
+	scope := strings.Join([]string{authz.date, authz.region, authz.service, "aws4_request"}, "/")
+	canonicalRequest := sigV4CanonicalRequest(r, authz.signedHeaders, payloadHash)
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm, amzDate, scope, hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+	key := sigV4SigningKey(secretAccessKey, authz.date, authz.region, authz.service)
+	signature := hex.EncodeToString(hmacSHA256(key, []byte(stringToSign)))
+	if !hmac.Equal([]byte(signature), []byte(authz.signature)) {
+		return "", errors.New("signature does not match")
+	}
+	return authz.accessKeyID, nil
+}
+
+// parseSigV4Authorization parses the Authorization header of a SigV4
+// signed request, of the form:
+//
+//	AWS4-HMAC-SHA256 Credential=<access key ID>/<date>/<region>/<service>/aws4_request,
+//	    SignedHeaders=<header>;<header>, Signature=<signature>
+func parseSigV4Authorization(header string) (sigV4Authorization, error) {
+	var authz sigV4Authorization
+	fields := strings.Fields(header)
+	if len(fields) == 0 || fields[0] != sigV4Algorithm {
+		return authz, fmt.Errorf("Authorization header must use the %s algorithm", sigV4Algorithm)
+	}
+	for _, param := range strings.Split(strings.Join(fields[1:], ""), ",") {
+		i := strings.IndexRune(param, '=')
+		if i < 0 {
+			return authz, fmt.Errorf("invalid Authorization header parameter %q", param)
+		}
+		switch key, value := param[:i], param[i+1:]; key {
+		case "Credential":
+			parts := strings.Split(value, "/")
+			if len(parts) != 5 || parts[4] != "aws4_request" {
+				return authz, fmt.Errorf("invalid Authorization header credential %q", value)
+			}
+			authz.accessKeyID = parts[0]
+			authz.date = parts[1]
+			authz.region = parts[2]
+			authz.service = parts[3]
+		case "SignedHeaders":
+			authz.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			authz.signature = value
+		}
+	}
+	if authz.accessKeyID == "" || len(authz.signedHeaders) == 0 || authz.signature == "" {
+		return authz, errors.New("Authorization header must include Credential, SignedHeaders, and Signature")
+	}
+	return authz, nil
+}
+
+// sigV4CanonicalRequest returns the canonical form of r for signing,
+// including the named headers.
+func sigV4CanonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+	var buf strings.Builder
+	buf.WriteString(r.Method)
+	buf.WriteByte('\n')
+	path := r.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	buf.WriteString(path)
+	buf.WriteByte('\n')
+	buf.WriteString(sigV4CanonicalQuery(r.URL.Query()))
+	buf.WriteByte('\n')
+	for _, name := range signedHeaders {
+		buf.WriteString(name)
+		buf.WriteByte(':')
+		buf.WriteString(sigV4HeaderValue(r, name))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	buf.WriteString(strings.Join(signedHeaders, ";"))
+	buf.WriteByte('\n')
+	buf.WriteString(payloadHash)
+	return buf.String()
+}
+
+// sigV4CanonicalQuery returns the canonical form of the query parameters,
+// sorted by name and then value, and URI-encoded.
+func sigV4CanonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, sigV4Escape(name)+"="+sigV4Escape(value))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// sigV4Escape URI-encodes s, escaping all characters other than the
+// unreserved characters of RFC 3986.
+func sigV4Escape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// sigV4HeaderValue returns the canonical value of the named header of r:
+// multiple values are joined with commas, and whitespace is trimmed and
+// collapsed.
+func sigV4HeaderValue(r *http.Request, name string) string {
+	var values []string
+	switch name {
+	case "host":
+		// The Host header is removed from r.Header.
+		values = []string{r.Host}
+	default:
+		values = r.Header.Values(name)
+		if len(values) == 0 && name == "content-length" && r.ContentLength >= 0 {
+			values = []string{strconv.FormatInt(r.ContentLength, 10)}
+		}
+	}
+	canonical := make([]string, len(values))
+	for i, value := range values {
+		canonical[i] = strings.Join(strings.Fields(value), " ")
+	}
+	return strings.Join(canonical, ",")
+}
+
+// sigV4SigningKey returns the key for signing requests with the given
+// secret access key and credential scope.
+func sigV4SigningKey(secretAccessKey, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), []byte(date))
+	key = hmacSHA256(key, []byte(region))
+	key = hmacSHA256(key, []byte(service))
+	return hmacSHA256(key, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// sigV4Authorizer authorizes all actions of requests whose SigV4
+// signature has been verified, as the signing credentials are
+// configured explicitly for the firehose endpoint.
+type sigV4Authorizer struct{}
+
+func (sigV4Authorizer) Authorize(context.Context, auth.Action, auth.Resource) error {
+	return nil
+}
@@ -0,0 +1,273 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package firehose
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/beater/auth"
+	"github.com/elastic/apm-server/model"
+)
+
+// The SigV4 fixtures are taken from the AWS Signature Version 4 test suite.
+const (
+	testSigV4AccessKeyID     = "AKIDEXAMPLE"
+	testSigV4SecretAccessKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testSigV4Date            = "20150830T123600Z"
+)
+
+var testSigV4Time = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+func newTestSigV4Verifier() *SigV4Verifier {
+	return &SigV4Verifier{
+		Credentials: map[string]string{testSigV4AccessKeyID: testSigV4SecretAccessKey},
+		Region:      "us-east-1",
+		Service:     "service",
+	}
+}
+
+func TestSigV4VerifierTestSuite(t *testing.T) {
+	for name, test := range map[string]struct {
+		method    string
+		target    string
+		signature string
+	}{
+		"get-vanilla": {
+			method:    http.MethodGet,
+			target:    "/",
+			signature: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		"post-vanilla": {
+			method:    http.MethodPost,
+			target:    "/",
+			signature: "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		},
+		"get-vanilla-query-order-key-case": {
+			method:    http.MethodGet,
+			target:    "/?Param2=value2&Param1=value1",
+			signature: "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(test.method, "http://example.amazonaws.com"+test.target, nil)
+			r.Header.Set("X-Amz-Date", testSigV4Date)
+			r.Header.Set("Authorization", fmt.Sprintf(
+				"%s Credential=%s/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=%s",
+				sigV4Algorithm, testSigV4AccessKeyID, test.signature,
+			))
+			accessKeyID, err := newTestSigV4Verifier().verify(r, emptyPayloadHash, testSigV4Time)
+			require.NoError(t, err)
+			assert.Equal(t, testSigV4AccessKeyID, accessKeyID)
+		})
+	}
+}
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+func TestSigV4VerifierErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		modify   func(r *http.Request, v *SigV4Verifier)
+		now      time.Time
+		expected string
+	}{
+		"unknown_access_key": {
+			modify: func(r *http.Request, v *SigV4Verifier) {
+				delete(v.Credentials, testSigV4AccessKeyID)
+			},
+			expected: `unknown access key ID "AKIDEXAMPLE"`,
+		},
+		"wrong_secret": {
+			modify: func(r *http.Request, v *SigV4Verifier) {
+				v.Credentials[testSigV4AccessKeyID] = "wrong"
+			},
+			expected: "signature does not match",
+		},
+		"wrong_region": {
+			modify: func(r *http.Request, v *SigV4Verifier) {
+				v.Region = "eu-west-1"
+			},
+			expected: `request signed for region "us-east-1", expected "eu-west-1"`,
+		},
+		"wrong_service": {
+			modify: func(r *http.Request, v *SigV4Verifier) {
+				v.Service = "firehose"
+			},
+			expected: `request signed for service "service", expected "firehose"`,
+		},
+		"modified_request": {
+			modify: func(r *http.Request, v *SigV4Verifier) {
+				r.URL.Path = "/other"
+			},
+			expected: "signature does not match",
+		},
+		"content_hash_mismatch": {
+			modify: func(r *http.Request, v *SigV4Verifier) {
+				r.Header.Set("X-Amz-Content-Sha256", strings.Repeat("0", 64))
+			},
+			expected: "X-Amz-Content-Sha256 header does not match request body",
+		},
+		"expired": {
+			now:      testSigV4Time.Add(16 * time.Minute),
+			expected: "request signed at 2015-08-30T12:36:00Z, outside the allowed skew of 15m0s",
+		},
+		"missing_date": {
+			modify: func(r *http.Request, v *SigV4Verifier) {
+				r.Header.Del("X-Amz-Date")
+			},
+			expected: `invalid X-Amz-Date header ""`,
+		},
+		"other_algorithm": {
+			modify: func(r *http.Request, v *SigV4Verifier) {
+				r.Header.Set("Authorization", "ApiKey abc123")
+			},
+			expected: "Authorization header must use the AWS4-HMAC-SHA256 algorithm",
+		},
+		"missing_signature": {
+			modify: func(r *http.Request, v *SigV4Verifier) {
+				r.Header.Set("Authorization", sigV4Algorithm+
+					" Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date",
+				)
+			},
+			expected: "Authorization header must include Credential, SignedHeaders, and Signature",
+		},
+		"unsigned_date": {
+			modify: func(r *http.Request, v *SigV4Verifier) {
+				r.Header.Set("Authorization", strings.Replace(
+					r.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date", "SignedHeaders=host", 1,
+				))
+			},
+			expected: "SignedHeaders must include host and x-amz-date",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// post-vanilla from the AWS Signature Version 4 test suite.
+			r := httptest.NewRequest(http.MethodPost, "http://example.amazonaws.com/", nil)
+			r.Header.Set("X-Amz-Date", testSigV4Date)
+			r.Header.Set("Authorization", sigV4Algorithm+
+				" Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request,"+
+				" SignedHeaders=host;x-amz-date,"+
+				" Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+			)
+			v := newTestSigV4Verifier()
+			if test.modify != nil {
+				test.modify(r, v)
+			}
+			now := test.now
+			if now.IsZero() {
+				now = testSigV4Time
+			}
+			_, err := v.verify(r, emptyPayloadHash, now)
+			assert.EqualError(t, err, test.expected)
+		})
+	}
+}
+
+func TestAuthSigV4(t *testing.T) {
+	var events []model.APMEvent
+	processor := model.ProcessBatchFunc(func(ctx context.Context, batch *model.Batch) error {
+		if err := auth.Authorize(ctx, auth.ActionEventIngest, auth.Resource{}); err != nil {
+			return err
+		}
+		events = append(events, (*batch)...)
+		return nil
+	})
+	authenticator := newRequiredAuthenticator(t)
+	verifier := newTestSigV4Verifier()
+	verifier.Service = "firehose"
+
+	var maxBodyBytes int64
+	handle := func(sign func(r *http.Request, body []byte)) testcaseFirehoseHandler {
+		tc := testcaseFirehoseHandler{path: "cloudwatch_log.json"}
+		tc.setup(t)
+		body, err := ioutil.ReadAll(tc.r.Body)
+		require.NoError(t, err)
+		tc.r.Body = ioutil.NopCloser(strings.NewReader(string(body)))
+		sign(tc.r, body)
+		h := Handler(processor, authenticator, HandlerConfig{
+			SigV4Verifier: verifier,
+			MaxBodyBytes:  maxBodyBytes,
+		})
+		h(tc.c)
+		return tc
+	}
+
+	tc := handle(func(r *http.Request, body []byte) {
+		signSigV4(r, body, time.Now())
+	})
+	assert.Equal(t, http.StatusOK, tc.w.Code, tc.w.Body.String())
+	require.NotEmpty(t, events)
+	for _, event := range events {
+		assert.Equal(t, testSigV4AccessKeyID, event.Labels[sigV4AccessKeyIDLabel])
+	}
+
+	// The access key header is ignored in SigV4 mode.
+	tc = handle(func(r *http.Request, body []byte) {
+		r.Header.Set("X-Amz-Firehose-Access-Key", "U25jcABcd0JzTjQzUjNDemdGTHk6Ri0xMTNCdVVRdXFSR0lGYzF0Wk5Vdw==")
+	})
+	assert.Equal(t, http.StatusUnauthorized, tc.w.Code)
+	assert.Contains(t, tc.w.Body.String(), "SigV4 signature is required for using /firehose endpoint")
+
+	// The signature covers the body, so modified bodies are rejected.
+	tc = handle(func(r *http.Request, body []byte) {
+		signSigV4(r, append(body, ' '), time.Now())
+	})
+	assert.Equal(t, http.StatusUnauthorized, tc.w.Code)
+	assert.Contains(t, tc.w.Body.String(), "SigV4 authentication failed: signature does not match")
+
+	// The body is buffered for verification, subject to MaxBodyBytes.
+	maxBodyBytes = 10
+	tc = handle(func(r *http.Request, body []byte) {
+		signSigV4(r, body, time.Now())
+	})
+	assert.Equal(t, http.StatusRequestEntityTooLarge, tc.w.Code)
+	assert.Contains(t, tc.w.Body.String(), "request body exceeds 10 bytes")
+}
+
+// signSigV4 signs r, with the given body, for the firehose service in
+// us-east-1 using the test credentials.
+func signSigV4(r *http.Request, body []byte, now time.Time) {
+	date := now.UTC().Format(sigV4DateFormat)
+	r.Header.Set("X-Amz-Date", date)
+	payloadHash := sha256.Sum256(body)
+	signedHeaders := []string{"content-type", "host", "x-amz-date"}
+	canonicalRequestHash := sha256.Sum256([]byte(
+		sigV4CanonicalRequest(r, signedHeaders, hex.EncodeToString(payloadHash[:])),
+	))
+	scope := date[:8] + "/us-east-1/firehose/aws4_request"
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm, date, scope, hex.EncodeToString(canonicalRequestHash[:]),
+	}, "\n")
+	key := sigV4SigningKey(testSigV4SecretAccessKey, date[:8], "us-east-1", "firehose")
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, testSigV4AccessKeyID, scope, strings.Join(signedHeaders, ";"),
+		hex.EncodeToString(hmacSHA256(key, []byte(stringToSign))),
+	))
+}
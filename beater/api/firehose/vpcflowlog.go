@@ -0,0 +1,137 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package firehose
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/apm-server/model"
+)
+
+// defaultVPCFlowLogFields holds the fields of the default (version 2)
+// VPC Flow Logs format, in order.
+//
+// https://docs.aws.amazon.com/vpc/latest/userguide/flow-logs.html#flow-logs-default
+var defaultVPCFlowLogFields = []string{
+	"version",
+	"account-id",
+	"interface-id",
+	"srcaddr",
+	"dstaddr",
+	"srcport",
+	"dstport",
+	"protocol",
+	"packets",
+	"bytes",
+	"start",
+	"end",
+	"action",
+	"log-status",
+}
+
+// ianaProtocols maps IANA protocol numbers to network transport names,
+// for the protocols commonly recorded in VPC Flow Logs.
+var ianaProtocols = map[string]string{
+	"1":  "icmp",
+	"6":  "tcp",
+	"17": "udp",
+	"58": "ipv6-icmp",
+}
+
+// parseVPCFlowLog attempts to parse line as a VPC Flow Log record with the
+// given space-separated fields, setting network fields in event and
+// recording unrecognised fields as labels. parseVPCFlowLog reports whether
+// line was parsed; if it returns false, event is left unmodified.
+//
+// Lines with a different number of values, or with values which are not
+// valid for their field (e.g. a non-numeric port), are not parsed. Values
+// of "-", which flow logs use for fields without data, are ignored.
+func parseVPCFlowLog(line string, fields []string, event *model.APMEvent) bool {
+	values := strings.Fields(line)
+	if len(values) != len(fields) {
+		return false
+	}
+
+	parsed := *event
+	parsed.Message = line
+	parsed.Labels = copyLabels(event.Labels, len(fields))
+	for i, field := range fields {
+		value := values[i]
+		if value == "-" {
+			continue
+		}
+		var err error
+		switch field {
+		case "account-id":
+			parsed.Cloud.Provider = "aws"
+			parsed.Cloud.AccountID = value
+		case "instance-id":
+			parsed.Cloud.InstanceID = value
+		case "region":
+			parsed.Cloud.Region = value
+		case "az-id":
+			parsed.Cloud.AvailabilityZone = value
+		case "srcaddr":
+			if parsed.Source.IP = net.ParseIP(value); parsed.Source.IP == nil {
+				return false
+			}
+		case "dstaddr":
+			if net.ParseIP(value) == nil {
+				return false
+			}
+			parsed.Destination.Address = value
+		case "srcport":
+			parsed.Source.Port, err = strconv.Atoi(value)
+		case "dstport":
+			parsed.Destination.Port, err = strconv.Atoi(value)
+		case "protocol":
+			if _, err = strconv.Atoi(value); err == nil {
+				parsed.Network.IANANumber = value
+				parsed.Network.Transport = ianaProtocols[value]
+			}
+		case "packets":
+			parsed.Network.Packets, err = strconv.ParseInt(value, 10, 64)
+		case "bytes":
+			parsed.Network.Bytes, err = strconv.ParseInt(value, 10, 64)
+		case "start":
+			var start int64
+			if start, err = strconv.ParseInt(value, 10, 64); err == nil {
+				parsed.Timestamp = time.Unix(start, 0)
+			}
+		case "action":
+			parsed.Event.Action = strings.ToLower(value)
+		case "version", "end":
+			if _, err = strconv.Atoi(value); err == nil {
+				parsed.Labels[strings.ReplaceAll(field, "-", "_")] = value
+			}
+		default:
+			parsed.Labels[strings.ReplaceAll(field, "-", "_")] = value
+		}
+		if err != nil {
+			return false
+		}
+	}
+	if len(parsed.Labels) == 0 {
+		parsed.Labels = nil
+	}
+	*event = parsed
+	return true
+}
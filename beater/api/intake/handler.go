@@ -33,6 +33,7 @@ import (
 	"github.com/elastic/apm-server/beater/request"
 	"github.com/elastic/apm-server/decoder"
 	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modelindexer"
 	"github.com/elastic/apm-server/processor/stream"
 	"github.com/elastic/apm-server/publish"
 )
@@ -144,10 +145,10 @@ func writeStreamResult(c *request.Context, sr *stream.Result) {
 				errID = request.IDResponseErrorsValidate
 			} else {
 				switch {
-				case errors.Is(err, publish.ErrChannelClosed):
+				case errors.Is(err, publish.ErrChannelClosed), errors.Is(err, modelindexer.ErrClosed):
 					errID = request.IDResponseErrorsShuttingDown
 					err = errServerShuttingDown
-				case errors.Is(err, publish.ErrFull):
+				case errors.Is(err, publish.ErrFull), errors.Is(err, modelindexer.ErrFull):
 					errID = request.IDResponseErrorsFullQueue
 				case errors.Is(err, errMethodNotAllowed):
 					errID = request.IDResponseErrorsMethodNotAllowed
@@ -36,6 +36,7 @@ import (
 	"github.com/elastic/apm-server/beater/headers"
 	"github.com/elastic/apm-server/beater/request"
 	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modelindexer"
 	"github.com/elastic/apm-server/model/modelprocessor"
 	"github.com/elastic/apm-server/processor/stream"
 	"github.com/elastic/apm-server/publish"
@@ -106,6 +107,18 @@ func TestIntakeHandler(t *testing.T) {
 				return publish.ErrFull
 			}),
 			code: http.StatusServiceUnavailable, id: request.IDResponseErrorsFullQueue},
+		"IndexerClosed": {
+			path: "errors.ndjson",
+			batchProcessor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				return modelindexer.ErrClosed
+			}),
+			code: http.StatusServiceUnavailable, id: request.IDResponseErrorsShuttingDown},
+		"IndexerFull": {
+			path: "errors.ndjson",
+			batchProcessor: model.ProcessBatchFunc(func(context.Context, *model.Batch) error {
+				return modelindexer.ErrFull
+			}),
+			code: http.StatusServiceUnavailable, id: request.IDResponseErrorsFullQueue},
 		"InvalidEvent": {
 			path: "invalid-event.ndjson",
 			code: http.StatusBadRequest, id: request.IDResponseErrorsValidate},
@@ -88,6 +88,7 @@ func NewMux(
 	ratelimitStore *ratelimit.Store,
 	sourcemapStore *sourcemap.Store,
 	fleetManaged bool,
+	namespace string,
 	publishReady func() bool,
 ) (*http.ServeMux, error) {
 	pool := request.NewContextPool()
@@ -103,6 +104,7 @@ func NewMux(
 		ratelimitStore: ratelimitStore,
 		sourcemapStore: sourcemapStore,
 		fleetManaged:   fleetManaged,
+		namespace:      namespace,
 	}
 
 	type route struct {
@@ -157,6 +159,7 @@ type routeBuilder struct {
 	ratelimitStore *ratelimit.Store
 	sourcemapStore *sourcemap.Store
 	fleetManaged   bool
+	namespace      string
 }
 
 func (r *routeBuilder) profileHandler() (request.Handler, error) {
@@ -169,8 +172,74 @@ func (r *routeBuilder) profileHandler() (request.Handler, error) {
 }
 
 func (r *routeBuilder) firehoseHandler() (request.Handler, error) {
-	h := firehose.Handler(r.batchProcessor, r.authenticator)
-	return middleware.Wrap(h, firehoseMiddleware(r.cfg, intake.MonitoringMap)...)
+	var logLevelPatterns []*regexp.Regexp
+	for _, pattern := range r.cfg.Firehose.LogLevelPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid log level pattern regex")
+		}
+		logLevelPatterns = append(logLevelPatterns, re)
+	}
+	var traceIDPattern, transactionIDPattern *regexp.Regexp
+	if pattern := r.cfg.Firehose.TraceIDPattern; pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid trace ID pattern regex")
+		}
+		traceIDPattern = re
+	}
+	if pattern := r.cfg.Firehose.TransactionIDPattern; pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid transaction ID pattern regex")
+		}
+		transactionIDPattern = re
+	}
+	var rateLimitStore *ratelimit.Store
+	if rateLimit := r.cfg.Firehose.RateLimit; rateLimit.RequestLimit > 0 {
+		store, err := ratelimit.NewStore(
+			rateLimit.KeyLimit,
+			rateLimit.RequestLimit,
+			3, // burst multiplier
+		)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create firehose rate limiter")
+		}
+		rateLimitStore = store
+	}
+	var sigV4Verifier *firehose.SigV4Verifier
+	if sigV4 := r.cfg.Firehose.SigV4; sigV4.Enabled {
+		credentials := make(map[string]string, len(sigV4.Credentials))
+		for _, c := range sigV4.Credentials {
+			credentials[c.AccessKeyID] = c.SecretAccessKey
+		}
+		sigV4Verifier = &firehose.SigV4Verifier{
+			Credentials: credentials,
+			Region:      sigV4.Region,
+			Service:     sigV4.Service,
+			MaxSkew:     sigV4.MaxSkew,
+		}
+	}
+	h := firehose.Handler(r.batchProcessor, r.authenticator, firehose.HandlerConfig{
+		RecordFormat:         r.cfg.Firehose.RecordFormat,
+		LineDelimiter:        r.cfg.Firehose.LineDelimiter,
+		ParseJSONLines:       r.cfg.Firehose.ParseJSONLines,
+		ParseVPCFlowLogs:     r.cfg.Firehose.ParseVPCFlowLogs,
+		VPCFlowLogFields:     r.cfg.Firehose.VPCFlowLogFields,
+		ExtractLogLevel:      r.cfg.Firehose.ExtractLogLevel,
+		LogLevelPatterns:     logLevelPatterns,
+		TraceIDKey:           r.cfg.Firehose.TraceIDKey,
+		TransactionIDKey:     r.cfg.Firehose.TransactionIDKey,
+		TraceIDPattern:       traceIDPattern,
+		TransactionIDPattern: transactionIDPattern,
+		MaxBodyBytes:         r.cfg.Firehose.MaxBodyBytes,
+		ProcessTimeout:       r.cfg.Firehose.ProcessTimeout,
+		MaxBatchSize:         r.cfg.Firehose.MaxBatchSize,
+		RateLimitStore:       rateLimitStore,
+		SigV4Verifier:        sigV4Verifier,
+		Namespace:            r.namespace,
+	})
+	return middleware.Wrap(h, firehoseMiddleware(r.cfg, firehose.MonitoringMap)...)
 }
 
 func (r *routeBuilder) backendIntakeHandler() (request.Handler, error) {
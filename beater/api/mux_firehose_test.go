@@ -0,0 +1,35 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package api
+
+import (
+	"testing"
+
+	"github.com/elastic/apm-server/beater/api/firehose"
+	"github.com/elastic/apm-server/beater/request"
+)
+
+func TestFirehoseHandler_MonitoringMiddleware(t *testing.T) {
+	// send GET request resulting in 405 Method Not Allowed, as auth is disabled by default
+	testMonitoringMiddleware(t, FirehosePath, firehose.MonitoringMap, map[request.ResultID]int{
+		request.IDRequestCount:                   1,
+		request.IDResponseCount:                  1,
+		request.IDResponseErrorsCount:            1,
+		request.IDResponseErrorsMethodNotAllowed: 1,
+	})
+}
@@ -135,6 +135,7 @@ func (m muxBuilder) build(cfg *config.Config) (http.Handler, error) {
 		ratelimitStore,
 		m.SourcemapStore,
 		m.Managed,
+		"default",
 		func() bool { return true },
 	)
 }
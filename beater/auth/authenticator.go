@@ -113,6 +113,11 @@ type Resource struct {
 	// the request. This may be empty if the agent is unknown or irrelevant,
 	// such as in a request to the healthcheck endpoint.
 	ServiceName string
+
+	// DataStream holds the data stream, formatted as "type-dataset-namespace",
+	// to which events will be written. This may be empty if the data stream
+	// is not known at the time of authorization.
+	DataStream string
 }
 
 // AuthenticationDetails holds authentication details for a client.
@@ -666,7 +666,9 @@ func (s *serverRunner) newFinalBatchProcessor(p *publish.Publisher) (model.Batch
 		*elasticsearch.Config `config:",inline"`
 		Experimental          bool          `config:"experimental"`
 		FlushBytes            string        `config:"flush_bytes"`
+		FlushCompressedBytes  bool          `config:"flush_compressed_bytes"`
 		FlushInterval         time.Duration `config:"flush_interval"`
+		CompressionLevel      int           `config:"compression_level" validate:"min=0, max=9"`
 	}
 	esConfig.FlushInterval = time.Second
 
@@ -692,8 +694,14 @@ func (s *serverRunner) newFinalBatchProcessor(p *publish.Publisher) (model.Batch
 		return nil, nil, err
 	}
 	indexer, err := modelindexer.New(client, modelindexer.Config{
-		FlushBytes:    flushBytes,
-		FlushInterval: esConfig.FlushInterval,
+		FlushBytes:           flushBytes,
+		FlushCompressedBytes: esConfig.FlushCompressedBytes,
+		FlushInterval:        esConfig.FlushInterval,
+		CompressionLevel:     esConfig.CompressionLevel,
+		Tracer:               s.tracer,
+		// The model indexer is used only with data streams enabled,
+		// so events should always have a complete data stream.
+		ValidateDataStreams: true,
 	})
 	if err != nil {
 		return nil, nil, err
@@ -711,6 +719,8 @@ func (s *serverRunner) newFinalBatchProcessor(p *publish.Publisher) (model.Batch
 		v.OnInt(stats.Added)
 		v.OnKey("failed")
 		v.OnInt(stats.Failed)
+		v.OnKey("toomany")
+		v.OnInt(stats.TooManyRequests)
 	})
 	return indexer, indexer.Close, nil
 }
@@ -73,6 +73,7 @@ type Config struct {
 	DataStreams               DataStreamsConfig       `config:"data_streams"`
 	DefaultServiceEnvironment string                  `config:"default_service_environment"`
 	JavaAttacherConfig        JavaAttacherConfig      `config:"java_attacher"`
+	Firehose                  FirehoseConfig          `config:"firehose"`
 
 	Pipeline string
 
@@ -122,6 +123,10 @@ func NewConfig(ucfg *common.Config, outputESCfg *common.Config) (*Config, error)
 		return nil, err
 	}
 
+	if err := c.Firehose.setup(); err != nil {
+		return nil, err
+	}
+
 	if err := c.Sampling.Tail.setup(logger, c.DataStreams.Enabled, outputESCfg); err != nil {
 		return nil, err
 	}
@@ -246,6 +251,7 @@ func DefaultConfig() *Config {
 		DataStreams:         defaultDataStreamsConfig(),
 		AgentAuth:           defaultAgentAuth(),
 		JavaAttacherConfig:  defaultJavaAttacherConfig(),
+		Firehose:            defaultFirehoseConfig(),
 		WaitReadyInterval:   5 * time.Second,
 	}
 }
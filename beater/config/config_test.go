@@ -97,6 +97,20 @@ func TestUnpackConfig(t *testing.T) {
 					"enabled": true,
 					"url":     "/debug/vars",
 				},
+				"firehose": map[string]interface{}{
+					"record_format":      "ndjson",
+					"line_delimiter":     "\r\n",
+					"max_body_bytes":     1024,
+					"process_timeout":    "5s",
+					"max_batch_size":     100,
+					"extract_log_level":  true,
+					"log_level_patterns": []string{`\[(\w+)\]`},
+					"trace_id_key":       "traceId",
+					"trace_id_pattern":   `trace_id=(\w+)`,
+					"rate_limit": map[string]interface{}{
+						"request_limit": 50,
+					},
+				},
 				"rum": map[string]interface{}{
 					"enabled": true,
 					"event_rate": map[string]interface{}{
@@ -292,6 +306,18 @@ func TestUnpackConfig(t *testing.T) {
 					Enabled:            false,
 					WaitForIntegration: true,
 				},
+				Firehose: FirehoseConfig{
+					RecordFormat:     "ndjson",
+					LineDelimiter:    "\r\n",
+					MaxBodyBytes:     1024,
+					ProcessTimeout:   5 * time.Second,
+					MaxBatchSize:     100,
+					ExtractLogLevel:  true,
+					LogLevelPatterns: []string{`\[(\w+)\]`},
+					TraceIDKey:       "traceId",
+					TraceIDPattern:   `trace_id=(\w+)`,
+					RateLimit:        FirehoseRateLimit{RequestLimit: 50, KeyLimit: 1000},
+				},
 				WaitReadyInterval: 5 * time.Second,
 			},
 		},
@@ -480,6 +506,12 @@ func TestUnpackConfig(t *testing.T) {
 					Enabled:            false,
 					WaitForIntegration: false,
 				},
+				Firehose: FirehoseConfig{
+					RecordFormat:   "text",
+					MaxBodyBytes:   65 * 1024 * 1024,
+					ProcessTimeout: 10 * time.Second,
+					RateLimit:      FirehoseRateLimit{KeyLimit: 1000},
+				},
 				WaitReadyInterval: 5 * time.Second,
 			},
 		},
@@ -0,0 +1,243 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FirehoseConfig holds configuration for the experimental firehose endpoint.
+type FirehoseConfig struct {
+	// RecordFormat holds the format of firehose log records: "text" for
+	// newline-delimited text lines, "json" for records each holding a
+	// single JSON document, or "ndjson" for records holding a JSON
+	// document on each line. "otlp_traces" and "otlp_metrics" identify
+	// records each holding a protobuf-encoded OTLP export request, for
+	// bridging OpenTelemetry data delivered through Firehose.
+	RecordFormat string `config:"record_format"`
+
+	// LineDelimiter holds the delimiter separating the lines of "text"
+	// firehose log records, such as "\r\n". If empty, "\n" is used.
+	LineDelimiter string `config:"line_delimiter"`
+
+	// ParseJSONLines controls whether firehose log lines holding JSON
+	// objects are parsed as structured logs.
+	ParseJSONLines bool `config:"parse_json_lines"`
+
+	// ParseVPCFlowLogs controls whether firehose log lines holding
+	// VPC Flow Log records are parsed into network fields.
+	ParseVPCFlowLogs bool `config:"parse_vpc_flow_logs"`
+
+	// VPCFlowLogFields holds the fields of a custom VPC Flow Logs
+	// format, in order. If empty, the default format is assumed.
+	VPCFlowLogFields []string `config:"vpc_flow_log_fields"`
+
+	// ExtractLogLevel controls whether the log level is extracted from
+	// plain-text firehose log lines, using LogLevelPatterns.
+	ExtractLogLevel bool `config:"extract_log_level"`
+
+	// LogLevelPatterns holds regular expressions for extracting the log
+	// level from plain-text log lines, each with a capture group matching
+	// the level. Patterns are matched in order. If empty, patterns for
+	// common level tokens such as "ERROR" and "level=warn" are used.
+	LogLevelPatterns []string `config:"log_level_patterns"`
+
+	// TraceIDKey and TransactionIDKey hold the keys of the trace and
+	// transaction IDs in JSON firehose logs, which may be dotted to
+	// address nested objects. If TraceIDKey is empty, "trace.id" is
+	// used; if TransactionIDKey is empty, transaction IDs are not
+	// extracted from JSON logs.
+	TraceIDKey       string `config:"trace_id_key"`
+	TransactionIDKey string `config:"transaction_id_key"`
+
+	// TraceIDPattern and TransactionIDPattern hold regular expressions
+	// for extracting the trace and transaction IDs from firehose log
+	// lines without them, each with a capture group matching the ID.
+	// If empty, IDs are not extracted by pattern.
+	TraceIDPattern       string `config:"trace_id_pattern"`
+	TransactionIDPattern string `config:"transaction_id_pattern"`
+
+	// MaxBodyBytes holds the maximum firehose request body size,
+	// in bytes, after decompression. Requests with larger bodies
+	// are rejected, as are gzip-compressed records which decompress
+	// to more than MaxBodyBytes.
+	MaxBodyBytes int64 `config:"max_body_bytes"`
+
+	// ProcessTimeout holds the maximum duration to wait for the events
+	// of a firehose request to be enqueued for publishing. Requests which
+	// time out are rejected with 503 Service Unavailable, so that they
+	// are retried. If zero, there is no timeout.
+	ProcessTimeout time.Duration `config:"process_timeout"`
+
+	// MaxBatchSize holds the maximum number of events of a firehose
+	// request to process in a single batch. Requests producing more
+	// events are processed in several batches. If zero, the events of
+	// each request are processed as a single batch.
+	MaxBatchSize int `config:"max_batch_size"`
+
+	// RateLimit holds configuration for rate limiting firehose requests
+	// per delivery stream.
+	RateLimit FirehoseRateLimit `config:"rate_limit"`
+
+	// SigV4 holds configuration for authenticating firehose requests
+	// by their AWS Signature Version 4 signature, instead of by the
+	// Firehose access key.
+	SigV4 FirehoseSigV4 `config:"sigv4"`
+}
+
+// FirehoseSigV4 holds configuration for authenticating firehose requests
+// signed with AWS Signature Version 4, for deployments which front the
+// firehose endpoint with IAM.
+type FirehoseSigV4 struct {
+	// Enabled controls whether firehose requests are authenticated by
+	// their SigV4 signature. When enabled, the Firehose access key is
+	// ignored, and requests without a valid signature are rejected.
+	Enabled bool `config:"enabled"`
+
+	// Region and Service hold the region and service name for which
+	// requests must be signed. If empty, requests signed for any
+	// region or service are accepted.
+	Region  string `config:"region"`
+	Service string `config:"service"`
+
+	// MaxSkew holds the maximum difference between the time a request
+	// was signed and the time it is received. If zero, 15 minutes is
+	// used, matching AWS services.
+	MaxSkew time.Duration `config:"max_skew"`
+
+	// Credentials holds the AWS credentials with which requests may
+	// be signed.
+	Credentials []FirehoseSigV4Credentials `config:"credentials"`
+}
+
+// FirehoseSigV4Credentials holds an AWS access key with which firehose
+// requests may be signed.
+type FirehoseSigV4Credentials struct {
+	AccessKeyID     string `config:"access_key_id"`
+	SecretAccessKey string `config:"secret_access_key"`
+}
+
+// FirehoseRateLimit holds configuration for rate limiting firehose
+// requests, keyed by the access key's API Key ID or the source ARN.
+type FirehoseRateLimit struct {
+	// RequestLimit holds the request rate limit per delivery stream,
+	// measured in requests per second, allowing bursts of up to three
+	// times the limit. If zero, requests are not rate limited.
+	RequestLimit int `config:"request_limit"`
+
+	// KeyLimit holds the maximum number of delivery streams for which
+	// a distinct rate limit is maintained. Once this has been reached,
+	// delivery streams will begin sharing rate limiters.
+	KeyLimit int `config:"key_limit"`
+}
+
+func defaultFirehoseConfig() FirehoseConfig {
+	// Firehose limits requests to 64MB; allow a little
+	// slack for the JSON envelope.
+	return FirehoseConfig{
+		RecordFormat:   "text",
+		MaxBodyBytes:   65 * 1024 * 1024,
+		ProcessTimeout: 10 * time.Second,
+		RateLimit: FirehoseRateLimit{
+			KeyLimit: 1000,
+		},
+	}
+}
+
+func (c *FirehoseConfig) setup() error {
+	switch c.RecordFormat {
+	case "text", "json", "ndjson", "otlp_traces", "otlp_metrics":
+	default:
+		return errors.Errorf(
+			"invalid value %q for `firehose.record_format`, expected one of: text, json, ndjson, otlp_traces, otlp_metrics",
+			c.RecordFormat,
+		)
+	}
+	if c.ProcessTimeout < 0 {
+		return errors.Errorf("invalid value %s for `firehose.process_timeout`, must not be negative", c.ProcessTimeout)
+	}
+	if c.MaxBatchSize < 0 {
+		return errors.Errorf("invalid value %d for `firehose.max_batch_size`, must not be negative", c.MaxBatchSize)
+	}
+	if c.RateLimit.RequestLimit < 0 {
+		return errors.Errorf("invalid value %d for `firehose.rate_limit.request_limit`, must not be negative", c.RateLimit.RequestLimit)
+	}
+	if c.RateLimit.RequestLimit > 0 && c.RateLimit.KeyLimit <= 0 {
+		return errors.Errorf("invalid value %d for `firehose.rate_limit.key_limit`, must be greater than zero", c.RateLimit.KeyLimit)
+	}
+	if c.SigV4.Enabled {
+		if err := c.SigV4.setup(); err != nil {
+			return err
+		}
+	}
+	if c.TraceIDPattern != "" {
+		if err := checkCapturePattern(c.TraceIDPattern, "firehose.trace_id_pattern"); err != nil {
+			return err
+		}
+	}
+	if c.TransactionIDPattern != "" {
+		if err := checkCapturePattern(c.TransactionIDPattern, "firehose.transaction_id_pattern"); err != nil {
+			return err
+		}
+	}
+	if !c.ExtractLogLevel {
+		return nil
+	}
+	for _, pattern := range c.LogLevelPatterns {
+		if err := checkCapturePattern(pattern, "firehose.log_level_patterns"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *FirehoseSigV4) setup() error {
+	if c.MaxSkew < 0 {
+		return errors.Errorf("invalid value %s for `firehose.sigv4.max_skew`, must not be negative", c.MaxSkew)
+	}
+	if len(c.Credentials) == 0 {
+		return errors.New("`firehose.sigv4.credentials` must be set when `firehose.sigv4.enabled` is true")
+	}
+	accessKeyIDs := make(map[string]bool, len(c.Credentials))
+	for _, credentials := range c.Credentials {
+		if credentials.AccessKeyID == "" || credentials.SecretAccessKey == "" {
+			return errors.New("`firehose.sigv4.credentials` must each set access_key_id and secret_access_key")
+		}
+		if accessKeyIDs[credentials.AccessKeyID] {
+			return errors.Errorf("duplicate access key ID %q in `firehose.sigv4.credentials`", credentials.AccessKeyID)
+		}
+		accessKeyIDs[credentials.AccessKeyID] = true
+	}
+	return nil
+}
+
+// checkCapturePattern returns an error if pattern, the value of the
+// given setting, is not a valid regex with at least one capture group.
+func checkCapturePattern(pattern, setting string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return errors.Wrapf(err, "invalid regex %q for `%s`", pattern, setting)
+	}
+	if re.NumSubexp() == 0 {
+		return errors.Errorf("regex %q for `%s` has no capture group", pattern, setting)
+	}
+	return nil
+}
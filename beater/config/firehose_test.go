@@ -0,0 +1,134 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFirehoseConfigRecordFormat(t *testing.T) {
+	config := defaultFirehoseConfig()
+	assert.Equal(t, "text", config.RecordFormat)
+	for _, format := range []string{"text", "json", "ndjson", "otlp_traces", "otlp_metrics"} {
+		config.RecordFormat = format
+		assert.NoError(t, config.setup())
+	}
+
+	config.RecordFormat = "xml"
+	assert.EqualError(t, config.setup(), "invalid value \"xml\" for `firehose.record_format`, expected one of: text, json, ndjson, otlp_traces, otlp_metrics")
+}
+
+func TestFirehoseConfigLogLevelPatterns(t *testing.T) {
+	config := defaultFirehoseConfig()
+	config.ExtractLogLevel = true
+	assert.NoError(t, config.setup())
+
+	config.LogLevelPatterns = []string{`level=(\w+)`}
+	assert.NoError(t, config.setup())
+
+	config.LogLevelPatterns = []string{"("}
+	assert.EqualError(t, config.setup(), "invalid regex \"(\" for `firehose.log_level_patterns`: error parsing regexp: missing closing ): `(`")
+
+	config.LogLevelPatterns = []string{"ERROR"}
+	assert.EqualError(t, config.setup(), "regex \"ERROR\" for `firehose.log_level_patterns` has no capture group")
+
+	// Patterns are only validated when log level extraction is enabled.
+	config.ExtractLogLevel = false
+	assert.NoError(t, config.setup())
+}
+
+func TestFirehoseConfigProcessTimeout(t *testing.T) {
+	config := defaultFirehoseConfig()
+	assert.Equal(t, 10*time.Second, config.ProcessTimeout)
+
+	config.ProcessTimeout = 0
+	assert.NoError(t, config.setup())
+
+	config.ProcessTimeout = -time.Second
+	assert.EqualError(t, config.setup(), "invalid value -1s for `firehose.process_timeout`, must not be negative")
+}
+
+func TestFirehoseConfigMaxBatchSize(t *testing.T) {
+	config := defaultFirehoseConfig()
+	assert.Zero(t, config.MaxBatchSize)
+
+	config.MaxBatchSize = 1000
+	assert.NoError(t, config.setup())
+
+	config.MaxBatchSize = -1
+	assert.EqualError(t, config.setup(), "invalid value -1 for `firehose.max_batch_size`, must not be negative")
+}
+
+func TestFirehoseConfigCorrelationPatterns(t *testing.T) {
+	config := defaultFirehoseConfig()
+	config.TraceIDPattern = `trace_id=(\w+)`
+	config.TransactionIDPattern = `transaction_id=(\w+)`
+	assert.NoError(t, config.setup())
+
+	config.TraceIDPattern = "trace_id"
+	assert.EqualError(t, config.setup(), "regex \"trace_id\" for `firehose.trace_id_pattern` has no capture group")
+
+	config.TraceIDPattern = ""
+	config.TransactionIDPattern = "("
+	assert.EqualError(t, config.setup(), "invalid regex \"(\" for `firehose.transaction_id_pattern`: error parsing regexp: missing closing ): `(`")
+}
+
+func TestFirehoseConfigRateLimit(t *testing.T) {
+	config := defaultFirehoseConfig()
+	assert.Equal(t, FirehoseRateLimit{KeyLimit: 1000}, config.RateLimit)
+	config.RateLimit.RequestLimit = 10
+	assert.NoError(t, config.setup())
+
+	config.RateLimit.RequestLimit = -1
+	assert.EqualError(t, config.setup(), "invalid value -1 for `firehose.rate_limit.request_limit`, must not be negative")
+
+	config.RateLimit = FirehoseRateLimit{RequestLimit: 10, KeyLimit: 0}
+	assert.EqualError(t, config.setup(), "invalid value 0 for `firehose.rate_limit.key_limit`, must be greater than zero")
+
+	// The key limit is only validated when rate limiting is enabled.
+	config.RateLimit.RequestLimit = 0
+	assert.NoError(t, config.setup())
+}
+
+func TestFirehoseConfigSigV4(t *testing.T) {
+	config := defaultFirehoseConfig()
+	assert.Equal(t, FirehoseSigV4{}, config.SigV4)
+
+	// The credentials are only validated when SigV4 is enabled.
+	config.SigV4.Credentials = []FirehoseSigV4Credentials{{AccessKeyID: "AKIDEXAMPLE"}}
+	assert.NoError(t, config.setup())
+
+	config.SigV4.Enabled = true
+	assert.EqualError(t, config.setup(), "`firehose.sigv4.credentials` must each set access_key_id and secret_access_key")
+
+	config.SigV4.Credentials[0].SecretAccessKey = "secret"
+	assert.NoError(t, config.setup())
+
+	config.SigV4.Credentials = append(config.SigV4.Credentials, config.SigV4.Credentials[0])
+	assert.EqualError(t, config.setup(), "duplicate access key ID \"AKIDEXAMPLE\" in `firehose.sigv4.credentials`")
+
+	config.SigV4.Credentials = nil
+	assert.EqualError(t, config.setup(), "`firehose.sigv4.credentials` must be set when `firehose.sigv4.enabled` is true")
+
+	config.SigV4.Credentials = []FirehoseSigV4Credentials{{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}}
+	config.SigV4.MaxSkew = -time.Second
+	assert.EqualError(t, config.setup(), "invalid value -1s for `firehose.sigv4.max_skew`, must not be negative")
+}
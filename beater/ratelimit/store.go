@@ -63,8 +63,12 @@ func NewStore(size, rateLimit, burstFactor int) (*Store, error) {
 
 // ForIP returns a rate limiter for the given IP.
 func (s *Store) ForIP(ip net.IP) *rate.Limiter {
-	key := ip.String()
+	return s.ForKey(ip.String())
+}
 
+// ForKey returns a rate limiter for the given key, such as
+// the identity of an authenticated client.
+func (s *Store) ForKey(key string) *rate.Limiter {
 	// lock get and add action for cache to allow proper eviction handling without
 	// race conditions.
 	s.mu.Lock()
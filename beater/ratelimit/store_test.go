@@ -79,3 +79,13 @@ func TestCacheOk(t *testing.T) {
 	limiter := store.ForIP(net.ParseIP("127.0.0.1"))
 	assert.NotNil(t, limiter)
 }
+
+func TestCacheForKey(t *testing.T) {
+	store, err := NewStore(2, 1, 1)
+	require.NoError(t, err)
+	limiter := store.ForKey("key-a")
+	assert.True(t, limiter.Allow())
+	assert.False(t, store.ForKey("key-a").Allow())
+	assert.True(t, store.ForKey("key-b").Allow())
+	assert.Equal(t, store.ForIP(net.ParseIP("127.0.0.1")), store.ForKey("127.0.0.1"))
+}
@@ -60,6 +60,8 @@ const (
 	IDResponseErrorsInvalidQuery ResultID = "response.errors.invalidquery"
 	// IDResponseErrorsRequestTooLarge identifies responses for too large requests
 	IDResponseErrorsRequestTooLarge ResultID = "response.errors.toolarge"
+	// IDResponseErrorsUnsupportedMediaType identifies responses for requests with an unsupported content encoding
+	IDResponseErrorsUnsupportedMediaType ResultID = "response.errors.unsupportedmedia"
 	// IDResponseErrorsDecode identifies responses for requests that could not be decoded
 	IDResponseErrorsDecode ResultID = "response.errors.decode"
 	// IDResponseErrorsValidate identifies responses for invalid requests
@@ -84,23 +86,24 @@ const (
 var (
 	// MapResultIDToStatus takes a ResultID and maps it to a status
 	MapResultIDToStatus = map[ResultID]Status{
-		IDResponseValidOK:                  {Code: http.StatusOK, Keyword: "request ok"},
-		IDResponseValidAccepted:            {Code: http.StatusAccepted, Keyword: "request accepted"},
-		IDResponseValidNotModified:         {Code: http.StatusNotModified, Keyword: "not modified"},
-		IDResponseErrorsForbidden:          {Code: http.StatusForbidden, Keyword: "forbidden request"},
-		IDResponseErrorsUnauthorized:       {Code: http.StatusUnauthorized, Keyword: "unauthorized"},
-		IDResponseErrorsNotFound:           {Code: http.StatusNotFound, Keyword: "404 page not found"},
-		IDResponseErrorsRequestTooLarge:    {Code: http.StatusRequestEntityTooLarge, Keyword: "request body too large"},
-		IDResponseErrorsInvalidQuery:       {Code: http.StatusBadRequest, Keyword: "invalid query"},
-		IDResponseErrorsDecode:             {Code: http.StatusBadRequest, Keyword: "data decoding error"},
-		IDResponseErrorsValidate:           {Code: http.StatusBadRequest, Keyword: "data validation error"},
-		IDResponseErrorsMethodNotAllowed:   {Code: http.StatusMethodNotAllowed, Keyword: "method not supported"},
-		IDResponseErrorsRateLimit:          {Code: http.StatusTooManyRequests, Keyword: "too many requests"},
-		IDResponseErrorsTimeout:            {Code: http.StatusServiceUnavailable, Keyword: "request timed out"},
-		IDResponseErrorsFullQueue:          {Code: http.StatusServiceUnavailable, Keyword: "queue is full"},
-		IDResponseErrorsShuttingDown:       {Code: http.StatusServiceUnavailable, Keyword: "server is shutting down"},
-		IDResponseErrorsServiceUnavailable: {Code: http.StatusServiceUnavailable, Keyword: "service unavailable"},
-		IDResponseErrorsInternal:           {Code: http.StatusInternalServerError, Keyword: "internal error"},
+		IDResponseValidOK:                    {Code: http.StatusOK, Keyword: "request ok"},
+		IDResponseValidAccepted:              {Code: http.StatusAccepted, Keyword: "request accepted"},
+		IDResponseValidNotModified:           {Code: http.StatusNotModified, Keyword: "not modified"},
+		IDResponseErrorsForbidden:            {Code: http.StatusForbidden, Keyword: "forbidden request"},
+		IDResponseErrorsUnauthorized:         {Code: http.StatusUnauthorized, Keyword: "unauthorized"},
+		IDResponseErrorsNotFound:             {Code: http.StatusNotFound, Keyword: "404 page not found"},
+		IDResponseErrorsRequestTooLarge:      {Code: http.StatusRequestEntityTooLarge, Keyword: "request body too large"},
+		IDResponseErrorsUnsupportedMediaType: {Code: http.StatusUnsupportedMediaType, Keyword: "unsupported media type"},
+		IDResponseErrorsInvalidQuery:         {Code: http.StatusBadRequest, Keyword: "invalid query"},
+		IDResponseErrorsDecode:               {Code: http.StatusBadRequest, Keyword: "data decoding error"},
+		IDResponseErrorsValidate:             {Code: http.StatusBadRequest, Keyword: "data validation error"},
+		IDResponseErrorsMethodNotAllowed:     {Code: http.StatusMethodNotAllowed, Keyword: "method not supported"},
+		IDResponseErrorsRateLimit:            {Code: http.StatusTooManyRequests, Keyword: "too many requests"},
+		IDResponseErrorsTimeout:              {Code: http.StatusServiceUnavailable, Keyword: "request timed out"},
+		IDResponseErrorsFullQueue:            {Code: http.StatusServiceUnavailable, Keyword: "queue is full"},
+		IDResponseErrorsShuttingDown:         {Code: http.StatusServiceUnavailable, Keyword: "server is shutting down"},
+		IDResponseErrorsServiceUnavailable:   {Code: http.StatusServiceUnavailable, Keyword: "service unavailable"},
+		IDResponseErrorsInternal:             {Code: http.StatusInternalServerError, Keyword: "internal error"},
 	}
 
 	// DefaultResultIDs is a list of the default result IDs used by the package.
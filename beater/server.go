@@ -180,7 +180,7 @@ func newServer(args ServerParams, listener net.Listener, reporter publish.Report
 	mux, err := api.NewMux(
 		args.Info, args.Config, reporter, batchProcessor,
 		authenticator, agentcfgFetchReporter, ratelimitStore,
-		args.SourcemapStore, args.Managed, publishReady,
+		args.SourcemapStore, args.Managed, args.Namespace, publishReady,
 	)
 	if err != nil {
 		return server{}, err
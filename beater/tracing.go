@@ -79,6 +79,7 @@ func newTracerServer(listener net.Listener, logger *logp.Logger) (*tracerServer,
 		ratelimitStore,
 		nil,                         // no sourcemap store
 		false,                       // not managed
+		"",                          // namespace is set when the events are processed
 		func() bool { return true }, // ready for publishing
 	)
 	if err != nil {
@@ -77,11 +77,12 @@ func TestAPMEventFields(t *testing.T) {
 			Destination: Destination{Address: destinationAddress, Port: destinationPort},
 			Process:     Process{Pid: pid},
 			User:        User{ID: uid, Email: mail},
-			Event:       Event{Outcome: outcome},
+			Event:       Event{Outcome: outcome, Action: "action", Dataset: "dataset", Module: "module"},
 			Session:     Session{ID: "session_id"},
 			URL:         URL{Original: "url"},
 			Labels:      common.MapStr{"a": "b", "c": 123},
 			Message:     "bottle",
+			Log:         EventLog{Level: "warn"},
 			Transaction: &Transaction{},
 			Timestamp:   time.Date(2019, 1, 3, 15, 17, 4, 908.596*1e6, time.FixedZone("+0100", 3600)),
 			Processor:   Processor{Name: "processor_name", Event: "processor_event"},
@@ -134,7 +135,7 @@ func TestAPMEventFields(t *testing.T) {
 				"ip":      destinationAddress,
 				"port":    destinationPort,
 			},
-			"event":   common.MapStr{"outcome": outcome},
+			"event":   common.MapStr{"outcome": outcome, "action": "action", "dataset": "dataset", "module": "module"},
 			"session": common.MapStr{"id": "session_id"},
 			"url":     common.MapStr{"original": "url"},
 			"labels": common.MapStr{
@@ -142,6 +143,7 @@ func TestAPMEventFields(t *testing.T) {
 				"c": 123,
 			},
 			"message": "bottle",
+			"log":     common.MapStr{"level": "warn"},
 			"trace": common.MapStr{
 				"id": traceID,
 			},
@@ -36,10 +36,25 @@ type Event struct {
 
 	// Outcome holds the event outcome: "success", "failure", or "unknown".
 	Outcome string
+
+	// Action holds the action captured by the event, e.g. "accept"
+	// or "reject" for network flow logs.
+	Action string
+
+	// Dataset holds the name of the dataset of the event, e.g.
+	// "nginx.access", for grouping events in the Logs UI.
+	Dataset string
+
+	// Module holds the name of the module the event's data is coming
+	// from, e.g. "nginx".
+	Module string
 }
 
 func (e *Event) fields() common.MapStr {
 	var fields mapStr
 	fields.maybeSetString("outcome", e.Outcome)
+	fields.maybeSetString("action", e.Action)
+	fields.maybeSetString("dataset", e.Dataset)
+	fields.maybeSetString("module", e.Module)
 	return common.MapStr(fields)
 }
@@ -17,6 +17,10 @@
 
 package model
 
+import (
+	"github.com/elastic/beats/v7/libbeat/common"
+)
+
 const (
 	AppLogsDataset = "apm.app"
 )
@@ -25,3 +29,17 @@ var (
 	// LogProcessor is the Processor value that should be assigned to log events.
 	LogProcessor = Processor{Name: "log", Event: "log"}
 )
+
+// EventLog holds information about a log event.
+//
+// See https://www.elastic.co/guide/en/ecs/current/ecs-log.html
+type EventLog struct {
+	// Level holds the log level of the event, such as "error" or "info".
+	Level string
+}
+
+func (l *EventLog) fields() common.MapStr {
+	var fields mapStr
+	fields.maybeSetString("level", l.Level)
+	return common.MapStr(fields)
+}
@@ -68,6 +68,7 @@ func metadataExceptions(keys ...string) func(key string) bool {
 		"Experimental",
 		"HTTP",
 		"Kubernetes",
+		"Log",
 		"Message",
 		"Network",
 		"Observer",
@@ -67,6 +67,8 @@ func isUnmappedMetadataField(key string) bool {
 		"HTTP.Request",
 		"HTTP.Response",
 		"HTTP.Version",
+		"Log",
+		"Log.Level",
 		"Message",
 		"Network",
 		"Network.Connection",
@@ -76,6 +78,10 @@ func isUnmappedMetadataField(key string) bool {
 		"Network.Carrier.MCC",
 		"Network.Carrier.MNC",
 		"Network.Carrier.ICC",
+		"Network.Transport",
+		"Network.IANANumber",
+		"Network.Bytes",
+		"Network.Packets",
 		"Observer",
 		"Observer.EphemeralID",
 		"Observer.Hostname",
@@ -102,6 +108,9 @@ func isUnmappedMetadataField(key string) bool {
 		"Event",
 		"Event.Duration",
 		"Event.Outcome",
+		"Event.Action",
+		"Event.Dataset",
+		"Event.Module",
 		"Service.Origin",
 		"Service.Origin.ID",
 		"Service.Origin.Name",
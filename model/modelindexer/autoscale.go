@@ -0,0 +1,95 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// autoScaler adjusts the number of bulk request buffers, and thereby the
+// number of bulk requests which may be flushing concurrently, according
+// to a moving average of the flush latency.
+//
+// The number of buffers is raised when an event is added and no buffer is
+// available, as long as the average latency is below the threshold. It is
+// lowered when a flush completes with the average latency above it.
+type autoScaler struct {
+	min       int64
+	max       int64
+	threshold int64 // nanoseconds
+
+	buffers int64 // accessed atomically
+	latency int64 // nanoseconds; accessed atomically
+}
+
+func newAutoScaler(min, max int, threshold time.Duration) *autoScaler {
+	return &autoScaler{
+		min:       int64(min),
+		max:       int64(max),
+		threshold: int64(threshold),
+		buffers:   int64(min),
+	}
+}
+
+// limit returns the current number of buffers.
+func (s *autoScaler) limit() int64 {
+	return atomic.LoadInt64(&s.buffers)
+}
+
+// grow reports whether a new buffer may be created, in which
+// case the number of buffers is incremented.
+func (s *autoScaler) grow() bool {
+	if atomic.LoadInt64(&s.latency) >= s.threshold {
+		return false
+	}
+	for {
+		n := atomic.LoadInt64(&s.buffers)
+		if n >= s.max {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.buffers, n, n+1) {
+			return true
+		}
+	}
+}
+
+// release records the latency of a completed flush, and reports whether
+// its buffer should be discarded, in which case the number of buffers is
+// decremented.
+func (s *autoScaler) release(d time.Duration) bool {
+	// Weight the latest observation by 1/4.
+	for {
+		old := atomic.LoadInt64(&s.latency)
+		if atomic.CompareAndSwapInt64(&s.latency, old, old+(int64(d)-old)/4) {
+			break
+		}
+	}
+	if atomic.LoadInt64(&s.latency) <= s.threshold {
+		return false
+	}
+	for {
+		n := atomic.LoadInt64(&s.buffers)
+		if n <= s.min {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.buffers, n, n-1) {
+			return true
+		}
+	}
+}
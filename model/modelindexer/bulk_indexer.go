@@ -19,10 +19,13 @@ package modelindexer
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
-	"fmt"
+	"io"
+	"net/http"
 	"strconv"
+	"sync"
 
 	"github.com/elastic/go-elasticsearch/v7/esapi"
 
@@ -47,25 +50,91 @@ import (
 // maximum possible size, based on configuration and throughput.
 
 type bulkIndexer struct {
-	client     elasticsearch.Client
-	itemsAdded int
-	buf        bytes.Buffer
-	aux        []byte
+	compressionLevel int
+	items            []bufferedItem
+	buf              bytes.Buffer
+	gzipBuf          bytes.Buffer
+	aux              []byte
+	added            int // number of items added since Reset
+
+	// incremental controls whether items are compressed as they are
+	// added, rather than when the request is flushed, so that the
+	// compressed length of the request is known before flushing.
+	incremental bool
+	gzipWriter  *gzip.Writer // non-nil while compressing incrementally
+	compressed  bool         // gzipBuf holds the complete compressed buffer
+
+	// header holds additional headers to set on bulk requests.
+	header http.Header
+
+	// seqs holds the disk queue sequence numbers of the items added,
+	// if any. seqs is not modified by Retain, so that all of the items
+	// added may be acknowledged once the request is complete.
+	seqs []uint64
+
+	// waiters holds the ProcessBatchSync callers waiting for the results
+	// of the items added, if any, and errs holds the errors of the items
+	// which failed to be indexed, keyed by position.
+	waiters []syncWaiter
+	errs    map[int]error
+}
+
+// bulkIndexerItem holds an item to be added to a bulk request.
+type bulkIndexerItem struct {
+	Index        string
+	Action       string
+	DocumentID   string
+	Pipeline     string
+	Routing      string
+	RequireAlias bool
+	Version      int64
+	VersionType  string // version is only sent if VersionType is non-empty
+	TimeSeries   bool   // created without an ID in a time series data stream
+	Body         io.Reader
+}
+
+// bufferedItem records the location, target index, and position of an item
+// in the buffer, so that bulk response items may be correlated with the
+// documents they refer to.
+type bufferedItem struct {
+	offset     int // offset of the item's action line in the buffer
+	index      string
+	position   int  // position at which the item was added, preserved by Retain
+	timeSeries bool // see bulkIndexerItem.TimeSeries
 }
 
-func newBulkIndexer(client elasticsearch.Client) *bulkIndexer {
-	return &bulkIndexer{client: client}
+// bulkFilterPath holds the filter_path for bulk requests, limiting the
+// response to the fields inspected by Indexer. Each item's status is always
+// present, so the filtered items still correspond to the request items by
+// position; the error is present only for failed items.
+var bulkFilterPath = []string{"took", "errors", "items.*.error", "items.*.status"}
+
+// gzipWriterPools holds a pool of gzip.Writers for each compression level.
+var gzipWriterPools [gzip.BestCompression + 1]sync.Pool
+
+func newBulkIndexer(compressionLevel int) *bulkIndexer {
+	return &bulkIndexer{compressionLevel: compressionLevel}
 }
 
 // BulkIndexer resets b, ready for a new request.
 func (b *bulkIndexer) Reset() {
-	b.itemsAdded = 0
+	b.items = b.items[:0]
+	b.added = 0
+	b.seqs = b.seqs[:0]
+	b.waiters = b.waiters[:0]
+	b.errs = nil
 	b.buf.Reset()
+	b.gzipBuf.Reset()
+	b.compressed = false
+	if b.gzipWriter != nil {
+		gzipWriterPools[b.compressionLevel].Put(b.gzipWriter)
+		b.gzipWriter = nil
+	}
 }
 
 // Added returns the number of buffered items.
 func (b *bulkIndexer) Items() int {
-	return b.itemsAdded
+	return len(b.items)
 }
 
 // Len returns the number of buffered bytes.
@@ -73,58 +142,215 @@ func (b *bulkIndexer) Len() int {
 	return b.buf.Len()
 }
 
-// Add encodes an item in the buffer.
-func (b *bulkIndexer) Add(item elasticsearch.BulkIndexerItem) error {
+// BodyLen returns the number of bytes in the body of the most
+// recent bulk request, after compression if enabled.
+func (b *bulkIndexer) BodyLen() int {
+	if b.compressionLevel != gzip.NoCompression {
+		return b.gzipBuf.Len()
+	}
+	return b.buf.Len()
+}
+
+// CompressedLen returns the number of compressed bytes buffered when
+// compressing incrementally, and zero otherwise.
+//
+// The compressor holds back some of its input until it has enough to
+// emit a block, so CompressedLen lags behind the final compressed length
+// of the request by up to the compressor's window size.
+func (b *bulkIndexer) CompressedLen() int {
+	if !b.incremental {
+		return 0
+	}
+	return b.gzipBuf.Len()
+}
+
+// Add encodes an item in the buffer, returning the number of bytes added.
+//
+// The item's body is fully consumed and copied into the buffer, so bodies
+// such as pooledReader may be released once Add returns. The buffered bulk
+// request may then be sent any number of times with Flush, to one or more
+// clients, without re-encoding the items.
+func (b *bulkIndexer) Add(item bulkIndexerItem) (int, error) {
+	offset := b.buf.Len()
 	b.writeMeta(item)
 	if _, err := b.buf.ReadFrom(item.Body); err != nil {
-		return err
+		b.buf.Truncate(offset)
+		return 0, err
 	}
 	b.buf.WriteRune('\n')
-	b.itemsAdded++
-	return nil
+	if b.incremental && b.compressionLevel != gzip.NoCompression {
+		if err := b.compressItem(b.buf.Bytes()[offset:]); err != nil {
+			b.buf.Truncate(offset)
+			return 0, err
+		}
+	}
+	b.items = append(b.items, bufferedItem{
+		offset:     offset,
+		index:      item.Index,
+		position:   b.added,
+		timeSeries: item.TimeSeries,
+	})
+	b.added++
+	return b.buf.Len() - offset, nil
+}
+
+// Index returns the target index of the buffered item at position i.
+func (b *bulkIndexer) Index(i int) string {
+	return b.items[i].index
 }
 
-func (b *bulkIndexer) writeMeta(item elasticsearch.BulkIndexerItem) {
+// TimeSeries reports whether the buffered item at position i was added
+// as a time series document without an ID.
+func (b *bulkIndexer) TimeSeries(i int) bool {
+	return b.items[i].timeSeries
+}
+
+// Position returns the position at which the buffered item currently at
+// position i was originally added, counting from zero. This differs from i
+// once items have been discarded by Retain.
+func (b *bulkIndexer) Position(i int) int {
+	return b.items[i].position
+}
+
+func (b *bulkIndexer) writeMeta(item bulkIndexerItem) {
 	b.buf.WriteRune('{')
 	b.aux = strconv.AppendQuote(b.aux, item.Action)
 	b.buf.Write(b.aux)
 	b.aux = b.aux[:0]
 	b.buf.WriteRune(':')
 	b.buf.WriteRune('{')
-	if item.DocumentID != "" {
-		b.buf.WriteString(`"_id":`)
-		b.aux = strconv.AppendQuote(b.aux, item.DocumentID)
+	var fields int
+	b.writeMetaField(&fields, `"_id":`, item.DocumentID)
+	b.writeMetaField(&fields, `"_index":`, item.Index)
+	b.writeMetaField(&fields, `"pipeline":`, item.Pipeline)
+	b.writeMetaField(&fields, `"routing":`, item.Routing)
+	if item.VersionType != "" {
+		if fields > 0 {
+			b.buf.WriteRune(',')
+		}
+		b.buf.WriteString(`"version":`)
+		b.aux = strconv.AppendInt(b.aux, item.Version, 10)
 		b.buf.Write(b.aux)
 		b.aux = b.aux[:0]
+		fields++
+		b.writeMetaField(&fields, `"version_type":`, item.VersionType)
 	}
-	if item.Index != "" {
-		if item.DocumentID != "" {
+	if item.RequireAlias {
+		if fields > 0 {
 			b.buf.WriteRune(',')
 		}
-		b.buf.WriteString(`"_index":`)
-		b.aux = strconv.AppendQuote(b.aux, item.Index)
-		b.buf.Write(b.aux)
-		b.aux = b.aux[:0]
+		b.buf.WriteString(`"require_alias":true`)
 	}
 	b.buf.WriteRune('}')
 	b.buf.WriteRune('}')
 	b.buf.WriteRune('\n')
 }
 
-// Flush executes a bulk request if there are any items buffered, and clears out the buffer.
-func (b *bulkIndexer) Flush(ctx context.Context) (elasticsearch.BulkIndexerResponse, error) {
-	if b.itemsAdded == 0 {
+// writeMetaField writes a quoted action metadata field if value is non-empty,
+// preceded by a comma if any fields have been written already.
+func (b *bulkIndexer) writeMetaField(fields *int, key, value string) {
+	if value == "" {
+		return
+	}
+	if *fields > 0 {
+		b.buf.WriteRune(',')
+	}
+	b.buf.WriteString(key)
+	b.aux = strconv.AppendQuote(b.aux, value)
+	b.buf.Write(b.aux)
+	b.aux = b.aux[:0]
+	*fields++
+}
+
+// Document returns the encoded document of the buffered item at position i.
+//
+// The returned slice refers to the buffer, and is only valid until the
+// next call to a method that modifies the buffer.
+func (b *bulkIndexer) Document(i int) []byte {
+	item := b.Item(i)
+	// Skip the action line, and trim the trailing newlines.
+	if n := bytes.IndexByte(item, '\n'); n >= 0 {
+		item = item[n+1:]
+	}
+	return bytes.TrimRight(item, "\n")
+}
+
+// Item returns the action line and document of the buffered item at
+// position i, each followed by a newline.
+//
+// The returned slice refers to the buffer, and is only valid until the
+// next call to a method that modifies the buffer.
+func (b *bulkIndexer) Item(i int) []byte {
+	data := b.buf.Bytes()
+	end := len(data)
+	if i+1 < len(b.items) {
+		end = b.items[i+1].offset
+	}
+	return data[b.items[i].offset:end]
+}
+
+// Retain discards all buffered items except for those at the given indices,
+// which must be in ascending order. Retain is used to retry a subset of the
+// items after a flush.
+func (b *bulkIndexer) Retain(indices []int) {
+	data := b.buf.Bytes()
+	var n int
+	for i, index := range indices {
+		start := b.items[index].offset
+		end := len(data)
+		if index+1 < len(b.items) {
+			end = b.items[index+1].offset
+		}
+		b.items[i] = b.items[index]
+		b.items[i].offset = n
+		n += copy(data[n:], data[start:end])
+	}
+	b.items = b.items[:len(indices)]
+	b.buf.Truncate(n)
+	// The retained items must be recompressed in full by the next Flush.
+	b.compressed = false
+}
+
+// Flush executes a bulk request with client if there are any items buffered.
+//
+// Each call to Flush sends the request body from the start of the buffer.
+// The buffer is left intact, so that items may be retried with Retain;
+// the caller is responsible for calling Reset.
+func (b *bulkIndexer) Flush(ctx context.Context, client esapi.Transport) (elasticsearch.BulkIndexerResponse, error) {
+	if len(b.items) == 0 {
 		return elasticsearch.BulkIndexerResponse{}, nil
 	}
 
-	req := esapi.BulkRequest{Body: &b.buf}
-	res, err := req.Do(ctx, b.client)
+	req := esapi.BulkRequest{
+		Body:       bytes.NewReader(b.buf.Bytes()),
+		FilterPath: bulkFilterPath,
+	}
+	if b.compressionLevel != gzip.NoCompression {
+		body, err := b.compress()
+		if err != nil {
+			return elasticsearch.BulkIndexerResponse{}, err
+		}
+		req.Body = body
+		req.Header = http.Header{"Content-Encoding": []string{"gzip"}}
+	}
+	if len(b.header) > 0 {
+		if req.Header == nil {
+			req.Header = make(http.Header, len(b.header))
+		}
+		for key, values := range b.header {
+			req.Header[key] = values
+		}
+	}
+	res, err := req.Do(ctx, client)
 	if err != nil {
 		return elasticsearch.BulkIndexerResponse{}, err
 	}
 	defer res.Body.Close()
 	if res.IsError() {
-		return elasticsearch.BulkIndexerResponse{}, fmt.Errorf("flush failed: %s", res.String())
+		return elasticsearch.BulkIndexerResponse{}, &FlushError{
+			StatusCode: res.StatusCode,
+			Message:    res.String(),
+		}
 	}
 
 	var resp elasticsearch.BulkIndexerResponse
@@ -133,3 +359,62 @@ func (b *bulkIndexer) Flush(ctx context.Context) (elasticsearch.BulkIndexerRespo
 	}
 	return resp, nil
 }
+
+// compress gzip-compresses the buffered items, returning a reader
+// for the compressed bytes.
+//
+// If the items have been compressed incrementally as they were added,
+// compress completes the compressed stream rather than starting over.
+func (b *bulkIndexer) compress() (io.Reader, error) {
+	if b.gzipWriter != nil {
+		w := b.gzipWriter
+		b.gzipWriter = nil
+		defer gzipWriterPools[b.compressionLevel].Put(w)
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		b.compressed = true
+	}
+	if b.compressed {
+		return bytes.NewReader(b.gzipBuf.Bytes()), nil
+	}
+	b.gzipBuf.Reset()
+	w, err := b.getGzipWriter()
+	if err != nil {
+		return nil, err
+	}
+	defer gzipWriterPools[b.compressionLevel].Put(w)
+	if _, err := w.Write(b.buf.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	b.compressed = b.incremental
+	return bytes.NewReader(b.gzipBuf.Bytes()), nil
+}
+
+// compressItem writes an encoded item to the incremental compressor,
+// starting a new compressed stream for the first item added.
+func (b *bulkIndexer) compressItem(data []byte) error {
+	if b.gzipWriter == nil {
+		b.gzipBuf.Reset()
+		w, err := b.getGzipWriter()
+		if err != nil {
+			return err
+		}
+		b.gzipWriter = w
+	}
+	_, err := b.gzipWriter.Write(data)
+	return err
+}
+
+// getGzipWriter returns a pooled gzip.Writer for b's compression level,
+// writing to b.gzipBuf.
+func (b *bulkIndexer) getGzipWriter() (*gzip.Writer, error) {
+	if w, ok := gzipWriterPools[b.compressionLevel].Get().(*gzip.Writer); ok {
+		w.Reset(&b.gzipBuf)
+		return w, nil
+	}
+	return gzip.NewWriterLevel(&b.gzipBuf, b.compressionLevel)
+}
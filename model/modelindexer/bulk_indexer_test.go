@@ -0,0 +1,358 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/elasticsearch"
+	"github.com/elastic/apm-server/model"
+)
+
+func TestBulkIndexerWriteMeta(t *testing.T) {
+	for name, tc := range map[string]struct {
+		item     bulkIndexerItem
+		expected string
+	}{
+		"index": {
+			item:     bulkIndexerItem{Action: "create", Index: "logs-apm_server-testing"},
+			expected: `{"create":{"_index":"logs-apm_server-testing"}}`,
+		},
+		"id": {
+			item:     bulkIndexerItem{Action: "index", Index: "logs-apm_server-testing", DocumentID: "abc"},
+			expected: `{"index":{"_id":"abc","_index":"logs-apm_server-testing"}}`,
+		},
+		"pipeline": {
+			item:     bulkIndexerItem{Action: "create", Index: "logs-apm_server-testing", Pipeline: "my-pipeline"},
+			expected: `{"create":{"_index":"logs-apm_server-testing","pipeline":"my-pipeline"}}`,
+		},
+		"routing": {
+			item:     bulkIndexerItem{Action: "create", Index: "custom-index", Routing: "user-1"},
+			expected: `{"create":{"_index":"custom-index","routing":"user-1"}}`,
+		},
+		"require_alias": {
+			item:     bulkIndexerItem{Action: "create", Index: "logs-apm_server-testing", RequireAlias: true},
+			expected: `{"create":{"_index":"logs-apm_server-testing","require_alias":true}}`,
+		},
+		"require_alias_only": {
+			item:     bulkIndexerItem{Action: "create", RequireAlias: true},
+			expected: `{"create":{"require_alias":true}}`,
+		},
+		"version": {
+			item:     bulkIndexerItem{Action: "index", Index: "logs-apm_server-testing", DocumentID: "abc", Version: 42, VersionType: "external"},
+			expected: `{"index":{"_id":"abc","_index":"logs-apm_server-testing","version":42,"version_type":"external"}}`,
+		},
+		"version_zero": {
+			item:     bulkIndexerItem{Action: "index", DocumentID: "abc", Version: 0, VersionType: "external"},
+			expected: `{"index":{"_id":"abc","version":0,"version_type":"external"}}`,
+		},
+		"version_only": {
+			item:     bulkIndexerItem{Action: "index", Version: 1, VersionType: "external"},
+			expected: `{"index":{"version":1,"version_type":"external"}}`,
+		},
+		"id_pipeline": {
+			item:     bulkIndexerItem{Action: "create", Index: "logs-apm_server-testing", DocumentID: "abc", Pipeline: "my-pipeline"},
+			expected: `{"create":{"_id":"abc","_index":"logs-apm_server-testing","pipeline":"my-pipeline"}}`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			indexer := newBulkIndexer(gzip.NoCompression)
+			indexer.writeMeta(tc.item)
+			assert.Equal(t, tc.expected+"\n", indexer.buf.String())
+		})
+	}
+}
+
+func TestBulkIndexerAdd(t *testing.T) {
+	indexer := newBulkIndexer(gzip.NoCompression)
+	var total int
+	for _, body := range []string{`{"a":1}`, `{"b":"two"}`} {
+		n, err := indexer.Add(bulkIndexerItem{
+			Index:  "logs-apm_server-testing",
+			Action: "create",
+			Body:   strings.NewReader(body),
+		})
+		require.NoError(t, err)
+		assert.Equal(t, len(`{"create":{"_index":"logs-apm_server-testing"}}`)+len(body)+2, n)
+		total += n
+	}
+	assert.Equal(t, indexer.Len(), total)
+}
+
+func TestBulkIndexerRetainPosition(t *testing.T) {
+	indexer := newBulkIndexer(gzip.NoCompression)
+	for _, index := range []string{"a", "b", "c", "d"} {
+		_, err := indexer.Add(bulkIndexerItem{
+			Index:  index,
+			Action: "create",
+			Body:   strings.NewReader(`{}`),
+		})
+		require.NoError(t, err)
+	}
+	indexer.Retain([]int{1, 3})
+	require.Equal(t, 2, indexer.Items())
+	assert.Equal(t, "b", indexer.Index(0))
+	assert.Equal(t, 1, indexer.Position(0))
+	assert.Equal(t, "d", indexer.Index(1))
+	assert.Equal(t, 3, indexer.Position(1))
+
+	// Positions are preserved by subsequent calls to Retain.
+	indexer.Retain([]int{1})
+	assert.Equal(t, "d", indexer.Index(0))
+	assert.Equal(t, 3, indexer.Position(0))
+
+	// Positions restart from zero after Reset.
+	indexer.Reset()
+	_, err := indexer.Add(bulkIndexerItem{Index: "e", Action: "create", Body: strings.NewReader(`{}`)})
+	require.NoError(t, err)
+	assert.Equal(t, 0, indexer.Position(0))
+}
+
+func TestBulkIndexerFlushReplay(t *testing.T) {
+	for _, level := range []int{gzip.NoCompression, gzip.BestSpeed} {
+		t.Run(fmt.Sprint(level), func(t *testing.T) {
+			var bodies []string
+			transport := transportFunc(func(req *http.Request) (*http.Response, error) {
+				var body io.Reader = req.Body
+				if req.Header.Get("Content-Encoding") == "gzip" {
+					r, err := gzip.NewReader(req.Body)
+					require.NoError(t, err)
+					body = r
+				}
+				data, err := io.ReadAll(body)
+				require.NoError(t, err)
+				bodies = append(bodies, string(data))
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader(`{"items":[{"create":{"status":201}}]}`)),
+				}, nil
+			})
+
+			r := defaultReaderPool.get()
+			r.buf.WriteString(`{"a":1}`)
+			indexer := newBulkIndexer(level)
+			_, err := indexer.Add(bulkIndexerItem{Index: "logs-apm_server-testing", Action: "create", Body: r})
+			require.NoError(t, err)
+
+			// The request body is replayed in full for each flush.
+			for i := 0; i < 2; i++ {
+				_, err := indexer.Flush(context.Background(), transport)
+				require.NoError(t, err)
+			}
+			expected := `{"create":{"_index":"logs-apm_server-testing"}}` + "\n" + `{"a":1}` + "\n"
+			assert.Equal(t, []string{expected, expected}, bodies)
+		})
+	}
+}
+
+func TestBulkIndexerIncrementalCompression(t *testing.T) {
+	var bodies []string
+	transport := transportFunc(func(req *http.Request) (*http.Response, error) {
+		r, err := gzip.NewReader(req.Body)
+		require.NoError(t, err)
+		data, err := io.ReadAll(r)
+		require.NoError(t, err)
+		bodies = append(bodies, string(data))
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader(`{"items":[]}`)),
+		}, nil
+	})
+
+	indexer := newBulkIndexer(gzip.BestSpeed)
+	indexer.incremental = true
+	assert.Equal(t, 0, indexer.CompressedLen())
+	for i := 0; indexer.CompressedLen() <= 10; i++ {
+		require.Less(t, i, 100000, "compressed length not increasing")
+		_, err := indexer.Add(bulkIndexerItem{
+			Index:  "logs-apm_server-testing",
+			Action: "create",
+			Body:   strings.NewReader(fmt.Sprintf(`{"i":%d}`, i)),
+		})
+		require.NoError(t, err)
+	}
+	// The compressed length lags behind the buffered length,
+	// but is known before the request is flushed.
+	assert.Less(t, indexer.CompressedLen(), indexer.Len())
+	expected := indexer.buf.String()
+
+	// The incrementally compressed body is completed by the first
+	// flush, and replayed as-is by subsequent flushes.
+	for i := 0; i < 2; i++ {
+		_, err := indexer.Flush(context.Background(), transport)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{expected, expected}, bodies)
+	assert.Equal(t, indexer.BodyLen(), indexer.CompressedLen())
+
+	// Retained items are compressed again in full.
+	indexer.Retain([]int{1})
+	_, err := indexer.Flush(context.Background(), transport)
+	require.NoError(t, err)
+	require.Len(t, bodies, 3)
+	assert.Equal(t, string(indexer.Item(0)), bodies[2])
+
+	// Reset starts a new compressed stream.
+	indexer.Reset()
+	assert.Equal(t, 0, indexer.CompressedLen())
+	_, err = indexer.Add(bulkIndexerItem{Index: "logs-apm_server-testing", Action: "create", Body: strings.NewReader(`{}`)})
+	require.NoError(t, err)
+	_, err = indexer.Flush(context.Background(), transport)
+	require.NoError(t, err)
+	require.Len(t, bodies, 4)
+	assert.Equal(t, indexer.buf.String(), bodies[3])
+}
+
+func TestBulkIndexerFilterPath(t *testing.T) {
+	var filterPath string
+	transport := transportFunc(func(req *http.Request) (*http.Response, error) {
+		filterPath = req.URL.Query().Get("filter_path")
+		// Successful items hold only their status in filtered responses.
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body: io.NopCloser(strings.NewReader(`{"took":3,"errors":true,"items":[` +
+				`{"create":{"status":201}},` +
+				`{"create":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}` +
+				`]}`)),
+		}, nil
+	})
+	indexer := newBulkIndexer(gzip.NoCompression)
+	for i := 0; i < 2; i++ {
+		_, err := indexer.Add(bulkIndexerItem{Index: "logs-apm_server-testing", Action: "create", Body: strings.NewReader(`{}`)})
+		require.NoError(t, err)
+	}
+	resp, err := indexer.Flush(context.Background(), transport)
+	require.NoError(t, err)
+	assert.Equal(t, "took,errors,items.*.error,items.*.status", filterPath)
+	assert.Equal(t, 3, resp.Took)
+	assert.True(t, resp.HasErrors)
+	require.Len(t, resp.Items, 2)
+	assert.Equal(t, http.StatusCreated, resp.Items[0]["create"].Status)
+	assert.Equal(t, http.StatusBadRequest, resp.Items[1]["create"].Status)
+	assert.Equal(t, "mapper_parsing_exception", resp.Items[1]["create"].Error.Type)
+}
+
+type transportFunc func(*http.Request) (*http.Response, error)
+
+func (f transportFunc) Perform(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func BenchmarkBulkIndexerCompress(b *testing.B) {
+	const bufferSize = 5 * 1024 * 1024
+	event := model.APMEvent{
+		Timestamp: time.Now(),
+		Processor: model.TransactionProcessor,
+		Agent:     model.Agent{Name: "go", Version: "1.14.0"},
+		Service: model.Service{
+			Name:        "opbeans-go",
+			Version:     "1.0.0",
+			Environment: "production",
+			Language:    model.Language{Name: "go", Version: "1.17"},
+		},
+		Host:  model.Host{Hostname: "opbeans-go-7d4f6c5b9-xk2lp", OS: model.OS{Platform: "linux"}},
+		Trace: model.Trace{ID: "0acd456789abcdef0123456789abcdef"},
+		Transaction: &model.Transaction{
+			ID:      "0123456789abcdef",
+			Name:    "GET /api/products/:id",
+			Type:    "request",
+			Result:  "HTTP 2xx",
+			Sampled: true,
+		},
+		Event:      model.Event{Duration: 12500 * time.Microsecond},
+		DataStream: model.DataStream{Type: "traces", Dataset: "apm", Namespace: "default"},
+	}
+
+	indexer := newBulkIndexer(gzip.NoCompression)
+	for indexer.Len() < bufferSize {
+		r := defaultReaderPool.get()
+		beatEvent := event.BeatEvent(context.Background())
+		require.NoError(b, r.encoder.AddRaw(&beatEvent))
+		_, err := indexer.Add(bulkIndexerItem{
+			Index:  "traces-apm-default",
+			Action: "create",
+			Body:   r,
+		})
+		require.NoError(b, err)
+	}
+
+	for level := gzip.NoCompression; level <= gzip.BestCompression; level++ {
+		b.Run(fmt.Sprint(level), func(b *testing.B) {
+			indexer.compressionLevel = level
+			b.SetBytes(int64(indexer.Len()))
+			b.ReportAllocs()
+			var wireBytes int64
+			for i := 0; i < b.N; i++ {
+				var body io.Reader = bytes.NewReader(indexer.buf.Bytes())
+				if level != gzip.NoCompression {
+					var err error
+					if body, err = indexer.compress(); err != nil {
+						b.Fatal(err)
+					}
+				}
+				n, err := io.Copy(io.Discard, body)
+				if err != nil {
+					b.Fatal(err)
+				}
+				wireBytes = n
+			}
+			b.ReportMetric(float64(wireBytes), "wire_bytes")
+		})
+	}
+}
+
+func BenchmarkBulkResponseDecode(b *testing.B) {
+	const items = 10000
+	full := `{"create":{"_index":"traces-apm-default","_id":"8GbJ4n4BVi7kW8bNzHAy","_version":1,` +
+		`"result":"created","_shards":{"total":2,"successful":1,"failed":0},` +
+		`"_seq_no":123456,"_primary_term":1,"status":201}}`
+	filtered := `{"create":{"status":201}}`
+	for name, item := range map[string]string{"full": full, "filtered": filtered} {
+		var buf bytes.Buffer
+		buf.WriteString(`{"took":42,"errors":false,"items":[`)
+		for i := 0; i < items; i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(item)
+		}
+		buf.WriteString(`]}`)
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(buf.Len()))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var resp elasticsearch.BulkIndexerResponse
+				if err := json.NewDecoder(bytes.NewReader(buf.Bytes())).Decode(&resp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
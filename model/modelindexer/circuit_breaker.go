@@ -0,0 +1,98 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"sync"
+	"time"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker tracks consecutive failed bulk requests, tripping
+// after a threshold is reached and rejecting events until a cool-down
+// period has elapsed.
+//
+// After the cool-down the breaker is half-open: events are accepted,
+// and the breaker closes after the next successful bulk request or
+// trips again after the next failed one.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown}
+}
+
+// allow reports whether events may be added, half-opening
+// the breaker if it is open and the cool-down has elapsed.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitOpen && time.Since(b.openedAt) >= b.cooldown {
+		b.state = circuitHalfOpen
+	}
+	return b.state != circuitOpen
+}
+
+// isOpen reports whether the breaker is open, and events are
+// being rejected.
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == circuitOpen && time.Since(b.openedAt) < b.cooldown
+}
+
+// success records a successful bulk request, closing the breaker.
+func (b *circuitBreaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.state = circuitClosed
+	b.failures = 0
+}
+
+// failure records a failed bulk request, reporting whether the
+// breaker tripped as a result.
+func (b *circuitBreaker) failure() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == circuitOpen {
+		// Requests flushed before the breaker tripped may still be failing.
+		return false
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.threshold {
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+		b.failures = 0
+		return true
+	}
+	return false
+}
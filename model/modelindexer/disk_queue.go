@@ -0,0 +1,585 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	diskQueueSegmentSuffix = ".seg"
+	diskQueueCheckpoint    = "checkpoint"
+
+	// diskQueueHeaderSize holds the size of each entry's header:
+	// the length and checksum of its data.
+	diskQueueHeaderSize = 8
+
+	// diskQueueMaxEntryBytes holds the maximum size of an entry's data,
+	// guarding against allocating for a corrupt length.
+	diskQueueMaxEntryBytes = 1 << 30
+
+	// diskQueueTimeSeries is set in an entry's flags if its item was
+	// created without an ID in a time series data stream.
+	diskQueueTimeSeries = 1 << 0
+)
+
+// diskQueueSegmentBytes holds the size beyond which the disk queue's
+// last segment is rotated. It is a variable for testing.
+var diskQueueSegmentBytes int64 = 64 * 1024 * 1024
+
+// diskQueueSync syncs a segment file to disk. It is a variable for testing.
+var diskQueueSync = (*os.File).Sync
+
+var (
+	diskQueueCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errDiskQueueCorrupt = errors.New("disk queue entry is corrupt")
+)
+
+// diskQueue is a durable, file-based FIFO queue of encoded bulk items, for
+// delivering events to Elasticsearch at least once across restarts.
+//
+// The queue is stored in a directory of segment files and a checkpoint
+// file. Entries are numbered consecutively from 1 in the order they are
+// appended. Each segment is named after the sequence number of its first
+// entry, as 20 zero-padded decimal digits with the ".seg" suffix, and
+// holds entries of the form:
+//
+//	length   uint32, big-endian: the number of bytes in data
+//	checksum uint32, big-endian: the CRC-32 (Castagnoli) checksum of data
+//	data     a flags byte, followed by the item's bulk action line and
+//	         document, each followed by a newline
+//
+// The flags byte holds item state not recorded in the action line:
+// diskQueueTimeSeries is set for items created without an ID in a time
+// series data stream, so their version conflicts are counted the same way
+// whether or not they were queued; see Config.TimeSeries.
+//
+// Entries are appended to the last segment, which is rotated when it would
+// exceed diskQueueSegmentBytes, and synced to disk before being delivered.
+// The checkpoint file holds the sequence number of the oldest entry which
+// has not been acknowledged, in decimal. Segments holding only acknowledged
+// entries are removed.
+//
+// When the queue is opened, entries from the checkpoint onwards are
+// delivered again, so entries delivered but not acknowledged before a crash
+// are delivered again. An incomplete or corrupt entry at the end of the last
+// segment, left by a crash while appending, is truncated. A missing or
+// invalid checkpoint is treated as acknowledging no entries in the remaining
+// segments.
+type diskQueue struct {
+	dir      string
+	maxBytes int64
+
+	mu       sync.Mutex
+	segments []diskQueueSegment // oldest first
+	bytes    int64              // total size of segments
+	w        *os.File           // last segment; nil once closed
+	wbuf     []byte
+	nextSeq  uint64              // sequence number of the next entry appended
+	ackSeq   uint64              // sequence number of the oldest unacknowledged entry
+	acked    map[uint64]struct{} // acknowledged entries after ackSeq
+	appended chan struct{}       // closed and replaced when entries are appended
+
+	// The following fields are owned by the goroutine calling next.
+	r       *os.File
+	readSeq uint64 // sequence number of the next entry to read
+	rbuf    []byte
+}
+
+// diskQueueSegment describes a segment file.
+type diskQueueSegment struct {
+	first uint64 // sequence number of the first entry
+	size  int64
+}
+
+// openDiskQueue opens the queue stored in dir, creating it if it does not
+// exist. Unacknowledged entries will be delivered again by next.
+//
+// If maxBytes is greater than zero, appending entries will fail with
+// ErrFull while the segments' total size would exceed it.
+func openDiskQueue(dir string, maxBytes int64) (*diskQueue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []diskQueueSegment
+	for _, entry := range dirEntries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, diskQueueSegmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, diskQueueSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, diskQueueSegment{first: first, size: info.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].first < segments[j].first
+	})
+
+	q := &diskQueue{
+		dir:      dir,
+		maxBytes: maxBytes,
+		acked:    make(map[uint64]struct{}),
+		appended: make(chan struct{}),
+	}
+	q.ackSeq = readDiskQueueCheckpoint(dir)
+	if len(segments) == 0 {
+		// Continue numbering from the checkpoint, if any.
+		if q.ackSeq == 0 {
+			q.ackSeq = 1
+		}
+		segments = append(segments, diskQueueSegment{first: q.ackSeq})
+	} else if q.ackSeq < segments[0].first {
+		q.ackSeq = segments[0].first
+	}
+
+	// Find the end of the last segment, truncating any incomplete
+	// or corrupt entry left by a crash while appending.
+	last := &segments[len(segments)-1]
+	q.w, err = os.OpenFile(q.segmentPath(last.first), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	n, size, err := scanDiskQueueSegment(q.w)
+	if err != nil {
+		q.w.Close()
+		return nil, err
+	}
+	if size != last.size {
+		if err := q.w.Truncate(size); err != nil {
+			q.w.Close()
+			return nil, err
+		}
+		last.size = size
+	}
+	if _, err := q.w.Seek(size, io.SeekStart); err != nil {
+		q.w.Close()
+		return nil, err
+	}
+	q.nextSeq = last.first + n
+	if q.ackSeq > q.nextSeq {
+		q.w.Close()
+		return nil, fmt.Errorf(
+			"disk queue checkpoint %d is beyond the last entry %d",
+			q.ackSeq, q.nextSeq-1,
+		)
+	}
+	q.segments = segments
+	for _, segment := range segments {
+		q.bytes += segment.size
+	}
+	q.readSeq = q.ackSeq
+	if err := q.removeAckedSegmentsLocked(); err != nil {
+		q.w.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// scanDiskQueueSegment reads the entries of the segment r from the start,
+// returning the number of valid entries and the size they occupy. Reading
+// stops at the first incomplete or corrupt entry.
+func scanDiskQueueSegment(r io.Reader) (entries uint64, size int64, err error) {
+	var buf []byte
+	for {
+		data, err := readDiskQueueEntry(r, &buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errDiskQueueCorrupt {
+			return entries, size, nil
+		} else if err != nil {
+			return 0, 0, err
+		}
+		entries++
+		size += int64(diskQueueHeaderSize + len(data))
+	}
+}
+
+// readDiskQueueEntry reads an entry from r, returning its data. The data is
+// read into *buf, which is grown as necessary, and is only valid until the
+// next call with buf. readDiskQueueEntry returns io.EOF if there are no more
+// entries, io.ErrUnexpectedEOF if the entry is incomplete, and
+// errDiskQueueCorrupt if its checksum does not match.
+func readDiskQueueEntry(r io.Reader, buf *[]byte) ([]byte, error) {
+	var header [diskQueueHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	checksum := binary.BigEndian.Uint32(header[4:])
+	if length > diskQueueMaxEntryBytes {
+		return nil, errDiskQueueCorrupt
+	}
+	if cap(*buf) < int(length) {
+		*buf = make([]byte, length)
+	}
+	data := (*buf)[:length]
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if crc32.Checksum(data, diskQueueCRCTable) != checksum {
+		return nil, errDiskQueueCorrupt
+	}
+	return data, nil
+}
+
+// readDiskQueueCheckpoint returns the sequence number held in the
+// checkpoint file in dir, or zero if it is missing or invalid.
+func readDiskQueueCheckpoint(dir string) uint64 {
+	data, err := os.ReadFile(filepath.Join(dir, diskQueueCheckpoint))
+	if err != nil {
+		return 0
+	}
+	seq, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return seq
+}
+
+func (q *diskQueue) segmentPath(first uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", first, diskQueueSegmentSuffix))
+}
+
+// write appends the items buffered in b to the queue as entries, syncing
+// them to disk before making them available to next. The entries of b are
+// written to the same segment.
+//
+// If the queue's size would exceed its maximum, write returns ErrFull. If
+// the queue has been closed, write returns ErrClosed.
+func (q *diskQueue) write(b *bulkIndexer) error {
+	return q.append(b, true)
+}
+
+// requeue appends the items buffered in b to the queue, as with write,
+// regardless of the queue's maximum size. requeue is used for retrying
+// entries which are then acknowledged, so does not grow the queue for
+// long.
+func (q *diskQueue) requeue(b *bulkIndexer) error {
+	return q.append(b, false)
+}
+
+func (q *diskQueue) append(b *bulkIndexer, limit bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.w == nil {
+		return ErrClosed
+	}
+	n := b.Items()
+	size := int64(b.Len() + n*(diskQueueHeaderSize+1))
+	if limit && q.maxBytes > 0 && q.bytes > 0 && q.bytes+size > q.maxBytes {
+		return ErrFull
+	}
+	last := &q.segments[len(q.segments)-1]
+	if last.size > 0 && last.size+size > diskQueueSegmentBytes {
+		if err := q.rotateLocked(); err != nil {
+			return err
+		}
+		last = &q.segments[len(q.segments)-1]
+	}
+
+	q.wbuf = q.wbuf[:0]
+	for i := 0; i < n; i++ {
+		// Append the data after space for the header,
+		// which is then filled in from the data.
+		start := len(q.wbuf)
+		q.wbuf = append(q.wbuf, make([]byte, diskQueueHeaderSize)...)
+		q.wbuf = appendQueuedItem(q.wbuf, b, i)
+		header := q.wbuf[start : start+diskQueueHeaderSize]
+		data := q.wbuf[start+diskQueueHeaderSize:]
+		binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+		binary.BigEndian.PutUint32(header[4:], crc32.Checksum(data, diskQueueCRCTable))
+	}
+	if _, err := q.w.Write(q.wbuf); err != nil {
+		return q.discardLocked(last.size, err)
+	}
+	if err := diskQueueSync(q.w); err != nil {
+		return q.discardLocked(last.size, err)
+	}
+	last.size += size
+	q.bytes += size
+	q.nextSeq += uint64(n)
+	close(q.appended)
+	q.appended = make(chan struct{})
+	return nil
+}
+
+// discardLocked truncates the last segment to size, discarding any entries
+// written by an append which failed with err, and returns err. If the entries
+// cannot be discarded the queue is closed, as entries appended after them
+// would otherwise be delivered with the wrong sequence numbers.
+func (q *diskQueue) discardLocked(size int64, err error) error {
+	discardErr := q.w.Truncate(size)
+	if discardErr == nil {
+		_, discardErr = q.w.Seek(size, io.SeekStart)
+	}
+	if discardErr != nil {
+		q.w.Close()
+		q.w = nil
+		return fmt.Errorf("%w (closing disk queue: %v)", err, discardErr)
+	}
+	return err
+}
+
+// rotateLocked closes the last segment, and creates a new one.
+func (q *diskQueue) rotateLocked() error {
+	f, err := os.OpenFile(q.segmentPath(q.nextSeq), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := q.w.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	q.w = f
+	q.segments = append(q.segments, diskQueueSegment{first: q.nextSeq})
+	return nil
+}
+
+// next returns the data and sequence number of the next entry in the queue,
+// waiting for one to be appended if necessary, or until ctx is done. The
+// data is only valid until the next call to next.
+//
+// next must not be called concurrently.
+func (q *diskQueue) next(ctx context.Context) ([]byte, uint64, error) {
+	for {
+		q.mu.Lock()
+		available := q.readSeq < q.nextSeq
+		appended := q.appended
+		q.mu.Unlock()
+		if available {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-appended:
+		}
+	}
+	if q.r == nil {
+		if err := q.openReader(); err != nil {
+			return nil, 0, err
+		}
+	}
+	data, err := readDiskQueueEntry(q.r, &q.rbuf)
+	if err == io.EOF {
+		// The entry is the first of the next segment.
+		q.r.Close()
+		q.r = nil
+		if err := q.openReader(); err != nil {
+			return nil, 0, err
+		}
+		data, err = readDiskQueueEntry(q.r, &q.rbuf)
+	}
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errDiskQueueCorrupt
+		}
+		return nil, 0, fmt.Errorf("failed to read disk queue entry %d: %w", q.readSeq, err)
+	}
+	seq := q.readSeq
+	q.readSeq++
+	return data, seq, nil
+}
+
+// openReader opens the segment holding the entry numbered q.readSeq,
+// positioned at that entry.
+func (q *diskQueue) openReader() error {
+	q.mu.Lock()
+	var segment diskQueueSegment
+	for _, s := range q.segments {
+		if s.first > q.readSeq {
+			break
+		}
+		segment = s
+	}
+	q.mu.Unlock()
+	f, err := os.Open(q.segmentPath(segment.first))
+	if err != nil {
+		return err
+	}
+	for seq := segment.first; seq < q.readSeq; seq++ {
+		if _, err := readDiskQueueEntry(f, &q.rbuf); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to skip disk queue entry %d: %w", seq, err)
+		}
+	}
+	q.r = f
+	return nil
+}
+
+// ack acknowledges the entries with the given sequence numbers, which will
+// not be delivered again once all preceding entries are acknowledged.
+func (q *diskQueue) ack(seqs []uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, seq := range seqs {
+		if seq >= q.ackSeq {
+			q.acked[seq] = struct{}{}
+		}
+	}
+	ackSeq := q.ackSeq
+	for {
+		if _, ok := q.acked[q.ackSeq]; !ok {
+			break
+		}
+		delete(q.acked, q.ackSeq)
+		q.ackSeq++
+	}
+	if q.ackSeq == ackSeq {
+		return nil
+	}
+	if err := q.writeCheckpointLocked(); err != nil {
+		return err
+	}
+	return q.removeAckedSegmentsLocked()
+}
+
+// writeCheckpointLocked replaces the checkpoint file. The file is not synced:
+// an outdated checkpoint only causes entries to be delivered again.
+func (q *diskQueue) writeCheckpointLocked() error {
+	path := filepath.Join(q.dir, diskQueueCheckpoint)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(q.ackSeq, 10)), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeAckedSegmentsLocked removes segments holding only acknowledged
+// entries, other than the last segment.
+func (q *diskQueue) removeAckedSegmentsLocked() error {
+	for len(q.segments) > 1 && q.segments[1].first <= q.ackSeq {
+		if err := os.Remove(q.segmentPath(q.segments[0].first)); err != nil {
+			return err
+		}
+		q.bytes -= q.segments[0].size
+		q.segments = q.segments[1:]
+	}
+	return nil
+}
+
+// pending returns the number of entries which have not been acknowledged.
+func (q *diskQueue) pending() int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return int64(q.nextSeq - q.ackSeq)
+}
+
+// close closes the queue's files. Unacknowledged entries will be delivered
+// again when the queue is next opened. close must not be called concurrently
+// with next.
+func (q *diskQueue) close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.r != nil {
+		q.r.Close()
+		q.r = nil
+	}
+	if q.w == nil {
+		return nil
+	}
+	err := q.w.Close()
+	q.w = nil
+	return err
+}
+
+// bulkActionMeta holds the metadata of a bulk action line.
+type bulkActionMeta struct {
+	DocumentID   string `json:"_id"`
+	Index        string `json:"_index"`
+	Pipeline     string `json:"pipeline"`
+	Routing      string `json:"routing"`
+	RequireAlias bool   `json:"require_alias"`
+	Version      int64  `json:"version"`
+	VersionType  string `json:"version_type"`
+}
+
+// appendQueuedItem appends the data of a disk queue entry for the item
+// buffered in b at position i to dst, returning the extended slice.
+func appendQueuedItem(dst []byte, b *bulkIndexer, i int) []byte {
+	var flags byte
+	if b.TimeSeries(i) {
+		flags |= diskQueueTimeSeries
+	}
+	dst = append(dst, flags)
+	return append(dst, b.Item(i)...)
+}
+
+// decodeQueuedItem decodes the data of a disk queue entry as a bulk item.
+// The item's body refers to data.
+func decodeQueuedItem(data []byte) (bulkIndexerItem, error) {
+	if len(data) == 0 {
+		return bulkIndexerItem{}, errors.New("missing disk queue entry flags")
+	}
+	flags := data[0]
+	data = data[1:]
+	n := bytes.IndexByte(data, '\n')
+	if n < 0 {
+		return bulkIndexerItem{}, errors.New("missing bulk action line")
+	}
+	var actions map[string]bulkActionMeta
+	if err := json.Unmarshal(data[:n], &actions); err != nil {
+		return bulkIndexerItem{}, fmt.Errorf("invalid bulk action line: %w", err)
+	}
+	if len(actions) != 1 {
+		return bulkIndexerItem{}, fmt.Errorf("expected 1 bulk action, got %d", len(actions))
+	}
+	var item bulkIndexerItem
+	for action, meta := range actions {
+		item = bulkIndexerItem{
+			Index:        meta.Index,
+			Action:       action,
+			DocumentID:   meta.DocumentID,
+			Pipeline:     meta.Pipeline,
+			Routing:      meta.Routing,
+			RequireAlias: meta.RequireAlias,
+			Version:      meta.Version,
+			VersionType:  meta.VersionType,
+			TimeSeries:   flags&diskQueueTimeSeries != 0,
+		}
+	}
+	// Remove the newline following the document, which is added again
+	// when the item is added to a bulk request.
+	item.Body = bytes.NewReader(bytes.TrimSuffix(data[n+1:], []byte("\n")))
+	return item, nil
+}
@@ -0,0 +1,263 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskQueue(t *testing.T) {
+	q, err := openDiskQueue(t.TempDir(), 0)
+	require.NoError(t, err)
+	defer q.close()
+
+	require.NoError(t, q.write(newQueuedBulkIndexer(t, `{"a":1}`, `{"b":2}`)))
+	require.NoError(t, q.write(newQueuedBulkIndexer(t, `{"c":3}`)))
+	assert.Equal(t, int64(3), q.pending())
+
+	for i, expected := range []string{`{"a":1}`, `{"b":2}`, `{"c":3}`} {
+		data, seq, err := q.next(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i+1), seq)
+		item, err := decodeQueuedItem(data)
+		require.NoError(t, err)
+		assert.Equal(t, "create", item.Action)
+		assert.Equal(t, "logs-apm_server-testing", item.Index)
+		assert.Equal(t, "doc-"+expected, item.DocumentID)
+		body, err := io.ReadAll(item.Body)
+		require.NoError(t, err)
+		assert.Equal(t, expected+"\n", string(body))
+	}
+
+	// next blocks until an entry is appended.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _, err = q.next(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// Entries are acknowledged in order.
+	require.NoError(t, q.ack([]uint64{2}))
+	assert.Equal(t, int64(3), q.pending())
+	require.NoError(t, q.ack([]uint64{1}))
+	assert.Equal(t, int64(1), q.pending())
+	assert.Equal(t, uint64(3), readDiskQueueCheckpoint(q.dir))
+}
+
+func TestDiskQueueRecovery(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openDiskQueue(dir, 0)
+	require.NoError(t, err)
+	require.NoError(t, q.write(newQueuedBulkIndexer(t, `{"a":1}`, `{"b":2}`, `{"c":3}`)))
+	for i := 0; i < 3; i++ {
+		_, _, err := q.next(context.Background())
+		require.NoError(t, err)
+	}
+	require.NoError(t, q.ack([]uint64{1}))
+	require.NoError(t, q.close())
+
+	// Simulate a crash while appending, leaving an incomplete entry.
+	segment := filepath.Join(dir, "00000000000000000001.seg")
+	f, err := os.OpenFile(segment, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 1, 0, 1, 2, 3})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// Unacknowledged entries are delivered again, and the
+	// incomplete entry is truncated.
+	q, err = openDiskQueue(dir, 0)
+	require.NoError(t, err)
+	defer q.close()
+	assert.Equal(t, int64(2), q.pending())
+	require.NoError(t, q.write(newQueuedBulkIndexer(t, `{"d":4}`)))
+	for _, expected := range []string{`{"b":2}`, `{"c":3}`, `{"d":4}`} {
+		data, _, err := q.next(context.Background())
+		require.NoError(t, err)
+		assert.Contains(t, string(data), expected)
+	}
+}
+
+func TestDiskQueueSegments(t *testing.T) {
+	defer func(size int64) { diskQueueSegmentBytes = size }(diskQueueSegmentBytes)
+	diskQueueSegmentBytes = 1
+
+	dir := t.TempDir()
+	q, err := openDiskQueue(dir, 0)
+	require.NoError(t, err)
+	defer q.close()
+
+	// Each write is made to a new segment, as
+	// the last segment exceeds the segment size.
+	for i := 0; i < 3; i++ {
+		require.NoError(t, q.write(newQueuedBulkIndexer(t, `{"a":1}`, `{"b":2}`)))
+	}
+	assert.Equal(t, []string{
+		"00000000000000000001.seg",
+		"00000000000000000003.seg",
+		"00000000000000000005.seg",
+	}, listSegments(t, dir))
+
+	for i := 0; i < 6; i++ {
+		_, _, err := q.next(context.Background())
+		require.NoError(t, err)
+	}
+
+	// Segments are removed once all of their entries are acknowledged,
+	// except for the last segment.
+	require.NoError(t, q.ack([]uint64{1, 2, 3}))
+	assert.Equal(t, []string{
+		"00000000000000000003.seg",
+		"00000000000000000005.seg",
+	}, listSegments(t, dir))
+	require.NoError(t, q.ack([]uint64{4, 5, 6}))
+	assert.Equal(t, []string{"00000000000000000005.seg"}, listSegments(t, dir))
+	assert.Equal(t, int64(0), q.pending())
+}
+
+func TestDiskQueueMaxBytes(t *testing.T) {
+	q, err := openDiskQueue(t.TempDir(), 100)
+	require.NoError(t, err)
+	defer q.close()
+
+	// A write to an empty queue is accepted regardless of its size.
+	require.NoError(t, q.write(newQueuedBulkIndexer(t, `{"a":"`+strings.Repeat("x", 100)+`"}`)))
+	assert.Equal(t, ErrFull, q.write(newQueuedBulkIndexer(t, `{"b":2}`)))
+
+	// Retried entries are requeued regardless of the maximum size.
+	assert.NoError(t, q.requeue(newQueuedBulkIndexer(t, `{"b":2}`)))
+	assert.Equal(t, int64(2), q.pending())
+}
+
+func TestDiskQueueSyncError(t *testing.T) {
+	defer func(sync func(*os.File) error) { diskQueueSync = sync }(diskQueueSync)
+	syncErr := errors.New("sync failed")
+
+	dir := t.TempDir()
+	q, err := openDiskQueue(dir, 0)
+	require.NoError(t, err)
+	defer q.close()
+	require.NoError(t, q.write(newQueuedBulkIndexer(t, `{"a":1}`)))
+
+	// Entries which fail to sync are discarded, so entries
+	// appended later are numbered and delivered correctly.
+	diskQueueSync = func(f *os.File) error { return syncErr }
+	assert.Equal(t, syncErr, q.write(newQueuedBulkIndexer(t, `{"b":2}`, `{"c":3}`)))
+	diskQueueSync = (*os.File).Sync
+	require.NoError(t, q.write(newQueuedBulkIndexer(t, `{"d":4}`)))
+	assert.Equal(t, int64(2), q.pending())
+	for i, expected := range []string{`{"a":1}`, `{"d":4}`} {
+		data, seq, err := q.next(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, uint64(i+1), seq)
+		assert.Contains(t, string(data), expected)
+	}
+	require.NoError(t, q.close())
+
+	q, err = openDiskQueue(dir, 0)
+	require.NoError(t, err)
+	defer q.close()
+	assert.Equal(t, int64(2), q.pending())
+
+	// If the entries cannot be discarded, the queue is closed.
+	diskQueueSync = func(f *os.File) error {
+		f.Close()
+		return syncErr
+	}
+	err = q.write(newQueuedBulkIndexer(t, `{"e":5}`))
+	assert.ErrorIs(t, err, syncErr)
+	assert.Equal(t, ErrClosed, q.write(newQueuedBulkIndexer(t, `{"f":6}`)))
+}
+
+func TestDecodeQueuedItem(t *testing.T) {
+	b := newBulkIndexer(gzip.NoCompression)
+	_, err := b.Add(bulkIndexerItem{
+		Index:        "logs-apm_server-testing",
+		Action:       "index",
+		DocumentID:   "abc",
+		Pipeline:     "my-pipeline",
+		Routing:      "user-1",
+		RequireAlias: true,
+		Version:      42,
+		VersionType:  "external",
+		Body:         strings.NewReader(`{"a":1}` + "\n"),
+	})
+	require.NoError(t, err)
+
+	_, err = b.Add(bulkIndexerItem{
+		Index:      "metrics-apm.internal-testing",
+		Action:     "create",
+		TimeSeries: true,
+		Body:       strings.NewReader(`{"b":2}` + "\n"),
+	})
+	require.NoError(t, err)
+
+	// The decoded items are added to a bulk request identically.
+	b2 := newBulkIndexer(gzip.NoCompression)
+	for i := 0; i < b.Items(); i++ {
+		item, err := decodeQueuedItem(appendQueuedItem(nil, b, i))
+		require.NoError(t, err)
+		_, err = b2.Add(item)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, b.buf.String(), b2.buf.String())
+	assert.False(t, b2.TimeSeries(0))
+	assert.True(t, b2.TimeSeries(1))
+
+	_, err = decodeQueuedItem(nil)
+	assert.EqualError(t, err, "missing disk queue entry flags")
+	_, err = decodeQueuedItem([]byte("\x00{}"))
+	assert.EqualError(t, err, "missing bulk action line")
+	_, err = decodeQueuedItem([]byte("\x00{}\n{}\n"))
+	assert.EqualError(t, err, "expected 1 bulk action, got 0")
+}
+
+// newQueuedBulkIndexer returns a bulkIndexer holding an item for
+// each of the given documents, as ProcessBatch adds them to the queue.
+func newQueuedBulkIndexer(t testing.TB, docs ...string) *bulkIndexer {
+	b := newBulkIndexer(gzip.NoCompression)
+	for _, doc := range docs {
+		_, err := b.Add(bulkIndexerItem{
+			Index:      "logs-apm_server-testing",
+			Action:     "create",
+			DocumentID: "doc-" + doc,
+			Body:       strings.NewReader(doc + "\n"),
+		})
+		require.NoError(t, err)
+	}
+	return b
+}
+
+func listSegments(t testing.TB, dir string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	require.NoError(t, err)
+	for i, match := range matches {
+		matches[i] = filepath.Base(match)
+	}
+	return matches
+}
@@ -0,0 +1,124 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// FailedDoc holds details of a document which failed to be indexed.
+type FailedDoc struct {
+	// Index holds the name of the index the document was targeting.
+	Index string
+
+	// Position holds the position of the document in the bulk request
+	// in which it was first sent, counting from zero. Retried documents
+	// keep their original position.
+	Position int
+
+	// Status holds the HTTP status code of the failed bulk item.
+	//
+	// Status is zero if the entire bulk request failed.
+	Status int
+
+	// ErrorType holds the type of error reported by Elasticsearch,
+	// such as "mapper_parsing_exception".
+	ErrorType string
+
+	// ErrorReason holds the reason for the failure.
+	ErrorReason string
+
+	// Body holds the JSON-encoded document.
+	Body []byte
+}
+
+// DocumentError is reported by Indexer.ProcessBatchSync for an event
+// whose document failed to be indexed.
+type DocumentError struct {
+	// Status holds the HTTP status code of the failed bulk item.
+	//
+	// Status is zero if the entire bulk request failed.
+	Status int
+
+	// ErrorType holds the type of error reported by Elasticsearch,
+	// such as "mapper_parsing_exception".
+	ErrorType string
+
+	// ErrorReason holds the reason for the failure.
+	ErrorReason string
+}
+
+func (e *DocumentError) Error() string {
+	if e.ErrorType == "" {
+		return fmt.Sprintf("failed to index document: %s", e.ErrorReason)
+	}
+	return fmt.Sprintf("failed to index document (%s): %s", e.ErrorType, e.ErrorReason)
+}
+
+// DeadLetterSink is an interface for receiving documents
+// which failed to be indexed due to non-retryable errors.
+type DeadLetterSink interface {
+	// Write writes docs to the sink.
+	//
+	// Write will be called by at most one goroutine at a time.
+	Write(ctx context.Context, docs []FailedDoc) error
+}
+
+// failedDocsRing is a fixed-size ring buffer of FailedDocs.
+type failedDocsRing struct {
+	dropped int64 // updated atomically
+
+	mu   sync.Mutex
+	ring []FailedDoc
+	next int
+	full bool
+}
+
+func newFailedDocsRing(size int) *failedDocsRing {
+	return &failedDocsRing{ring: make([]FailedDoc, size)}
+}
+
+// add adds doc to the ring, overwriting the oldest FailedDoc if the ring is full.
+func (r *failedDocsRing) add(doc FailedDoc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.full {
+		atomic.AddInt64(&r.dropped, 1)
+	}
+	r.ring[r.next] = doc
+	r.next++
+	if r.next == len(r.ring) {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// docs returns a copy of the FailedDocs in the ring, oldest first.
+func (r *failedDocsRing) docs() []FailedDoc {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]FailedDoc(nil), r.ring[:r.next]...)
+	}
+	docs := make([]FailedDoc, 0, len(r.ring))
+	docs = append(docs, r.ring[r.next:]...)
+	return append(docs, r.ring[:r.next]...)
+}
@@ -0,0 +1,72 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// failureReason categorises the permanent failure of a bulk item,
+// for reporting failures by reason in Stats.
+type failureReason int
+
+const (
+	failureOther failureReason = iota
+	failureMapping
+	failureVersionConflict
+	failureTooManyRequests
+	failureTransport
+	numFailureReasons
+)
+
+// failureCounters holds the number of failed items for each reason.
+type failureCounters [numFailureReasons]int64
+
+func (c *failureCounters) add(reason failureReason) {
+	atomic.AddInt64(&c[reason], 1)
+}
+
+func (c *failureCounters) load(reason failureReason) int64 {
+	return atomic.LoadInt64(&c[reason])
+}
+
+// classifyItemFailure returns the reason for the failure of a bulk item,
+// given the status and error type of its response. Items which failed due
+// to the whole bulk request failing are classified as failureTransport by
+// the caller.
+func classifyItemFailure(status int, errorType string) failureReason {
+	switch errorType {
+	case "mapper_parsing_exception",
+		"mapper_exception",
+		"strict_dynamic_mapping_exception",
+		"document_parsing_exception":
+		return failureMapping
+	case "version_conflict_engine_exception":
+		return failureVersionConflict
+	case "es_rejected_execution_exception":
+		return failureTooManyRequests
+	}
+	switch status {
+	case http.StatusConflict:
+		return failureVersionConflict
+	case http.StatusTooManyRequests:
+		return failureTooManyRequests
+	}
+	return failureOther
+}
@@ -0,0 +1,45 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassifyItemFailure(t *testing.T) {
+	for _, test := range []struct {
+		status    int
+		errorType string
+		expected  failureReason
+	}{
+		{http.StatusBadRequest, "mapper_parsing_exception", failureMapping},
+		{http.StatusBadRequest, "strict_dynamic_mapping_exception", failureMapping},
+		{http.StatusBadRequest, "document_parsing_exception", failureMapping},
+		{http.StatusConflict, "version_conflict_engine_exception", failureVersionConflict},
+		{http.StatusConflict, "", failureVersionConflict},
+		{http.StatusTooManyRequests, "es_rejected_execution_exception", failureTooManyRequests},
+		{http.StatusTooManyRequests, "", failureTooManyRequests},
+		{http.StatusBadRequest, "illegal_argument_exception", failureOther},
+		{http.StatusInternalServerError, "", failureOther},
+	} {
+		assert.Equal(t, test.expected, classifyItemFailure(test.status, test.errorType), "%d %s", test.status, test.errorType)
+	}
+}
@@ -0,0 +1,111 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/elastic/apm-server/elasticsearch"
+)
+
+// Flusher performs bulk requests for an Indexer created with
+// NewWithFlusher, in place of an Elasticsearch client. This allows
+// the responses to bulk requests to be controlled, such as in tests
+// exercising the handling of failed requests and documents.
+type Flusher interface {
+	// Flush performs a bulk request with body, which holds the
+	// uncompressed, newline-delimited bulk request items, and returns
+	// the bulk response.
+	//
+	// If the bulk request fails with an error response, Flush should
+	// return a *FlushError, whose status code determines whether the
+	// request is retried. Other errors are not retried.
+	Flush(ctx context.Context, body io.Reader) (elasticsearch.BulkIndexerResponse, error)
+}
+
+// FlushError is returned for bulk requests which receive an error response.
+type FlushError struct {
+	// StatusCode holds the HTTP status code of the response.
+	StatusCode int
+
+	// Message holds a description of the error response.
+	Message string
+}
+
+func (e *FlushError) Error() string {
+	return fmt.Sprintf("flush failed: %s", e.Message)
+}
+
+// NewWithFlusher returns a new Indexer which performs bulk requests with
+// flusher. Config.Transport is ignored, and Ping and Verify always succeed, as there
+// is no Elasticsearch client; SetClient may be used to replace flusher
+// with a client.
+func NewWithFlusher(flusher Flusher, cfg Config) (*Indexer, error) {
+	cfg.Transport = flusherTransport{flusher}
+	return New(nil, cfg)
+}
+
+// flusherTransport is an esapi.Transport which performs
+// bulk requests with a Flusher.
+type flusherTransport struct {
+	flusher Flusher
+}
+
+func (t flusherTransport) Perform(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != "/_bulk" {
+		// Respond successfully to other requests, such as Ping.
+		return newFlusherResponse(http.StatusOK, ""), nil
+	}
+	var body io.Reader = req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		r, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		body = r
+	}
+	resp, err := t.flusher.Flush(req.Context(), body)
+	if err != nil {
+		var flushErr *FlushError
+		if errors.As(err, &flushErr) {
+			return newFlusherResponse(flushErr.StatusCode, flushErr.Message), nil
+		}
+		return nil, err
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return nil, err
+	}
+	return newFlusherResponse(http.StatusOK, string(data)), nil
+}
+
+func newFlusherResponse(statusCode int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: statusCode,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
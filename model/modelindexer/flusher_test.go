@@ -0,0 +1,129 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/go-elasticsearch/v7/esutil"
+
+	"github.com/elastic/apm-server/elasticsearch"
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modelindexer"
+)
+
+type flusherFunc func(ctx context.Context, body io.Reader) (elasticsearch.BulkIndexerResponse, error)
+
+func (f flusherFunc) Flush(ctx context.Context, body io.Reader) (elasticsearch.BulkIndexerResponse, error) {
+	return f(ctx, body)
+}
+
+func TestNewWithFlusher(t *testing.T) {
+	var mu sync.Mutex
+	var requests int
+	flusher := flusherFunc(func(ctx context.Context, body io.Reader) (elasticsearch.BulkIndexerResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests == 1 {
+			return elasticsearch.BulkIndexerResponse{}, &modelindexer.FlushError{
+				StatusCode: http.StatusTooManyRequests,
+				Message:    "too many requests",
+			}
+		}
+		// The body is decompressed before being passed to the flusher.
+		var lines int
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				lines++
+			}
+		}
+		if lines != 4 {
+			panic(fmt.Sprintf("expected 2 items, got %d lines", lines))
+		}
+		item := esutil.BulkIndexerResponseItem{Status: http.StatusBadRequest}
+		item.Error.Type = "mapper_parsing_exception"
+		item.Error.Reason = "failed to parse"
+		return elasticsearch.BulkIndexerResponse{HasErrors: true, Items: []map[string]esutil.BulkIndexerResponseItem{
+			{"create": {Status: http.StatusCreated}},
+			{"create": item},
+		}}, nil
+	})
+	indexer, err := modelindexer.NewWithFlusher(flusher, modelindexer.Config{
+		FlushInterval:    time.Minute,
+		CompressionLevel: gzip.BestSpeed,
+		RetryBackoff:     time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	require.NoError(t, indexer.Ping(context.Background()))
+
+	batch := model.Batch{
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}},
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+
+	// The request was retried after the 429, and then one document
+	// failed to be indexed.
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, modelindexer.Stats{
+		Added:            2,
+		Failed:           1,
+		FailedMapping:    1,
+		RetriedDocs:      2,
+		AvailableBuffers: 10,
+		BulkRequests:     2,
+	}, indexerStats(t, indexer))
+}
+
+func TestNewWithFlusherError(t *testing.T) {
+	flusher := flusherFunc(func(ctx context.Context, body io.Reader) (elasticsearch.BulkIndexerResponse, error) {
+		return elasticsearch.BulkIndexerResponse{}, errors.New("boom")
+	})
+	indexer, err := modelindexer.NewWithFlusher(flusher, modelindexer.Config{FlushInterval: time.Minute})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{{Timestamp: time.Now()}}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	err = indexer.Flush(context.Background())
+	assert.EqualError(t, err, "boom")
+
+	// Errors other than *FlushError are not retried.
+	stats := indexerStats(t, indexer)
+	assert.Equal(t, int64(1), stats.BulkRequests)
+	assert.Equal(t, int64(1), stats.FailedTransport)
+}
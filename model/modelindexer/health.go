@@ -0,0 +1,131 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// healthWindowBuckets holds the number of buckets into which the
+// health window is divided.
+const healthWindowBuckets = 10
+
+// HealthStatus holds the health of an Indexer, derived from the outcomes
+// of recent flushes and the state of the circuit breaker.
+type HealthStatus struct {
+	// Healthy reports whether the indexer is succeeding in indexing
+	// events: the circuit breaker is not open, and the proportion of
+	// flushes which failed within Config.HealthWindow does not exceed
+	// Config.HealthFailureRatio.
+	Healthy bool
+
+	// Reason holds a description of why the indexer is unhealthy,
+	// or is empty if it is healthy.
+	Reason string
+
+	// Flushes and FailedFlushes hold the number of flushes which
+	// completed, and the number of those which failed, within
+	// Config.HealthWindow.
+	Flushes       int64
+	FailedFlushes int64
+}
+
+// Health returns the health of the indexer, for use as a readiness
+// signal, e.g. for load balancer health checks.
+//
+// A flush fails if its bulk request fails entirely, after exhausting any
+// retries, such as due to Elasticsearch being unavailable. Flushes with
+// individual items which fail to be indexed, such as due to mapping
+// conflicts, are not considered failed, as those failures are specific
+// to the events.
+func (i *Indexer) Health() HealthStatus {
+	flushes, failed := i.health.counts(time.Now())
+	status := HealthStatus{Healthy: true, Flushes: flushes, FailedFlushes: failed}
+	if i.breaker != nil && i.breaker.isOpen() {
+		status.Healthy = false
+		status.Reason = "circuit breaker open"
+	} else if flushes > 0 && float64(failed)/float64(flushes) > i.config.HealthFailureRatio {
+		status.Healthy = false
+		status.Reason = fmt.Sprintf(
+			"%d of %d flushes failed in the last %s",
+			failed, flushes, i.config.HealthWindow,
+		)
+	}
+	return status
+}
+
+// Healthy reports whether the indexer is healthy. See Health.
+func (i *Indexer) Healthy() bool {
+	return i.Health().Healthy
+}
+
+// healthWindow accumulates the outcomes of flushes over a sliding window.
+// The window is divided into buckets, each counting the flushes completed
+// within a fixed period, so outcomes expire without recording each one.
+type healthWindow struct {
+	bucketDuration time.Duration
+
+	mu      sync.Mutex
+	buckets [healthWindowBuckets]healthBucket
+}
+
+type healthBucket struct {
+	period  int64 // the period counted, in units of bucketDuration since the epoch
+	flushes int64
+	failed  int64
+}
+
+func newHealthWindow(window time.Duration) *healthWindow {
+	bucketDuration := window / healthWindowBuckets
+	if bucketDuration <= 0 {
+		bucketDuration = 1
+	}
+	return &healthWindow{bucketDuration: bucketDuration}
+}
+
+// record records the outcome of a flush completed at now.
+func (w *healthWindow) record(now time.Time, failed bool) {
+	period := now.UnixNano() / int64(w.bucketDuration)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	b := &w.buckets[period%healthWindowBuckets]
+	if b.period != period {
+		*b = healthBucket{period: period}
+	}
+	b.flushes++
+	if failed {
+		b.failed++
+	}
+}
+
+// counts returns the number of flushes, and failed flushes,
+// recorded within the window ending at now.
+func (w *healthWindow) counts(now time.Time) (flushes, failed int64) {
+	period := now.UnixNano() / int64(w.bucketDuration)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, b := range w.buckets {
+		if period-b.period < healthWindowBuckets {
+			flushes += b.flushes
+			failed += b.failed
+		}
+	}
+	return flushes, failed
+}
@@ -0,0 +1,79 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// indexStats holds per-index bulk indexing statistics,
+// which are updated atomically.
+type indexStats struct {
+	added         int64
+	active        int64
+	failed        int64
+	retried       int64
+	flushDuration int64 // nanoseconds
+}
+
+// indexStatsMap holds indexStats keyed by index name.
+type indexStatsMap struct {
+	mu sync.RWMutex
+	m  map[string]*indexStats
+}
+
+func newIndexStatsMap() *indexStatsMap {
+	return &indexStatsMap{m: make(map[string]*indexStats)}
+}
+
+// get returns the indexStats for index, creating it if it does not exist.
+func (m *indexStatsMap) get(index string) *indexStats {
+	m.mu.RLock()
+	stats, ok := m.m[index]
+	m.mu.RUnlock()
+	if ok {
+		return stats
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if stats, ok := m.m[index]; ok {
+		return stats
+	}
+	stats = &indexStats{}
+	m.m[index] = stats
+	return stats
+}
+
+// snapshot returns a copy of the current statistics for each index.
+func (m *indexStatsMap) snapshot() map[string]Stats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	out := make(map[string]Stats, len(m.m))
+	for index, stats := range m.m {
+		out[index] = Stats{
+			Added:         atomic.LoadInt64(&stats.added),
+			Active:        atomic.LoadInt64(&stats.active),
+			Failed:        atomic.LoadInt64(&stats.failed),
+			RetriedDocs:   atomic.LoadInt64(&stats.retried),
+			FlushDuration: time.Duration(atomic.LoadInt64(&stats.flushDuration)),
+		}
+	}
+	return out
+}
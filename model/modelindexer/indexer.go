@@ -19,18 +19,27 @@ package modelindexer
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"math/rand"
+	"net"
+	"net/http"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"go.elastic.co/apm"
+	"go.opentelemetry.io/otel/metric"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/elastic/beats/v7/libbeat/esleg/eslegclient"
 	"github.com/elastic/beats/v7/libbeat/logp"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+	"github.com/elastic/go-hdrhistogram"
 
 	"github.com/elastic/apm-server/elasticsearch"
 	logs "github.com/elastic/apm-server/log"
@@ -39,38 +48,151 @@ import (
 
 const (
 	logRateLimit = time.Minute
+
+	actionCreate = "create"
+	actionIndex  = "index"
+	actionUpdate = "update"
+
+	versionTypeExternal = "external"
+
+	// maxRetryBackoff holds the maximum duration to wait between
+	// attempts to retry failed bulk items.
+	maxRetryBackoff = 10 * time.Second
+
+	// waitPollInterval holds the interval at which Wait checks
+	// whether all events have been flushed.
+	waitPollInterval = 10 * time.Millisecond
+
+	// Bounds and precision of the bulk request latency histogram.
+	minFlushLatency        = time.Microsecond
+	maxFlushLatency        = time.Hour
+	flushLatencySigFigures = 2
 )
 
-// ErrClosed is returned from methods of closed Indexers.
-var ErrClosed = errors.New("model indexer closed")
+var (
+	// ErrClosed is returned from methods of closed Indexers.
+	ErrClosed = errors.New("model indexer closed")
+
+	// ErrFull is returned from ProcessBatch when no bulk request buffer
+	// becomes available within Config.AddTimeout.
+	ErrFull = errors.New("model indexer full")
+
+	// ErrCircuitOpen is returned from ProcessBatch while the indexer's
+	// circuit breaker is open, following consecutive failed bulk requests.
+	ErrCircuitOpen = errors.New("model indexer circuit breaker open")
+
+	// ErrDocumentTooLarge is reported by ProcessBatchSync for events which
+	// were dropped for exceeding Config.MaxDocumentBytes.
+	ErrDocumentTooLarge = errors.New("document exceeds maximum size")
+
+	// ErrInvalidDataStream is wrapped by the errors returned for events
+	// with an empty data stream type, dataset, or namespace, when
+	// Config.ValidateDataStreams is true.
+	ErrInvalidDataStream = errors.New("invalid data stream")
+)
 
 // Indexer is a model.BatchProcessor which bulk indexes events as Elasticsearch documents.
 //
 // Indexer buffers events in their JSON encoding until either the accumulated buffer reaches
-// `config.FlushBytes`, or `config.FlushInterval` elapses.
+// `config.FlushBytes`, the number of buffered events reaches `config.FlushDocuments` (if set),
+// or `config.FlushInterval` elapses.
 //
 // Indexer fills a single bulk request buffer at a time to ensure bulk requests are optimally
 // sized, avoiding sparse bulk requests as much as possible. After a bulk request is flushed,
 // the next event added will wait for the next available bulk request buffer and repeat the
-// process.
+// process. If `config.ActiveShards` is greater than one, that many buffers are filled
+// concurrently, with events distributed between them round-robin, trading bulk request
+// size for reduced lock contention between concurrent calls to ProcessBatch.
 //
 // Up to `config.MaxRequests` bulk requests may be flushing/active concurrently, to allow the
 // server to make progress encoding while Elasticsearch is busy servicing flushed bulk requests.
+// If `config.AutoScale` is true, the limit is adjusted between `config.ActiveShards` and
+// `config.MaxRequests` according to flush latency.
+//
+// If `config.DiskQueueDir` is set, events are persisted to a queue on disk before being
+// buffered, and removed from the queue once flushed, so they survive a crash or restart.
 type Indexer struct {
-	eventsAdded  int64
-	eventsActive int64
-	eventsFailed int64
-	config       Config
-	logger       *logp.Logger
-	available    chan *bulkIndexer
-	g            errgroup.Group
-
-	mu       sync.RWMutex
-	closing  bool
-	closed   chan struct{}
-	activeMu sync.Mutex
-	active   *bulkIndexer
-	timer    *time.Timer
+	eventsAdded       int64
+	eventsActive      int64
+	activeBytes       int64 // bytes buffered in active shards
+	eventsFailed      int64
+	failures          failureCounters // eventsFailed by reason
+	eventsLost        int64           // events failed due to flushes cancelled by Close
+	docsRetried       int64
+	tooManyReqs       int64
+	tooLarge          int64
+	invalidDataStream int64
+	deduplicated      int64 // create actions rejected as duplicates by a TSDS
+	failedSecond      int64 // items which failed to be indexed by the secondary
+	bulkRequests      int64
+	esTook            int64 // milliseconds, as reported by Elasticsearch
+	bytesFlushed      int64
+	bytesRaw          int64 // uncompressed bytes flushed
+	config            Config
+	logger            *logp.Logger
+	readers           *readerPool
+	indexStats        *indexStatsMap  // nil if per-index stats are disabled
+	failedDocs        *failedDocsRing // nil if failed documents are not retained
+	breaker           *circuitBreaker // nil if the circuit breaker is disabled
+	health            *healthWindow
+
+	deadLettersDropped int64
+	deadLetterQueue    chan []FailedDoc // nil if there is no dead letter sink
+	deadLetterDone     chan struct{}
+	deadLetterOnce     sync.Once
+	available          chan *bulkIndexer
+	scaler             *autoScaler // nil if AutoScale is disabled
+	g                  errgroup.Group
+
+	queue     *diskQueue // nil if there is no disk queue
+	stopQueue context.CancelFunc
+	queueDone chan struct{}
+
+	transportMu sync.RWMutex
+	transport   esapi.Transport // used for bulk requests
+
+	latencyMu sync.Mutex
+	latency   *hdrhistogram.Histogram
+	metrics   *indexerMetrics // nil if there is no Meter
+
+	mu             sync.RWMutex
+	closing        bool
+	closed         chan struct{}
+	shards         []*activeShard
+	nextShardIndex uint32
+
+	inflightMu sync.Mutex
+	inflight   map[*inflightFlush]struct{}
+
+	flushErrorsMu   sync.Mutex
+	flushErrors     int
+	flushErrorsDocs int
+	flushErr        error // first flush error
+	lastFlushErr    error
+
+	closeSummaryOnce sync.Once
+}
+
+// activeShard holds a bulk request buffer being filled with events,
+// and the timer for flushing it after Config.FlushInterval. The timer
+// is started when the buffer becomes active, and is not reset by
+// subsequent events.
+type activeShard struct {
+	mu     sync.Mutex
+	active *bulkIndexer
+	bytes  int // bytes added to active, compared against FlushBytes
+	timer  *time.Timer
+
+	// activeSince holds the time at which the first event was added
+	// to active, in Unix nanoseconds, or zero if active is nil. It is
+	// accessed atomically, so that Stats does not take the lock.
+	activeSince int64
+}
+
+// inflightFlush tracks the completion of a background flush.
+type inflightFlush struct {
+	done chan struct{}
+	err  error // set before done is closed
 }
 
 // Config holds configuration for Indexer.
@@ -81,15 +203,390 @@ type Config struct {
 	// If MaxRequests is less than or equal to zero, the default of 10 will be used.
 	MaxRequests int
 
+	// ActiveShards holds the number of bulk request buffers which may be
+	// filled concurrently. Each shard has its own lock and flush timer, so
+	// increasing ActiveShards reduces contention between goroutines calling
+	// ProcessBatch, at the cost of smaller bulk requests. Buffers are taken
+	// from the same pool of MaxRequests buffers, so ActiveShards must not
+	// exceed MaxRequests.
+	//
+	// If ActiveShards is less than or equal to zero, the default of 1 will be used.
+	ActiveShards int
+
 	// FlushBytes holds the flush threshold in bytes.
 	//
 	// If FlushBytes is zero, the default of 5MB will be used.
 	FlushBytes int
 
+	// FlushCompressedBytes controls whether FlushBytes is compared against
+	// the compressed size of the buffered bulk request, rather than its
+	// uncompressed size. FlushCompressedBytes has no effect unless
+	// CompressionLevel is non-zero.
+	//
+	// Measuring the compressed size requires compressing events as they
+	// are added, which moves the cost of compression from the background
+	// flush goroutines to the goroutines calling ProcessBatch, and means
+	// items retried after a partial failure must be compressed again.
+	// The compressed size is also approximate, as the compressor holds
+	// back some of its input until the request is flushed. Because the
+	// uncompressed size is then unbounded by FlushBytes, memory usage
+	// should be bounded with FlushDocuments or MaxRequests instead.
+	//
+	// By default FlushBytes is compared against the uncompressed size.
+	// Stats.BytesFlushed and Stats.BytesUncompressed report both sizes,
+	// which may be used to determine a suitable FlushBytes either way.
+	FlushCompressedBytes bool
+
+	// FlushDocuments holds the flush threshold in number of documents.
+	//
+	// If FlushDocuments is zero, bulk requests will only be flushed
+	// according to FlushBytes and FlushInterval.
+	FlushDocuments int
+
 	// FlushInterval holds the flush threshold as a duration.
 	//
+	// FlushInterval is measured from when the first event is added to
+	// a bulk request buffer, and is not extended by events added after
+	// that, bounding the time for which any event is buffered even when
+	// events arrive slowly.
+	//
 	// If FlushInterval is zero, the default of 30 seconds will be used.
 	FlushInterval time.Duration
+
+	// FlushIntervalJitter holds a fraction in the range [0,1) by which to
+	// randomly vary FlushInterval each time a flush timer is started, by up
+	// to plus or minus that fraction. This avoids many indexers or shards
+	// started at the same time from flushing simultaneously.
+	//
+	// If FlushIntervalJitter is zero, FlushInterval will be used as is.
+	FlushIntervalJitter float64
+
+	// TrackPerIndexStats controls whether or not bulk indexing statistics
+	// are tracked for each index, for reporting through Indexer.IndexStats.
+	//
+	// Tracking per-index statistics incurs additional overhead, so it is
+	// disabled by default.
+	TrackPerIndexStats bool
+
+	// MaxFailedDocsRetained holds the maximum number of documents which
+	// failed to be indexed to retain in memory, for reporting through
+	// Indexer.FailedDocs. When the limit is reached, the oldest failed
+	// documents will be dropped.
+	//
+	// If MaxFailedDocsRetained is zero, failed documents will not be retained.
+	MaxFailedDocsRetained int
+
+	// DeadLetterSink, if non-nil, is sent documents which Elasticsearch
+	// failed to index due to non-retryable errors, or which remained
+	// unindexed after MaxRetries attempts, including documents in bulk
+	// requests which failed entirely.
+	//
+	// Failed documents are sent to the sink asynchronously by a single
+	// goroutine, through a queue with capacity for MaxRequests batches
+	// of failed documents. If the queue is full, failed documents will
+	// be dropped rather than blocking indexing. No guarantees are made
+	// about the order in which failed documents are sent to the sink.
+	DeadLetterSink DeadLetterSink
+
+	// Transport, if non-nil, is used for performing bulk requests in place
+	// of the client passed to New. This allows bulk requests to be sent with
+	// different connection settings, such as timeouts, proxies, or connection
+	// pool sizes, to other requests made with the client; for example, using
+	// a client created by elasticsearch.NewClientParams with a dedicated
+	// http.Transport.
+	Transport esapi.Transport
+
+	// Headers holds HTTP headers to set on each bulk request, including
+	// those sent to SecondaryClient, such as a tenant header for routing
+	// by a proxy. Header values are never logged.
+	//
+	// Headers must not include Content-Type or Content-Encoding, which are
+	// set according to the request body. Note that some client transports
+	// replace any User-Agent header with their own.
+	Headers map[string]string
+
+	// SecondaryClient, if non-nil, is sent a copy of each bulk request,
+	// mirroring all documents to a second Elasticsearch cluster. Each bulk
+	// request is sent to the secondary before the first attempt to send it
+	// to the primary, and is not retried.
+	//
+	// Failures to index documents in the secondary are counted separately,
+	// in Stats.FailedSecondary, and do not otherwise affect indexing: they
+	// are not reported by Close, sent to the dead letter sink, or counted
+	// by the circuit breaker.
+	SecondaryClient elasticsearch.Client
+
+	// Tracer, if non-nil, is used to trace bulk indexing. Each flush is
+	// recorded as a span named "ModelIndexer.flush" if the flush was
+	// triggered with a context containing a transaction, or otherwise
+	// as a transaction of the same name.
+	Tracer *apm.Tracer
+
+	// Meter, if it has an implementation, is used to register OpenTelemetry
+	// instruments for the indexer's event counters and bulk request latency.
+	// The failed events counter is attributed with the data stream when
+	// TrackPerIndexStats is true.
+	//
+	// If Meter is the zero value, no instruments will be created.
+	Meter metric.Meter
+
+	// DocumentAction, if non-nil, is called for each event to determine the
+	// bulk action ("create", "index", or "update") and document ID to use.
+	// If DocumentAction returns an empty action, "create" will be used.
+	// The "update" action requires a document ID, and is performed as an
+	// upsert of the entire document.
+	//
+	// If DocumentAction is nil, all events will be indexed using the "create"
+	// action with no document ID, letting Elasticsearch generate IDs.
+	DocumentAction func(*model.APMEvent) (action, documentID string)
+
+	// EventVersion, if non-nil, is called for each event to determine an
+	// external version for its document. If EventVersion returns true, the
+	// bulk action is sent with the returned version and "version_type":
+	// "external", and Elasticsearch will reject the document if a document
+	// with the same ID and a greater or equal version already exists.
+	//
+	// External versioning is only supported for the "index" action; see
+	// DocumentAction. Events for which EventVersion returns true with any
+	// other action will fail to be encoded.
+	EventVersion func(*model.APMEvent) (version int64, ok bool)
+
+	// EventIndex, if non-nil, is called for each event to determine the
+	// index and routing value to use for its document, overriding the
+	// default of indexing into the event's data stream. If EventIndex
+	// returns an empty index, the event's data stream will be used.
+	EventIndex func(*model.APMEvent) (index, routing string)
+
+	// IndexNamer, if non-nil, is called to determine the index for events
+	// for which EventIndex is nil or returns an empty index, replacing the
+	// default of indexing into the event's data stream. This allows writing
+	// to indices named by some other scheme, such as date-suffixed indices
+	// like "logs-firehose-2024.01".
+	//
+	// Documents are created with the "create" action unless DocumentAction
+	// specifies otherwise, which requires the index either to exist, or to
+	// be created automatically. Depending on the naming scheme, this may
+	// require index templates or aliases to be set up in Elasticsearch.
+	//
+	// If IndexNamer is nil, events are indexed into their data streams,
+	// named "<type>-<dataset>-<namespace>".
+	IndexNamer func(*model.APMEvent) string
+
+	// TimeSeries, if non-nil, is called for each event to determine whether
+	// it targets a time series data stream (TSDS). The documents of such
+	// events are indexed using the "create" action without a document ID,
+	// even if DocumentAction returns one, so that Elasticsearch derives the
+	// ID from the document's dimensions and timestamp. Events for which
+	// TimeSeries returns true with any other action will fail to be encoded.
+	//
+	// Elasticsearch rejects documents with the same dimensions and timestamp
+	// as an existing document with a version conflict. Version conflicts
+	// for events for which TimeSeries returned true are counted in
+	// Stats.Deduplicated rather than as failures; those for other events
+	// are counted as failures, even if created without a document ID.
+	TimeSeries func(*model.APMEvent) bool
+
+	// EncoderFactory, if non-nil, is called to create Encoders for encoding
+	// events as documents, in place of the default JSON encoder. Encoders
+	// are pooled and reused by the indexer, so EncoderFactory is called
+	// only when no pooled Encoder is available.
+	//
+	// The encoder is passed model.APMEvent.BeatEvent's result, and must
+	// write each document on a single line, followed by a newline.
+	EncoderFactory func(io.Writer) Encoder
+
+	// Pipeline holds the name of an ingest pipeline to process documents
+	// with. If Pipeline is empty, the data stream's default pipeline will
+	// be used.
+	Pipeline string
+
+	// EventPipeline, if non-nil, is called for each event to override
+	// Pipeline. If EventPipeline returns an empty string, Pipeline will
+	// be used.
+	EventPipeline func(*model.APMEvent) string
+
+	// RequireAlias controls whether bulk actions are sent with
+	// "require_alias": true, causing them to fail rather than auto-create
+	// a regular index if the target index does not already exist as an
+	// alias or data stream.
+	RequireAlias bool
+
+	// ValidateDataStreams controls whether events indexed into their data
+	// stream, rather than an index from EventIndex or IndexNamer, are
+	// checked to have a non-empty data stream type, dataset, and namespace.
+	// Events failing the check would be rejected by Elasticsearch for their
+	// malformed index name, such as "logs--default"; instead they are
+	// skipped with an error wrapping ErrInvalidDataStream, logged, and
+	// counted in Stats.InvalidDataStream.
+	ValidateDataStreams bool
+
+	// OrderedBatches controls whether the events of each batch passed to
+	// ProcessBatch are added to the same bulk request, in batch order,
+	// rather than possibly being split across bulk requests which may
+	// complete in any order. This may be used where the relative order
+	// of documents matters, such as for state transitions.
+	//
+	// This reduces throughput: a shard's lock is held while the whole
+	// batch is added, so concurrent callers contend for it, and bulk
+	// requests may exceed FlushBytes or FlushDocuments by up to a batch,
+	// being flushed only once the batch has been added. Documents which
+	// fail and are retried are sent in later bulk requests, so their order
+	// is not preserved. OrderedBatches applies only to ProcessBatch, and
+	// cannot be used with DiskQueueDir.
+	OrderedBatches bool
+
+	// DrainOnClose controls whether Close drains the indexer before
+	// closing it, to reduce the events rejected during a graceful
+	// shutdown, such as while a load balancer stops routing requests
+	// to the server.
+	//
+	// If DrainOnClose is true, Close first flushes the events buffered
+	// when it is called, and waits for those flushes, and any already
+	// in progress, to complete, or for the context passed to Close to be
+	// done. Until then, ProcessBatch continues to accept events, which
+	// are buffered as usual and may be flushed by reaching FlushBytes or
+	// FlushDocuments. Close then proceeds as if DrainOnClose were false:
+	// ProcessBatch returns ErrClosed, and the events accepted while
+	// draining are flushed.
+	//
+	// If DrainOnClose is false, ProcessBatch stops accepting events as
+	// soon as Close is called: calls made while Close is flushing wait
+	// for it to return, and then return ErrClosed.
+	DrainOnClose bool
+
+	// CompressionLevel holds the gzip compression level used for bulk
+	// request bodies, from 1 (best speed) to 9 (best compression).
+	//
+	// If CompressionLevel is zero, bulk requests will not be compressed.
+	CompressionLevel int
+
+	// AddTimeout holds the maximum duration to wait for a bulk request
+	// buffer to become available when adding an event, after which
+	// ProcessBatch will return ErrFull.
+	//
+	// If AddTimeout is zero, ProcessBatch will wait indefinitely, or
+	// until its context is cancelled.
+	AddTimeout time.Duration
+
+	// MaxDocumentBytes holds the maximum size of an encoded document in bytes.
+	// Events whose encoded documents exceed this size will be dropped.
+	//
+	// If MaxDocumentBytes is zero, document size is not limited.
+	MaxDocumentBytes int
+
+	// FlushTimeout holds the maximum duration for each bulk request,
+	// after which the request will be cancelled and its items counted
+	// as failed. Timed out requests are not retried, as the items may
+	// have been indexed.
+	//
+	// If FlushTimeout is zero, bulk requests will not time out, though
+	// they may still be cancelled by closing the indexer.
+	FlushTimeout time.Duration
+
+	// MaxRetries holds the maximum number of times a bulk item will be
+	// retried after failing with a retryable error, such as 429 (Too Many
+	// Requests) or 503 (Service Unavailable). Bulk requests which fail
+	// entirely due to a connection error, or a 429 or 5xx response, are
+	// also retried up to MaxRetries times.
+	//
+	// If MaxRetries is zero, the default of 3 will be used. If MaxRetries
+	// is less than zero, failed items will not be retried.
+	MaxRetries int
+
+	// RetryBackoff holds the initial duration to wait before retrying
+	// failed bulk items. The backoff doubles with each attempt, up to
+	// a maximum of 10 seconds.
+	//
+	// If RetryBackoff is zero, the default of 100 milliseconds will be used.
+	RetryBackoff time.Duration
+
+	// CircuitBreakerThreshold holds the number of consecutive bulk requests
+	// which must fail, after exhausting retries, to trip the circuit breaker.
+	// While the breaker is open, ProcessBatch fails fast with ErrCircuitOpen
+	// rather than buffering events. After CircuitBreakerCooldown the breaker
+	// half-opens, accepting events again: it closes after the next successful
+	// bulk request, or trips again after the next failed one.
+	//
+	// If CircuitBreakerThreshold is zero, the circuit breaker is disabled.
+	CircuitBreakerThreshold int
+
+	// CircuitBreakerCooldown holds the duration for which the circuit
+	// breaker remains open after tripping.
+	//
+	// If CircuitBreakerCooldown is zero, the default of 30 seconds will be used.
+	CircuitBreakerCooldown time.Duration
+
+	// HealthWindow holds the duration of the sliding window over which
+	// the outcomes of flushes are accumulated for Indexer.Health.
+	//
+	// If HealthWindow is zero, the default of 1 minute will be used.
+	HealthWindow time.Duration
+
+	// HealthFailureRatio holds the proportion of flushes within
+	// HealthWindow which may fail before Indexer.Health reports the
+	// indexer as unhealthy, in the range (0,1].
+	//
+	// If HealthFailureRatio is zero, the default of 0.5 will be used.
+	HealthFailureRatio float64
+
+	// AutoScale controls whether the number of bulk requests which may be
+	// flushing concurrently is adjusted according to flush latency, between
+	// ActiveShards and MaxRequests. The limit starts at ActiveShards. It is
+	// raised when an event is added while no bulk request buffer is
+	// available, if the average flush latency is below AutoScaleLatency,
+	// and lowered as flushes complete while the average is above it.
+	//
+	// If AutoScale is false, MaxRequests bulk requests may always be
+	// flushing concurrently.
+	AutoScale bool
+
+	// AutoScaleLatency holds the flush latency threshold for AutoScale,
+	// compared against a moving average of the time taken to flush each
+	// bulk request, including retries.
+	//
+	// If AutoScaleLatency is zero, the default of 1 second will be used.
+	AutoScaleLatency time.Duration
+
+	// OnFlush, if non-nil, is called after each flush for which Elasticsearch
+	// returned a bulk response, once any retries have completed. It is not
+	// called for flushes which fail entirely, such as due to a connection
+	// error; those are reported by Stats.LastError and Close.
+	//
+	// OnFlush is called from the flushing goroutine before the bulk request
+	// buffer is made available for reuse, so it should return quickly to
+	// avoid blocking the indexer.
+	OnFlush func(FlushResult)
+
+	// DiskQueueDir, if non-empty, holds the path of a directory in which
+	// to persist events before indexing them, so that events which have
+	// been accepted by ProcessBatch are not lost if the process crashes
+	// before they are flushed. The directory is created if it does not
+	// exist. See diskQueue for the file format.
+	//
+	// When enabled, ProcessBatch encodes events and appends them to the
+	// queue, syncing it to disk before returning, and a background
+	// goroutine adds the queued events to bulk requests. Queued events are
+	// removed once they have been flushed and Elasticsearch has returned a
+	// bulk response, or the bulk request has failed with a non-retryable
+	// error; events which failed to be indexed are reported as usual.
+	// Events in bulk requests which failed with a retryable error, after
+	// exhausting MaxRetries, are appended to the queue again to be retried.
+	//
+	// Events which have not been flushed when the indexer is closed, or
+	// when the process crashes, are indexed again after the indexer is next
+	// created with the same DiskQueueDir. Events may therefore be indexed
+	// more than once; use DocumentAction to set document IDs if duplicates
+	// must be avoided.
+	//
+	// AddTimeout does not apply to queued events: ProcessBatch returns
+	// ErrFull only when the queue reaches DiskQueueMaxBytes.
+	DiskQueueDir string
+
+	// DiskQueueMaxBytes holds the maximum size of the disk queue in bytes,
+	// beyond which ProcessBatch will return ErrFull.
+	//
+	// If DiskQueueMaxBytes is zero, the default of 1GB will be used.
+	DiskQueueMaxBytes int64
 }
 
 // New returns a new Indexer that indexes events directly into data streams.
@@ -98,34 +595,213 @@ func New(client elasticsearch.Client, cfg Config) (*Indexer, error) {
 	if cfg.MaxRequests <= 0 {
 		cfg.MaxRequests = 10
 	}
-	if cfg.FlushBytes <= 0 {
-		cfg.FlushBytes = 5 * 1024 * 1024
+	if cfg.ActiveShards <= 0 {
+		cfg.ActiveShards = 1
 	}
-	if cfg.FlushInterval <= 0 {
-		cfg.FlushInterval = 30 * time.Second
+	if cfg.FlushIntervalJitter < 0 || cfg.FlushIntervalJitter >= 1 {
+		return nil, fmt.Errorf(
+			"expected FlushIntervalJitter in range [0,1), got %v",
+			cfg.FlushIntervalJitter,
+		)
+	}
+	if cfg.ActiveShards > cfg.MaxRequests {
+		return nil, fmt.Errorf(
+			"expected ActiveShards no greater than MaxRequests (%d), got %d",
+			cfg.MaxRequests, cfg.ActiveShards,
+		)
+	}
+	setFlushDefaults(&cfg)
+	if cfg.CompressionLevel < gzip.NoCompression || cfg.CompressionLevel > gzip.BestCompression {
+		return nil, fmt.Errorf(
+			"expected CompressionLevel in range [%d,%d], got %d",
+			gzip.NoCompression, gzip.BestCompression, cfg.CompressionLevel,
+		)
+	}
+	if cfg.MaxRetries == 0 {
+		cfg.MaxRetries = 3
+	}
+	if cfg.RetryBackoff <= 0 {
+		cfg.RetryBackoff = 100 * time.Millisecond
+	}
+	if cfg.CircuitBreakerCooldown <= 0 {
+		cfg.CircuitBreakerCooldown = 30 * time.Second
+	}
+	if cfg.HealthWindow <= 0 {
+		cfg.HealthWindow = time.Minute
+	}
+	if cfg.HealthFailureRatio == 0 {
+		cfg.HealthFailureRatio = 0.5
+	}
+	if cfg.HealthFailureRatio < 0 || cfg.HealthFailureRatio > 1 {
+		return nil, fmt.Errorf(
+			"expected HealthFailureRatio in range (0,1], got %v",
+			cfg.HealthFailureRatio,
+		)
+	}
+	if cfg.OrderedBatches && cfg.DiskQueueDir != "" {
+		return nil, errors.New("OrderedBatches cannot be used with DiskQueueDir")
+	}
+	for key := range cfg.Headers {
+		switch http.CanonicalHeaderKey(key) {
+		case "Content-Type", "Content-Encoding":
+			return nil, fmt.Errorf("header %q cannot be set in Headers", key)
+		}
+	}
+	var transport esapi.Transport = client
+	if cfg.Transport != nil {
+		transport = cfg.Transport
+	}
+	if cfg.AutoScaleLatency <= 0 {
+		cfg.AutoScaleLatency = time.Second
+	}
+	if cfg.DiskQueueMaxBytes <= 0 {
+		cfg.DiskQueueMaxBytes = 1024 * 1024 * 1024
+	}
+	var scaler *autoScaler
+	buffers := cfg.MaxRequests
+	if cfg.AutoScale {
+		scaler = newAutoScaler(cfg.ActiveShards, cfg.MaxRequests, cfg.AutoScaleLatency)
+		buffers = cfg.ActiveShards
 	}
 	available := make(chan *bulkIndexer, cfg.MaxRequests)
-	for i := 0; i < cfg.MaxRequests; i++ {
-		available <- newBulkIndexer(client)
+	for i := 0; i < buffers; i++ {
+		available <- newIndexerBulkIndexer(cfg)
 	}
-	return &Indexer{
+	shards := make([]*activeShard, cfg.ActiveShards)
+	for i := range shards {
+		shards[i] = &activeShard{}
+	}
+	indexer := &Indexer{
+		transport: transport,
 		config:    cfg,
 		logger:    logger,
+		readers:   defaultReaderPool,
 		available: available,
+		scaler:    scaler,
 		closed:    make(chan struct{}),
-	}, nil
+		shards:    shards,
+		inflight:  make(map[*inflightFlush]struct{}),
+		health:    newHealthWindow(cfg.HealthWindow),
+		latency: hdrhistogram.New(
+			minFlushLatency.Microseconds(),
+			maxFlushLatency.Microseconds(),
+			flushLatencySigFigures,
+		),
+	}
+	if cfg.TrackPerIndexStats {
+		indexer.indexStats = newIndexStatsMap()
+	}
+	if cfg.MaxFailedDocsRetained > 0 {
+		indexer.failedDocs = newFailedDocsRing(cfg.MaxFailedDocsRetained)
+	}
+	if cfg.CircuitBreakerThreshold > 0 {
+		indexer.breaker = newCircuitBreaker(cfg.CircuitBreakerThreshold, cfg.CircuitBreakerCooldown)
+	}
+	if cfg.EncoderFactory != nil {
+		indexer.readers = &readerPool{newEncoder: func(buf *bytes.Buffer) Encoder {
+			return cfg.EncoderFactory(buf)
+		}}
+	}
+	if cfg.Meter.MeterImpl() != nil {
+		metrics, err := newIndexerMetrics(indexer, cfg.Meter)
+		if err != nil {
+			return nil, fmt.Errorf("failed to register metrics: %w", err)
+		}
+		indexer.metrics = metrics
+	}
+	if cfg.DiskQueueDir != "" {
+		queue, err := openDiskQueue(cfg.DiskQueueDir, cfg.DiskQueueMaxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open disk queue: %w", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		indexer.queue = queue
+		indexer.stopQueue = cancel
+		indexer.queueDone = make(chan struct{})
+		go indexer.runDiskQueue(ctx)
+	}
+	if cfg.DeadLetterSink != nil {
+		indexer.deadLetterQueue = make(chan []FailedDoc, cfg.MaxRequests)
+		indexer.deadLetterDone = make(chan struct{})
+		go indexer.runDeadLetterSink()
+	}
+	return indexer, nil
+}
+
+func setFlushDefaults(cfg *Config) {
+	if cfg.FlushBytes <= 0 {
+		cfg.FlushBytes = 5 * 1024 * 1024
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = 30 * time.Second
+	}
+}
+
+// Reconfigure updates the indexer's flush thresholds: FlushBytes,
+// FlushDocuments, and FlushInterval. Defaults are applied to zero
+// values as in New. All other fields of cfg are ignored, except for
+// MaxRequests and ActiveShards: Reconfigure returns an error if either
+// is non-zero and differs from the indexer's current configuration.
+//
+// Buffered events are unaffected. The new thresholds take effect for
+// the next event added; if a flush timer is already running, it may
+// fire once more after the old FlushInterval.
+func (i *Indexer) Reconfigure(cfg Config) error {
+	if cfg.MaxRequests != 0 && cfg.MaxRequests != i.config.MaxRequests {
+		return errors.New("MaxRequests cannot be reconfigured")
+	}
+	if cfg.ActiveShards != 0 && cfg.ActiveShards != i.config.ActiveShards {
+		return errors.New("ActiveShards cannot be reconfigured")
+	}
+	setFlushDefaults(&cfg)
+	for _, shard := range i.shards {
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+	}
+	i.config.FlushBytes = cfg.FlushBytes
+	i.config.FlushDocuments = cfg.FlushDocuments
+	i.config.FlushInterval = cfg.FlushInterval
+	return nil
 }
 
 // Close closes the indexer, first flushing any queued events.
 //
 // Close returns an error if any flush attempts during the indexer's
-// lifetime returned an error. If ctx is cancelled, Close returns and
-// any ongoing flush attempts are cancelled.
+// lifetime failed, summarising the number of failed bulk requests and
+// unindexed documents, and wrapping the first flush error. Failed flushes
+// do not prevent the remaining queued events from being flushed. If ctx
+// is cancelled, Close returns and any ongoing flush attempts are cancelled.
+//
+// Close waits for all buffered events to be flushed, only cancelling ongoing
+// flushes once ctx is cancelled. If any events were not indexed due to their
+// flushes being cancelled, ClosedWithDataLoss reports the number of events
+// lost from the returned error.
+// If Config.DiskQueueDir is set, such events, and any events which remain
+// in the disk queue, are retained for indexing when the queue is next opened.
+//
+// If Config.DrainOnClose is true, Close drains the indexer before closing
+// it, continuing to accept events until the events buffered when Close is
+// called have been flushed.
+//
+// The first call to Close logs a summary of the indexer's lifetime stats,
+// which remain available through Stats.
 func (i *Indexer) Close(ctx context.Context) error {
+	if i.config.DrainOnClose {
+		// Flush errors are summarised below, and if ctx is
+		// cancelled, the ongoing flushes are cancelled below.
+		_ = i.Flush(ctx)
+	}
 	i.mu.Lock()
 	defer i.mu.Unlock()
 	if !i.closing {
 		i.closing = true
+		if i.queue != nil {
+			// Stop adding queued events, so they can be flushed.
+			// Events remaining in the queue will be delivered
+			// when it is next opened.
+			i.stopQueue()
+			<-i.queueDone
+		}
 
 		// Close i.closed when ctx is cancelled,
 		// unblock any ongoing flush attempts.
@@ -139,191 +815,1629 @@ func (i *Indexer) Close(ctx context.Context) error {
 			}
 		}()
 
-		i.activeMu.Lock()
-		defer i.activeMu.Unlock()
-		if i.active != nil && i.timer.Stop() {
-			i.flushActiveLocked(ctx)
+		// The flushes are cancelled through i.closed, rather than by
+		// ctx's deadline, so that their queued events are recognised
+		// as cancelled by Close and are not acknowledged.
+		for _, shard := range i.shards {
+			shard.mu.Lock()
+			if shard.active != nil && shard.timer.Stop() {
+				i.flushActiveLocked(apm.DetachedContext(ctx), shard)
+			}
+			shard.mu.Unlock()
+		}
+	}
+	i.g.Wait()
+	err := i.flushErrorSummary()
+	if i.queue != nil {
+		if closeErr := i.queue.close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close disk queue: %w", closeErr)
+		}
+	}
+	if lost := atomic.LoadInt64(&i.eventsLost); lost > 0 {
+		err = &dataLossError{events: int(lost), err: err}
+	}
+	i.closeSummaryOnce.Do(i.logCloseSummary)
+	if i.deadLetterQueue != nil {
+		// Wait for queued failed documents to be sent to the dead letter sink.
+		i.deadLetterOnce.Do(func() { close(i.deadLetterQueue) })
+		select {
+		case <-i.deadLetterDone:
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
 		}
 	}
-	return i.g.Wait()
+	return err
 }
 
-// Stats returns the bulk indexing stats.
-func (i *Indexer) Stats() Stats {
-	return Stats{
-		Added:  atomic.LoadInt64(&i.eventsAdded),
-		Active: atomic.LoadInt64(&i.eventsActive),
-		Failed: atomic.LoadInt64(&i.eventsFailed),
+// Flush flushes any buffered events, and waits for all ongoing flushes to
+// complete. Unlike Close, the indexer may continue to be used after Flush
+// returns.
+//
+// Flush returns the first error returned by the flushes it waited for. If
+// ctx is cancelled, Flush returns without waiting for them to complete.
+func (i *Indexer) Flush(ctx context.Context) error {
+	if !i.flushShards(apm.DetachedContext(ctx)) {
+		return ErrClosed
+	}
+
+	i.inflightMu.Lock()
+	flushes := make([]*inflightFlush, 0, len(i.inflight))
+	for flush := range i.inflight {
+		flushes = append(flushes, flush)
 	}
+	i.inflightMu.Unlock()
+
+	var err error
+	for _, flush := range flushes {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-flush.done:
+			if err == nil {
+				err = flush.err
+			}
+		}
+	}
+	return err
 }
 
-// ProcessBatch creates a document for each event in batch, and adds them to the
-// Elasticsearch bulk indexer.
-//
-// If the indexer has been closed, ProcessBatch returns ErrClosed.
-func (i *Indexer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
+// TriggerFlush starts flushing any buffered events, without waiting for
+// the flushes to complete, such as for forcing buffered events to be indexed
+// from a signal handler or admin endpoint while debugging. TriggerFlush does
+// nothing if no events are buffered, or if the indexer is closed.
+func (i *Indexer) TriggerFlush() {
+	i.flushShards(context.Background())
+}
+
+// flushShards starts flushing the active bulk indexer of each shard,
+// returning false if the indexer is closing.
+func (i *Indexer) flushShards(ctx context.Context) bool {
 	i.mu.RLock()
 	defer i.mu.RUnlock()
 	if i.closing {
-		return ErrClosed
+		return false
 	}
-	for _, event := range *batch {
-		if err := i.processEvent(ctx, &event); err != nil {
-			return err
+	for _, shard := range i.shards {
+		shard.mu.Lock()
+		if shard.active != nil {
+			// If the timer has already fired, flushActive will
+			// find no active bulk indexer and do nothing.
+			shard.timer.Stop()
+			i.flushActiveLocked(ctx, shard)
 		}
+		shard.mu.Unlock()
 	}
-	return nil
+	return true
 }
 
-func (i *Indexer) processEvent(ctx context.Context, event *model.APMEvent) error {
-	r := getPooledReader()
-	beatEvent := event.BeatEvent(ctx)
-	if err := r.encoder.AddRaw(&beatEvent); err != nil {
-		return err
-	}
-
-	r.indexBuilder.WriteString(event.DataStream.Type)
-	r.indexBuilder.WriteByte('-')
-	r.indexBuilder.WriteString(event.DataStream.Dataset)
-	r.indexBuilder.WriteByte('-')
-	r.indexBuilder.WriteString(event.DataStream.Namespace)
-	index := r.indexBuilder.String()
-
-	i.activeMu.Lock()
-	defer i.activeMu.Unlock()
-	if i.active == nil {
+// Wait blocks until all events added to the indexer have been flushed, or
+// until ctx is done, in which case Wait returns ctx.Err(). Unlike Flush,
+// Wait does not cause buffered events to be flushed early; they are flushed
+// according to the configured thresholds. Events may continue to be added
+// while waiting, which may delay Wait returning.
+func (i *Indexer) Wait(ctx context.Context) error {
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&i.eventsActive) != 0 || (i.queue != nil && i.queue.pending() != 0) {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case i.active = <-i.available:
-		}
-		if i.timer == nil {
-			i.timer = time.AfterFunc(
-				i.config.FlushInterval,
-				i.flushActive,
-			)
-		} else {
-			i.timer.Reset(i.config.FlushInterval)
+		case <-ticker.C:
 		}
 	}
+	return nil
+}
 
-	if err := i.active.Add(elasticsearch.BulkIndexerItem{
-		Index:  index,
-		Action: "create",
-		Body:   r,
-	}); err != nil {
+// Ping checks that Elasticsearch is reachable, by sending a lightweight
+// request with the client or transport used for bulk requests. Ping may be
+// used to check readiness before processing events.
+func (i *Indexer) Ping(ctx context.Context) error {
+	res, err := esapi.PingRequest{}.Do(ctx, i.bulkTransport())
+	if err != nil {
 		return err
 	}
-	atomic.AddInt64(&i.eventsAdded, 1)
-	atomic.AddInt64(&i.eventsActive, 1)
-
-	if i.active.Len() >= i.config.FlushBytes {
-		if i.timer.Stop() {
-			i.flushActiveLocked(context.Background())
-		}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("ping failed: %s", res.Status())
 	}
 	return nil
 }
 
-func (i *Indexer) flushActive() {
-	i.activeMu.Lock()
-	defer i.activeMu.Unlock()
-	i.flushActiveLocked(context.Background())
+// SetClient replaces the client used for bulk requests, including any
+// Config.Transport, such as to fail over to another Elasticsearch cluster
+// without losing buffered events.
+//
+// Bulk requests flushed after SetClient returns will use the new client.
+// Flushes which are already in progress, including their retries, will
+// continue to use the previous client until they complete.
+func (i *Indexer) SetClient(client elasticsearch.Client) {
+	i.transportMu.Lock()
+	defer i.transportMu.Unlock()
+	i.transport = client
 }
 
-func (i *Indexer) flushActiveLocked(ctx context.Context) {
-	// Create a child context which is cancelled when the context passed to i.Close is cancelled.
-	flushed := make(chan struct{})
-	ctx, cancel := context.WithCancel(ctx)
-	go func() {
-		defer cancel()
-		select {
-		case <-i.closed:
-		case <-flushed:
-		}
-	}()
-	bulkIndexer := i.active
-	i.active = nil
-	i.g.Go(func() error {
-		defer close(flushed)
-		err := i.flush(ctx, bulkIndexer)
-		bulkIndexer.Reset()
-		i.available <- bulkIndexer
-		return err
-	})
+// bulkTransport returns the transport to use for bulk requests.
+func (i *Indexer) bulkTransport() esapi.Transport {
+	i.transportMu.RLock()
+	defer i.transportMu.RUnlock()
+	return i.transport
 }
 
-func (i *Indexer) flush(ctx context.Context, bulkIndexer *bulkIndexer) error {
-	n := bulkIndexer.Items()
-	if n == 0 {
-		return nil
+// Stats returns the bulk indexing stats.
+func (i *Indexer) Stats() Stats {
+	var failedDocsDropped int64
+	if i.failedDocs != nil {
+		failedDocsDropped = atomic.LoadInt64(&i.failedDocs.dropped)
 	}
-	defer atomic.AddInt64(&i.eventsActive, -int64(n))
-	resp, err := bulkIndexer.Flush(ctx)
-	if err != nil {
-		atomic.AddInt64(&i.eventsFailed, int64(n))
-		i.logger.With(logp.Error(err)).Error("bulk indexing request failed")
-		return err
+	return Stats{
+		Added:                 atomic.LoadInt64(&i.eventsAdded),
+		Active:                atomic.LoadInt64(&i.eventsActive),
+		ActiveBytes:           atomic.LoadInt64(&i.activeBytes),
+		OldestActiveEventAge:  i.oldestActiveEventAge(),
+		Failed:                atomic.LoadInt64(&i.eventsFailed),
+		FailedMapping:         i.failures.load(failureMapping),
+		FailedVersionConflict: i.failures.load(failureVersionConflict),
+		FailedTooManyRequests: i.failures.load(failureTooManyRequests),
+		FailedTransport:       i.failures.load(failureTransport),
+		FailedOther:           i.failures.load(failureOther),
+		RetriedDocs:           atomic.LoadInt64(&i.docsRetried),
+		TooManyRequests:       atomic.LoadInt64(&i.tooManyReqs),
+		TooLarge:              atomic.LoadInt64(&i.tooLarge),
+		InvalidDataStream:     atomic.LoadInt64(&i.invalidDataStream),
+		Deduplicated:          atomic.LoadInt64(&i.deduplicated),
+		FailedSecondary:       atomic.LoadInt64(&i.failedSecond),
+		AvailableBuffers:      len(i.available),
+		MaxRequests:           i.maxRequests(),
+		BulkRequests:          atomic.LoadInt64(&i.bulkRequests),
+		ESTookMillis:          atomic.LoadInt64(&i.esTook),
+		BytesFlushed:          atomic.LoadInt64(&i.bytesFlushed),
+		BytesUncompressed:     atomic.LoadInt64(&i.bytesRaw),
+		FailedDocsDropped:     failedDocsDropped,
+		DeadLettersDropped:    atomic.LoadInt64(&i.deadLettersDropped),
+		CircuitOpen:           i.breaker != nil && i.breaker.isOpen(),
+		LastError:             i.lastFlushError(),
 	}
-	var eventsFailed int64
-	for _, item := range resp.Items {
-		for _, info := range item {
-			if info.Error.Type != "" || info.Status > 201 {
-				eventsFailed++
-				i.logger.Errorf(
-					"failed to index event (%s): %s",
-					info.Error.Type, info.Error.Reason,
-				)
-			}
+}
+
+// oldestActiveEventAge returns the time elapsed since the first event was
+// added to the oldest of the shards' active bulk request buffers.
+func (i *Indexer) oldestActiveEventAge() time.Duration {
+	var oldest int64
+	for _, shard := range i.shards {
+		since := atomic.LoadInt64(&shard.activeSince)
+		if since != 0 && (oldest == 0 || since < oldest) {
+			oldest = since
 		}
 	}
-	if eventsFailed > 0 {
-		atomic.AddInt64(&i.eventsFailed, eventsFailed)
+	if oldest == 0 {
+		return 0
 	}
-	return nil
+	return time.Since(time.Unix(0, oldest))
 }
 
-var pool sync.Pool
+// maxRequests returns the current limit on concurrent bulk requests.
+func (i *Indexer) maxRequests() int64 {
+	if i.scaler != nil {
+		return i.scaler.limit()
+	}
+	return int64(i.config.MaxRequests)
+}
 
-type pooledReader struct {
-	buf          bytes.Buffer
-	indexBuilder strings.Builder
-	encoder      encoder
+func (i *Indexer) lastFlushError() error {
+	i.flushErrorsMu.Lock()
+	defer i.flushErrorsMu.Unlock()
+	return i.lastFlushErr
 }
 
-func getPooledReader() *pooledReader {
-	if r, ok := pool.Get().(*pooledReader); ok {
-		return r
+// FailedDocs returns the most recent documents which failed to be indexed,
+// oldest first, up to Config.MaxFailedDocsRetained.
+//
+// FailedDocs returns nil if Config.MaxFailedDocsRetained is zero.
+func (i *Indexer) FailedDocs() []FailedDoc {
+	if i.failedDocs == nil {
+		return nil
 	}
-	r := &pooledReader{}
-	r.encoder = eslegclient.NewJSONEncoder(&r.buf, false)
-	return r
+	return i.failedDocs.docs()
 }
 
-func (r *pooledReader) Read(p []byte) (int, error) {
-	n, err := r.buf.Read(p)
-	if err == io.EOF {
-		// Release the reader back into the pool after it has been consumed.
-		r.indexBuilder.Reset()
-		r.encoder.Reset()
-		pool.Put(r)
+// LatencyStats returns statistics for the latency of bulk requests,
+// measured from the time a request is sent until the response is received.
+//
+// If reset is true, the latency histogram is reset after the statistics are
+// taken, so a caller may periodically obtain statistics for each interval.
+func (i *Indexer) LatencyStats(reset bool) LatencyStats {
+	i.latencyMu.Lock()
+	defer i.latencyMu.Unlock()
+	stats := LatencyStats{
+		Count: i.latency.TotalCount(),
+		P50:   time.Duration(i.latency.ValueAtQuantile(50)) * time.Microsecond,
+		P95:   time.Duration(i.latency.ValueAtQuantile(95)) * time.Microsecond,
+		P99:   time.Duration(i.latency.ValueAtQuantile(99)) * time.Microsecond,
+		Max:   time.Duration(i.latency.Max()) * time.Microsecond,
 	}
-	return n, err
+	if reset {
+		i.latency.Reset()
+	}
+	return stats
 }
 
-type encoder interface {
-	AddRaw(interface{}) error
-	Reset()
+// recordLatency records the latency of a bulk request.
+func (i *Indexer) recordLatency(ctx context.Context, d time.Duration) {
+	if i.metrics != nil {
+		i.metrics.recordFlushDuration(ctx, d)
+	}
+	if d < minFlushLatency {
+		d = minFlushLatency
+	} else if d > maxFlushLatency {
+		d = maxFlushLatency
+	}
+	i.latencyMu.Lock()
+	defer i.latencyMu.Unlock()
+	i.latency.RecordValue(d.Microseconds())
 }
 
-// Stats holds bulk indexing statistics.
-type Stats struct {
-	// Active holds the active number of items waiting in the indexer's queue.
+// IndexStats returns the bulk indexing stats for each index, keyed by index name.
+//
+// IndexStats returns nil unless Config.TrackPerIndexStats is true. The FlushDuration
+// field of each Stats holds the accumulated time spent flushing bulk requests that
+// contained items for the index.
+func (i *Indexer) IndexStats() map[string]Stats {
+	if i.indexStats == nil {
+		return nil
+	}
+	return i.indexStats.snapshot()
+}
+
+// ProcessBatch creates a document for each event in batch, and adds them to the
+// Elasticsearch bulk indexer.
+//
+// If the indexer has been closed, ProcessBatch returns ErrClosed. If the
+// circuit breaker is open, ProcessBatch returns ErrCircuitOpen.
+//
+// Events which cannot be encoded as documents are skipped, and the remaining
+// events in the batch are processed. ProcessBatch then returns an error
+// summarising the number of events skipped, and wrapping the first error.
+//
+// If Config.DiskQueueDir is set, the encoded events are appended to the disk
+// queue, and ProcessBatch returns once they have been synced to disk. If the
+// queue is full, ProcessBatch returns ErrFull and no events are queued.
+//
+// If Config.OrderedBatches is true, the events are encoded before any are
+// added, and then added to the same bulk request buffer.
+//
+// Otherwise, ProcessBatch returns immediately if an event cannot be added to
+// a bulk request buffer. If ctx is cancelled or its deadline is exceeded while
+// waiting for a buffer to become available, ProcessBatch returns ctx.Err();
+// events preceding the one being added remain buffered for indexing.
+func (i *Indexer) ProcessBatch(ctx context.Context, batch *model.Batch) error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.closing {
+		return ErrClosed
+	}
+	if i.breaker != nil && !i.breaker.allow() {
+		return ErrCircuitOpen
+	}
+	var skipped int
+	var firstErr error
+	var queued *bulkIndexer
+	var ordered []bulkIndexerItem
+	if i.queue != nil {
+		queued = newBulkIndexer(gzip.NoCompression)
+	} else if i.config.OrderedBatches {
+		ordered = make([]bulkIndexerItem, 0, len(*batch))
+	}
+	for _, event := range *batch {
+		var err error
+		switch {
+		case queued != nil:
+			err = i.queueEvent(ctx, &event, queued)
+		case ordered != nil:
+			var item bulkIndexerItem
+			if item, err = i.encodeEvent(ctx, &event); err == nil && item.Body != nil {
+				ordered = append(ordered, item)
+			}
+		default:
+			err = i.processEvent(ctx, &event)
+		}
+		if err != nil {
+			var encodeErr encodeError
+			if !errors.As(err, &encodeErr) {
+				return err
+			}
+			if firstErr == nil {
+				firstErr = encodeErr.err
+			}
+			skipped++
+		}
+	}
+	if queued != nil && queued.Items() > 0 {
+		if err := i.queue.write(queued); err != nil {
+			return err
+		}
+	}
+	if len(ordered) > 0 {
+		if err := i.addOrderedItems(ctx, ordered); err != nil {
+			return err
+		}
+	}
+	if skipped > 0 {
+		return fmt.Errorf(
+			"failed to encode %d of %d events, first error: %w",
+			skipped, len(*batch), firstErr,
+		)
+	}
+	return nil
+}
+
+// encodeError is returned by processEvent when an event cannot be
+// encoded as a document, and has been skipped.
+type encodeError struct {
+	err error
+}
+
+func (e encodeError) Error() string {
+	return e.err.Error()
+}
+
+// ProcessBatchSync is like ProcessBatch, but waits for the bulk requests
+// containing the batch's events to complete, and returns the result of
+// indexing each event, by position in batch. A nil result means that the
+// event's document was indexed.
+//
+// ProcessBatchSync trades throughput for confirmation that events have been
+// indexed: callers wait until the events' bulk requests are flushed, which may
+// take up to Config.FlushInterval, and then until all retries are complete.
+// If an event cannot be encoded its result is the encoding error, and if it
+// exceeds Config.MaxDocumentBytes its result is ErrDocumentTooLarge. If the
+// document fails to be indexed, its result is a *DocumentError.
+//
+// Events are added directly to bulk requests, bypassing the disk queue if
+// Config.DiskQueueDir is set, as the caller is informed of their results.
+//
+// ProcessBatchSync returns an error, and no results, if the indexer has
+// been closed, the circuit breaker is open, or an event cannot be added to
+// a bulk request buffer. If ctx is cancelled or its deadline is exceeded,
+// ProcessBatchSync returns ctx.Err(); events already added remain buffered
+// for indexing.
+func (i *Indexer) ProcessBatchSync(ctx context.Context, batch *model.Batch) ([]error, error) {
+	results := &syncBatch{errs: make([]error, len(*batch))}
+	if err := i.addSyncBatch(ctx, batch, results); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		results.wg.Wait()
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-done:
+	}
+	return results.errs, nil
+}
+
+// addSyncBatch adds the events in batch to bulk request buffers, recording
+// results for those events which are not added.
+func (i *Indexer) addSyncBatch(ctx context.Context, batch *model.Batch, results *syncBatch) error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.closing {
+		return ErrClosed
+	}
+	if i.breaker != nil && !i.breaker.allow() {
+		return ErrCircuitOpen
+	}
+	for index := range *batch {
+		item, err := i.encodeEvent(ctx, &(*batch)[index])
+		if err != nil {
+			var encodeErr encodeError
+			if !errors.As(err, &encodeErr) {
+				return err
+			}
+			results.errs[index] = encodeErr.err
+			continue
+		}
+		if item.Body == nil {
+			results.errs[index] = ErrDocumentTooLarge
+			continue
+		}
+		results.wg.Add(1)
+		if err := i.addItem(ctx, item, 0, &syncWaiter{batch: results, event: index}); err != nil {
+			results.wg.Done()
+			return err
+		}
+	}
+	return nil
+}
+
+// syncBatch holds the results of a batch of events processed by
+// ProcessBatchSync, and the number of events awaiting results.
+type syncBatch struct {
+	wg   sync.WaitGroup
+	errs []error
+}
+
+// syncWaiter associates an item in a bulk request with the event
+// from which it was encoded, in a batch processed by ProcessBatchSync.
+type syncWaiter struct {
+	batch    *syncBatch
+	event    int // position of the event in the batch
+	position int // position of the item in the bulk request
+}
+
+// notifySyncWaiters reports the results of the items flushed with
+// bulkIndexer to the ProcessBatchSync callers waiting for them.
+func notifySyncWaiters(bulkIndexer *bulkIndexer) {
+	for _, w := range bulkIndexer.waiters {
+		w.batch.errs[w.event] = bulkIndexer.errs[w.position]
+		w.batch.wg.Done()
+	}
+}
+
+func (i *Indexer) processEvent(ctx context.Context, event *model.APMEvent) error {
+	item, err := i.encodeEvent(ctx, event)
+	if err != nil || item.Body == nil {
+		return err
+	}
+	return i.addItem(ctx, item, 0, nil)
+}
+
+// queueEvent encodes event, and adds it to queued for
+// appending to the disk queue.
+func (i *Indexer) queueEvent(ctx context.Context, event *model.APMEvent, queued *bulkIndexer) error {
+	item, err := i.encodeEvent(ctx, event)
+	if err != nil || item.Body == nil {
+		return err
+	}
+	_, err = queued.Add(item)
+	return err
+}
+
+// encodeEvent encodes event as a bulk item, with a *pooledReader body. If
+// the event is dropped due to exceeding Config.MaxDocumentBytes, the item
+// is returned with a nil body.
+func (i *Indexer) encodeEvent(ctx context.Context, event *model.APMEvent) (bulkIndexerItem, error) {
+	action, documentID := actionCreate, ""
+	if i.config.DocumentAction != nil {
+		action, documentID = i.config.DocumentAction(event)
+		switch action {
+		case "":
+			action = actionCreate
+		case actionCreate, actionIndex:
+		case actionUpdate:
+			if documentID == "" {
+				return bulkIndexerItem{}, encodeError{errors.New("document ID is required for update action")}
+			}
+		default:
+			return bulkIndexerItem{}, encodeError{fmt.Errorf("unsupported bulk action %q", action)}
+		}
+	}
+	timeSeries := i.config.TimeSeries != nil && i.config.TimeSeries(event)
+	if timeSeries {
+		if action != actionCreate {
+			return bulkIndexerItem{}, encodeError{fmt.Errorf("%s action is not supported for time series data streams", action)}
+		}
+		documentID = ""
+	}
+	var version int64
+	var versionType string
+	if i.config.EventVersion != nil {
+		var ok bool
+		if version, ok = i.config.EventVersion(event); ok {
+			if action != actionIndex {
+				return bulkIndexerItem{}, encodeError{fmt.Errorf("external versioning is not supported for %s action", action)}
+			}
+			versionType = versionTypeExternal
+		}
+	}
+
+	r := i.readers.get()
+	beatEvent := event.BeatEvent(ctx)
+	if action == actionUpdate {
+		r.buf.WriteString(`{"doc":`)
+	}
+	if err := r.encoder.AddRaw(&beatEvent); err != nil {
+		r.release()
+		return bulkIndexerItem{}, encodeError{err}
+	}
+	if action == actionUpdate {
+		// Replace the newline added by the encoder.
+		r.buf.Truncate(r.buf.Len() - 1)
+		r.buf.WriteString(`,"doc_as_upsert":true}` + "\n")
+	}
+	if i.config.MaxDocumentBytes > 0 && r.buf.Len() > i.config.MaxDocumentBytes {
+		atomic.AddInt64(&i.tooLarge, 1)
+		i.logger.Warnf(
+			"dropping event: document size %d exceeds maximum of %d bytes",
+			r.buf.Len(), i.config.MaxDocumentBytes,
+		)
+		r.release()
+		return bulkIndexerItem{}, nil
+	}
+
+	var index, routing string
+	if i.config.EventIndex != nil {
+		index, routing = i.config.EventIndex(event)
+	}
+	if index == "" && i.config.IndexNamer != nil {
+		index = i.config.IndexNamer(event)
+	} else if index == "" {
+		if i.config.ValidateDataStreams {
+			if err := checkDataStream(event.DataStream); err != nil {
+				r.release()
+				atomic.AddInt64(&i.invalidDataStream, 1)
+				i.logger.Warnf("skipping %s processor event: %s", event.Processor.Name, err)
+				return bulkIndexerItem{}, encodeError{err}
+			}
+		}
+		r.indexBuilder.WriteString(event.DataStream.Type)
+		r.indexBuilder.WriteByte('-')
+		r.indexBuilder.WriteString(event.DataStream.Dataset)
+		r.indexBuilder.WriteByte('-')
+		r.indexBuilder.WriteString(event.DataStream.Namespace)
+		index = r.indexBuilder.String()
+	}
+
+	pipeline := i.config.Pipeline
+	if i.config.EventPipeline != nil {
+		if eventPipeline := i.config.EventPipeline(event); eventPipeline != "" {
+			pipeline = eventPipeline
+		}
+	}
+
+	return bulkIndexerItem{
+		Index:        index,
+		Action:       action,
+		DocumentID:   documentID,
+		Pipeline:     pipeline,
+		Routing:      routing,
+		RequireAlias: i.config.RequireAlias,
+		Version:      version,
+		VersionType:  versionType,
+		TimeSeries:   timeSeries,
+		Body:         r,
+	}, nil
+}
+
+// checkDataStream returns an error wrapping ErrInvalidDataStream
+// if any component of ds is empty, as the data stream name would
+// otherwise be malformed, such as "logs--default".
+func checkDataStream(ds model.DataStream) error {
+	var empty string
+	switch {
+	case ds.Type == "":
+		empty = "type"
+	case ds.Dataset == "":
+		empty = "dataset"
+	case ds.Namespace == "":
+		empty = "namespace"
+	default:
+		return nil
+	}
+	return fmt.Errorf("%w: empty data stream %s", ErrInvalidDataStream, empty)
+}
+
+// addItem adds item to the active bulk request buffer of the next shard,
+// waiting for a buffer to become available if necessary. If seq is non-zero,
+// it holds the item's disk queue sequence number, which is acknowledged once
+// the item has been flushed. If waiter is non-nil, the item's result will be
+// reported to it once the item has been flushed.
+func (i *Indexer) addItem(ctx context.Context, item bulkIndexerItem, seq uint64, waiter *syncWaiter) error {
+	shard := i.nextShard()
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if err := i.addItemLocked(ctx, shard, item, seq, waiter); err != nil {
+		return err
+	}
+	i.maybeFlushLocked(ctx, shard)
+	return nil
+}
+
+// addOrderedItems adds items to the active bulk request buffer of the
+// next shard, as for addItem, holding the shard's lock until all items
+// have been added so that they are flushed in the same bulk request.
+// If an item cannot be added, the remaining items are released.
+func (i *Indexer) addOrderedItems(ctx context.Context, items []bulkIndexerItem) error {
+	shard := i.nextShard()
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	for j, item := range items {
+		if err := i.addItemLocked(ctx, shard, item, 0, nil); err != nil {
+			for _, item := range items[j+1:] {
+				if r, ok := item.Body.(*pooledReader); ok {
+					r.release()
+				}
+			}
+			return err
+		}
+	}
+	i.maybeFlushLocked(ctx, shard)
+	return nil
+}
+
+// nextShard returns the shard to which the next item should be added.
+func (i *Indexer) nextShard() *activeShard {
+	if len(i.shards) == 1 {
+		return i.shards[0]
+	}
+	n := atomic.AddUint32(&i.nextShardIndex, 1)
+	return i.shards[n%uint32(len(i.shards))]
+}
+
+// addItemLocked adds item to the active bulk request buffer of shard,
+// which must be locked, without flushing it.
+func (i *Indexer) addItemLocked(ctx context.Context, shard *activeShard, item bulkIndexerItem, seq uint64, waiter *syncWaiter) error {
+	if shard.active == nil {
+		if err := i.waitAvailableLocked(ctx, shard); err != nil {
+			if r, ok := item.Body.(*pooledReader); ok {
+				r.release()
+			}
+			return err
+		}
+		atomic.StoreInt64(&shard.activeSince, time.Now().UnixNano())
+		if shard.timer == nil {
+			shard.timer = time.AfterFunc(
+				i.flushInterval(),
+				func() { i.flushActive(shard) },
+			)
+		} else {
+			shard.timer.Reset(i.flushInterval())
+		}
+	}
+
+	n, err := shard.active.Add(item)
+	if err != nil {
+		return err
+	}
+	if seq != 0 {
+		shard.active.seqs = append(shard.active.seqs, seq)
+	}
+	if waiter != nil {
+		waiter.position = shard.active.Position(shard.active.Items() - 1)
+		shard.active.waiters = append(shard.active.waiters, *waiter)
+	}
+	shard.bytes += n
+	atomic.AddInt64(&i.activeBytes, int64(n))
+	atomic.AddInt64(&i.eventsAdded, 1)
+	atomic.AddInt64(&i.eventsActive, 1)
+	if i.indexStats != nil {
+		stats := i.indexStats.get(item.Index)
+		atomic.AddInt64(&stats.added, 1)
+		atomic.AddInt64(&stats.active, 1)
+	}
+	return nil
+}
+
+// maybeFlushLocked flushes the active bulk request buffer of shard,
+// which must be locked, if it has reached FlushBytes or FlushDocuments.
+func (i *Indexer) maybeFlushLocked(ctx context.Context, shard *activeShard) {
+	if shard.active == nil {
+		return
+	}
+	flushBytes := shard.bytes
+	if shard.active.incremental {
+		flushBytes = shard.active.CompressedLen()
+	}
+	if flushBytes >= i.config.FlushBytes ||
+		(i.config.FlushDocuments > 0 && shard.active.Items() >= i.config.FlushDocuments) {
+		if shard.timer.Stop() {
+			i.flushActiveLocked(apm.DetachedContext(ctx), shard)
+		}
+	}
+}
+
+// newIndexerBulkIndexer returns a new bulk request buffer for cfg,
+// compressing incrementally if cfg.FlushCompressedBytes is set, and
+// setting cfg.Headers on its requests.
+func newIndexerBulkIndexer(cfg Config) *bulkIndexer {
+	b := newBulkIndexer(cfg.CompressionLevel)
+	b.incremental = cfg.FlushCompressedBytes && cfg.CompressionLevel != gzip.NoCompression
+	if len(cfg.Headers) > 0 {
+		b.header = make(http.Header, len(cfg.Headers))
+		for key, value := range cfg.Headers {
+			b.header.Set(key, value)
+		}
+	}
+	return b
+}
+
+// flushInterval returns the duration after which to flush a newly active
+// bulk request buffer, applying Config.FlushIntervalJitter if non-zero.
+func (i *Indexer) flushInterval() time.Duration {
+	interval := i.config.FlushInterval
+	if i.config.FlushIntervalJitter > 0 {
+		jitter := (2*rand.Float64() - 1) * i.config.FlushIntervalJitter
+		interval += time.Duration(jitter * float64(interval))
+	}
+	return interval
+}
+
+// waitAvailableLocked waits for a bulk request buffer to become available,
+// and sets it as the shard's active buffer.
+func (i *Indexer) waitAvailableLocked(ctx context.Context, shard *activeShard) error {
+	if i.scaler != nil {
+		select {
+		case shard.active = <-i.available:
+			return nil
+		default:
+		}
+		if i.scaler.grow() {
+			shard.active = newIndexerBulkIndexer(i.config)
+			return nil
+		}
+	}
+	var timeout <-chan time.Time
+	if i.config.AddTimeout > 0 {
+		timer := time.NewTimer(i.config.AddTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout:
+		return ErrFull
+	case shard.active = <-i.available:
+		return nil
+	}
+}
+
+func (i *Indexer) flushActive(shard *activeShard) {
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if shard.active != nil {
+		i.flushActiveLocked(context.Background(), shard)
+	}
+}
+
+func (i *Indexer) flushActiveLocked(ctx context.Context, shard *activeShard) {
+	// Create a child context which is cancelled when the context passed to i.Close is cancelled.
+	flushed := make(chan struct{})
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		defer cancel()
+		select {
+		case <-i.closed:
+		case <-flushed:
+		}
+	}()
+	bulkIndexer := shard.active
+	shard.active = nil
+	atomic.StoreInt64(&shard.activeSince, 0)
+	atomic.AddInt64(&i.activeBytes, -int64(shard.bytes))
+	shard.bytes = 0
+	inflight := &inflightFlush{done: flushed}
+	i.inflightMu.Lock()
+	i.inflight[inflight] = struct{}{}
+	i.inflightMu.Unlock()
+	i.g.Go(func() error {
+		items := bulkIndexer.Items()
+		start := time.Now()
+		deadLetters, err := i.flush(ctx, bulkIndexer)
+		if len(bulkIndexer.seqs) > 0 {
+			i.ackQueued(bulkIndexer, err)
+		}
+		if len(bulkIndexer.waiters) > 0 {
+			notifySyncWaiters(bulkIndexer)
+		}
+		bulkIndexer.Reset()
+		if i.scaler == nil || items == 0 || !i.scaler.release(time.Since(start)) {
+			i.available <- bulkIndexer
+		}
+		if len(deadLetters) > 0 {
+			i.enqueueDeadLetters(deadLetters)
+		}
+		i.inflightMu.Lock()
+		delete(i.inflight, inflight)
+		i.inflightMu.Unlock()
+		inflight.err = err
+		close(flushed)
+		return nil
+	})
+}
+
+// runDiskQueue adds events from the disk queue to bulk requests,
+// until ctx is cancelled.
+func (i *Indexer) runDiskQueue(ctx context.Context) {
+	defer close(i.queueDone)
+	for {
+		data, seq, err := i.queue.next(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				i.logger.With(logp.Error(err)).Error("failed to read from disk queue, no longer indexing queued events")
+			}
+			return
+		}
+		item, err := decodeQueuedItem(data)
+		if err != nil {
+			i.logger.With(logp.Error(err)).Errorf("dropping invalid disk queue entry %d", seq)
+			if err := i.queue.ack([]uint64{seq}); err != nil {
+				i.logger.With(logp.Error(err)).Error("failed to acknowledge disk queue entries")
+			}
+			continue
+		}
+		// Queued events have already been accepted,
+		// so wait for a buffer regardless of AddTimeout.
+		for {
+			if err = i.addItem(ctx, item, seq, nil); err != ErrFull {
+				break
+			}
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				i.logger.With(logp.Error(err)).Error("failed to add queued event, no longer indexing queued events")
+			}
+			return
+		}
+	}
+}
+
+// ackQueued acknowledges the disk queue entries of the events flushed with
+// bulkIndexer, given the flush error. Entries are not acknowledged if the
+// flush was cancelled by Close, so that they are delivered again when the
+// queue is next opened. If the flush failed with a retryable error, the
+// events remaining in bulkIndexer are first appended to the queue again.
+func (i *Indexer) ackQueued(bulkIndexer *bulkIndexer, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err != nil && isRetryableFlushError(err) && bulkIndexer.Items() > 0 {
+		if err := i.queue.requeue(bulkIndexer); err != nil {
+			i.logger.With(logp.Error(err)).Error("failed to requeue events, they will be retried on restart")
+			return
+		}
+	}
+	if err := i.queue.ack(bulkIndexer.seqs); err != nil {
+		i.logger.With(logp.Error(err)).Error("failed to acknowledge disk queue entries")
+	}
+}
+
+// dataLossError is returned by Close when events were not indexed due
+// to their flushes being cancelled, wrapping the flush error summary.
+type dataLossError struct {
+	events int
+	err    error
+}
+
+func (e *dataLossError) Error() string {
+	return fmt.Sprintf("closed with data loss, %d events not indexed: %s", e.events, e.err)
+}
+
+func (e *dataLossError) Unwrap() error {
+	return e.err
+}
+
+// ClosedWithDataLoss reports whether err, returned by Indexer.Close,
+// indicates that buffered events were lost due to the context passed
+// to Close being cancelled before they could be flushed, and if so,
+// the number of events lost.
+func ClosedWithDataLoss(err error) (n int, ok bool) {
+	var dataLossErr *dataLossError
+	if errors.As(err, &dataLossErr) {
+		return dataLossErr.events, true
+	}
+	return 0, false
+}
+
+// flushFailed records the failure of a flush, due to err, with
+// the given number of documents failing to be indexed.
+func (i *Indexer) flushFailed(err error, failed int) {
+	i.flushErrorsMu.Lock()
+	defer i.flushErrorsMu.Unlock()
+	i.flushErrors++
+	i.flushErrorsDocs += failed
+	if i.flushErr == nil {
+		i.flushErr = err
+	}
+	i.lastFlushErr = err
+}
+
+// logCloseSummary logs a summary of the indexer's lifetime stats,
+// at error level if any events failed to be indexed.
+func (i *Indexer) logCloseSummary() {
+	stats := i.Stats()
+	logger := i.logger.With(
+		"events.added", stats.Added,
+		"events.failed", stats.Failed,
+		"events.retried", stats.RetriedDocs,
+		"bulk_requests", stats.BulkRequests,
+		"bytes_flushed", stats.BytesFlushed,
+	)
+	if stats.LastError != nil {
+		logger = logger.With(logp.Error(stats.LastError))
+	}
+	if stats.Failed > 0 || stats.LastError != nil {
+		logger.Error("model indexer closed with failures")
+		return
+	}
+	logger.Info("model indexer closed")
+}
+
+// flushErrorSummary returns an error summarising the flushes that have
+// failed, wrapping the first flush error, or nil if no flushes have failed.
+func (i *Indexer) flushErrorSummary() error {
+	i.flushErrorsMu.Lock()
+	defer i.flushErrorsMu.Unlock()
+	if i.flushErrors == 0 {
+		return nil
+	}
+	return fmt.Errorf(
+		"%d bulk requests failed (%d documents not indexed), first error: %w",
+		i.flushErrors, i.flushErrorsDocs, i.flushErr,
+	)
+}
+
+// flush flushes the items buffered in bulkIndexer, retrying failed items
+// as necessary. If there is a dead letter sink, flush returns the items
+// which failed permanently, including those which could not be indexed
+// due to a request-level error.
+func (i *Indexer) flush(ctx context.Context, bulkIndexer *bulkIndexer) ([]FailedDoc, error) {
+	n := bulkIndexer.Items()
+	if n == 0 {
+		return nil, nil
+	}
+	var deadLetters []FailedDoc
+	var deadLettersPtr *[]FailedDoc
+	if i.deadLetterQueue != nil {
+		deadLettersPtr = &deadLetters
+	}
+	defer atomic.AddInt64(&i.eventsActive, -int64(n))
+	if i.indexStats != nil {
+		defer i.flushIndexStats(bulkIndexer)()
+	}
+	var failed int
+	var err error
+	defer func() {
+		if err != nil {
+			i.flushFailed(err, failed)
+			if errors.Is(err, context.Canceled) && i.queue == nil {
+				// Queued events are retained in the disk queue.
+				atomic.AddInt64(&i.eventsLost, int64(failed))
+			}
+		}
+		if !errors.Is(err, context.Canceled) {
+			// Flushes cancelled by Close say nothing of the
+			// health of Elasticsearch, so are not recorded.
+			i.health.record(time.Now(), err != nil)
+		}
+	}()
+	flushStart := time.Now()
+	transport := i.bulkTransport()
+	if i.config.Tracer != nil {
+		var endSpan func(failed int, err error)
+		ctx, endSpan = i.startFlushSpan(ctx, bulkIndexer)
+		defer func() { endSpan(failed, err) }()
+	}
+	if i.config.SecondaryClient != nil {
+		// Flush to the secondary first, as retrying items
+		// for the primary discards the successful items.
+		i.flushSecondary(ctx, bulkIndexer)
+	}
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		var resp elasticsearch.BulkIndexerResponse
+		resp, err = i.flushBulkIndexer(ctx, transport, bulkIndexer)
+		i.recordLatency(ctx, time.Since(start))
+		if err != nil {
+			if attempt < i.config.MaxRetries && isRetryableFlushError(err) {
+				i.logger.With(logp.Error(err)).Warn("bulk indexing request failed, retrying")
+				i.itemsRetried(bulkIndexer)
+				if err = i.waitRetry(ctx, attempt); err == nil {
+					continue
+				}
+			}
+			failed += bulkIndexer.Items()
+			i.allItemsFailed(deadLettersPtr, bulkIndexer, err)
+			i.logger.With(logp.Error(err)).Error("bulk indexing request failed")
+			if i.breaker != nil && !errors.Is(err, context.Canceled) && i.breaker.failure() {
+				i.logger.Warnf(
+					"circuit breaker tripped, rejecting events for %s",
+					i.config.CircuitBreakerCooldown,
+				)
+			}
+			return deadLetters, err
+		}
+		if i.breaker != nil {
+			i.breaker.success()
+		}
+		atomic.AddInt64(&i.esTook, int64(resp.Took))
+		items := resp.Items
+		if !resp.HasErrors {
+			// Skip checking the items if Elasticsearch
+			// reported that none of them failed.
+			items = nil
+		} else if len(items) > bulkIndexer.Items() {
+			// Response items correspond to the request items by position,
+			// so excess items cannot be correlated with any document.
+			i.logger.Errorf(
+				"bulk response has %d items, expected %d: ignoring excess items",
+				len(items), bulkIndexer.Items(),
+			)
+			items = items[:bulkIndexer.Items()]
+		}
+		var retry []int
+		var itemFailures map[itemFailureKey]*itemFailureSummary
+		for index, item := range items {
+			for _, info := range item {
+				if info.Status == http.StatusTooManyRequests {
+					atomic.AddInt64(&i.tooManyReqs, 1)
+				}
+				if info.Error.Type != "" || info.Status > 201 {
+					if i.config.TimeSeries != nil && isDuplicate(bulkIndexer, index, elasticsearch.BulkIndexerResponseItem(info)) {
+						atomic.AddInt64(&i.deduplicated, 1)
+						continue
+					}
+					if attempt < i.config.MaxRetries && isRetryable(elasticsearch.BulkIndexerResponseItem(info)) {
+						retry = append(retry, index)
+						if i.indexStats != nil {
+							atomic.AddInt64(&i.indexStats.get(bulkIndexer.Index(index)).retried, 1)
+						}
+						continue
+					}
+					failed++
+					i.itemFailed(
+						deadLettersPtr, bulkIndexer, index,
+						classifyItemFailure(info.Status, info.Error.Type),
+						info.Status, info.Error.Type, info.Error.Reason,
+					)
+					// Log the document's index and position as fields, as
+					// the logger's rate limit is applied by message.
+					i.logger.With(
+						"index", bulkIndexer.Index(index),
+						"position", bulkIndexer.Position(index),
+					).Debugf(
+						"failed to index event (%s): %s",
+						info.Error.Type, info.Error.Reason,
+					)
+					if itemFailures == nil {
+						itemFailures = make(map[itemFailureKey]*itemFailureSummary)
+					}
+					key := itemFailureKey{index: bulkIndexer.Index(index), errorType: info.Error.Type}
+					summary, ok := itemFailures[key]
+					if !ok {
+						summary = &itemFailureSummary{reason: info.Error.Reason}
+						itemFailures[key] = summary
+					}
+					summary.count++
+				}
+			}
+		}
+		for key, summary := range itemFailures {
+			i.logger.With("count", summary.count).Errorf(
+				"failed to index events in %s (%s): %s",
+				key.index, key.errorType, summary.reason,
+			)
+		}
+		if len(retry) == 0 {
+			if i.config.OnFlush != nil {
+				i.config.OnFlush(FlushResult{
+					Indexed:  n - failed,
+					Failed:   failed,
+					Duration: time.Since(flushStart),
+				})
+			}
+			return deadLetters, nil
+		}
+
+		// Retain only the retryable items, and wait before retrying.
+		bulkIndexer.Retain(retry)
+		atomic.AddInt64(&i.docsRetried, int64(len(retry)))
+		if err = i.waitRetry(ctx, attempt); err != nil {
+			failed += bulkIndexer.Items()
+			i.allItemsFailed(deadLettersPtr, bulkIndexer, err)
+			return deadLetters, err
+		}
+	}
+}
+
+// flushSecondary sends the items buffered in bulkIndexer to the
+// secondary cluster, counting any which fail to be indexed.
+func (i *Indexer) flushSecondary(ctx context.Context, bulkIndexer *bulkIndexer) {
+	if i.config.FlushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, i.config.FlushTimeout)
+		defer cancel()
+	}
+	resp, err := bulkIndexer.Flush(ctx, i.config.SecondaryClient)
+	if err != nil {
+		atomic.AddInt64(&i.failedSecond, int64(bulkIndexer.Items()))
+		i.logger.With(logp.Error(err)).Warn("secondary bulk indexing request failed")
+		return
+	}
+	if !resp.HasErrors {
+		return
+	}
+	var failed int64
+	for _, item := range resp.Items {
+		for _, info := range item {
+			if info.Error.Type != "" || info.Status > 201 {
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		atomic.AddInt64(&i.failedSecond, failed)
+		i.logger.Warnf("failed to index %d events in secondary", failed)
+	}
+}
+
+// itemFailureKey identifies a group of bulk items which failed to be
+// indexed in a single bulk request, for logging.
+type itemFailureKey struct {
+	index     string
+	errorType string
+}
+
+// itemFailureSummary records the number of bulk items in a group which
+// failed to be indexed, and the error reason of the first.
+type itemFailureSummary struct {
+	count  int
+	reason string
+}
+
+// itemsRetried records that all items buffered in bulkIndexer
+// will be retried, following a request-level error.
+func (i *Indexer) itemsRetried(bulkIndexer *bulkIndexer) {
+	n := bulkIndexer.Items()
+	atomic.AddInt64(&i.docsRetried, int64(n))
+	if i.indexStats != nil {
+		for index := 0; index < n; index++ {
+			atomic.AddInt64(&i.indexStats.get(bulkIndexer.Index(index)).retried, 1)
+		}
+	}
+}
+
+// waitRetry waits for the backoff duration following the given
+// (zero-based) attempt, returning early with ctx.Err() if ctx is
+// cancelled.
+func (i *Indexer) waitRetry(ctx context.Context, attempt int) error {
+	timer := time.NewTimer(i.retryBackoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// startFlushSpan starts a span for flushing bulkIndexer, or a transaction
+// if ctx does not contain one. The returned function ends the span, labelling
+// it with the number of failed items and recording the flush error, if any.
+func (i *Indexer) startFlushSpan(
+	ctx context.Context,
+	bulkIndexer *bulkIndexer,
+) (context.Context, func(failed int, err error)) {
+	indices := make(map[string]struct{})
+	for j := 0; j < bulkIndexer.Items(); j++ {
+		indices[bulkIndexer.Index(j)] = struct{}{}
+	}
+	setLabels := func(setLabel func(string, interface{})) {
+		setLabel("items", bulkIndexer.Items())
+		setLabel("bytes", bulkIndexer.Len())
+		setLabel("indices", len(indices))
+	}
+
+	const name, spanType = "ModelIndexer.flush", "output"
+	if apm.TransactionFromContext(ctx) != nil {
+		span, ctx := apm.StartSpan(ctx, name, spanType)
+		setLabels(span.Context.SetLabel)
+		return ctx, func(failed int, err error) {
+			span.Context.SetLabel("failed", failed)
+			if err != nil {
+				span.Outcome = "failure"
+				apm.CaptureError(ctx, err).Send()
+			}
+			span.End()
+		}
+	}
+	tx := i.config.Tracer.StartTransaction(name, spanType)
+	ctx = apm.ContextWithTransaction(ctx, tx)
+	setLabels(tx.Context.SetLabel)
+	return ctx, func(failed int, err error) {
+		tx.Context.SetLabel("failed", failed)
+		if err != nil {
+			tx.Outcome = "failure"
+			apm.CaptureError(ctx, err).Send()
+		}
+		tx.End()
+	}
+}
+
+// flushBulkIndexer executes a single bulk request, subject to FlushTimeout.
+func (i *Indexer) flushBulkIndexer(
+	ctx context.Context,
+	transport esapi.Transport,
+	bulkIndexer *bulkIndexer,
+) (elasticsearch.BulkIndexerResponse, error) {
+	if i.config.FlushTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, i.config.FlushTimeout)
+		defer cancel()
+	}
+	resp, err := bulkIndexer.Flush(ctx, transport)
+	atomic.AddInt64(&i.bulkRequests, 1)
+	atomic.AddInt64(&i.bytesFlushed, int64(bulkIndexer.BodyLen()))
+	atomic.AddInt64(&i.bytesRaw, int64(bulkIndexer.Len()))
+	return resp, err
+}
+
+// allItemsFailed records the permanent failure of all items
+// buffered in bulkIndexer, due to a request-level error.
+func (i *Indexer) allItemsFailed(deadLetters *[]FailedDoc, bulkIndexer *bulkIndexer, err error) {
+	var status int
+	var flushErr *FlushError
+	if errors.As(err, &flushErr) {
+		status = flushErr.StatusCode
+	}
+	for index := 0; index < bulkIndexer.Items(); index++ {
+		i.itemFailed(deadLetters, bulkIndexer, index, failureTransport, status, "", err.Error())
+	}
+}
+
+// itemFailed records the permanent failure of the item buffered in
+// bulkIndexer at the given position, for the given reason. If deadLetters
+// is non-nil, the failed document will be appended to it.
+func (i *Indexer) itemFailed(
+	deadLetters *[]FailedDoc,
+	bulkIndexer *bulkIndexer,
+	index int,
+	reason failureReason,
+	status int,
+	errorType, errorReason string,
+) {
+	atomic.AddInt64(&i.eventsFailed, 1)
+	i.failures.add(reason)
+	if len(bulkIndexer.waiters) > 0 {
+		if bulkIndexer.errs == nil {
+			bulkIndexer.errs = make(map[int]error)
+		}
+		bulkIndexer.errs[bulkIndexer.Position(index)] = &DocumentError{
+			Status:      status,
+			ErrorType:   errorType,
+			ErrorReason: errorReason,
+		}
+	}
+	if i.indexStats != nil {
+		atomic.AddInt64(&i.indexStats.get(bulkIndexer.Index(index)).failed, 1)
+	}
+	if i.failedDocs == nil && deadLetters == nil {
+		return
+	}
+	doc := FailedDoc{
+		Index:       bulkIndexer.Index(index),
+		Position:    bulkIndexer.Position(index),
+		Status:      status,
+		ErrorType:   errorType,
+		ErrorReason: errorReason,
+		Body:        append([]byte(nil), bulkIndexer.Document(index)...),
+	}
+	if i.failedDocs != nil {
+		i.failedDocs.add(doc)
+	}
+	if deadLetters != nil {
+		*deadLetters = append(*deadLetters, doc)
+	}
+}
+
+// enqueueDeadLetters enqueues docs to be sent to the dead letter sink,
+// dropping them if the queue is full.
+func (i *Indexer) enqueueDeadLetters(docs []FailedDoc) {
+	select {
+	case i.deadLetterQueue <- docs:
+	default:
+		atomic.AddInt64(&i.deadLettersDropped, int64(len(docs)))
+		i.logger.Warnf("dead letter queue is full, dropped %d failed documents", len(docs))
+	}
+}
+
+// runDeadLetterSink sends queued failed documents to the dead letter sink,
+// until the queue is closed.
+func (i *Indexer) runDeadLetterSink() {
+	defer close(i.deadLetterDone)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-i.closed:
+			cancel()
+		}
+	}()
+	for docs := range i.deadLetterQueue {
+		if err := i.config.DeadLetterSink.Write(ctx, docs); err != nil {
+			i.logger.With(logp.Error(err)).Error("failed to write to dead letter sink")
+		}
+	}
+}
+
+// flushIndexStats is called at the start of a flush to count the items
+// in bulkIndexer for each index. It returns a function to be called when
+// the flush completes, which updates the per-index active item counts and
+// flush durations.
+func (i *Indexer) flushIndexStats(bulkIndexer *bulkIndexer) func() {
+	start := time.Now()
+	counts := make(map[string]int64)
+	for j := 0; j < bulkIndexer.Items(); j++ {
+		counts[bulkIndexer.Index(j)]++
+	}
+	return func() {
+		duration := int64(time.Since(start))
+		for index, n := range counts {
+			stats := i.indexStats.get(index)
+			atomic.AddInt64(&stats.active, -n)
+			atomic.AddInt64(&stats.flushDuration, duration)
+		}
+	}
+}
+
+// retryBackoff returns the duration to wait before retrying failed
+// bulk items, after the given (zero-based) attempt.
+func (i *Indexer) retryBackoff(attempt int) time.Duration {
+	backoff := i.config.RetryBackoff
+	for ; attempt > 0 && backoff < maxRetryBackoff; attempt-- {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff
+}
+
+// isRetryableFlushError reports whether or not a bulk request which
+// failed with err may be retried.
+//
+// Requests which timed out or were cancelled are not retried, as they may
+// have been partially or fully processed by Elasticsearch, and retrying
+// could duplicate documents.
+func isRetryableFlushError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var flushErr *FlushError
+	if errors.As(err, &flushErr) {
+		return flushErr.StatusCode == http.StatusTooManyRequests ||
+			flushErr.StatusCode >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && !netErr.Timeout()
+}
+
+// isDuplicate reports whether a bulk response item holds a version conflict
+// for a time series document without an ID, buffered in bulkIndexer at the
+// given position. Such conflicts arise when a document is rejected as a
+// duplicate by a time series data stream; see Config.TimeSeries.
+func isDuplicate(bulkIndexer *bulkIndexer, index int, info elasticsearch.BulkIndexerResponseItem) bool {
+	return info.Status == http.StatusConflict && bulkIndexer.TimeSeries(index)
+}
+
+// isRetryable reports whether or not a failed bulk item may be retried.
+func isRetryable(info elasticsearch.BulkIndexerResponseItem) bool {
+	switch info.Status {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	}
+	return info.Error.Type == "es_rejected_execution_exception"
+}
+
+// defaultReaderPool holds pooledReaders using the default encoder,
+// shared by all Indexers without a Config.EncoderFactory.
+var defaultReaderPool = &readerPool{newEncoder: newJSONEncoder}
+
+// readerPool holds a pool of pooledReaders, with encoders created by newEncoder.
+type readerPool struct {
+	pool       sync.Pool
+	newEncoder func(*bytes.Buffer) Encoder
+}
+
+type pooledReader struct {
+	buf          bytes.Buffer
+	indexBuilder strings.Builder
+	encoder      Encoder
+	pool         *readerPool
+}
+
+func (p *readerPool) get() *pooledReader {
+	if r, ok := p.pool.Get().(*pooledReader); ok {
+		return r
+	}
+	r := &pooledReader{pool: p}
+	r.encoder = p.newEncoder(&r.buf)
+	return r
+}
+
+func (r *pooledReader) Read(p []byte) (int, error) {
+	n, err := r.buf.Read(p)
+	if err == io.EOF {
+		// Release the reader back into the pool after it has been consumed.
+		r.release()
+	}
+	return n, err
+}
+
+func (r *pooledReader) release() {
+	r.buf.Reset()
+	r.indexBuilder.Reset()
+	r.encoder.Reset()
+	r.pool.pool.Put(r)
+}
+
+// Encoder encodes events as JSON documents.
+type Encoder interface {
+	// AddRaw encodes v as a JSON document followed by a newline,
+	// writing it to the io.Writer the Encoder was created with.
+	AddRaw(v interface{}) error
+
+	// Reset resets any state held by the Encoder, before it is reused.
+	Reset()
+}
+
+func newJSONEncoder(buf *bytes.Buffer) Encoder {
+	return eslegclient.NewJSONEncoder(buf, false)
+}
+
+// Stats holds bulk indexing statistics.
+type Stats struct {
+	// Active holds the active number of items waiting in the indexer's queue.
 	Active int64
 
+	// ActiveBytes holds the number of bytes buffered in bulk requests
+	// which are being filled, and have not yet been flushed.
+	//
+	// ActiveBytes is not reported by Indexer.IndexStats.
+	ActiveBytes int64
+
+	// OldestActiveEventAge holds the time elapsed since the oldest event
+	// buffered in a bulk request being filled was added, bounding the time
+	// for which events have been buffered before being flushed. Events
+	// waiting for a buffer to become available are not included.
+	//
+	// OldestActiveEventAge is zero if no events are buffered, and is not
+	// reported by Indexer.IndexStats.
+	OldestActiveEventAge time.Duration
+
 	// Added holds the number of items added to the indexer.
 	Added int64
 
 	// Failed holds the number of indexing operations that failed.
+	//
+	// If Config.SecondaryClient is set, Failed holds the number of
+	// operations that failed in the primary cluster only.
 	Failed int64
+
+	// FailedMapping, FailedVersionConflict, FailedTooManyRequests,
+	// FailedTransport, and FailedOther break down Failed by the reason
+	// for failure. FailedMapping counts documents rejected due to their
+	// mapping, such as mapper_parsing_exception; FailedVersionConflict
+	// counts version conflicts; FailedTooManyRequests counts operations
+	// which failed with 429 (Too Many Requests) after exhausting retries;
+	// and FailedTransport counts operations in bulk requests which failed
+	// entirely, such as due to a connection error or an error response.
+	//
+	// These are not reported by Indexer.IndexStats.
+	FailedMapping         int64
+	FailedVersionConflict int64
+	FailedTooManyRequests int64
+	FailedTransport       int64
+	FailedOther           int64
+
+	// FailedSecondary holds the number of indexing operations that
+	// failed in the secondary cluster, if Config.SecondaryClient is set.
+	//
+	// FailedSecondary is not reported by Indexer.IndexStats.
+	FailedSecondary int64
+
+	// RetriedDocs holds the number of times items were retried after
+	// failing with a retryable error.
+	RetriedDocs int64
+
+	// TooManyRequests holds the number of times Elasticsearch responded
+	// to an indexing operation with 429 (Too Many Requests), including
+	// operations which were subsequently retried.
+	//
+	// Operations which fail permanently with 429 are also included in Failed.
+	TooManyRequests int64
+
+	// TooLarge holds the number of events which were dropped due to
+	// exceeding Config.MaxDocumentBytes. These are not included in Added.
+	TooLarge int64
+
+	// InvalidDataStream holds the number of events which were skipped
+	// due to having an empty data stream type, dataset, or namespace; see
+	// Config.ValidateDataStreams. These are not included in Added.
+	InvalidDataStream int64
+
+	// Deduplicated holds the number of documents which were rejected by
+	// a time series data stream as duplicates of existing documents. These
+	// are expected when events are redelivered, and are not included in
+	// Failed; see Config.TimeSeries.
+	//
+	// Deduplicated is not reported by Indexer.IndexStats.
+	Deduplicated int64
+
+	// AvailableBuffers holds the number of bulk request buffers which
+	// are neither being filled nor flushed. When this reaches zero,
+	// adding events will block until a flush completes.
+	AvailableBuffers int
+
+	// MaxRequests holds the current limit on the number of bulk requests
+	// which may be flushing concurrently. This is Config.MaxRequests,
+	// unless Config.AutoScale is true.
+	//
+	// MaxRequests is not reported by Indexer.IndexStats.
+	MaxRequests int64
+
+	// BulkRequests holds the number of bulk requests made,
+	// including retries and requests that failed.
+	BulkRequests int64
+
+	// ESTookMillis holds the accumulated time in milliseconds spent by
+	// Elasticsearch processing bulk requests, as reported in their responses.
+	//
+	// ESTookMillis is not reported by Indexer.IndexStats.
+	ESTookMillis int64
+
+	// BytesFlushed holds the number of bytes sent in bulk request bodies,
+	// after compression if Config.CompressionLevel is non-zero.
+	BytesFlushed int64
+
+	// BytesUncompressed holds the number of bytes sent in bulk request
+	// bodies, prior to any compression.
+	BytesUncompressed int64
+
+	// FailedDocsDropped holds the number of failed documents which were
+	// dropped from the retained failed documents, due to the limit set
+	// by Config.MaxFailedDocsRetained.
+	FailedDocsDropped int64
+
+	// DeadLettersDropped holds the number of failed documents which were
+	// dropped rather than sent to Config.DeadLetterSink, due to the sink
+	// not keeping up.
+	DeadLettersDropped int64
+
+	// CircuitOpen reports whether the circuit breaker is open, and
+	// ProcessBatch is rejecting events with ErrCircuitOpen.
+	CircuitOpen bool
+
+	// LastError holds the error from the most recent failed flush,
+	// or nil if no flushes have failed.
+	//
+	// LastError is not reported by Indexer.IndexStats.
+	LastError error
+
+	// FlushDuration holds the accumulated time spent flushing bulk requests.
+	//
+	// FlushDuration is only reported by Indexer.IndexStats.
+	FlushDuration time.Duration
+}
+
+// FlushResult holds the outcome of a flush, passed to Config.OnFlush.
+type FlushResult struct {
+	// Indexed holds the number of items successfully indexed.
+	Indexed int
+
+	// Failed holds the number of items which failed to be indexed,
+	// after exhausting any retries.
+	Failed int
+
+	// Duration holds the time taken to flush the items, including
+	// any retries.
+	Duration time.Duration
+}
+
+// LatencyStats holds bulk request latency statistics.
+type LatencyStats struct {
+	// Count holds the number of bulk requests recorded.
+	Count int64
+
+	// P50, P95, and P99 hold the 50th, 95th, and 99th
+	// percentile bulk request latencies respectively.
+	P50, P95, P99 time.Duration
+
+	// Max holds the maximum bulk request latency.
+	Max time.Duration
 }
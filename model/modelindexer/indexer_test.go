@@ -19,18 +19,24 @@ package modelindexer_test
 
 import (
 	"bufio"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.elastic.co/apm/apmtest"
+	"go.opentelemetry.io/otel/metric/metrictest"
+	"go.uber.org/zap/zapcore"
 
 	"github.com/elastic/beats/v7/libbeat/logp"
 	"github.com/elastic/go-elasticsearch/v7/esutil"
@@ -88,16 +94,19 @@ func TestModelIndexer(t *testing.T) {
 		err := indexer.ProcessBatch(context.Background(), &batch)
 		require.NoError(t, err)
 	}
-	assert.Equal(t, modelindexer.Stats{Added: N, Active: N}, indexer.Stats())
+	assert.Equal(t, modelindexer.Stats{Added: N, Active: N, AvailableBuffers: 9}, indexerStats(t, indexer))
 
 	// Closing the indexer flushes enqueued events.
 	err = indexer.Close(context.Background())
 	require.NoError(t, err)
 	assert.Equal(t, modelindexer.Stats{
-		Added:  N,
-		Active: 0,
-		Failed: 1,
-	}, indexer.Stats())
+		Added:            N,
+		Active:           0,
+		Failed:           1,
+		FailedOther:      1,
+		AvailableBuffers: 10,
+		BulkRequests:     1,
+	}, indexerStats(t, indexer))
 }
 
 func TestModelIndexerFlushInterval(t *testing.T) {
@@ -136,6 +145,94 @@ func TestModelIndexerFlushInterval(t *testing.T) {
 	}
 }
 
+func TestModelIndexerFlushIntervalTrickle(t *testing.T) {
+	requests := make(chan struct{}, 1)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case requests <- struct{}{}:
+		}
+	})
+	const flushInterval = 100 * time.Millisecond
+	indexer, err := modelindexer.New(client, modelindexer.Config{FlushInterval: flushInterval})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	// Add events more frequently than the flush interval. The buffer
+	// should still be flushed once the flush interval has elapsed
+	// since the first event was added.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	start := time.Now()
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(flushInterval / 10)
+		defer ticker.Stop()
+		for {
+			batch := model.Batch{model.APMEvent{Timestamp: time.Now(), DataStream: model.DataStream{
+				Type:      "logs",
+				Dataset:   "apm_server",
+				Namespace: "testing",
+			}}}
+			if err := indexer.ProcessBatch(context.Background(), &batch); err != nil {
+				return
+			}
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	select {
+	case <-requests:
+		assert.Less(t, int64(time.Since(start)), int64(5*flushInterval))
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for request, flush interval elapsed")
+	}
+}
+
+func TestModelIndexerFlushIntervalJitter(t *testing.T) {
+	requests := make(chan struct{}, 1)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case requests <- struct{}{}:
+		}
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval:       10 * time.Millisecond,
+		FlushIntervalJitter: 0.5,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	start := time.Now()
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+
+	select {
+	case <-requests:
+		assert.GreaterOrEqual(t, time.Since(start), 5*time.Millisecond)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for request, flush interval elapsed")
+	}
+}
+
+func TestModelIndexerFlushIntervalJitterInvalid(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {})
+	for _, jitter := range []float64{-0.1, 1} {
+		_, err := modelindexer.New(client, modelindexer.Config{FlushIntervalJitter: jitter})
+		assert.EqualError(t, err, fmt.Sprintf("expected FlushIntervalJitter in range [0,1), got %v", jitter))
+	}
+}
+
 func TestModelIndexerFlushBytes(t *testing.T) {
 	requests := make(chan struct{}, 1)
 	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
@@ -145,8 +242,2131 @@ func TestModelIndexerFlushBytes(t *testing.T) {
 		}
 	})
 	indexer, err := modelindexer.New(client, modelindexer.Config{
-		FlushBytes: 1024,
-		// Default flush interval is 30 seconds
+		FlushBytes: 1024,
+		// Default flush interval is 30 seconds
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now(), DataStream: model.DataStream{
+		Type:      "logs",
+		Dataset:   "apm_server",
+		Namespace: "testing",
+	}}}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+
+	select {
+	case <-requests:
+		t.Fatal("unexpected request, flush bytes not exceeded")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < 100; i++ {
+		err = indexer.ProcessBatch(context.Background(), &batch)
+		require.NoError(t, err)
+	}
+
+	select {
+	case <-requests:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for request, flush bytes exceeded")
+	}
+}
+
+func TestModelIndexerFlushCompressedBytes(t *testing.T) {
+	requests := make(chan struct{}, 1)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- struct{}{}:
+		default:
+		}
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushBytes:           1024,
+		FlushCompressedBytes: true,
+		CompressionLevel:     gzip.BestSpeed,
+		// Default flush interval is 30 seconds
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now(), DataStream: model.DataStream{
+		Type:      "logs",
+		Dataset:   "apm_server",
+		Namespace: "testing",
+	}}}
+	for i := 0; i < 100; i++ {
+		err = indexer.ProcessBatch(context.Background(), &batch)
+		require.NoError(t, err)
+	}
+
+	// The uncompressed size exceeds FlushBytes, but the compressed size does not.
+	assert.Greater(t, indexer.Stats().ActiveBytes, int64(1024))
+	select {
+	case <-requests:
+		t.Fatal("unexpected request, compressed flush bytes not exceeded")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < 10000; i++ {
+		err = indexer.ProcessBatch(context.Background(), &batch)
+		require.NoError(t, err)
+	}
+
+	select {
+	case <-requests:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for request, compressed flush bytes exceeded")
+	}
+}
+
+func TestModelIndexerCompressionLevel(t *testing.T) {
+	var docs int64
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			panic("expected gzip-encoded request body")
+		}
+		body, err := gzip.NewReader(r.Body)
+		if err != nil {
+			panic(err)
+		}
+		defer body.Close()
+		scanner := bufio.NewScanner(body)
+		var result elasticsearch.BulkIndexerResponse
+		for scanner.Scan() {
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusCreated}
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		atomic.AddInt64(&docs, int64(len(result.Items)))
+		json.NewEncoder(w).Encode(result)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		CompressionLevel: gzip.BestSpeed,
+		FlushInterval:    time.Minute,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	const N = 10
+	for i := 0; i < N; i++ {
+		batch := model.Batch{model.APMEvent{Timestamp: time.Now(), DataStream: model.DataStream{
+			Type:      "logs",
+			Dataset:   "apm_server",
+			Namespace: "testing",
+		}}}
+		err := indexer.ProcessBatch(context.Background(), &batch)
+		require.NoError(t, err)
+	}
+
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(N), atomic.LoadInt64(&docs))
+	assert.Equal(t, modelindexer.Stats{Added: N, AvailableBuffers: 10, BulkRequests: 1}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerBytesFlushed(t *testing.T) {
+	for _, compressionLevel := range []int{gzip.NoCompression, gzip.BestSpeed} {
+		t.Run(fmt.Sprint(compressionLevel), func(t *testing.T) {
+			var bytesFlushed, bytesUncompressed int64
+			client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+				var body io.Reader = r.Body
+				if r.Header.Get("Content-Encoding") == "gzip" {
+					var err error
+					if body, err = gzip.NewReader(r.Body); err != nil {
+						panic(err)
+					}
+				}
+				n, err := io.Copy(io.Discard, body)
+				if err != nil {
+					panic(err)
+				}
+				atomic.AddInt64(&bytesFlushed, r.ContentLength)
+				atomic.AddInt64(&bytesUncompressed, n)
+				fmt.Fprintln(w, "{}")
+			})
+			indexer, err := modelindexer.New(client, modelindexer.Config{
+				CompressionLevel: compressionLevel,
+				FlushDocuments:   5,
+			})
+			require.NoError(t, err)
+			defer indexer.Close(context.Background())
+
+			batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+			for i := 0; i < 10; i++ {
+				err = indexer.ProcessBatch(context.Background(), &batch)
+				require.NoError(t, err)
+			}
+			err = indexer.Close(context.Background())
+			require.NoError(t, err)
+
+			stats := indexer.Stats()
+			assert.Equal(t, int64(2), stats.BulkRequests)
+			assert.Equal(t, bytesFlushed, stats.BytesFlushed)
+			assert.Equal(t, bytesUncompressed, stats.BytesUncompressed)
+			if compressionLevel == gzip.NoCompression {
+				assert.Equal(t, stats.BytesUncompressed, stats.BytesFlushed)
+			} else {
+				assert.Less(t, stats.BytesFlushed, stats.BytesUncompressed)
+			}
+		})
+	}
+}
+
+func TestModelIndexerCompressionLevelInvalid(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {})
+	_, err := modelindexer.New(client, modelindexer.Config{CompressionLevel: 10})
+	assert.EqualError(t, err, "expected CompressionLevel in range [0,9], got 10")
+}
+
+func TestModelIndexerActiveShards(t *testing.T) {
+	var requests int64
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		ActiveShards:  2,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	// Events are distributed between shards, each filling their own buffer.
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	for i := 0; i < 4; i++ {
+		require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	}
+	assert.Equal(t, modelindexer.Stats{Added: 4, Active: 4, AvailableBuffers: 8}, indexerStats(t, indexer))
+
+	require.NoError(t, indexer.Flush(context.Background()))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&requests))
+	assert.Equal(t, modelindexer.Stats{Added: 4, AvailableBuffers: 10, BulkRequests: 2}, indexerStats(t, indexer))
+
+	err = indexer.Reconfigure(modelindexer.Config{ActiveShards: 3})
+	assert.EqualError(t, err, "ActiveShards cannot be reconfigured")
+}
+
+func TestModelIndexerActiveBytes(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		ActiveShards:  2,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	assert.Zero(t, indexer.Stats().ActiveBytes)
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	activeBytes := indexer.Stats().ActiveBytes
+	assert.NotZero(t, activeBytes)
+
+	// ActiveBytes accounts for all shards.
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	assert.Equal(t, 2*activeBytes, indexer.Stats().ActiveBytes)
+
+	require.NoError(t, indexer.Flush(context.Background()))
+	assert.Zero(t, indexer.Stats().ActiveBytes)
+}
+
+func TestModelIndexerOldestActiveEventAge(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		ActiveShards:  2,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	assert.Zero(t, indexer.Stats().OldestActiveEventAge)
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	before := time.Now()
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	// Events added to another shard later do not affect the age,
+	// which is measured from the oldest active buffer's first event.
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	age := indexer.Stats().OldestActiveEventAge
+	assert.GreaterOrEqual(t, age, 50*time.Millisecond)
+	assert.LessOrEqual(t, age, time.Since(before))
+
+	// The age is reset once the active buffers are flushed.
+	require.NoError(t, indexer.Flush(context.Background()))
+	assert.Zero(t, indexer.Stats().OldestActiveEventAge)
+}
+
+func TestModelIndexerActiveShardsInvalid(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {})
+	_, err := modelindexer.New(client, modelindexer.Config{MaxRequests: 2, ActiveShards: 3})
+	assert.EqualError(t, err, "expected ActiveShards no greater than MaxRequests (2), got 3")
+}
+
+func TestModelIndexerFlushDocuments(t *testing.T) {
+	requests := make(chan int, 10)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		var n int
+		for scanner.Scan() {
+			if scanner.Scan() {
+				n++
+			}
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		requests <- n
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushDocuments: 10,
+		// Default flush bytes is 5MB, and flush interval is 30 seconds
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now(), DataStream: model.DataStream{
+		Type:      "logs",
+		Dataset:   "apm_server",
+		Namespace: "testing",
+	}}}
+	for i := 0; i < 9; i++ {
+		err = indexer.ProcessBatch(context.Background(), &batch)
+		require.NoError(t, err)
+	}
+
+	select {
+	case <-requests:
+		t.Fatal("unexpected request, flush documents not reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+
+	select {
+	case n := <-requests:
+		assert.Equal(t, 10, n)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for request, flush documents reached")
+	}
+}
+
+func TestModelIndexerOrderedBatches(t *testing.T) {
+	for _, ordered := range []bool{false, true} {
+		t.Run(fmt.Sprint(ordered), func(t *testing.T) {
+			requests := make(chan []string, 10)
+			client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+				scanner := bufio.NewScanner(r.Body)
+				var messages []string
+				for scanner.Scan() {
+					if !scanner.Scan() {
+						panic("expected source")
+					}
+					var doc struct {
+						Message string `json:"message"`
+					}
+					if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+						panic(err)
+					}
+					messages = append(messages, doc.Message)
+					scanner.Scan() // empty line
+				}
+				requests <- messages
+				fmt.Fprintln(w, "{}")
+			})
+			indexer, err := modelindexer.New(client, modelindexer.Config{
+				FlushDocuments: 2,
+				FlushInterval:  time.Minute,
+				OrderedBatches: ordered,
+			})
+			require.NoError(t, err)
+			defer indexer.Close(context.Background())
+
+			var batch model.Batch
+			for _, message := range []string{"a", "b", "c", "d", "e"} {
+				batch = append(batch, model.APMEvent{Timestamp: time.Now(), Message: message})
+			}
+			require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+			require.NoError(t, indexer.Flush(context.Background()))
+			close(requests)
+
+			var messages [][]string
+			for request := range requests {
+				messages = append(messages, request)
+			}
+			if ordered {
+				// The batch is not split across bulk requests,
+				// despite exceeding FlushDocuments.
+				assert.Equal(t, [][]string{{"a", "b", "c", "d", "e"}}, messages)
+			} else {
+				assert.Len(t, messages, 3)
+			}
+		})
+	}
+}
+
+func TestModelIndexerOrderedBatchesDiskQueue(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {})
+	_, err := modelindexer.New(client, modelindexer.Config{
+		OrderedBatches: true,
+		DiskQueueDir:   t.TempDir(),
+	})
+	assert.EqualError(t, err, "OrderedBatches cannot be used with DiskQueueDir")
+}
+
+func TestModelIndexerDocumentAction(t *testing.T) {
+	type bulkItem struct {
+		action  string
+		meta    map[string]string
+		partial bool
+	}
+	items := make(chan bulkItem, 3)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		var result elasticsearch.BulkIndexerResponse
+		for scanner.Scan() {
+			action := make(map[string]map[string]string)
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				panic(err)
+			}
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			var source map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &source); err != nil {
+				panic(err)
+			}
+			for actionType, meta := range action {
+				_, partial := source["doc"]
+				items <- bulkItem{action: actionType, meta: meta, partial: partial}
+				item := esutil.BulkIndexerResponseItem{Status: http.StatusCreated}
+				result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{actionType: item})
+			}
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		DocumentAction: func(event *model.APMEvent) (string, string) {
+			switch event.Message {
+			case "index":
+				return "index", "index_id"
+			case "update":
+				return "update", "update_id"
+			}
+			return "", ""
+		},
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	dataStream := model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}
+	batch := model.Batch{
+		{Timestamp: time.Now(), DataStream: dataStream},
+		{Timestamp: time.Now(), DataStream: dataStream, Message: "index"},
+		{Timestamp: time.Now(), DataStream: dataStream, Message: "update"},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+
+	index := "logs-apm_server-testing"
+	assert.Equal(t, bulkItem{action: "create", meta: map[string]string{"_index": index}}, <-items)
+	assert.Equal(t, bulkItem{action: "index", meta: map[string]string{"_index": index, "_id": "index_id"}}, <-items)
+	assert.Equal(t, bulkItem{action: "update", meta: map[string]string{"_index": index, "_id": "update_id"}, partial: true}, <-items)
+}
+
+func TestModelIndexerTimeSeries(t *testing.T) {
+	ids := make(chan string, 3)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		result := elasticsearch.BulkIndexerResponse{HasErrors: true}
+		for scanner.Scan() {
+			action := make(map[string]map[string]string)
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				panic(err)
+			}
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			for actionType, meta := range action {
+				ids <- meta["_id"]
+				// Every document is a duplicate of an existing document.
+				item := esutil.BulkIndexerResponseItem{Status: http.StatusConflict}
+				item.Error.Type = "version_conflict_engine_exception"
+				item.Error.Reason = "version conflict, document already exists"
+				result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{actionType: item})
+			}
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		DocumentAction: func(event *model.APMEvent) (string, string) {
+			switch event.Message {
+			case "index":
+				return "index", "index_id"
+			case "no_id":
+				return "create", ""
+			}
+			return "create", "create_id"
+		},
+		TimeSeries: func(event *model.APMEvent) bool {
+			return event.DataStream.Type == "metrics"
+		},
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "metrics", Dataset: "apm.internal", Namespace: "testing"}},
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}},
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "metrics", Dataset: "apm.internal", Namespace: "testing"}, Message: "index"},
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}, Message: "no_id"},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	assert.EqualError(t, err, "failed to encode 1 of 4 events, first error: index action is not supported for time series data streams")
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+
+	// The time series document is sent without a document ID, and its
+	// version conflict is not counted as a failure, unlike that of the
+	// other document created without an ID.
+	assert.Equal(t, "", <-ids)
+	assert.Equal(t, "create_id", <-ids)
+	assert.Equal(t, "", <-ids)
+	assert.Equal(t, modelindexer.Stats{
+		Added:                 3,
+		Failed:                2,
+		FailedVersionConflict: 2,
+		Deduplicated:          1,
+		AvailableBuffers:      10,
+		BulkRequests:          1,
+	}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerEventVersion(t *testing.T) {
+	versions := map[string]int64{"a": 42, "create": 1}
+	actions := make(chan string, 2)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			actions <- scanner.Text()
+			scanner.Scan() // source
+			scanner.Scan() // empty line
+		}
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		DocumentAction: func(event *model.APMEvent) (string, string) {
+			if event.Message == "create" {
+				return "create", ""
+			}
+			return "index", event.Message
+		},
+		EventVersion: func(event *model.APMEvent) (int64, bool) {
+			version, ok := versions[event.Message]
+			return version, ok
+		},
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	dataStream := model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}
+	batch := model.Batch{
+		{Timestamp: time.Now(), DataStream: dataStream, Message: "a"},
+		{Timestamp: time.Now(), DataStream: dataStream, Message: "b"},
+		{Timestamp: time.Now(), DataStream: dataStream, Message: "create"},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	assert.EqualError(t, err, "failed to encode 1 of 3 events, first error: external versioning is not supported for create action")
+	require.NoError(t, indexer.Flush(context.Background()))
+
+	assert.Equal(t, `{"index":{"_id":"a","_index":"logs-apm_server-testing","version":42,"version_type":"external"}}`, <-actions)
+	assert.Equal(t, `{"index":{"_id":"b","_index":"logs-apm_server-testing"}}`, <-actions)
+}
+
+func TestModelIndexerDocumentActionInvalid(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {})
+	var action, documentID string
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		DocumentAction: func(*model.APMEvent) (string, string) {
+			return action, documentID
+		},
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	action = "delete"
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	assert.EqualError(t, err, `failed to encode 1 of 1 events, first error: unsupported bulk action "delete"`)
+
+	action = "update"
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	assert.EqualError(t, err, "failed to encode 1 of 1 events, first error: document ID is required for update action")
+}
+
+func TestModelIndexerProcessBatchPartial(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		DocumentAction: func(event *model.APMEvent) (string, string) {
+			if event.Service.Name == "invalid" {
+				return "delete", ""
+			}
+			return "", ""
+		},
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	// Events which fail to encode are skipped,
+	// without affecting the rest of the batch.
+	batch := model.Batch{
+		model.APMEvent{Timestamp: time.Now()},
+		model.APMEvent{Timestamp: time.Now(), Service: model.Service{Name: "invalid"}},
+		model.APMEvent{Timestamp: time.Now()},
+		model.APMEvent{Timestamp: time.Now(), Service: model.Service{Name: "invalid"}},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	assert.EqualError(t, err, `failed to encode 2 of 4 events, first error: unsupported bulk action "delete"`)
+	assert.Equal(t, modelindexer.Stats{Added: 2, Active: 2, AvailableBuffers: 9}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerEncoderFactory(t *testing.T) {
+	docs := make(chan string, 10)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			if scanner.Scan() {
+				docs <- scanner.Text()
+			}
+			scanner.Scan() // empty line
+		}
+		fmt.Fprintln(w, "{}")
+	})
+	var encoders int64
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		EncoderFactory: func(w io.Writer) modelindexer.Encoder {
+			atomic.AddInt64(&encoders, 1)
+			return &staticEncoder{w: w, doc: `{"custom":true}`}
+		},
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	const N = 10
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	for i := 0; i < N; i++ {
+		require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	}
+	require.NoError(t, indexer.Flush(context.Background()))
+	for i := 0; i < N; i++ {
+		assert.Equal(t, `{"custom":true}`, <-docs)
+	}
+
+	// Encoders are pooled, and reused for subsequent events.
+	assert.Less(t, atomic.LoadInt64(&encoders), int64(N))
+}
+
+func TestModelIndexerPipeline(t *testing.T) {
+	pipelines := make(chan string, 2)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			action := make(map[string]map[string]string)
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				panic(err)
+			}
+			for _, meta := range action {
+				pipelines <- meta["pipeline"]
+			}
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		Pipeline:      "default-pipeline",
+		EventPipeline: func(event *model.APMEvent) string {
+			return event.Message
+		},
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{
+		{Timestamp: time.Now()},
+		{Timestamp: time.Now(), Message: "event-pipeline"},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "default-pipeline", <-pipelines)
+	assert.Equal(t, "event-pipeline", <-pipelines)
+}
+
+func TestModelIndexerRequireAlias(t *testing.T) {
+	for _, requireAlias := range []bool{false, true} {
+		t.Run(fmt.Sprint(requireAlias), func(t *testing.T) {
+			actions := make(chan string, 1)
+			client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+				scanner := bufio.NewScanner(r.Body)
+				if scanner.Scan() {
+					actions <- scanner.Text()
+				}
+				fmt.Fprintln(w, "{}")
+			})
+			indexer, err := modelindexer.New(client, modelindexer.Config{
+				FlushInterval: time.Minute,
+				RequireAlias:  requireAlias,
+			})
+			require.NoError(t, err)
+			defer indexer.Close(context.Background())
+
+			batch := model.Batch{model.APMEvent{Timestamp: time.Now(), DataStream: model.DataStream{
+				Type:      "logs",
+				Dataset:   "apm_server",
+				Namespace: "testing",
+			}}}
+			require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+			require.NoError(t, indexer.Close(context.Background()))
+			if requireAlias {
+				assert.Equal(t, `{"create":{"_index":"logs-apm_server-testing","require_alias":true}}`, <-actions)
+			} else {
+				assert.Equal(t, `{"create":{"_index":"logs-apm_server-testing"}}`, <-actions)
+			}
+		})
+	}
+}
+
+func TestModelIndexerValidateDataStreams(t *testing.T) {
+	logp.DevelopmentSetup(logp.ToObserverOutput())
+
+	var indices []string
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		var result elasticsearch.BulkIndexerResponse
+		for scanner.Scan() {
+			var action map[string]struct {
+				Index string `json:"_index"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				panic(err)
+			}
+			indices = append(indices, action["create"].Index)
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusCreated}
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+			scanner.Scan() // source
+			scanner.Scan() // empty line
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval:       time.Minute,
+		ValidateDataStreams: true,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	dataStream := model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}
+	for name, test := range map[string]func(*model.DataStream){
+		"type":      func(ds *model.DataStream) { ds.Type = "" },
+		"dataset":   func(ds *model.DataStream) { ds.Dataset = "" },
+		"namespace": func(ds *model.DataStream) { ds.Namespace = "" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			event := model.APMEvent{Timestamp: time.Now(), Processor: model.LogProcessor, DataStream: dataStream}
+			test(&event.DataStream)
+			batch := model.Batch{event}
+			err := indexer.ProcessBatch(context.Background(), &batch)
+			assert.ErrorIs(t, err, modelindexer.ErrInvalidDataStream)
+			assert.EqualError(t, err, "failed to encode 1 of 1 events, first error: invalid data stream: empty data stream "+name)
+
+			logs := logp.ObserverLogs().TakeAll()
+			require.Len(t, logs, 1)
+			assert.Equal(t, "skipping log processor event: invalid data stream: empty data stream "+name, logs[0].Message)
+		})
+	}
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now(), DataStream: dataStream}}
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, indexer.Close(context.Background()))
+	assert.Equal(t, []string{"logs-apm_server-testing"}, indices)
+	assert.Equal(t, modelindexer.Stats{
+		Added:             1,
+		InvalidDataStream: 3,
+		AvailableBuffers:  10,
+		BulkRequests:      1,
+	}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerIndexStats(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		var result elasticsearch.BulkIndexerResponse
+		for scanner.Scan() {
+			action := make(map[string]map[string]string)
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				panic(err)
+			}
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusCreated}
+			if action["create"]["_index"] == "logs-apm_server-failing" {
+				result.HasErrors = true
+				item.Status = http.StatusBadRequest
+				item.Error.Type = "mapper_parsing_exception"
+			}
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval:      time.Minute,
+		TrackPerIndexStats: true,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	assert.Empty(t, indexer.IndexStats())
+
+	batch := model.Batch{
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}},
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}},
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "failing"}},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]modelindexer.Stats{
+		"logs-apm_server-testing": {Added: 2, Active: 2},
+		"logs-apm_server-failing": {Added: 1, Active: 1},
+	}, indexer.IndexStats())
+
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+	indexStats := indexer.IndexStats()
+	require.Len(t, indexStats, 2)
+	for index, stats := range indexStats {
+		assert.NotZero(t, stats.FlushDuration, index)
+		stats.FlushDuration = 0
+		indexStats[index] = stats
+	}
+	assert.Equal(t, map[string]modelindexer.Stats{
+		"logs-apm_server-testing": {Added: 2},
+		"logs-apm_server-failing": {Added: 1, Failed: 1},
+	}, indexStats)
+	assert.Equal(t, modelindexer.Stats{Added: 3, Failed: 1, FailedMapping: 1, AvailableBuffers: 10, BulkRequests: 1}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerIndexStatsDisabled(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {})
+	indexer, err := modelindexer.New(client, modelindexer.Config{})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	assert.Nil(t, indexer.IndexStats())
+}
+
+func TestModelIndexerLatencyStats(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{FlushDocuments: 1})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	assert.Equal(t, modelindexer.LatencyStats{}, indexer.LatencyStats(false))
+
+	const N = 3
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	for i := 0; i < N; i++ {
+		err = indexer.ProcessBatch(context.Background(), &batch)
+		require.NoError(t, err)
+	}
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+
+	stats := indexer.LatencyStats(true)
+	assert.Equal(t, int64(N), stats.Count)
+	assert.GreaterOrEqual(t, stats.P50, 10*time.Millisecond)
+	assert.GreaterOrEqual(t, stats.P95, stats.P50)
+	assert.GreaterOrEqual(t, stats.P99, stats.P95)
+	assert.GreaterOrEqual(t, stats.Max, stats.P99)
+
+	// The histogram should have been reset.
+	assert.Equal(t, modelindexer.LatencyStats{}, indexer.LatencyStats(false))
+}
+
+func TestModelIndexerFailedDocs(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		result := elasticsearch.BulkIndexerResponse{HasErrors: true}
+		for scanner.Scan() {
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusBadRequest}
+			item.Error.Type = "mapper_parsing_exception"
+			item.Error.Reason = "failed to parse"
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval:         time.Minute,
+		MaxFailedDocsRetained: 2,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	assert.Empty(t, indexer.FailedDocs())
+
+	dataStream := model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}
+	batch := model.Batch{
+		{Timestamp: time.Now(), DataStream: dataStream, Message: "first"},
+		{Timestamp: time.Now(), DataStream: dataStream, Message: "second"},
+		{Timestamp: time.Now(), DataStream: dataStream, Message: "third"},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+
+	failedDocs := indexer.FailedDocs()
+	require.Len(t, failedDocs, 2)
+	for i, message := range []string{"second", "third"} {
+		var doc map[string]interface{}
+		require.NoError(t, json.Unmarshal(failedDocs[i].Body, &doc))
+		assert.Equal(t, message, doc["message"])
+		failedDocs[i].Body = nil
+		assert.Equal(t, modelindexer.FailedDoc{
+			Index:       "logs-apm_server-testing",
+			Position:    i + 1,
+			Status:      http.StatusBadRequest,
+			ErrorType:   "mapper_parsing_exception",
+			ErrorReason: "failed to parse",
+		}, failedDocs[i])
+	}
+	assert.Equal(t, modelindexer.Stats{Added: 3, Failed: 3, FailedMapping: 3, FailedDocsDropped: 1, AvailableBuffers: 10, BulkRequests: 1}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerBulkResponseExcessItems(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// Respond with more items than were sent, which
+		// cannot be correlated with any document.
+		item := esutil.BulkIndexerResponseItem{Status: http.StatusBadRequest}
+		item.Error.Type = "mapper_parsing_exception"
+		result := elasticsearch.BulkIndexerResponse{HasErrors: true}
+		for i := 0; i < 3; i++ {
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{FlushInterval: time.Minute})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, modelindexer.Stats{
+		Added:            1,
+		Failed:           1,
+		FailedMapping:    1,
+		AvailableBuffers: 10,
+		BulkRequests:     1,
+	}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerDeadLetterSink(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		var result elasticsearch.BulkIndexerResponse
+		for scanner.Scan() {
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusCreated}
+			if len(result.Items)%2 == 1 {
+				result.HasErrors = true
+				item.Status = http.StatusBadRequest
+				item.Error.Type = "mapper_parsing_exception"
+			}
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+
+	var mu sync.Mutex
+	var deadLetters []modelindexer.FailedDoc
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushDocuments: 2,
+		DeadLetterSink: deadLetterSinkFunc(func(ctx context.Context, docs []modelindexer.FailedDoc) error {
+			mu.Lock()
+			defer mu.Unlock()
+			deadLetters = append(deadLetters, docs...)
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	const N = 10
+	for i := 0; i < N; i++ {
+		batch := model.Batch{model.APMEvent{Timestamp: time.Now(), DataStream: model.DataStream{
+			Type:      "logs",
+			Dataset:   "apm_server",
+			Namespace: "testing",
+		}}}
+		err := indexer.ProcessBatch(context.Background(), &batch)
+		require.NoError(t, err)
+	}
+
+	// Closing the indexer waits for the dead letter sink.
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, modelindexer.Stats{Added: N, Failed: N / 2, FailedMapping: N / 2, AvailableBuffers: 10, BulkRequests: 5}, indexerStats(t, indexer))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, deadLetters, N/2)
+	for _, doc := range deadLetters {
+		assert.Equal(t, "logs-apm_server-testing", doc.Index)
+		assert.Equal(t, "mapper_parsing_exception", doc.ErrorType)
+		assert.NotEmpty(t, doc.Body)
+	}
+}
+
+func TestModelIndexerProcessBatchSync(t *testing.T) {
+	unblock := make(chan struct{})
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		scanner := bufio.NewScanner(r.Body)
+		result := elasticsearch.BulkIndexerResponse{HasErrors: true}
+		for scanner.Scan() {
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			var doc map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+				panic(err)
+			}
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusCreated}
+			if doc["message"] == "bad" {
+				item.Status = http.StatusBadRequest
+				item.Error.Type = "mapper_parsing_exception"
+				item.Error.Reason = "failed to parse"
+			}
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval:    time.Millisecond,
+		MaxDocumentBytes: 200,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	dataStream := model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}
+	batch := model.Batch{
+		{Timestamp: time.Now(), DataStream: dataStream, Message: "good"},
+		{Timestamp: time.Now(), DataStream: dataStream, Message: "bad"},
+		{Timestamp: time.Now(), DataStream: dataStream, Message: strings.Repeat("x", 200)},
+		{Timestamp: time.Now(), DataStream: dataStream, Message: "also good"},
+	}
+	type result struct {
+		errs []error
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		errs, err := indexer.ProcessBatchSync(context.Background(), &batch)
+		results <- result{errs, err}
+	}()
+
+	// ProcessBatchSync waits until the bulk request has completed.
+	select {
+	case <-results:
+		t.Fatal("ProcessBatchSync returned before the bulk request completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(unblock)
+
+	var res result
+	select {
+	case res = <-results:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for ProcessBatchSync to return")
+	}
+	require.NoError(t, res.err)
+	assert.Equal(t, []error{
+		nil,
+		&modelindexer.DocumentError{
+			Status:      http.StatusBadRequest,
+			ErrorType:   "mapper_parsing_exception",
+			ErrorReason: "failed to parse",
+		},
+		modelindexer.ErrDocumentTooLarge,
+		nil,
+	}, res.errs)
+	assert.Equal(t, modelindexer.Stats{Added: 3, Failed: 1, FailedMapping: 1, TooLarge: 1, AvailableBuffers: 10, BulkRequests: 1}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerProcessBatchSyncContextDone(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {})
+	indexer, err := modelindexer.New(client, modelindexer.Config{FlushInterval: time.Minute})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	batch := model.Batch{{Timestamp: time.Now(), Message: "buffered"}}
+	errs, err := indexer.ProcessBatchSync(ctx, &batch)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Nil(t, errs)
+
+	// The event remains buffered for indexing.
+	assert.Equal(t, int64(1), indexer.Stats().Active)
+}
+
+func TestModelIndexerFlush(t *testing.T) {
+	var indexed int64
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		var n int64
+		for scanner.Scan() {
+			if scanner.Scan() {
+				n++
+			}
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt64(&indexed, n)
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{FlushInterval: time.Minute})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	// Flushing with no buffered events is a no-op.
+	err = indexer.Flush(context.Background())
+	require.NoError(t, err)
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	for i := 0; i < 2; i++ {
+		err = indexer.ProcessBatch(context.Background(), &batch)
+		require.NoError(t, err)
+		err = indexer.Flush(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, int64(i+1), atomic.LoadInt64(&indexed))
+		assert.Equal(t, modelindexer.Stats{Added: int64(i + 1), AvailableBuffers: 10, BulkRequests: int64(i + 1)}, indexerStats(t, indexer))
+	}
+
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+	err = indexer.Flush(context.Background())
+	assert.Equal(t, modelindexer.ErrClosed, err)
+}
+
+func TestModelIndexerTriggerFlush(t *testing.T) {
+	requests := make(chan int, 1)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		var n int
+		for scanner.Scan() {
+			if scanner.Text() != "" {
+				n++
+			}
+		}
+		requests <- n / 2
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		FlushBytes:    1024 * 1024,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	// Triggering a flush with no buffered events is a no-op.
+	indexer.TriggerFlush()
+
+	batch := model.Batch{{Timestamp: time.Now()}, {Timestamp: time.Now()}}
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	assert.Equal(t, int64(2), indexer.Stats().Active)
+
+	// The partially filled buffer is flushed without
+	// waiting for FlushBytes or FlushInterval.
+	indexer.TriggerFlush()
+	select {
+	case n := <-requests:
+		assert.Equal(t, 2, n)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for bulk request")
+	}
+	// Flush waits for the triggered flush to complete.
+	require.NoError(t, indexer.Flush(context.Background()))
+	assert.Equal(t, modelindexer.Stats{Added: 2, AvailableBuffers: 10, BulkRequests: 1}, indexerStats(t, indexer))
+
+	// Triggering a flush after Close is a no-op.
+	require.NoError(t, indexer.Close(context.Background()))
+	indexer.TriggerFlush()
+	select {
+	case <-requests:
+		t.Fatal("unexpected bulk request")
+	default:
+	}
+}
+
+func TestModelIndexerFlushError(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		RetryBackoff:  time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	err = indexer.Flush(context.Background())
+	assert.EqualError(t, err, "flush failed: [500 Internal Server Error] ")
+}
+
+func TestModelIndexerOnFlush(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		var result elasticsearch.BulkIndexerResponse
+		for scanner.Scan() {
+			scanner.Scan() // source
+			scanner.Scan() // empty line
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusCreated}
+			if len(result.Items) == 0 {
+				result.HasErrors = true
+				item.Status = http.StatusBadRequest
+			}
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	results := make(chan modelindexer.FlushResult, 1)
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		OnFlush: func(result modelindexer.FlushResult) {
+			results <- result
+		},
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{
+		model.APMEvent{Timestamp: time.Now()},
+		model.APMEvent{Timestamp: time.Now()},
+		model.APMEvent{Timestamp: time.Now()},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	err = indexer.Flush(context.Background())
+	require.NoError(t, err)
+
+	select {
+	case result := <-results:
+		assert.Equal(t, 2, result.Indexed)
+		assert.Equal(t, 1, result.Failed)
+		assert.NotZero(t, result.Duration)
+	default:
+		t.Fatal("OnFlush was not called")
+	}
+}
+
+func TestModelIndexerMaxDocumentBytes(t *testing.T) {
+	messages := make(chan string, 2)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			var doc map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+				panic(err)
+			}
+			messages <- doc["message"].(string)
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval:    time.Minute,
+		MaxDocumentBytes: 200,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{
+		{Timestamp: time.Now(), Message: "small"},
+		{Timestamp: time.Now(), Message: strings.Repeat("x", 200)},
+		{Timestamp: time.Now(), Message: "also small"},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, "small", <-messages)
+	assert.Equal(t, "also small", <-messages)
+	assert.Equal(t, modelindexer.Stats{Added: 2, TooLarge: 1, AvailableBuffers: 10, BulkRequests: 1}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerTracing(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		result := elasticsearch.BulkIndexerResponse{HasErrors: true}
+		for scanner.Scan() {
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusBadRequest}
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	tracer := apmtest.NewRecordingTracer()
+	defer tracer.Close()
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		Tracer:        tracer.Tracer,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}},
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "other"}},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+
+	tracer.Flush(nil)
+	payloads := tracer.Payloads()
+	require.Len(t, payloads.Transactions, 1)
+	tx := payloads.Transactions[0]
+	assert.Equal(t, "ModelIndexer.flush", tx.Name)
+	assert.Equal(t, "output", tx.Type)
+	labels := make(map[string]interface{})
+	for _, label := range tx.Context.Tags {
+		labels[label.Key] = label.Value
+	}
+	assert.Equal(t, float64(2), labels["items"])
+	assert.Equal(t, float64(2), labels["indices"])
+	assert.Equal(t, float64(2), labels["failed"])
+	assert.Contains(t, labels, "bytes")
+}
+
+func TestModelIndexerMeter(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		result := elasticsearch.BulkIndexerResponse{HasErrors: true}
+		for scanner.Scan() {
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusCreated}
+			if strings.Contains(scanner.Text(), `"other"`) {
+				item.Status = http.StatusBadRequest
+			}
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	meterImpl, meter := metrictest.NewMeter()
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval:      time.Minute,
+		TrackPerIndexStats: true,
+		Meter:              meter,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}},
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "other"}},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+
+	meterImpl.RunAsyncInstruments()
+	var flushDurations int
+	counters := make(map[string]int64)
+	for _, m := range metrictest.AsStructs(meterImpl.MeasurementBatches) {
+		switch m.Name {
+		case "modelindexer.flush.duration":
+			flushDurations++
+			continue
+		case "modelindexer.events.failed":
+			counters[m.Name+":"+m.Labels["data_stream"].AsString()] = m.Number.AsInt64()
+			continue
+		}
+		counters[m.Name] = m.Number.AsInt64()
+	}
+	assert.Equal(t, 1, flushDurations)
+	assert.Equal(t, map[string]int64{
+		"modelindexer.events.added":                          2,
+		"modelindexer.events.active":                         0,
+		"modelindexer.events.retried":                        0,
+		"modelindexer.events.failed:logs-apm_server-testing": 0,
+		"modelindexer.events.failed:logs-apm_server-other":   1,
+	}, counters)
+}
+
+func TestModelIndexerTransport(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected bulk request sent with the indexer's client")
+	})
+	var requests int64
+	transport := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.Write([]byte(`{"items":[{"create":{"status":201}}]}`))
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		Transport:     transport,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, indexer.Close(context.Background()))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&requests))
+	assert.Equal(t, int64(1), indexer.Stats().BulkRequests)
+}
+
+func TestModelIndexerHeaders(t *testing.T) {
+	var requests int64
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		assert.Equal(t, "tenant-1", r.Header.Get("X-Tenant"))
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		w.Write([]byte(`{"items":[{"create":{"status":201}}]}`))
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		CompressionLevel: gzip.BestSpeed,
+		FlushInterval:    time.Minute,
+		Headers:          map[string]string{"x-tenant": "tenant-1"},
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, indexer.Close(context.Background()))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&requests))
+}
+
+func TestModelIndexerHeadersInvalid(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {})
+	for _, key := range []string{"Content-Type", "content-encoding"} {
+		_, err := modelindexer.New(client, modelindexer.Config{
+			Headers: map[string]string{key: "secret-value"},
+		})
+		require.Error(t, err)
+		assert.EqualError(t, err, fmt.Sprintf("header %q cannot be set in Headers", key))
+		assert.NotContains(t, err.Error(), "secret-value")
+	}
+}
+
+func TestModelIndexerSecondaryClient(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"items":[{"create":{"status":201}},{"create":{"status":201}}]}`))
+	})
+	var secondaryRequests int64
+	secondary := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&secondaryRequests, 1) > 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"errors":true,"items":[{"create":{"status":201}},{"create":{"status":400,"error":{"type":"x"}}}]}`))
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval:   time.Minute,
+		SecondaryClient: secondary,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{
+		model.APMEvent{Timestamp: time.Now()},
+		model.APMEvent{Timestamp: time.Now()},
+	}
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, indexer.Flush(context.Background()))
+	assert.Equal(t, modelindexer.Stats{
+		Added:            2,
+		FailedSecondary:  1,
+		AvailableBuffers: 10,
+		BulkRequests:     1,
+	}, indexerStats(t, indexer))
+
+	// Request-level failures in the secondary count all items as failed,
+	// but do not fail the flush or Close.
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, indexer.Flush(context.Background()))
+	require.NoError(t, indexer.Close(context.Background()))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&secondaryRequests))
+	assert.Equal(t, modelindexer.Stats{
+		Added:            4,
+		FailedSecondary:  3,
+		AvailableBuffers: 10,
+		BulkRequests:     2,
+	}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerWait(t *testing.T) {
+	var requests int64
+	srvctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	block := make(chan struct{})
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 2 {
+			select {
+			case <-srvctx.Done():
+			case <-block:
+			}
+		}
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{FlushInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	// Wait returns immediately when there are no events.
+	require.NoError(t, indexer.Wait(context.Background()))
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now(), DataStream: model.DataStream{
+		Type:      "logs",
+		Dataset:   "apm_server",
+		Namespace: "testing",
+	}}}
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, indexer.Wait(context.Background()))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&requests))
+	assert.Equal(t, int64(0), indexer.Stats().Active)
+
+	// The indexer may still be used after Wait returns. The second
+	// request blocks, so Wait returns when its context is done.
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	ctx, cancelWait := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelWait()
+	assert.Equal(t, context.DeadlineExceeded, indexer.Wait(ctx))
+	assert.Equal(t, int64(1), indexer.Stats().Active)
+
+	close(block)
+	require.NoError(t, indexer.Wait(context.Background()))
+	assert.Equal(t, modelindexer.Stats{Added: 2, AvailableBuffers: 10, BulkRequests: 2}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerDiskQueue(t *testing.T) {
+	var indexed int64
+	srvctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var block int32
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&block) == 1 {
+			<-srvctx.Done()
+			return
+		}
+		scanner := bufio.NewScanner(r.Body)
+		var result elasticsearch.BulkIndexerResponse
+		for scanner.Scan() {
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusCreated}
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		atomic.AddInt64(&indexed, int64(len(result.Items)))
+		json.NewEncoder(w).Encode(result)
+	})
+	dir := t.TempDir()
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now(), DataStream: model.DataStream{
+		Type:      "logs",
+		Dataset:   "apm_server",
+		Namespace: "testing",
+	}}}
+
+	// Queued events are indexed by the background consumer.
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: 10 * time.Millisecond,
+		DiskQueueDir:  dir,
+	})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	}
+	require.NoError(t, indexer.Wait(context.Background()))
+	assert.Equal(t, int64(3), atomic.LoadInt64(&indexed))
+
+	// Events whose flushes are cancelled by Close remain queued,
+	// so they are not reported as lost.
+	atomic.StoreInt32(&block, 1)
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	require.Eventually(t, func() bool {
+		return indexer.Stats().Active == 2
+	}, 10*time.Second, 10*time.Millisecond)
+	ctx, cancelClose := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelClose()
+	err = indexer.Close(ctx)
+	require.Error(t, err)
+	_, ok := modelindexer.ClosedWithDataLoss(err)
+	assert.False(t, ok)
+
+	// The queued events are indexed when the queue is next opened.
+	atomic.StoreInt32(&block, 0)
+	indexer, err = modelindexer.New(client, modelindexer.Config{
+		FlushInterval: 10 * time.Millisecond,
+		DiskQueueDir:  dir,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	require.NoError(t, indexer.Wait(context.Background()))
+	assert.Equal(t, int64(5), atomic.LoadInt64(&indexed))
+	assert.Equal(t, modelindexer.Stats{Added: 2, AvailableBuffers: 10, BulkRequests: 1}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerDiskQueueRequeue(t *testing.T) {
+	var requests int64
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		scanner := bufio.NewScanner(r.Body)
+		var result elasticsearch.BulkIndexerResponse
+		for scanner.Scan() {
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusCreated}
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: 10 * time.Millisecond,
+		MaxRetries:    -1,
+		DiskQueueDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	// The bulk request fails with a retryable error and is not retried,
+	// so the event is requeued and indexed by the next bulk request.
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, indexer.Wait(context.Background()))
+	assert.Equal(t, int64(2), atomic.LoadInt64(&requests))
+	stats := indexerStats(t, indexer)
+	stats.LastError = nil
+	assert.Equal(t, modelindexer.Stats{Added: 2, Failed: 1, FailedTransport: 1, AvailableBuffers: 10, BulkRequests: 2}, stats)
+}
+
+func TestModelIndexerDiskQueueTimeSeries(t *testing.T) {
+	srvctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var block int32 = 1
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&block) == 1 {
+			<-srvctx.Done()
+			return
+		}
+		scanner := bufio.NewScanner(r.Body)
+		result := elasticsearch.BulkIndexerResponse{HasErrors: true}
+		for scanner.Scan() {
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			// Every document is a duplicate of an existing document.
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusConflict}
+			item.Error.Type = "version_conflict_engine_exception"
+			item.Error.Reason = "version conflict, document already exists"
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	dir := t.TempDir()
+	config := modelindexer.Config{
+		FlushInterval: 10 * time.Millisecond,
+		DiskQueueDir:  dir,
+		DocumentAction: func(event *model.APMEvent) (string, string) {
+			return "create", ""
+		},
+		TimeSeries: func(event *model.APMEvent) bool {
+			return event.DataStream.Type == "metrics"
+		},
+	}
+
+	// Queue the events without indexing them, as if the process
+	// stopped before they were flushed.
+	indexer, err := modelindexer.New(client, config)
+	require.NoError(t, err)
+	batch := model.Batch{
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "metrics", Dataset: "apm.internal", Namespace: "testing"}},
+		{Timestamp: time.Now(), DataStream: model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}},
+	}
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	require.Eventually(t, func() bool {
+		return indexer.Stats().Active == 2
+	}, 10*time.Second, 10*time.Millisecond)
+	ctx, cancelClose := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelClose()
+	require.Error(t, indexer.Close(ctx))
+
+	// When the queued events are indexed after reopening the queue, only
+	// the time series document's version conflict is not counted as a
+	// failure, as when the events are indexed without the queue.
+	atomic.StoreInt32(&block, 0)
+	indexer, err = modelindexer.New(client, config)
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	require.NoError(t, indexer.Wait(context.Background()))
+	assert.Equal(t, modelindexer.Stats{
+		Added:                 2,
+		Failed:                1,
+		FailedVersionConflict: 1,
+		Deduplicated:          1,
+		AvailableBuffers:      10,
+		BulkRequests:          1,
+	}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerPing(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {})
+	indexer, err := modelindexer.New(client, modelindexer.Config{})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	assert.NoError(t, indexer.Ping(context.Background()))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, `{"version":{"number":"1.2.3"}}`)
+	}))
+	defer srv.Close()
+	config := elasticsearch.DefaultConfig()
+	config.Hosts = elasticsearch.Hosts{srv.URL}
+	transport, err := elasticsearch.NewClient(config)
+	require.NoError(t, err)
+
+	// Ping uses the transport for bulk requests, if specified.
+	indexer, err = modelindexer.New(client, modelindexer.Config{Transport: transport})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	assert.EqualError(t, indexer.Ping(context.Background()), "ping failed: 500 Internal Server Error")
+}
+
+func TestModelIndexerSetClient(t *testing.T) {
+	newClient := func(requests *int64) elasticsearch.Client {
+		return newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(requests, 1)
+			w.Write([]byte(`{"items":[{"create":{"status":201}}]}`))
+		})
+	}
+	var requests1, requests2 int64
+	indexer, err := modelindexer.New(newClient(&requests1), modelindexer.Config{FlushInterval: time.Minute})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, indexer.Flush(context.Background()))
+
+	// Buffered events are flushed with the new client.
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	indexer.SetClient(newClient(&requests2))
+	require.NoError(t, indexer.Flush(context.Background()))
+	assert.NoError(t, indexer.Ping(context.Background()))
+
+	assert.Equal(t, int64(1), atomic.LoadInt64(&requests1))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&requests2))
+}
+
+func TestModelIndexerESTook(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		// Items are not checked for failures unless "errors" is true.
+		w.Write([]byte(`{"took":7,"errors":false,"items":[{"create":{"status":400}}]}`))
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{FlushInterval: time.Minute})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	for i := 0; i < 2; i++ {
+		require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+		require.NoError(t, indexer.Flush(context.Background()))
+	}
+	assert.Equal(t, modelindexer.Stats{
+		Added:            2,
+		AvailableBuffers: 10,
+		BulkRequests:     2,
+		ESTookMillis:     14,
+	}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerReconfigure(t *testing.T) {
+	requests := make(chan struct{}, 1)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case requests <- struct{}{}:
+		default:
+		}
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{FlushInterval: time.Minute})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	err = indexer.Reconfigure(modelindexer.Config{MaxRequests: 1})
+	assert.EqualError(t, err, "MaxRequests cannot be reconfigured")
+
+	err = indexer.Reconfigure(modelindexer.Config{FlushDocuments: 2, FlushInterval: time.Minute})
+	require.NoError(t, err)
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	select {
+	case <-requests:
+		t.Fatal("unexpected request, flush documents not reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	select {
+	case <-requests:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for request, flush documents reached")
+	}
+}
+
+func TestModelIndexerAddTimeout(t *testing.T) {
+	srvctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-srvctx.Done():
+		case <-r.Context().Done():
+		}
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		MaxRequests:    1,
+		FlushDocuments: 1,
+		AddTimeout:     10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	// The first event is flushed immediately, and the flush will block
+	// until the server context is cancelled. This leaves no buffers
+	// available for the second event.
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	assert.Equal(t, 0, indexer.Stats().AvailableBuffers)
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	assert.Equal(t, modelindexer.ErrFull, err)
+
+	cancel()
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, modelindexer.Stats{Added: 1, AvailableBuffers: 1, BulkRequests: 1}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerProcessBatchContextDone(t *testing.T) {
+	srvctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-srvctx.Done():
+		case <-r.Context().Done():
+		}
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		MaxRequests:    1,
+		FlushDocuments: 1,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	// The first event is flushed immediately, and the flush will block
+	// until the server context is cancelled. This leaves no buffers
+	// available for the second event, which blocks until its context
+	// is done.
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+
+	ctx, cancelProcess := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- indexer.ProcessBatch(ctx, &batch) }()
+	select {
+	case err := <-errs:
+		t.Fatalf("ProcessBatch returned before context was cancelled: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancelProcess()
+	select {
+	case err := <-errs:
+		assert.Equal(t, context.Canceled, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for ProcessBatch to return")
+	}
+
+	ctx, cancelProcess = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelProcess()
+	err = indexer.ProcessBatch(ctx, &batch)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	cancel()
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, modelindexer.Stats{Added: 1, AvailableBuffers: 1, BulkRequests: 1}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerAutoScale(t *testing.T) {
+	srvctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-srvctx.Done():
+		case <-r.Context().Done():
+		}
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		MaxRequests:      3,
+		FlushDocuments:   1,
+		AddTimeout:       10 * time.Millisecond,
+		AutoScale:        true,
+		AutoScaleLatency: 5 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	stats := indexer.Stats()
+	assert.Equal(t, int64(1), stats.MaxRequests)
+	assert.Equal(t, 1, stats.AvailableBuffers)
+
+	// Each event is flushed immediately, and the flush will block until
+	// the server context is cancelled. With no flushes yet completed,
+	// the limit is raised for each event until MaxRequests is reached.
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	}
+	assert.Equal(t, int64(3), indexer.Stats().MaxRequests)
+	assert.Equal(t, modelindexer.ErrFull, indexer.ProcessBatch(context.Background(), &batch))
+
+	// The flushes take longer than AutoScaleLatency,
+	// so the limit is lowered as they complete.
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	require.NoError(t, indexer.Flush(context.Background()))
+	stats = indexer.Stats()
+	assert.Equal(t, int64(1), stats.MaxRequests)
+	assert.Equal(t, 1, stats.AvailableBuffers)
+}
+
+func TestModelIndexerMaxRequestsStats(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {})
+	indexer, err := modelindexer.New(client, modelindexer.Config{})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	assert.Equal(t, int64(10), indexer.Stats().MaxRequests)
+}
+
+func TestModelIndexerEventIndex(t *testing.T) {
+	metas := make(chan map[string]string, 2)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			action := make(map[string]map[string]string)
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				panic(err)
+			}
+			metas <- action["create"]
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		EventIndex: func(event *model.APMEvent) (string, string) {
+			if event.Message == "" {
+				return "", ""
+			}
+			return "custom-index", event.Message
+		},
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	dataStream := model.DataStream{Type: "logs", Dataset: "apm_server", Namespace: "testing"}
+	batch := model.Batch{
+		{Timestamp: time.Now(), DataStream: dataStream},
+		{Timestamp: time.Now(), DataStream: dataStream, Message: "routing_value"},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"_index": "logs-apm_server-testing"}, <-metas)
+	assert.Equal(t, map[string]string{"_index": "custom-index", "routing": "routing_value"}, <-metas)
+}
+
+func TestModelIndexerIndexNamer(t *testing.T) {
+	indices := make(chan string, 3)
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			action := make(map[string]map[string]string)
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				panic(err)
+			}
+			indices <- action["create"]["_index"]
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		fmt.Fprintln(w, "{}")
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		EventIndex: func(event *model.APMEvent) (string, string) {
+			if event.Message == "" {
+				return "", ""
+			}
+			return "custom-index", ""
+		},
+		IndexNamer: func(event *model.APMEvent) string {
+			return fmt.Sprintf(
+				"%s-%s-%s",
+				event.DataStream.Type, event.DataStream.Dataset,
+				event.Timestamp.Format("2006.01"),
+			)
+		},
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	dataStream := model.DataStream{Type: "logs", Dataset: "firehose", Namespace: "default"}
+	batch := model.Batch{
+		{Timestamp: time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), DataStream: dataStream},
+		{Timestamp: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), DataStream: dataStream},
+		// EventIndex takes precedence over IndexNamer.
+		{Timestamp: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC), DataStream: dataStream, Message: "custom"},
+	}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "logs-firehose-2024.01", <-indices)
+	assert.Equal(t, "logs-firehose-2024.02", <-indices)
+	assert.Equal(t, "custom-index", <-indices)
+}
+
+func TestModelIndexerServerError(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		RetryBackoff:  time.Millisecond,
 	})
 	require.NoError(t, err)
 	defer indexer.Close(context.Background())
@@ -159,29 +2379,326 @@ func TestModelIndexerFlushBytes(t *testing.T) {
 	err = indexer.ProcessBatch(context.Background(), &batch)
 	require.NoError(t, err)
 
-	select {
-	case <-requests:
-		t.Fatal("unexpected request, flush bytes not exceeded")
-	case <-time.After(50 * time.Millisecond):
-	}
+	// Closing the indexer flushes enqueued events. The request is
+	// retried up to the default MaxRetries before failing.
+	err = indexer.Close(context.Background())
+	require.EqualError(t, err, "1 bulk requests failed (1 documents not indexed), "+
+		"first error: flush failed: [500 Internal Server Error] ")
+	stats := indexerStats(t, indexer)
+	assert.EqualError(t, stats.LastError, "flush failed: [500 Internal Server Error] ")
+	stats.LastError = nil
+	assert.Equal(t, modelindexer.Stats{
+		Added:            1,
+		Active:           0,
+		Failed:           1,
+		FailedTransport:  1,
+		RetriedDocs:      3,
+		AvailableBuffers: 10,
+		BulkRequests:     4,
+	}, stats)
+}
 
-	for i := 0; i < 100; i++ {
-		err = indexer.ProcessBatch(context.Background(), &batch)
+func TestModelIndexerServerErrorRetry(t *testing.T) {
+	var requests int64
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"items":[{"create":{"status":201}}]}`))
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		RetryBackoff:  time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+
+	// The request-level error is retried, and the event indexed.
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, modelindexer.Stats{
+		Added:            1,
+		RetriedDocs:      1,
+		AvailableBuffers: 10,
+		BulkRequests:     2,
+	}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerServerErrorDeadLetterSink(t *testing.T) {
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	var mu sync.Mutex
+	var deadLetters []modelindexer.FailedDoc
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushDocuments: 2,
+		MaxRetries:     -1,
+		DeadLetterSink: deadLetterSinkFunc(func(ctx context.Context, docs []modelindexer.FailedDoc) error {
+			mu.Lock()
+			defer mu.Unlock()
+			deadLetters = append(deadLetters, docs...)
+			return nil
+		}),
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	const N = 5
+	for i := 0; i < N; i++ {
+		batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+		err := indexer.ProcessBatch(context.Background(), &batch)
 		require.NoError(t, err)
 	}
 
-	select {
-	case <-requests:
-	case <-time.After(10 * time.Second):
-		t.Fatal("timed out waiting for request, flush bytes exceeded")
+	// All bulk requests fail, and Close summarises the failures
+	// after flushing the remaining event.
+	err = indexer.Close(context.Background())
+	require.EqualError(t, err, "3 bulk requests failed (5 documents not indexed), "+
+		"first error: flush failed: [500 Internal Server Error] ")
+	stats := indexerStats(t, indexer)
+	assert.EqualError(t, stats.LastError, "flush failed: [500 Internal Server Error] ")
+	stats.LastError = nil
+	assert.Equal(t, modelindexer.Stats{Added: N, Failed: N, FailedTransport: N, AvailableBuffers: 10, BulkRequests: 3}, stats)
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, deadLetters, N)
+	for _, doc := range deadLetters {
+		assert.Equal(t, http.StatusInternalServerError, doc.Status)
+		assert.Equal(t, "flush failed: [500 Internal Server Error] ", doc.ErrorReason)
+		assert.NotEmpty(t, doc.Body)
 	}
 }
 
-func TestModelIndexerServerError(t *testing.T) {
+func TestModelIndexerCircuitBreaker(t *testing.T) {
+	var failing int32 = 1
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"items":[{"create":{"status":201}}]}`))
+	})
+	const cooldown = 50 * time.Millisecond
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval:           time.Minute,
+		MaxRetries:              -1,
+		CircuitBreakerThreshold: 2,
+		CircuitBreakerCooldown:  cooldown,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	processAndFlush := func() error {
+		batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+		if err := indexer.ProcessBatch(context.Background(), &batch); err != nil {
+			return err
+		}
+		return indexer.Flush(context.Background())
+	}
+
+	// The breaker trips after two consecutive failed bulk requests.
+	assert.Error(t, processAndFlush())
+	assert.False(t, indexer.Stats().CircuitOpen)
+	assert.Error(t, processAndFlush())
+	assert.True(t, indexer.Stats().CircuitOpen)
+	assert.Equal(t, modelindexer.ErrCircuitOpen, processAndFlush())
+
+	// After the cool-down the breaker half-opens, and
+	// trips again after a single failed bulk request.
+	time.Sleep(cooldown)
+	assert.False(t, indexer.Stats().CircuitOpen)
+	assert.Error(t, processAndFlush())
+	assert.True(t, indexer.Stats().CircuitOpen)
+	assert.Equal(t, modelindexer.ErrCircuitOpen, processAndFlush())
+
+	// Once Elasticsearch recovers, a successful bulk
+	// request in the half-open state closes the breaker.
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(cooldown)
+	assert.NoError(t, processAndFlush())
+	assert.False(t, indexer.Stats().CircuitOpen)
+	assert.NoError(t, processAndFlush())
+
+	stats := indexerStats(t, indexer)
+	assert.Equal(t, int64(5), stats.Added)
+	assert.Equal(t, int64(3), stats.Failed)
+	assert.Equal(t, int64(5), stats.BulkRequests)
+}
+
+func TestModelIndexerHealth(t *testing.T) {
+	var failing int32
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`{"items":[{"create":{"status":201}}]}`))
+	})
+	const window = 200 * time.Millisecond
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval:      time.Minute,
+		MaxRetries:         -1,
+		HealthWindow:       window,
+		HealthFailureRatio: 0.5,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	processAndFlush := func() error {
+		batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+		if err := indexer.ProcessBatch(context.Background(), &batch); err != nil {
+			return err
+		}
+		return indexer.Flush(context.Background())
+	}
+
+	// The indexer is healthy before any flushes.
+	assert.Equal(t, modelindexer.HealthStatus{Healthy: true}, indexer.Health())
+	assert.NoError(t, processAndFlush())
+	assert.NoError(t, processAndFlush())
+	assert.True(t, indexer.Healthy())
+
+	// A run of failures flips the indexer to unhealthy once
+	// more than half of the recent flushes have failed.
+	atomic.StoreInt32(&failing, 1)
+	assert.Error(t, processAndFlush())
+	assert.Error(t, processAndFlush())
+	assert.True(t, indexer.Healthy())
+	assert.Error(t, processAndFlush())
+	assert.Equal(t, modelindexer.HealthStatus{
+		Reason:        "3 of 5 flushes failed in the last 200ms",
+		Flushes:       5,
+		FailedFlushes: 3,
+	}, indexer.Health())
+
+	// Once Elasticsearch recovers, the indexer becomes healthy
+	// again as the failures expire from the window.
+	atomic.StoreInt32(&failing, 0)
+	time.Sleep(window)
+	assert.NoError(t, processAndFlush())
+	assert.Equal(t, modelindexer.HealthStatus{Healthy: true, Flushes: 1}, indexer.Health())
+}
+
+func TestModelIndexerHealthCircuitBreaker(t *testing.T) {
 	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 	})
-	indexer, err := modelindexer.New(client, modelindexer.Config{FlushInterval: time.Minute})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval:           time.Minute,
+		MaxRetries:              -1,
+		CircuitBreakerThreshold: 1,
+		HealthFailureRatio:      1,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	assert.Error(t, indexer.Flush(context.Background()))
+
+	// The failure ratio does not exceed 1, but the breaker is open.
+	health := indexer.Health()
+	assert.False(t, health.Healthy)
+	assert.Equal(t, "circuit breaker open", health.Reason)
+
+	_, err = modelindexer.New(client, modelindexer.Config{HealthFailureRatio: 1.5})
+	assert.EqualError(t, err, "expected HealthFailureRatio in range (0,1], got 1.5")
+}
+
+func TestModelIndexerRetry(t *testing.T) {
+	var requests int64
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		attempt := atomic.AddInt64(&requests, 1)
+		scanner := bufio.NewScanner(r.Body)
+		var result elasticsearch.BulkIndexerResponse
+		for scanner.Scan() {
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusCreated}
+			switch {
+			case attempt == 1 && len(result.Items)%2 == 0:
+				// Reject every second item in the first request;
+				// these should be retried.
+				result.HasErrors = true
+				item.Status = http.StatusTooManyRequests
+				item.Error.Type = "es_rejected_execution_exception"
+			case attempt == 1 && len(result.Items) == 1:
+				// Fail one item with a non-retryable error.
+				result.HasErrors = true
+				item.Status = http.StatusConflict
+				item.Error.Type = "version_conflict_engine_exception"
+			}
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		RetryBackoff:  time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	const N = 10
+	for i := 0; i < N; i++ {
+		batch := model.Batch{model.APMEvent{Timestamp: time.Now(), DataStream: model.DataStream{
+			Type:      "logs",
+			Dataset:   "apm_server",
+			Namespace: "testing",
+		}}}
+		err := indexer.ProcessBatch(context.Background(), &batch)
+		require.NoError(t, err)
+	}
+
+	err = indexer.Close(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&requests))
+	assert.Equal(t, modelindexer.Stats{
+		Added:                 N,
+		Active:                0,
+		Failed:                1,
+		FailedVersionConflict: 1,
+		RetriedDocs:           N / 2,
+		TooManyRequests:       N / 2,
+		AvailableBuffers:      10,
+		BulkRequests:          2,
+	}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerRetryExhausted(t *testing.T) {
+	var requests int64
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		scanner := bufio.NewScanner(r.Body)
+		result := elasticsearch.BulkIndexerResponse{HasErrors: true}
+		for scanner.Scan() {
+			if !scanner.Scan() {
+				panic("expected source")
+			}
+			item := esutil.BulkIndexerResponseItem{Status: http.StatusServiceUnavailable}
+			result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+			if scanner.Scan() && scanner.Text() != "" {
+				panic("expected empty line")
+			}
+		}
+		json.NewEncoder(w).Encode(result)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		MaxRetries:    2,
+		RetryBackoff:  time.Millisecond,
+	})
 	require.NoError(t, err)
 	defer indexer.Close(context.Background())
 
@@ -193,14 +2710,91 @@ func TestModelIndexerServerError(t *testing.T) {
 	err = indexer.ProcessBatch(context.Background(), &batch)
 	require.NoError(t, err)
 
-	// Closing the indexer flushes enqueued events.
 	err = indexer.Close(context.Background())
-	require.EqualError(t, err, "flush failed: [500 Internal Server Error] ")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), atomic.LoadInt64(&requests))
 	assert.Equal(t, modelindexer.Stats{
-		Added:  1,
-		Active: 0,
-		Failed: 1,
-	}, indexer.Stats())
+		Added:            1,
+		Active:           0,
+		Failed:           1,
+		FailedOther:      1,
+		RetriedDocs:      2,
+		AvailableBuffers: 10,
+		BulkRequests:     3,
+	}, indexerStats(t, indexer))
+}
+
+func TestModelIndexerFlushTimeout(t *testing.T) {
+	srvctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-srvctx.Done():
+		case <-r.Context().Done():
+		}
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushDocuments: 1,
+		FlushTimeout:   10 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+
+	// The flush should time out, returning the buffer to the pool
+	// and counting the event as failed.
+	errch := make(chan error, 1)
+	go func() { errch <- indexer.Close(context.Background()) }()
+	select {
+	case err := <-errch:
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for flush to time out")
+	}
+	stats := indexerStats(t, indexer)
+	assert.ErrorIs(t, stats.LastError, context.DeadlineExceeded)
+	stats.LastError = nil
+	assert.Equal(t, modelindexer.Stats{Added: 1, Failed: 1, FailedTransport: 1, AvailableBuffers: 10, BulkRequests: 1}, stats)
+}
+
+func TestModelIndexerFlushTimeoutClose(t *testing.T) {
+	srvctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-srvctx.Done():
+		case <-r.Context().Done():
+		}
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushDocuments: 1,
+		FlushTimeout:   time.Minute,
+	})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	err = indexer.ProcessBatch(context.Background(), &batch)
+	require.NoError(t, err)
+
+	// Cancelling the context passed to Close should cancel the
+	// flush before FlushTimeout elapses.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	errch := make(chan error, 1)
+	go func() { errch <- indexer.Close(ctx) }()
+	select {
+	case err := <-errch:
+		assert.ErrorIs(t, err, context.Canceled)
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for flush to be cancelled")
+	}
+	stats := indexer.Stats()
+	assert.Equal(t, int64(1), stats.Added)
+	assert.Equal(t, int64(1), stats.Failed)
 }
 
 func TestModelIndexerLogRateLimit(t *testing.T) {
@@ -251,13 +2845,66 @@ func TestModelIndexerLogRateLimit(t *testing.T) {
 	err = indexer.Close(context.Background())
 	assert.NoError(t, err)
 
-	entries := logp.ObserverLogs().TakeAll()
+	// Failed items are logged individually at debug level.
+	entries := logp.ObserverLogs().FilterMessageSnippet("failed to index event ").TakeAll()
 	require.Len(t, entries, 2)
 	messages := []string{entries[0].Message, entries[1].Message}
 	assert.ElementsMatch(t, []string{
 		"failed to index event (error_type): error_reason_even",
 		"failed to index event (error_type): error_reason_odd",
 	}, messages)
+	for _, entry := range entries {
+		assert.Equal(t, zapcore.DebugLevel, entry.Level)
+		assert.Equal(t, "logs-apm_server-testing", entry.ContextMap()["index"])
+	}
+	assert.ElementsMatch(t, []interface{}{int64(0), int64(1)}, []interface{}{
+		entries[0].ContextMap()["position"],
+		entries[1].ContextMap()["position"],
+	})
+
+	// Failed items are aggregated by index and error type for each
+	// bulk request, and logged at error level with the first reason.
+	entries = logp.ObserverLogs().FilterMessageSnippet("failed to index events").TakeAll()
+	require.Len(t, entries, 1)
+	assert.Equal(t, zapcore.ErrorLevel, entries[0].Level)
+	assert.Equal(t, "failed to index events in logs-apm_server-testing (error_type): error_reason_even", entries[0].Message)
+	assert.Greater(t, entries[0].ContextMap()["count"], int64(1))
+}
+
+func TestModelIndexerCloseSummary(t *testing.T) {
+	logp.DevelopmentSetup(logp.ToObserverOutput())
+
+	client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{
+		FlushInterval: time.Minute,
+		MaxRetries:    -1,
+	})
+	require.NoError(t, err)
+
+	batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	err = indexer.Close(context.Background())
+	assert.Error(t, err)
+	assert.Error(t, indexer.Close(context.Background()))
+
+	// Failures are not reported as data loss unless flushes are cancelled.
+	_, ok := modelindexer.ClosedWithDataLoss(err)
+	assert.False(t, ok)
+
+	// The summary is logged once, however many times Close is called.
+	entries := logp.ObserverLogs().FilterMessageSnippet("model indexer closed").TakeAll()
+	require.Len(t, entries, 1)
+	assert.Equal(t, "model indexer closed with failures", entries[0].Message)
+	assert.Equal(t, zapcore.ErrorLevel, entries[0].Level)
+	fields := entries[0].ContextMap()
+	assert.Equal(t, int64(1), fields["events.added"])
+	assert.Equal(t, int64(1), fields["events.failed"])
+	assert.Equal(t, int64(0), fields["events.retried"])
+	assert.Equal(t, int64(1), fields["bulk_requests"])
+	assert.NotZero(t, fields["bytes_flushed"])
+	assert.Equal(t, "flush failed: [500 Internal Server Error] ", fields["error"])
 }
 
 func TestModelIndexerCloseFlushContext(t *testing.T) {
@@ -299,11 +2946,99 @@ func TestModelIndexerCloseFlushContext(t *testing.T) {
 	select {
 	case err := <-errch:
 		assert.Error(t, err)
+		n, ok := modelindexer.ClosedWithDataLoss(err)
+		assert.True(t, ok)
+		assert.Equal(t, 1, n)
 	case <-time.After(10 * time.Second):
 		t.Fatal("timed out waiting for flush to unblock")
 	}
 }
 
+func TestModelIndexerDrainOnClose(t *testing.T) {
+	for _, drain := range []bool{false, true} {
+		t.Run(fmt.Sprintf("drain=%v", drain), func(t *testing.T) {
+			var indexed int64
+			received := make(chan struct{}, 1)
+			release := make(chan struct{})
+			var requests int64
+			client := newMockElasticsearchClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt64(&requests, 1) == 1 {
+					// Block the first bulk request until released.
+					received <- struct{}{}
+					<-release
+				}
+				scanner := bufio.NewScanner(r.Body)
+				for scanner.Scan() {
+					if scanner.Scan() {
+						atomic.AddInt64(&indexed, 1)
+					}
+					scanner.Scan()
+				}
+				w.Write([]byte(`{"items":[]}`))
+			})
+			indexer, err := modelindexer.New(client, modelindexer.Config{
+				FlushInterval: time.Minute,
+				DrainOnClose:  drain,
+			})
+			require.NoError(t, err)
+
+			processBatch := func() error {
+				batch := model.Batch{model.APMEvent{Timestamp: time.Now()}}
+				return indexer.ProcessBatch(context.Background(), &batch)
+			}
+			require.NoError(t, processBatch())
+
+			errch := make(chan error, 1)
+			go func() { errch <- indexer.Close(context.Background()) }()
+			select {
+			case <-received:
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for bulk request")
+			}
+
+			// While the events buffered when Close was called are being
+			// flushed, events are accepted if draining. Otherwise, adding
+			// events blocks until Close returns, and then fails.
+			added := make(chan error, 1)
+			go func() { added <- processBatch() }()
+			if drain {
+				select {
+				case err := <-added:
+					assert.NoError(t, err)
+				case <-time.After(10 * time.Second):
+					t.Fatal("timed out waiting for indexer.ProcessBatch")
+				}
+			}
+			select {
+			case err := <-errch:
+				t.Fatalf("unexpected return from indexer.Close: %v", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			// Once the flush completes, Close flushes the events
+			// accepted while draining, and events are rejected.
+			close(release)
+			select {
+			case err := <-errch:
+				assert.NoError(t, err)
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting for indexer.Close")
+			}
+			if !drain {
+				assert.Equal(t, modelindexer.ErrClosed, <-added)
+			}
+			assert.Equal(t, modelindexer.ErrClosed, processBatch())
+
+			expected := int64(1)
+			if drain {
+				expected = 2
+			}
+			assert.Equal(t, expected, atomic.LoadInt64(&indexed))
+			assert.Equal(t, expected, indexer.Stats().Added)
+		})
+	}
+}
+
 func BenchmarkModelIndexer(b *testing.B) {
 	var indexed int64
 	client := newMockElasticsearchClient(b, func(w http.ResponseWriter, r *http.Request) {
@@ -331,6 +3066,7 @@ func BenchmarkModelIndexer(b *testing.B) {
 			Timestamp: time.Now(),
 		},
 	}
+	b.ReportAllocs()
 	b.RunParallel(func(pb *testing.PB) {
 		for pb.Next() {
 			if err := indexer.ProcessBatch(context.Background(), &batch); err != nil {
@@ -346,6 +3082,122 @@ func BenchmarkModelIndexer(b *testing.B) {
 	assert.Equal(b, int64(b.N), indexed)
 }
 
+// BenchmarkModelIndexerFlushSuccess measures adding and flushing
+// 1000 events, with a response indicating that all were indexed.
+func BenchmarkModelIndexerFlushSuccess(b *testing.B) {
+	const N = 1000
+	result := elasticsearch.BulkIndexerResponse{Took: 1}
+	for i := 0; i < N; i++ {
+		item := esutil.BulkIndexerResponseItem{Status: http.StatusCreated}
+		result.Items = append(result.Items, map[string]esutil.BulkIndexerResponseItem{"create": item})
+	}
+	response, err := json.Marshal(result)
+	require.NoError(b, err)
+	client := newMockElasticsearchClient(b, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(response)
+	})
+	indexer, err := modelindexer.New(client, modelindexer.Config{FlushInterval: time.Minute})
+	require.NoError(b, err)
+	defer indexer.Close(context.Background())
+
+	batch := make(model.Batch, N)
+	for i := range batch {
+		batch[i] = model.APMEvent{Processor: model.TransactionProcessor, Timestamp: time.Now()}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := indexer.ProcessBatch(context.Background(), &batch); err != nil {
+			b.Fatal(err)
+		}
+		if err := indexer.Flush(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkModelIndexerActiveShards measures ProcessBatch with 64 concurrent
+// producers, to compare lock contention with varying numbers of active shards.
+func BenchmarkModelIndexerActiveShards(b *testing.B) {
+	const producers = 64
+	for _, shards := range []int{1, 4, 8} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			client := newMockElasticsearchClient(b, func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				fmt.Fprintln(w, "{}")
+			})
+			indexer, err := modelindexer.New(client, modelindexer.Config{
+				FlushInterval: time.Second,
+				ActiveShards:  shards,
+			})
+			require.NoError(b, err)
+			defer indexer.Close(context.Background())
+
+			batch := model.Batch{
+				model.APMEvent{
+					Processor: model.TransactionProcessor,
+					Timestamp: time.Now(),
+				},
+			}
+			remaining := int64(b.N)
+			var wg sync.WaitGroup
+			b.ResetTimer()
+			for p := 0; p < producers; p++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for atomic.AddInt64(&remaining, -1) >= 0 {
+						if err := indexer.ProcessBatch(context.Background(), &batch); err != nil {
+							b.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			b.StopTimer()
+			if err := indexer.Close(context.Background()); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+// staticEncoder is a modelindexer.Encoder which encodes all events as doc.
+type staticEncoder struct {
+	w   io.Writer
+	doc string
+}
+
+func (e *staticEncoder) AddRaw(interface{}) error {
+	_, err := io.WriteString(e.w, e.doc+"\n")
+	return err
+}
+
+func (e *staticEncoder) Reset() {}
+
+type deadLetterSinkFunc func(context.Context, []modelindexer.FailedDoc) error
+
+func (f deadLetterSinkFunc) Write(ctx context.Context, docs []modelindexer.FailedDoc) error {
+	return f(ctx, docs)
+}
+
+// indexerStats returns indexer.Stats(), with byte counts zeroed after
+// checking that they are non-zero if and only if bulk requests were made.
+// ActiveBytes is zeroed without checking; see TestModelIndexerActiveBytes.
+func indexerStats(t testing.TB, indexer *modelindexer.Indexer) modelindexer.Stats {
+	stats := indexer.Stats()
+	assert.Equal(t, stats.BulkRequests > 0, stats.BytesFlushed > 0)
+	assert.Equal(t, stats.BulkRequests > 0, stats.BytesUncompressed > 0)
+	stats.BytesFlushed = 0
+	stats.BytesUncompressed = 0
+	stats.ActiveBytes = 0
+	stats.OldestActiveEventAge = 0
+	stats.MaxRequests = 0
+	return stats
+}
+
 func newMockElasticsearchClient(t testing.TB, bulkHandler http.HandlerFunc) elasticsearch.Client {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,101 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/unit"
+)
+
+// dataStreamKey is the attribute key used for identifying the
+// index (data stream) associated with failed events.
+const dataStreamKey = attribute.Key("data_stream")
+
+// indexerMetrics holds OpenTelemetry instruments for an Indexer.
+//
+// Asynchronous instruments are observed from the Indexer's existing
+// counters; only flush latency is recorded synchronously.
+type indexerMetrics struct {
+	flushDuration metric.Float64ValueRecorder
+}
+
+// newIndexerMetrics registers instruments for i with meter.
+func newIndexerMetrics(i *Indexer, meter metric.Meter) (*indexerMetrics, error) {
+	var added, failed, retried metric.Int64SumObserver
+	var active metric.Int64UpDownSumObserver
+	batch := meter.NewBatchObserver(func(ctx context.Context, result metric.BatchObserverResult) {
+		result.Observe(nil,
+			added.Observation(atomic.LoadInt64(&i.eventsAdded)),
+			retried.Observation(atomic.LoadInt64(&i.docsRetried)),
+			active.Observation(atomic.LoadInt64(&i.eventsActive)),
+		)
+		if i.indexStats == nil {
+			result.Observe(nil, failed.Observation(atomic.LoadInt64(&i.eventsFailed)))
+			return
+		}
+		for index, stats := range i.indexStats.snapshot() {
+			labels := []attribute.KeyValue{dataStreamKey.String(index)}
+			result.Observe(labels, failed.Observation(stats.Failed))
+		}
+	})
+
+	var err error
+	if added, err = batch.NewInt64SumObserver(
+		"modelindexer.events.added",
+		metric.WithDescription("Number of events added to the indexer."),
+	); err != nil {
+		return nil, err
+	}
+	if failed, err = batch.NewInt64SumObserver(
+		"modelindexer.events.failed",
+		metric.WithDescription("Number of events which failed to be indexed."),
+	); err != nil {
+		return nil, err
+	}
+	if retried, err = batch.NewInt64SumObserver(
+		"modelindexer.events.retried",
+		metric.WithDescription("Number of event indexing attempts which were retried."),
+	); err != nil {
+		return nil, err
+	}
+	if active, err = batch.NewInt64UpDownSumObserver(
+		"modelindexer.events.active",
+		metric.WithDescription("Number of events buffered or being flushed."),
+	); err != nil {
+		return nil, err
+	}
+	flushDuration, err := meter.NewFloat64ValueRecorder(
+		"modelindexer.flush.duration",
+		metric.WithDescription("Duration of bulk requests."),
+		metric.WithUnit(unit.Milliseconds),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &indexerMetrics{flushDuration: flushDuration}, nil
+}
+
+// recordFlushDuration records the duration of a single bulk request.
+func (m *indexerMetrics) recordFlushDuration(ctx context.Context, d time.Duration) {
+	m.flushDuration.Record(ctx, float64(d)/float64(time.Millisecond))
+}
@@ -0,0 +1,179 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+// Package modelindexerprom provides a Prometheus collector for the
+// stats of a modelindexer.Indexer, kept separate so that modelindexer
+// does not depend on the Prometheus client library.
+package modelindexerprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/elastic/apm-server/model/modelindexer"
+)
+
+const namespace = "modelindexer"
+
+var (
+	eventsAddedDesc = newDesc(
+		"events_added_total",
+		"Number of events added to the indexer.",
+	)
+	eventsActiveDesc = newDesc(
+		"events_active",
+		"Number of events added to the indexer and not yet flushed.",
+	)
+	eventsFailedDesc = newDesc(
+		"events_failed_total",
+		"Number of events which failed to be indexed, by reason.",
+		"reason",
+	)
+	eventsFailedSecondaryDesc = newDesc(
+		"events_failed_secondary_total",
+		"Number of events which failed to be indexed in the secondary cluster.",
+	)
+	eventsRetriedDesc = newDesc(
+		"events_retried_total",
+		"Number of event indexing attempts which were retried.",
+	)
+	eventsTooLargeDesc = newDesc(
+		"events_too_large_total",
+		"Number of events dropped for exceeding the maximum document size.",
+	)
+	eventsInvalidDataStreamDesc = newDesc(
+		"events_invalid_data_stream_total",
+		"Number of events skipped for having an incomplete data stream.",
+	)
+	eventsDeduplicatedDesc = newDesc(
+		"events_deduplicated_total",
+		"Number of events rejected by time series data streams as duplicates.",
+	)
+	tooManyRequestsDesc = newDesc(
+		"too_many_requests_total",
+		"Number of indexing operations rejected with 429 Too Many Requests, including those retried.",
+	)
+	bulkRequestsDesc = newDesc(
+		"bulk_requests_total",
+		"Number of bulk requests made, including retries and failed requests.",
+	)
+	bytesFlushedDesc = newDesc(
+		"flushed_bytes_total",
+		"Number of bytes sent in bulk request bodies, after any compression.",
+	)
+	bytesUncompressedDesc = newDesc(
+		"flushed_uncompressed_bytes_total",
+		"Number of bytes sent in bulk request bodies, before any compression.",
+	)
+	elasticsearchTookDesc = newDesc(
+		"elasticsearch_took_seconds_total",
+		"Time spent by Elasticsearch processing bulk requests, as reported in their responses.",
+	)
+	failedDocsDroppedDesc = newDesc(
+		"failed_docs_dropped_total",
+		"Number of failed documents dropped from those retained.",
+	)
+	deadLettersDroppedDesc = newDesc(
+		"dead_letters_dropped_total",
+		"Number of failed documents dropped rather than sent to the dead letter sink.",
+	)
+	activeBytesDesc = newDesc(
+		"active_bytes",
+		"Number of bytes buffered in bulk requests which have not yet been flushed.",
+	)
+	oldestActiveEventAgeDesc = newDesc(
+		"oldest_active_event_age_seconds",
+		"Time elapsed since the oldest event buffered in a bulk request was added.",
+	)
+	availableBuffersDesc = newDesc(
+		"available_buffers",
+		"Number of bulk request buffers which are neither being filled nor flushed.",
+	)
+	maxRequestsDesc = newDesc(
+		"max_requests",
+		"Limit on the number of bulk requests which may be flushing concurrently.",
+	)
+	circuitOpenDesc = newDesc(
+		"circuit_open",
+		"Whether the circuit breaker is open, with events being rejected (1), or not (0).",
+	)
+)
+
+func newDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil)
+}
+
+// Collector returns a prometheus.Collector which reports the stats of
+// indexer, as returned by Indexer.Stats, when collected. Cumulative stats
+// are reported as counters, and the others as gauges. Failed events are
+// reported by the reason for failure: "mapping", "version_conflict",
+// "too_many_requests", "transport", or "other".
+//
+// To report the stats of several indexers, wrap each collector with a
+// distinguishing label using prometheus.WrapRegistererWith.
+func Collector(indexer *modelindexer.Indexer) prometheus.Collector {
+	return collector{indexer}
+}
+
+type collector struct {
+	indexer *modelindexer.Indexer
+}
+
+// Describe implements prometheus.Collector.
+func (c collector) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(c, ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c collector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.indexer.Stats()
+	counter := func(desc *prometheus.Desc, value float64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, value, labels...)
+	}
+	gauge := func(desc *prometheus.Desc, value float64) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, value)
+	}
+
+	counter(eventsAddedDesc, float64(stats.Added))
+	counter(eventsFailedDesc, float64(stats.FailedMapping), "mapping")
+	counter(eventsFailedDesc, float64(stats.FailedVersionConflict), "version_conflict")
+	counter(eventsFailedDesc, float64(stats.FailedTooManyRequests), "too_many_requests")
+	counter(eventsFailedDesc, float64(stats.FailedTransport), "transport")
+	counter(eventsFailedDesc, float64(stats.FailedOther), "other")
+	counter(eventsFailedSecondaryDesc, float64(stats.FailedSecondary))
+	counter(eventsRetriedDesc, float64(stats.RetriedDocs))
+	counter(eventsTooLargeDesc, float64(stats.TooLarge))
+	counter(eventsInvalidDataStreamDesc, float64(stats.InvalidDataStream))
+	counter(eventsDeduplicatedDesc, float64(stats.Deduplicated))
+	counter(tooManyRequestsDesc, float64(stats.TooManyRequests))
+	counter(bulkRequestsDesc, float64(stats.BulkRequests))
+	counter(bytesFlushedDesc, float64(stats.BytesFlushed))
+	counter(bytesUncompressedDesc, float64(stats.BytesUncompressed))
+	counter(elasticsearchTookDesc, float64(stats.ESTookMillis)/1000)
+	counter(failedDocsDroppedDesc, float64(stats.FailedDocsDropped))
+	counter(deadLettersDroppedDesc, float64(stats.DeadLettersDropped))
+
+	gauge(eventsActiveDesc, float64(stats.Active))
+	gauge(activeBytesDesc, float64(stats.ActiveBytes))
+	gauge(oldestActiveEventAgeDesc, stats.OldestActiveEventAge.Seconds())
+	gauge(availableBuffersDesc, float64(stats.AvailableBuffers))
+	gauge(maxRequestsDesc, float64(stats.MaxRequests))
+	var circuitOpen float64
+	if stats.CircuitOpen {
+		circuitOpen = 1
+	}
+	gauge(circuitOpenDesc, circuitOpen)
+}
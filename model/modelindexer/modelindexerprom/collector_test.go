@@ -0,0 +1,108 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexerprom_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/elastic/apm-server/elasticsearch"
+	"github.com/elastic/apm-server/model"
+	"github.com/elastic/apm-server/model/modelindexer"
+	"github.com/elastic/apm-server/model/modelindexer/modelindexerprom"
+)
+
+func TestCollector(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		fmt.Fprintln(w, `{"version":{"number":"1.2.3"}}`)
+	})
+	mux.HandleFunc("/_bulk", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"took":1500,"errors":true,"items":[`+
+			`{"create":{"status":201}},`+
+			`{"create":{"status":400,"error":{"type":"mapper_parsing_exception"}}}`+
+			`]}`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	config := elasticsearch.DefaultConfig()
+	config.Hosts = elasticsearch.Hosts{srv.URL}
+	client, err := elasticsearch.NewClient(config)
+	require.NoError(t, err)
+
+	indexer, err := modelindexer.New(client, modelindexer.Config{FlushInterval: time.Minute})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+
+	batch := model.Batch{{Timestamp: time.Now()}, {Timestamp: time.Now()}}
+	require.NoError(t, indexer.ProcessBatch(context.Background(), &batch))
+	require.NoError(t, indexer.Flush(context.Background()))
+
+	collector := modelindexerprom.Collector(indexer)
+	registry := prometheus.NewPedanticRegistry()
+	require.NoError(t, registry.Register(collector))
+
+	err = testutil.CollectAndCompare(collector, strings.NewReader(`
+# HELP modelindexer_events_added_total Number of events added to the indexer.
+# TYPE modelindexer_events_added_total counter
+modelindexer_events_added_total 2
+# HELP modelindexer_events_active Number of events added to the indexer and not yet flushed.
+# TYPE modelindexer_events_active gauge
+modelindexer_events_active 0
+# HELP modelindexer_events_failed_total Number of events which failed to be indexed, by reason.
+# TYPE modelindexer_events_failed_total counter
+modelindexer_events_failed_total{reason="mapping"} 1
+modelindexer_events_failed_total{reason="other"} 0
+modelindexer_events_failed_total{reason="too_many_requests"} 0
+modelindexer_events_failed_total{reason="transport"} 0
+modelindexer_events_failed_total{reason="version_conflict"} 0
+# HELP modelindexer_bulk_requests_total Number of bulk requests made, including retries and failed requests.
+# TYPE modelindexer_bulk_requests_total counter
+modelindexer_bulk_requests_total 1
+# HELP modelindexer_elasticsearch_took_seconds_total Time spent by Elasticsearch processing bulk requests, as reported in their responses.
+# TYPE modelindexer_elasticsearch_took_seconds_total counter
+modelindexer_elasticsearch_took_seconds_total 1.5
+# HELP modelindexer_circuit_open Whether the circuit breaker is open, with events being rejected (1), or not (0).
+# TYPE modelindexer_circuit_open gauge
+modelindexer_circuit_open 0
+`),
+		"modelindexer_events_added_total",
+		"modelindexer_events_active",
+		"modelindexer_events_failed_total",
+		"modelindexer_bulk_requests_total",
+		"modelindexer_elasticsearch_took_seconds_total",
+		"modelindexer_circuit_open",
+	)
+	assert.NoError(t, err)
+
+	// All metrics are reported, and pass the registry's consistency checks.
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	assert.Len(t, families, 20)
+}
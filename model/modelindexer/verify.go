@@ -0,0 +1,105 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/elastic/beats/v7/libbeat/common"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
+)
+
+// ErrUnsupportedElasticsearch is returned by Verify, wrapped with a
+// description, when the target of bulk requests is not a supported
+// version of Elasticsearch.
+var ErrUnsupportedElasticsearch = errors.New("unsupported Elasticsearch")
+
+var (
+	// minElasticsearchVersion holds the minimum supported version of
+	// Elasticsearch, the first to support the require_alias bulk
+	// parameter, and bulk create requests for data streams.
+	minElasticsearchVersion = common.MustNewVersion("7.10.0")
+
+	// productHeaderVersion holds the first version of Elasticsearch
+	// which responds with the X-Elastic-Product header.
+	productHeaderVersion = common.MustNewVersion("7.14.0")
+)
+
+const elasticsearchTagline = "You Know, for Search"
+
+// Verify checks that the target of bulk requests is a supported version
+// of Elasticsearch, by requesting its root endpoint with the client or
+// transport used for bulk requests, as for Ping. Verify may be used to
+// detect misconfiguration, such as targeting OpenSearch or an older
+// version of Elasticsearch, before processing events, rather than once
+// bulk requests fail.
+//
+// If the target is not a supported version of Elasticsearch, Verify
+// returns an error wrapping ErrUnsupportedElasticsearch; other errors,
+// such as failing to connect, are returned as is. Verify is optional,
+// and need not be called where the root endpoint is unavailable, such
+// as behind a proxy which allows only bulk requests. Indexers created
+// with NewWithFlusher are always verified successfully.
+func (i *Indexer) Verify(ctx context.Context) error {
+	transport := i.bulkTransport()
+	if _, ok := transport.(flusherTransport); ok {
+		return nil
+	}
+	res, err := esapi.InfoRequest{}.Do(ctx, transport)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("failed to get Elasticsearch info: %s", res.Status())
+	}
+	var info struct {
+		Version struct {
+			Number      string `json:"number"`
+			BuildFlavor string `json:"build_flavor"`
+		} `json:"version"`
+		Tagline string `json:"tagline"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return fmt.Errorf("%w: failed to decode info: %s", ErrUnsupportedElasticsearch, err)
+	}
+	version, err := common.NewVersion(info.Version.Number)
+	if err != nil {
+		return fmt.Errorf("%w: invalid version %q", ErrUnsupportedElasticsearch, info.Version.Number)
+	}
+	if res.Header.Get("X-Elastic-Product") != "Elasticsearch" {
+		// Versions prior to 7.14 do not identify themselves with the
+		// product header, so fall back to checking the tagline.
+		if !version.LessThan(productHeaderVersion) || info.Tagline != elasticsearchTagline {
+			return fmt.Errorf("%w: target is not Elasticsearch", ErrUnsupportedElasticsearch)
+		}
+	}
+	if version.LessThan(minElasticsearchVersion) {
+		return fmt.Errorf(
+			"%w: version %s is not supported, expected %s or later",
+			ErrUnsupportedElasticsearch, version, minElasticsearchVersion,
+		)
+	}
+	if info.Version.BuildFlavor == "oss" {
+		return fmt.Errorf("%w: the OSS distribution is not supported", ErrUnsupportedElasticsearch)
+	}
+	return nil
+}
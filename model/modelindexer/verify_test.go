@@ -0,0 +1,115 @@
+// Licensed to Elasticsearch B.V. under one or more contributor
+// license agreements. See the NOTICE file distributed with
+// this work for additional information regarding copyright
+// ownership. Elasticsearch B.V. licenses this file to you under
+// the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+
+package modelindexer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexerVerify(t *testing.T) {
+	for name, test := range map[string]struct {
+		status      int
+		product     string
+		body        string
+		expectedErr string
+		unsupported bool
+	}{
+		"supported": {
+			product: "Elasticsearch",
+			body:    `{"version":{"number":"7.16.0","build_flavor":"default"}}`,
+		},
+		"supported_without_header": {
+			body: `{"version":{"number":"7.10.2","build_flavor":"default"},"tagline":"You Know, for Search"}`,
+		},
+		"missing_header": {
+			body:        `{"version":{"number":"7.16.0","build_flavor":"default"},"tagline":"You Know, for Search"}`,
+			expectedErr: "unsupported Elasticsearch: target is not Elasticsearch",
+			unsupported: true,
+		},
+		"opensearch": {
+			body:        `{"version":{"distribution":"opensearch","number":"1.2.0"},"tagline":"The OpenSearch Project: https://opensearch.org/"}`,
+			expectedErr: "unsupported Elasticsearch: target is not Elasticsearch",
+			unsupported: true,
+		},
+		"too_old": {
+			body:        `{"version":{"number":"6.8.0","build_flavor":"default"},"tagline":"You Know, for Search"}`,
+			expectedErr: "unsupported Elasticsearch: version 6.8.0 is not supported, expected 7.10.0 or later",
+			unsupported: true,
+		},
+		"oss": {
+			body:        `{"version":{"number":"7.10.2","build_flavor":"oss"},"tagline":"You Know, for Search"}`,
+			expectedErr: "unsupported Elasticsearch: the OSS distribution is not supported",
+			unsupported: true,
+		},
+		"invalid_version": {
+			product:     "Elasticsearch",
+			body:        `{"version":{"number":"x"}}`,
+			expectedErr: `unsupported Elasticsearch: invalid version "x"`,
+			unsupported: true,
+		},
+		"error_status": {
+			status:      http.StatusForbidden,
+			body:        `{}`,
+			expectedErr: "failed to get Elasticsearch info: 403 Forbidden",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			indexer, err := New(nil, Config{Transport: transportFunc(func(r *http.Request) (*http.Response, error) {
+				assert.Equal(t, "/", r.URL.Path)
+				status := test.status
+				if status == 0 {
+					status = http.StatusOK
+				}
+				header := make(http.Header)
+				if test.product != "" {
+					header.Set("X-Elastic-Product", test.product)
+				}
+				return &http.Response{
+					StatusCode: status,
+					Header:     header,
+					Body:       io.NopCloser(strings.NewReader(test.body)),
+				}, nil
+			})})
+			require.NoError(t, err)
+			defer indexer.Close(context.Background())
+
+			err = indexer.Verify(context.Background())
+			if test.expectedErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, test.expectedErr)
+			assert.Equal(t, test.unsupported, errors.Is(err, ErrUnsupportedElasticsearch))
+		})
+	}
+}
+
+func TestIndexerVerifyFlusher(t *testing.T) {
+	indexer, err := NewWithFlusher(nil, Config{})
+	require.NoError(t, err)
+	defer indexer.Close(context.Background())
+	assert.NoError(t, indexer.Verify(context.Background()))
+}
@@ -30,10 +30,23 @@ type SetDataStream struct {
 	Namespace string
 }
 
+type eventNamespacesKey struct{}
+
+// ContextWithEventNamespaces returns a copy of ctx with which SetDataStream
+// keeps the namespaces already set on events, setting s.Namespace only for
+// events without one. It is used by the firehose handler for routing events
+// to namespaces by content.
+func ContextWithEventNamespaces(ctx context.Context) context.Context {
+	return context.WithValue(ctx, eventNamespacesKey{}, true)
+}
+
 // ProcessBatch sets data stream fields for each event in b.
 func (s *SetDataStream) ProcessBatch(ctx context.Context, b *model.Batch) error {
+	keepNamespaces, _ := ctx.Value(eventNamespacesKey{}).(bool)
 	for i := range *b {
-		(*b)[i].DataStream.Namespace = s.Namespace
+		if !keepNamespaces || (*b)[i].DataStream.Namespace == "" {
+			(*b)[i].DataStream.Namespace = s.Namespace
+		}
 		if (*b)[i].DataStream.Type == "" || (*b)[i].DataStream.Dataset == "" {
 			s.setDataStream(&(*b)[i])
 		}
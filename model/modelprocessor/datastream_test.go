@@ -67,6 +67,12 @@ func TestSetDataStream(t *testing.T) {
 			ProfileSample: &model.ProfileSample{},
 		},
 		output: model.DataStream{Type: "metrics", Dataset: "apm.profiling", Namespace: "custom"},
+	}, {
+		input: model.APMEvent{
+			Processor:  model.LogProcessor,
+			DataStream: model.DataStream{Type: "logs", Dataset: "aws.waf", Namespace: "security"},
+		},
+		output: model.DataStream{Type: "logs", Dataset: "aws.waf", Namespace: "custom"},
 	}}
 
 	for _, test := range tests {
@@ -78,3 +84,19 @@ func TestSetDataStream(t *testing.T) {
 	}
 
 }
+
+func TestSetDataStreamEventNamespaces(t *testing.T) {
+	batch := model.Batch{{
+		Processor:  model.LogProcessor,
+		DataStream: model.DataStream{Type: "logs", Dataset: "aws.waf", Namespace: "security"},
+	}, {
+		Processor:  model.LogProcessor,
+		DataStream: model.DataStream{Type: "logs", Dataset: "firehose"},
+	}}
+	processor := modelprocessor.SetDataStream{Namespace: "custom"}
+	ctx := modelprocessor.ContextWithEventNamespaces(context.Background())
+	err := processor.ProcessBatch(ctx, &batch)
+	assert.NoError(t, err)
+	assert.Equal(t, model.DataStream{Type: "logs", Dataset: "aws.waf", Namespace: "security"}, batch[0].DataStream)
+	assert.Equal(t, model.DataStream{Type: "logs", Dataset: "firehose", Namespace: "custom"}, batch[1].DataStream)
+}
@@ -25,6 +25,20 @@ type Network struct {
 
 	// Carrier holds information about a connection carrier.
 	Carrier NetworkCarrier
+
+	// Transport holds the name of the network transport protocol,
+	// e.g. "tcp" or "udp".
+	Transport string
+
+	// IANANumber holds the IANA protocol number of the network
+	// transport protocol, e.g. "6" for TCP.
+	IANANumber string
+
+	// Bytes holds the total number of bytes transferred.
+	Bytes int64
+
+	// Packets holds the total number of packets transferred.
+	Packets int64
 }
 
 type NetworkConnection struct {
@@ -58,6 +72,14 @@ func (n *Network) fields() common.MapStr {
 	var network mapStr
 	network.maybeSetMapStr("connection", n.Connection.fields())
 	network.maybeSetMapStr("carrier", n.Carrier.fields())
+	network.maybeSetString("transport", n.Transport)
+	network.maybeSetString("iana_number", n.IANANumber)
+	if n.Bytes > 0 {
+		network.set("bytes", n.Bytes)
+	}
+	if n.Packets > 0 {
+		network.set("packets", n.Packets)
+	}
 	return common.MapStr(network)
 }
 
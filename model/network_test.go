@@ -46,6 +46,10 @@ func TestNetworkTransform(t *testing.T) {
 					MNC:  "03",
 					ICC:  "UK",
 				},
+				Transport:  "tcp",
+				IANANumber: "6",
+				Bytes:      40,
+				Packets:    1,
 			},
 			Output: common.MapStr{
 				"connection": common.MapStr{
@@ -58,6 +62,10 @@ func TestNetworkTransform(t *testing.T) {
 					"mnc":  "03",
 					"icc":  "UK",
 				},
+				"transport":   "tcp",
+				"iana_number": "6",
+				"bytes":       int64(40),
+				"packets":     int64(1),
 			},
 		},
 	}